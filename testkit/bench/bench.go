@@ -0,0 +1,399 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+)
+
+// Label is applied to every service the benchmark creates
+const Label = "testkit-bench"
+
+// Config describes the workload to run
+type Config struct {
+	Image      string   `json:"image"`
+	Command    []string `json:"command"`
+	Replicas   uint64   `json:"replicas"`
+	ScaleTo    uint64   `json:"scale_to"`
+	Iterations int      `json:"iterations"`
+	Requests   int      `json:"requests"`
+	// Timeout bounds every individual converge wait
+	Timeout time.Duration `json:"timeout"`
+	// GoBench selects the Go benchmarks of the e2e image to run after the
+	// workload, none if it's empty. Each runs for at least GoBenchTime
+	GoBench     string        `json:"go_bench,omitempty"`
+	GoBenchTime time.Duration `json:"go_bench_time,omitempty"`
+}
+
+// DefaultConfig runs the e2e util test server, which answers plain HTTP on
+// port 80
+func DefaultConfig() Config {
+	return Config{
+		Image:       "dockerswarm/e2e:latest",
+		Command:     []string{"util", "test-server"},
+		Replicas:    1,
+		ScaleTo:     10,
+		Iterations:  3,
+		Requests:    200,
+		Timeout:     2 * time.Minute,
+		GoBenchTime: 30 * time.Second,
+	}
+}
+
+// Stats summarizes a set of latency samples, in milliseconds
+type Stats struct {
+	Samples int     `json:"samples"`
+	Min     float64 `json:"min_ms"`
+	Max     float64 `json:"max_ms"`
+	Mean    float64 `json:"mean_ms"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+	// StdDev is the sample standard deviation, for comparing runs
+	StdDev float64 `json:"stddev_ms"`
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// NewStats computes the summary of the samples
+func NewStats(samples []time.Duration) Stats {
+	if len(samples) == 0 {
+		return Stats{}
+	}
+	sorted := make(durations, len(samples))
+	copy(sorted, samples)
+	sort.Sort(sorted)
+
+	var total time.Duration
+	for _, s := range sorted {
+		total += s
+	}
+	mean := ms(total / time.Duration(len(sorted)))
+	var squares float64
+	for _, s := range sorted {
+		squares += (ms(s) - mean) * (ms(s) - mean)
+	}
+	stddev := 0.0
+	if len(sorted) > 1 {
+		stddev = math.Sqrt(squares / float64(len(sorted)-1))
+	}
+	percentile := func(p float64) float64 {
+		return ms(sorted[int(p*float64(len(sorted)-1))])
+	}
+	return Stats{
+		Samples: len(sorted),
+		Min:     ms(sorted[0]),
+		Max:     ms(sorted[len(sorted)-1]),
+		Mean:    mean,
+		P50:     percentile(0.50),
+		P90:     percentile(0.90),
+		P99:     percentile(0.99),
+		StdDev:  stddev,
+	}
+}
+
+// Result is the JSON baseline produced by a benchmark run
+type Result struct {
+	Environment      string    `json:"environment"`
+	EngineVersion    string    `json:"engine_version"`
+	Nodes            int       `json:"nodes"`
+	Start            time.Time `json:"start"`
+	Config           Config    `json:"config"`
+	ImagePull        Stats     `json:"image_pull"`
+	CreateToConverge Stats     `json:"create_to_converge"`
+	ScaleUp          Stats     `json:"scale_up"`
+	ScaleDown        Stats     `json:"scale_down"`
+	LBRequest        Stats     `json:"lb_request"`
+	LBErrors         int       `json:"lb_errors"`
+	// GoBenchmarks are the results of the Go benchmarks, if any were run
+	GoBenchmarks []GoBenchmark `json:"go_benchmarks,omitempty"`
+}
+
+// Run executes the workload against the environment
+func Run(env *machines.Environment, cfg Config) (*Result, error) {
+	manager, err := env.GetManager()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := manager.GetEngineAPI()
+	if err != nil {
+		return nil, err
+	}
+	version, err := cli.ServerVersion(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Environment:   env.StackName,
+		EngineVersion: version.Version,
+		Nodes:         len(env.Machines),
+		Start:         time.Now(),
+		Config:        cfg,
+	}
+	// Don't let an earlier aborted run skew the numbers
+	if err := Cleanup(cli); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Measuring pull of %s on %d nodes", cfg.Image, len(env.Machines))
+	pulls, err := pullAll(env, cfg.Image)
+	if err != nil {
+		return nil, err
+	}
+	res.ImagePull = NewStats(pulls)
+
+	var creates, scaleUps, scaleDowns, requests []time.Duration
+	for i := 0; i < cfg.Iterations; i++ {
+		log.Infof("Iteration %d of %d", i+1, cfg.Iterations)
+		spec := serviceSpec(cfg, i)
+		start := time.Now()
+		service, err := cli.ServiceCreate(context.TODO(), spec, types.ServiceCreateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if err := WaitForReplicas(cli, service.ID, cfg.Replicas, cfg.Timeout); err != nil {
+			return nil, err
+		}
+		creates = append(creates, time.Since(start))
+
+		d, err := scale(cli, service.ID, cfg.ScaleTo, cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		scaleUps = append(scaleUps, d)
+
+		lat, errCount, err := loadBalance(env, cli, service.ID, cfg.Requests)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, lat...)
+		res.LBErrors += errCount
+
+		d, err = scale(cli, service.ID, cfg.Replicas, cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		scaleDowns = append(scaleDowns, d)
+
+		if err := cli.ServiceRemove(context.TODO(), service.ID); err != nil {
+			return nil, err
+		}
+		if err := WaitForReplicas(cli, service.ID, 0, cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	res.CreateToConverge = NewStats(creates)
+	res.ScaleUp = NewStats(scaleUps)
+	res.ScaleDown = NewStats(scaleDowns)
+	res.LBRequest = NewStats(requests)
+
+	if cfg.GoBench != "" {
+		if res.GoBenchmarks, err = RunGo(env, cfg.Image, cfg.GoBench, cfg.GoBenchTime); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Cleanup removes any services left behind by a benchmark
+func Cleanup(cli *client.Client) error {
+	args := filters.NewArgs()
+	args.Add("label", Label)
+	services, err := cli.ServiceList(context.TODO(), types.ServiceListOptions{Filters: args})
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		log.Debugf("Removing leftover service %s", service.Spec.Name)
+		if err := cli.ServiceRemove(context.TODO(), service.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serviceSpec(cfg Config, iteration int) swarm.ServiceSpec {
+	replicas := cfg.Replicas
+	return swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name:   fmt.Sprintf("%s-%d", Label, iteration),
+			Labels: map[string]string{Label: "true"},
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{
+				Image:   cfg.Image,
+				Command: cfg.Command,
+			},
+		},
+		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
+		EndpointSpec: &swarm.EndpointSpec{
+			Ports: []swarm.PortConfig{
+				{
+					Protocol:   swarm.PortConfigProtocolTCP,
+					TargetPort: 80,
+				},
+			},
+		},
+	}
+}
+
+// pullAll removes and re-pulls the image on every machine at the same time,
+// returning how long each pull took
+func pullAll(env *machines.Environment, image string) ([]time.Duration, error) {
+	type result struct {
+		d   time.Duration
+		err error
+	}
+	resChan := make(chan result, len(env.Machines))
+	for _, m := range env.Machines {
+		go func(m machines.Machine) {
+			// Pulls can take a long time, don't use the default client timeout
+			cli, err := m.GetEngineAPIWithTimeout(10 * time.Minute)
+			if err != nil {
+				resChan <- result{err: err}
+				return
+			}
+			cli.ImageRemove(context.TODO(), image, types.ImageRemoveOptions{Force: true})
+			start := time.Now()
+			r, err := cli.ImagePull(context.TODO(), image, types.ImagePullOptions{})
+			if err != nil {
+				resChan <- result{err: fmt.Errorf("failed to pull %s on %s: %s", image, m.GetName(), err)}
+				return
+			}
+			_, err = ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				resChan <- result{err: fmt.Errorf("failed to pull %s on %s: %s", image, m.GetName(), err)}
+				return
+			}
+			resChan <- result{d: time.Since(start)}
+		}(m)
+	}
+	res := []time.Duration{}
+	for range env.Machines {
+		r := <-resChan
+		if r.err != nil {
+			return nil, r.err
+		}
+		res = append(res, r.d)
+	}
+	return res, nil
+}
+
+func scale(cli *client.Client, serviceID string, replicas uint64, timeout time.Duration) (time.Duration, error) {
+	service, _, err := cli.ServiceInspectWithRaw(context.TODO(), serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	service.Spec.Mode.Replicated.Replicas = &replicas
+	start := time.Now()
+	if _, err := cli.ServiceUpdate(context.TODO(), serviceID, service.Meta.Version, service.Spec, types.ServiceUpdateOptions{}); err != nil {
+		return 0, err
+	}
+	if err := WaitForReplicas(cli, serviceID, replicas, timeout); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// WaitForReplicas polls until exactly the given number of the service's tasks
+// are running (and no others are meant to be)
+func WaitForReplicas(cli *client.Client, serviceID string, replicas uint64, timeout time.Duration) error {
+	args := filters.NewArgs()
+	args.Add("service", serviceID)
+	args.Add("desired-state", "running")
+	// bounds the task listings too, for a hung call not to outlast timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var lastErr error
+	err := machines.PollTimeout(timeout, 250*time.Millisecond, func() (bool, error) {
+		tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: args})
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		running := uint64(0)
+		for _, task := range tasks {
+			if task.Status.State == swarm.TaskStateRunning {
+				running++
+			}
+		}
+		if running == replicas && uint64(len(tasks)) == replicas {
+			return true, nil
+		}
+		lastErr = fmt.Errorf("%d of %d tasks running", running, replicas)
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("service %s did not converge within %v: %s", serviceID, timeout, lastErr)
+	}
+	return nil
+}
+
+// loadBalance spreads the requests across every node's ingress port,
+// returning the latency of the successful ones and the number of failures
+func loadBalance(env *machines.Environment, cli *client.Client, serviceID string, requests int) ([]time.Duration, int, error) {
+	service, _, err := cli.ServiceInspectWithRaw(context.TODO(), serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	var published uint32
+	for _, port := range service.Endpoint.Ports {
+		if port.TargetPort == 80 {
+			published = port.PublishedPort
+		}
+	}
+	if published == 0 {
+		return nil, 0, fmt.Errorf("service %s has no published port", serviceID)
+	}
+	ips := []string{}
+	for _, m := range env.Machines {
+		ip, err := m.GetIP()
+		if err != nil {
+			return nil, 0, err
+		}
+		ips = append(ips, ip)
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	latencies := []time.Duration{}
+	errCount := 0
+	for i := 0; i < requests; i++ {
+		url := fmt.Sprintf("http://%s:%d/", ips[i%len(ips)], published)
+		start := time.Now()
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			log.Debugf("Request to %s failed: %s", url, err)
+			errCount++
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			errCount++
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	return latencies, errCount, nil
+}
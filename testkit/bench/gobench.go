@@ -0,0 +1,90 @@
+package bench
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/soak"
+)
+
+var (
+	// goBenchLine matches the result of a Go benchmark, e.g.
+	// "BenchmarkServiceCreate-4   	      10	1523456789 ns/op"
+	goBenchLine = regexp.MustCompile(`^(Benchmark\S+?)(-\d+)?\s+(\d+)\s+([0-9.]+) ns/op`)
+	// goBenchHeader starts the log of a benchmark
+	goBenchHeader = regexp.MustCompile(`^--- BENCH: (Benchmark\S+?)(-\d+)?$`)
+	// goBenchMetric matches a metric the e2e benchmarks log
+	goBenchMetric = regexp.MustCompile(`^\s+\S+:\d+: metric (\S+) ([0-9.]+) ns/op$`)
+)
+
+// GoBenchmark is the result of one of the Go benchmarks of the e2e tests
+type GoBenchmark struct {
+	Name       string  `json:"name"`
+	Iterations int     `json:"iterations"`
+	NsPerOp    float64 `json:"ns_per_op"`
+	// Metrics are the timings of the steps of an op, in ns/op
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+// RunGo runs the Go benchmarks of the e2e image matching the pattern on the
+// environment's manager, each for at least benchtime
+func RunGo(env *machines.Environment, image, pattern string, benchtime time.Duration) ([]GoBenchmark, error) {
+	manager, err := env.GetManager()
+	if err != nil {
+		return nil, err
+	}
+	command := strings.Join([]string{
+		"docker", "run", "--rm", "--net=host",
+		"-v", "/var/run/docker.sock:/var/run/docker.sock",
+		image, soak.TestBinary,
+		"-test.run", "'^$'",
+		"-test.bench", fmt.Sprintf("'%s'", pattern),
+		"-test.benchtime", benchtime.String(),
+		"-test.timeout", "0",
+	}, " ")
+	log.Infof("Running Go benchmarks %s on %s", pattern, manager.GetName())
+	out, err := manager.MachineSSH(command)
+	if err != nil {
+		return nil, fmt.Errorf("Go benchmarks failed: %s: %s", err, out)
+	}
+	return parseGoBench(out), nil
+}
+
+// parseGoBench reads the results of the benchmarks from their output, with
+// the metrics they logged last
+func parseGoBench(out string) []GoBenchmark {
+	results := []GoBenchmark{}
+	byName := map[string]int{}
+	current := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := goBenchLine.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[3])
+			ns, _ := strconv.ParseFloat(m[4], 64)
+			byName[m[1]] = len(results)
+			results = append(results, GoBenchmark{Name: m[1], Iterations: n, NsPerOp: ns, Metrics: map[string]float64{}})
+			current = ""
+			continue
+		}
+		if m := goBenchHeader.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			continue
+		}
+		if m := goBenchMetric.FindStringSubmatch(line); m != nil && current != "" {
+			if i, ok := byName[current]; ok {
+				results[i].Metrics[m[1]], _ = strconv.ParseFloat(m[2], 64)
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			current = ""
+		}
+	}
+	return results
+}
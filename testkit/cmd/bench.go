@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/bench"
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench <environment>",
+	Short: "measure service converge, scaling, pull and load balancer latencies",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Environment name missing")
+		}
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		cfg := bench.DefaultConfig()
+		flags := cmd.Flags()
+		if cfg.Image, err = flags.GetString("image"); err != nil {
+			return err
+		}
+		if cfg.Replicas, err = flags.GetUint64("replicas"); err != nil {
+			return err
+		}
+		if cfg.ScaleTo, err = flags.GetUint64("scale"); err != nil {
+			return err
+		}
+		if cfg.Iterations, err = flags.GetInt("iterations"); err != nil {
+			return err
+		}
+		if cfg.Requests, err = flags.GetInt("requests"); err != nil {
+			return err
+		}
+		if cfg.Timeout, err = flags.GetDuration("timeout"); err != nil {
+			return err
+		}
+		cfg.GoBench, _ = flags.GetString("go-bench")
+		if cfg.GoBenchTime, err = flags.GetDuration("go-benchtime"); err != nil {
+			return err
+		}
+		output, _ := flags.GetString("output")
+
+		env, lock, err := lockEnvironment(args[0])
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		res, err := bench.Run(env, cfg)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		if output != "" {
+			return ioutil.WriteFile(output, data, 0644)
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
+
+func init() {
+	defaults := bench.DefaultConfig()
+	benchCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+	benchCmd.Flags().String("image", defaults.Image, "image to run, must serve HTTP on port 80")
+	benchCmd.Flags().Uint64("replicas", defaults.Replicas, "replicas to create the service with")
+	benchCmd.Flags().Uint64("scale", defaults.ScaleTo, "replicas to scale the service up to")
+	benchCmd.Flags().Int("iterations", defaults.Iterations, "number of create/scale/remove cycles")
+	benchCmd.Flags().Int("requests", defaults.Requests, "load balancer requests per iteration")
+	benchCmd.Flags().Duration("timeout", defaults.Timeout, "maximum time to wait for each operation to converge")
+	benchCmd.Flags().String("go-bench", "", "also run the Go benchmarks of the image matching this pattern, e.g. .")
+	benchCmd.Flags().Duration("go-benchtime", defaults.GoBenchTime, "how long to run each Go benchmark for at least")
+	benchCmd.Flags().StringP("output", "o", "", "write the JSON results to a file instead of stdout")
+}
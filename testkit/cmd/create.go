@@ -5,14 +5,95 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/spf13/cobra"
 
 	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/trace"
 )
 
+// createEnvironment provisions one set of machines and, unless noInit is
+// set, forms a swarm out of them with the first machines as the managers
+func createEnvironment(linuxCount, windowsCount, managers int, noInit bool, listenAddr string) ([]machines.Machine, error) {
+	if managers < 1 || managers > linuxCount+windowsCount {
+		return nil, fmt.Errorf("Manager count must be between 1 and the number of machines")
+	}
+	lm, wm, err := machines.GetTestMachines(linuxCount, windowsCount)
+	if err != nil {
+		return nil, err
+	}
+	ms := append(lm, wm...)
+	if noInit {
+		trace.FinishCluster(machines.StackName(ms[0]), nil)
+		return ms, nil
+	}
+	err = initSwarm(ms, managers, listenAddr)
+	trace.FinishCluster(machines.StackName(ms[0]), err)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// initSwarm initializes a swarm on the first machine, joins the next ones up
+// to the manager count as managers and the rest as workers
+func initSwarm(ms []machines.Machine, managers int, listenAddr string) error {
+	cli, err := ms[0].GetEngineAPI()
+	if err != nil {
+		return err
+	}
+	internalIP, err := ms[0].GetInternalIP()
+	if err != nil {
+		return err
+	}
+	logger := machines.MachineLog(ms[0])
+	logger.Debug("Initializing swarm")
+	start := time.Now()
+	_, err = cli.SwarmInit(context.TODO(), swarm.InitRequest{
+		ListenAddr:    listenAddr,
+		AdvertiseAddr: internalIP,
+	})
+	machines.LogPhase(logger, "swarm-init", start, err)
+	if err != nil {
+		return err
+	}
+	swarmInfo, err := cli.SwarmInspect(context.TODO())
+	if err != nil {
+		return err
+	}
+	info, err := cli.Info(context.TODO())
+	if err != nil {
+		return err
+	}
+	for i, m := range ms[1:] {
+		role, token := "worker", swarmInfo.JoinTokens.Worker
+		if i+1 < managers {
+			role, token = "manager", swarmInfo.JoinTokens.Manager
+		}
+		logger := machines.MachineLog(m)
+		logger.Debugf("Joining as %s", role)
+		cliW, err := m.GetEngineAPI()
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		err = cliW.SwarmJoin(context.TODO(), swarm.JoinRequest{
+			ListenAddr:  listenAddr,
+			RemoteAddrs: []string{info.Swarm.RemoteManagers[0].Addr},
+			JoinToken:   token,
+		})
+		machines.LogPhase(logger, "swarm-join", start, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var createCmd = &cobra.Command{
 	Use:   "create <linux_count> <windows_count>",
 	Short: "Provision a test environment",
@@ -24,8 +105,8 @@ var createCmd = &cobra.Command{
 		if debug {
 			log.SetLevel(log.DebugLevel)
 		}
-		if len(args) == 0 {
-			return errors.New("Config missing")
+		if len(args) < 2 {
+			return errors.New("Machine counts missing")
 		}
 
 		linuxCount, err := strconv.Atoi(args[0])
@@ -37,61 +118,53 @@ var createCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		lm, wm, err := machines.GetTestMachines(linuxCount, windowsCount)
-		if err != nil {
-			log.Fatalf("Failure: %s", err)
-		}
 		noInit, err := cmd.Flags().GetBool("no-swarm")
 		if err != nil {
 			return err
 		}
 		listenAddr, _ := cmd.Flags().GetString("listen-addr")
-		machines := append(lm, wm...)
-		if !noInit {
-			// Init and join
-			cli, err := machines[0].GetEngineAPI()
-			if err != nil {
-				return err
-			}
-			internalIP, err := machines[0].GetInternalIP()
-			if err != nil {
-				return err
-			}
-			log.Debugf("Initializing swarm on %s", machines[0].GetName())
-			_, err = cli.SwarmInit(context.TODO(), swarm.InitRequest{
-				ListenAddr:    listenAddr,
-				AdvertiseAddr: internalIP,
-			})
-			if err != nil {
-				return err
-			}
-			swarmInfo, err := cli.SwarmInspect(context.TODO())
-			if err != nil {
-				return err
-			}
-			info, err := cli.Info(context.TODO())
-			if err != nil {
-				return err
+		managers, err := cmd.Flags().GetInt("managers")
+		if err != nil {
+			return err
+		}
+		clusters, err := cmd.Flags().GetInt("clusters")
+		if err != nil {
+			return err
+		}
+		if clusters < 1 {
+			return errors.New("--clusters must be at least 1")
+		}
+
+		// Each environment gets a name no other one on the host has, picked
+		// and locked by the driver, and everything it keeps on the host is
+		// named after it: its machines, their disks and its lock record. The
+		// CA and the client certificates of the driver are shared by design
+		results := make([][]machines.Machine, clusters)
+		errs := make([]error, clusters)
+		var wg sync.WaitGroup
+		for i := 0; i < clusters; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = createEnvironment(linuxCount, windowsCount, managers, noInit, listenAddr)
+			}(i)
+		}
+		wg.Wait()
+
+		failed := 0
+		for i := range results {
+			if errs[i] != nil {
+				log.Errorf("Failure: %s", errs[i])
+				failed++
+				continue
 			}
-			for _, m := range machines[1:] {
-				log.Debugf("Joining %s as worker", m.GetName())
-				cliW, err := m.GetEngineAPI()
-				if err != nil {
-					return err
-				}
-				err = cliW.SwarmJoin(context.TODO(), swarm.JoinRequest{
-					ListenAddr:  listenAddr,
-					RemoteAddrs: []string{info.Swarm.RemoteManagers[0].Addr},
-					JoinToken:   swarmInfo.JoinTokens.Worker,
-				})
-				if err != nil {
-					return err
-				}
+			for _, m := range results[i] {
+				fmt.Println(m.GetConnectionEnv())
+				fmt.Println("")
 			}
 		}
-		for _, m := range machines {
-			fmt.Println(m.GetConnectionEnv())
-			fmt.Println("")
+		if failed > 0 {
+			return fmt.Errorf("%d of %d environments failed to create", failed, clusters)
 		}
 		return nil
 	},
@@ -101,4 +174,6 @@ func init() {
 	createCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
 	createCmd.Flags().BoolP("no-swarm", "n", false, "skip swarm init and join")
 	createCmd.Flags().String("listen-addr", "0.0.0.0:2377", "passed to swarm init and join")
+	createCmd.Flags().Int("managers", 1, "number of machines joined as swarm managers")
+	createCmd.Flags().Int("clusters", 1, "number of environments to create in parallel, each with its own name, machines and swarm")
 }
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/credentials"
+)
+
+var credentialsCmd = &cobra.Command{
+	Use:   "credentials",
+	Short: "manage the encrypted store of the cloud drivers' secrets",
+}
+
+var credentialsSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "store a secret, read from stdin so it isn't in the shell's history",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Secret name missing")
+		}
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		value = strings.TrimSpace(value)
+		if value == "" {
+			if err != nil {
+				return fmt.Errorf("Failed to read the secret from stdin: %s", err)
+			}
+			return errors.New("The secret is empty")
+		}
+		if err := credentials.Set(args[0], value); err != nil {
+			return err
+		}
+		fmt.Printf("Stored %s in %s\n", args[0], credentials.StorePath)
+		return nil
+	},
+}
+
+var credentialsRemoveCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "remove a secret from the store",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Secret name missing")
+		}
+		err := credentials.Remove(args[0])
+		if err == credentials.ErrNotFound {
+			return fmt.Errorf("%s is not in %s", args[0], credentials.StorePath)
+		}
+		return err
+	},
+}
+
+var credentialsListCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list the names of the secrets in the store",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := credentials.Names()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	},
+}
+
+func init() {
+	credentialsCmd.AddCommand(credentialsSetCmd, credentialsRemoveCmd, credentialsListCmd)
+}
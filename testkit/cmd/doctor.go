@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/credentials"
+	"github.com/docker/docker-e2e/testkit/machines"
+)
+
+// check is one of the things doctor makes sure of, returning what it found
+type check struct {
+	name string
+	run  func() (string, error)
+}
+
+// lookPath checks that the driver's tool is installed
+func lookPath(tool string) check {
+	return check{tool, func() (string, error) {
+		return exec.LookPath(tool)
+	}}
+}
+
+// secretSource checks where the secret comes from, without showing it.
+// Optional secrets may be missing
+func secretSource(name string, optional bool) check {
+	return check{name, func() (string, error) {
+		_, source, err := credentials.Lookup(name)
+		if err == credentials.ErrNotFound && optional {
+			return "not set", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return "from " + source, nil
+	}}
+}
+
+// driverChecks returns the checks of the driver in MACHINE_DRIVER
+func driverChecks(driver string) []check {
+	switch driver {
+	case "aws":
+		return []check{
+			secretSource("AWS_ACCESS_KEY_ID", true),
+			secretSource("AWS_SECRET_ACCESS_KEY", true),
+			secretSource("AWS_SESSION_TOKEN", true),
+			{"AWS identity", func() (string, error) {
+				config := aws.NewConfig().WithRegion(machines.AWSRegion)
+				s, err := session.NewSession(config.WithCredentials(machines.AWSCredentials(config)))
+				if err != nil {
+					return "", err
+				}
+				id, err := sts.New(s).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%s in account %s", aws.StringValue(id.Arn), aws.StringValue(id.Account)), nil
+			}},
+			{"AWS_KEY_PATH", func() (string, error) {
+				if machines.AWSKeyName == "" || machines.AWSKeyPath == "" {
+					return "", fmt.Errorf("AWS_KEY_NAME and AWS_KEY_PATH must be set to SSH into the machines")
+				}
+				f, err := os.Open(machines.AWSKeyPath)
+				if err != nil {
+					return "", err
+				}
+				f.Close()
+				return fmt.Sprintf("%s, key pair %s", machines.AWSKeyPath, machines.AWSKeyName), nil
+			}},
+		}
+	case "virsh":
+		return []check{lookPath("virsh"), lookPath("qemu-img")}
+	case "vbox":
+		return []check{lookPath("VBoxManage"), lookPath("qemu-img")}
+	default:
+		return []check{lookPath("docker-machine")}
+	}
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "check that the driver is set up, and that its credentials are valid",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		driver := os.Getenv("MACHINE_DRIVER")
+		checks := []check{
+			{"credentials store", func() (string, error) {
+				names, err := credentials.Names()
+				if err != nil {
+					return "", err
+				}
+				if names == nil {
+					return "none at " + credentials.StorePath, nil
+				}
+				return fmt.Sprintf("%d secrets in %s", len(names), credentials.StorePath), nil
+			}},
+		}
+		checks = append(checks, driverChecks(driver)...)
+		if machines.EngineCommit != "" {
+			checks = append(checks, lookPath("docker"))
+		} else if machines.EngineBinary != "" && !strings.Contains(machines.EngineBinary, "://") {
+			checks = append(checks, check{"ENGINE_BINARY", func() (string, error) {
+				_, err := os.Stat(machines.EngineBinary)
+				return machines.EngineBinary, err
+			}})
+		}
+
+		if driver == "" {
+			driver = "docker-machine"
+		}
+		fmt.Printf("Driver: %s\n", driver)
+		failed := 0
+		for _, c := range checks {
+			found, err := c.run()
+			if err != nil {
+				fmt.Printf("FAIL  %s: %s\n", c.name, err)
+				failed++
+				continue
+			}
+			fmt.Printf("ok    %s: %s\n", c.name, found)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+)
+
+var buildImageCmd = &cobra.Command{
+	Use:   "build-image <environment>",
+	Short: "build the e2e image from source on a manager and load it on every node",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Environment name missing")
+		}
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+		dir, _ := cmd.Flags().GetString("context")
+		tag, _ := cmd.Flags().GetString("tag")
+
+		env, err := findEnvironment(args[0])
+		if err != nil {
+			return err
+		}
+		m, err := env.GetManager()
+		if err != nil {
+			return err
+		}
+		id, err := machines.BuildImage(m, dir, tag)
+		if err != nil {
+			return err
+		}
+		if err := machines.DistributeImage(m, env.Machines, tag); err != nil {
+			return err
+		}
+		log.Infof("%s is %s on every node", tag, id)
+		// pin the tests to the image by its ID, which doesn't move when the
+		// tag is rebuilt
+		fmt.Printf("E2E_IMAGE=%s\n", id)
+		return nil
+	},
+}
+
+func init() {
+	buildImageCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+	buildImageCmd.Flags().String("context", "tests", "directory of the e2e image's Dockerfile")
+	buildImageCmd.Flags().String("tag", "docker-e2e:local", "tag for the built image")
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/docker/docker-e2e/testkit/machines"
 	"github.com/spf13/cobra"
@@ -17,17 +18,29 @@ var listCmd = &cobra.Command{
 		}
 
 		for _, stack := range stacks {
+			name := stack.StackName
+			if cost, ok := stack.EstimatedCost(); ok {
+				name = fmt.Sprintf("%s ($%.2f)", name, cost)
+			}
 			if cmd.Flags().Changed("full") {
-				fmt.Printf("%s\n", stack.StackName)
+				fmt.Printf("%s\n", name)
 				for _, m := range stack.Machines {
 					ip, err := m.GetIP()
 					if err != nil {
 						ip = err.Error()
 					}
-					fmt.Printf("\t%s %s\n", m.GetName(), ip)
+					if b, ok := m.(machines.Billable); ok && b.IsStopped() {
+						fmt.Printf("\t%s %s %s paused\n", m.GetName(), ip, b.GetInstanceType())
+					} else if ok {
+						uptime := time.Since(b.GetLaunchTime())
+						uptime -= uptime % time.Minute
+						fmt.Printf("\t%s %s %s up %v\n", m.GetName(), ip, b.GetInstanceType(), uptime)
+					} else {
+						fmt.Printf("\t%s %s\n", m.GetName(), ip)
+					}
 				}
 			} else {
-				fmt.Printf("%v\n", stack.StackName)
+				fmt.Printf("%v\n", name)
 			}
 		}
 		return nil
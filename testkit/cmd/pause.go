@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+)
+
+// findEnvironment looks up a running environment by its stack name
+func findEnvironment(name string) (*machines.Environment, error) {
+	stacks, err := machines.ListEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	for _, stack := range stacks {
+		if stack.StackName == name {
+			return stack, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find environment %s", name)
+}
+
+// lockEnvironment looks up the environment after locking it, for no other
+// testkit process on the host to destroy it or work on it until the lock is
+// released
+func lockEnvironment(name string) (*machines.Environment, *machines.ClusterLock, error) {
+	lock, err := machines.LockCluster(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	env, err := findEnvironment(name)
+	if err != nil {
+		lock.Unlock()
+		return nil, nil, err
+	}
+	return env, lock, nil
+}
+
+// eachMachine runs the action on every machine of the environment, going on
+// past the ones that fail so the environment isn't left half done, and
+// returns the errors of all of them
+func eachMachine(env *machines.Environment, action string, fn func(machines.Machine) error) error {
+	failures := []string{}
+	for _, m := range env.Machines {
+		log.Debugf("Running %s on %s", action, m.GetName())
+		if err := fn(m); err != nil {
+			log.Errorf("Failed to %s %s: %s", action, m.GetName(), err)
+			failures = append(failures, fmt.Sprintf("%s: %s", m.GetName(), err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to %s %d of %d machines: %s", action, len(failures), len(env.Machines), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+var pauseCmd = &cobra.Command{
+	Use:   "pause <environment>",
+	Short: "suspend all machines in an environment, preserving their state",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Environment name missing")
+		}
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		env, lock, err := lockEnvironment(args[0])
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		if err := eachMachine(env, "pause", machines.Machine.Pause); err != nil {
+			return err
+		}
+		fmt.Printf("%v\n", env.StackName)
+		return nil
+	},
+}
+
+var unpauseCmd = &cobra.Command{
+	Use:   "unpause <environment>",
+	Short: "resume all machines in a previously paused environment",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Environment name missing")
+		}
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		env, lock, err := lockEnvironment(args[0])
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		if err := eachMachine(env, "resume", machines.Machine.Resume); err != nil {
+			return err
+		}
+		fmt.Printf("%v\n", env.StackName)
+		return nil
+	},
+}
+
+func init() {
+	pauseCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+	unpauseCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+}
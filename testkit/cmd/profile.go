@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/docker/docker-e2e/testkit/credentials"
+	"github.com/docker/docker-e2e/testkit/machines"
+)
+
+// Profile bundles what a kind of run needs, so users don't export a dozen
+// variables before every one:
+//
+//	default: virsh-lab
+//	profiles:
+//	  virsh-lab:
+//	    driver: virsh
+//	    env:
+//	      VIRSH_DISK_DIR: /srv/e2e
+//	      VIRSH_MEMORY: "4096"
+//	    flags:
+//	      create:
+//	        managers: "3"
+//	  aws-nightly:
+//	    driver: aws
+//	    env:
+//	      AWS_KEY_NAME: nightly
+//	      AWS_KEY_PATH: ~/.ssh/nightly.pem
+//	      AWS_INSTANCE_TYPE: m4.large
+//
+// Driver is the MACHINE_DRIVER, and Env any of the variables the drivers
+// read, like where their credentials are and the sizes of the machines.
+// Flags are the defaults of the flags of every command, by command name.
+// What's set explicitly, in the environment or on the command line, wins
+type Profile struct {
+	Driver string                       `yaml:"driver,omitempty"`
+	Env    map[string]string            `yaml:"env,omitempty"`
+	Flags  map[string]map[string]string `yaml:"flags,omitempty"`
+}
+
+// globalConfig is the configuration file, with its profiles by name
+type globalConfig struct {
+	Default  string              `yaml:"default,omitempty"`
+	Profiles map[string]*Profile `yaml:"profiles,omitempty"`
+}
+
+// configPath returns where the configuration file is: TESTKIT_CONFIG, or
+// testkit/config.yaml in the user's configuration directory
+func configPath() string {
+	if path := os.Getenv("TESTKIT_CONFIG"); path != "" {
+		return path
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "testkit", "config.yaml")
+}
+
+// expandHome replaces a leading ~ of a path with the user's home directory
+func expandHome(path string) string {
+	if path == "~" || len(path) > 1 && path[:2] == "~/" {
+		return filepath.Join(os.Getenv("HOME"), path[1:])
+	}
+	return path
+}
+
+// loadProfile reads the named profile, or the default one if name is empty.
+// There's no profile without a configuration file or a default
+func loadProfile(name string) (*Profile, error) {
+	path := configPath()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && name == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := globalConfig{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", path, err)
+	}
+	if name == "" {
+		name = config.Default
+	}
+	if name == "" {
+		return nil, nil
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		names := []string{}
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("No profile %s in %s, it has %v", name, path, names)
+	}
+	return profile, nil
+}
+
+// apply sets the variables of the profile that aren't set already, and the
+// defaults of the command's flags that weren't given
+func (p *Profile) apply(cmd *cobra.Command) error {
+	env := map[string]string{}
+	for k, v := range p.Env {
+		env[k] = v
+	}
+	if p.Driver != "" {
+		env["MACHINE_DRIVER"] = p.Driver
+	}
+	for k, v := range env {
+		if _, ok := os.LookupEnv(k); !ok {
+			os.Setenv(k, expandHome(v))
+		}
+	}
+	machines.LoadEnv()
+	credentials.LoadEnv()
+
+	for name, value := range p.Flags[cmd.Name()] {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("The profile sets --%s, which %s doesn't have", name, cmd.Name())
+		}
+		if flag.Changed {
+			continue
+		}
+		if err := cmd.Flags().Set(name, value); err != nil {
+			return fmt.Errorf("The profile sets --%s to %q: %s", name, value, err)
+		}
+	}
+	return nil
+}
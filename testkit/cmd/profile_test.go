@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestProfileEnv(t *testing.T) {
+	os.Setenv("TESTKIT_TEST_SET", "explicit")
+	os.Unsetenv("TESTKIT_TEST_UNSET")
+	defer os.Unsetenv("TESTKIT_TEST_SET")
+	defer os.Unsetenv("TESTKIT_TEST_UNSET")
+
+	p := &Profile{Env: map[string]string{
+		"TESTKIT_TEST_SET":   "profile",
+		"TESTKIT_TEST_UNSET": "profile",
+	}}
+	if err := p.apply(&cobra.Command{Use: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if value := os.Getenv("TESTKIT_TEST_SET"); value != "explicit" {
+		t.Errorf("the profile overrode a variable already set, got %q", value)
+	}
+	if value := os.Getenv("TESTKIT_TEST_UNSET"); value != "profile" {
+		t.Errorf("the profile didn't set a variable left unset, got %q", value)
+	}
+}
+
+func TestProfileFlags(t *testing.T) {
+	cmd := &cobra.Command{Use: "create"}
+	cmd.Flags().Int("managers", 1, "")
+	cmd.Flags().String("listen", "", "")
+	if err := cmd.ParseFlags([]string{"--managers=5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Profile{Flags: map[string]map[string]string{
+		"create": {"managers": "3", "listen": "eth0"},
+	}}
+	if err := p.apply(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if managers, _ := cmd.Flags().GetInt("managers"); managers != 5 {
+		t.Errorf("the profile overrode --managers given on the command line, got %d", managers)
+	}
+	if listen, _ := cmd.Flags().GetString("listen"); listen != "eth0" {
+		t.Errorf("the profile didn't set --listen, got %q", listen)
+	}
+}
+
+func TestProfileUnknownFlag(t *testing.T) {
+	p := &Profile{Flags: map[string]map[string]string{
+		"create": {"no-such-flag": "1"},
+	}}
+	if err := p.apply(&cobra.Command{Use: "create"}); err == nil {
+		t.Errorf("the profile set a flag create doesn't have")
+	}
+}
@@ -16,9 +16,18 @@ var removeCmd = &cobra.Command{
 		if len(args) == 0 {
 			return errors.New("Environment name missing")
 		}
+		// Grab the spend before the machines go away; not finding the
+		// environment here is left for DestroyEnvironment to report
+		env, _ := findEnvironment(args[0])
 		if err := machines.DestroyEnvironment(args[0]); err != nil {
 			return err
 		}
+		if env != nil {
+			if cost, ok := env.EstimatedCost(); ok {
+				fmt.Printf("%v ($%.2f)\n", args[0], cost)
+				return nil
+			}
+		}
 		fmt.Printf("%v\n", args[0])
 		return nil
 	},
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/report"
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "work with the results of runs",
+}
+
+var reportDiffCmd = &cobra.Command{
+	Use:   "diff <baseline> <current>",
+	Short: "compare a run's results and benchmarks to a baseline, failing on regressions",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("Baseline and current runs missing")
+		}
+		threshold, err := cmd.Flags().GetFloat64("threshold")
+		if err != nil {
+			return err
+		}
+		output, _ := cmd.Flags().GetString("output")
+
+		baseline, err := report.Load(args[0])
+		if err != nil {
+			return err
+		}
+		current, err := report.Load(args[1])
+		if err != nil {
+			return err
+		}
+		diff, err := report.Compare(baseline, current, threshold)
+		if err != nil {
+			return err
+		}
+		if output != "" {
+			data, err := json.MarshalIndent(diff, "", "  ")
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(output, data, 0644); err != nil {
+				return err
+			}
+		}
+
+		for _, t := range diff.NewFailures {
+			fmt.Printf("FAIL   %s (was %s)\n", t.Name, describeStatus(t.Baseline))
+		}
+		for _, t := range diff.NewFlaky {
+			fmt.Printf("FLAKY  %s (was %s)\n", t.Name, describeStatus(t.Baseline))
+		}
+		for _, t := range diff.Fixed {
+			fmt.Printf("FIXED  %s\n", t.Name)
+		}
+		for _, m := range diff.Metrics {
+			mark := "       "
+			if m.Significant {
+				mark = "SLOWER "
+			}
+			fmt.Printf("%s%s: %.1fms -> %.1fms (%+.1f%%)\n", mark, m.Metric, m.Baseline, m.Current, 100*m.Change)
+		}
+		if diff.Regressed() {
+			return fmt.Errorf("%d newly failing tests, %d metrics regressed", len(diff.NewFailures), len(diff.Regressions))
+		}
+		return nil
+	},
+}
+
+// describeStatus names the status of a test in the baseline
+func describeStatus(status string) string {
+	if status == "" {
+		return "not run"
+	}
+	return status
+}
+
+func init() {
+	reportCmd.AddCommand(reportDiffCmd)
+	reportDiffCmd.Flags().Float64("threshold", 0.1, "how much slower a metric's mean has to be to regress, 0.1 being 10%")
+	reportDiffCmd.Flags().StringP("output", "o", "", "also write the comparison as JSON to a file")
+}
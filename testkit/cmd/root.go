@@ -4,11 +4,14 @@ import (
 	"io/ioutil"
 	"os"
 
+	log "github.com/Sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/docker/docker-e2e/testkit/environment"
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/trace"
 	"github.com/spf13/cobra"
 )
 
@@ -37,7 +40,8 @@ func loadConfig(path string) (*Config, error) {
 }
 
 func newSession() *session.Session {
-	s, err := session.NewSession(aws.NewConfig().WithRegion(region))
+	config := aws.NewConfig().WithRegion(region)
+	s, err := session.NewSession(config.WithCredentials(machines.AWSCredentials(config)))
 	if err != nil {
 		panic(err)
 	}
@@ -45,11 +49,42 @@ func newSession() *session.Session {
 }
 
 var mainCmd = &cobra.Command{
-	Use:   os.Args[0],
-	Short: "Docker End to End Testing",
+	Use:               os.Args[0],
+	Short:             "Docker End to End Testing",
+	PersistentPreRunE: setup,
+}
+
+// setup applies the profile and the global flags before any command runs
+func setup(cmd *cobra.Command, args []string) error {
+	name, err := cmd.Flags().GetString("profile")
+	if err != nil {
+		return err
+	}
+	profile, err := loadProfile(name)
+	if err != nil {
+		return err
+	}
+	if profile != nil {
+		if err := profile.apply(cmd); err != nil {
+			return err
+		}
+	}
+	format, err := cmd.Flags().GetString("log-format")
+	if err != nil {
+		return err
+	}
+	endpoint, err := cmd.Flags().GetString("trace-endpoint")
+	if err != nil {
+		return err
+	}
+	trace.SetEndpoint(endpoint)
+	return machines.SetLogFormat(format)
 }
 
 func init() {
+	mainCmd.PersistentFlags().String("profile", "", "profile of the configuration file to use, its default one if not set, see TESTKIT_CONFIG")
+	mainCmd.PersistentFlags().String("log-format", "text", "format of the logs, text or json with the cluster, machine, phase and duration as fields")
+	mainCmd.PersistentFlags().String("trace-endpoint", "", "send spans of the environments' creation to this Zipkin-compatible collector, e.g. http://jaeger:9411/api/v2/spans")
 	mainCmd.AddCommand(
 		envCmd,
 		createCmd,
@@ -58,9 +93,24 @@ func init() {
 		sshCmd,
 		listCmd,
 		removeCmd,
+		pauseCmd,
+		unpauseCmd,
+		serveCmd,
+		benchCmd,
+		soakCmd,
+		upgradeCmd,
+		buildImageCmd,
+		shardCmd,
+		reportCmd,
+		credentialsCmd,
+		doctorCmd,
 	)
 }
 
 func Execute() error {
-	return mainCmd.Execute()
+	err := mainCmd.Execute()
+	if err := trace.Flush(true); err != nil {
+		log.Warnf("Failed to send the traces: %s", err)
+	}
+	return err
 }
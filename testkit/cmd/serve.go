@@ -0,0 +1,593 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/metrics"
+	"github.com/docker/docker-e2e/testkit/trace"
+)
+
+type machineInfo struct {
+	Name          string `json:"name"`
+	IP            string `json:"ip"`
+	InternalIP    string `json:"internal_ip"`
+	DockerHost    string `json:"docker_host"`
+	Windows       bool   `json:"windows"`
+	ConnectionEnv string `json:"connection_env"`
+}
+
+type environmentInfo struct {
+	Name          string        `json:"name"`
+	Machines      []machineInfo `json:"machines"`
+	EstimatedCost *float64      `json:"estimated_cost,omitempty"`
+}
+
+type createRequest struct {
+	Linux      int    `json:"linux"`
+	Windows    int    `json:"windows"`
+	Managers   int    `json:"managers"`
+	NoSwarm    bool   `json:"no_swarm"`
+	ListenAddr string `json:"listen_addr"`
+}
+
+type runRequest struct {
+	Commands []string `json:"commands"`
+}
+
+type runResult struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newEnvironmentInfo(name string, ms []machines.Machine) environmentInfo {
+	info := environmentInfo{Name: name, Machines: []machineInfo{}}
+	for _, m := range ms {
+		ip, _ := m.GetIP()
+		internalIP, _ := m.GetInternalIP()
+		info.Machines = append(info.Machines, machineInfo{
+			Name:          m.GetName(),
+			IP:            ip,
+			InternalIP:    internalIP,
+			DockerHost:    m.GetDockerHost(),
+			Windows:       m.IsWindows(),
+			ConnectionEnv: m.GetConnectionEnv(),
+		})
+	}
+	env := &machines.Environment{StackName: name, Machines: ms}
+	if cost, ok := env.EstimatedCost(); ok {
+		info.EstimatedCost = &cost
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("Failed to write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// provisionBuckets are the upper bounds, in seconds, of the buckets of the
+// provisioning and destroy durations
+var provisionBuckets = []float64{30, 60, 120, 300, 600, 900, 1200, 1800, 3600}
+
+// serveMetrics are what the server exposes on /metrics
+type serveMetrics struct {
+	*metrics.Registry
+	provisionDuration metrics.Histogram
+	provisioning      metrics.Gauge
+	destroyDuration   metrics.Histogram
+	machineActions    metrics.Counter
+	environments      metrics.Gauge
+	machines          metrics.Gauge
+}
+
+func newServeMetrics() *serveMetrics {
+	r := metrics.NewRegistry()
+	m := &serveMetrics{
+		Registry:          r,
+		provisionDuration: r.NewHistogram("testkit_provision_duration_seconds", "How long creating an environment took, by result.", provisionBuckets, "result"),
+		provisioning:      r.NewGauge("testkit_provisioning", "Environments being created, or waiting for a slot to be."),
+		destroyDuration:   r.NewHistogram("testkit_destroy_duration_seconds", "How long destroying an environment took, by result.", provisionBuckets, "result"),
+		machineActions:    r.NewCounter("testkit_machine_actions_total", "Power operations on machines, by action and result.", "action", "result"),
+		environments:      r.NewGauge("testkit_environments", "Environments on this host."),
+		machines:          r.NewGauge("testkit_machines", "Machines of the environments on this host, by OS.", "os"),
+	}
+	m.provisioning.Set(0)
+	// the environments can be created and destroyed by other testkit
+	// commands too, so they're counted on every scrape
+	r.OnScrape(func() {
+		stacks, err := machines.ListEnvironments()
+		if err != nil {
+			log.Warnf("Failed to list the environments for the metrics: %s", err)
+			return
+		}
+		m.machines.Reset()
+		m.machines.Set(0, "linux")
+		m.machines.Set(0, "windows")
+		for _, stack := range stacks {
+			for _, machine := range stack.Machines {
+				platform := "linux"
+				if machine.IsWindows() {
+					platform = "windows"
+				}
+				m.machines.Add(1, platform)
+			}
+		}
+		m.environments.Set(float64(len(stacks)))
+	})
+	return m
+}
+
+// resultLabel is the label value of the outcome of an operation
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// server exposes environment management over HTTP so that remote CI workers
+// don't need direct access to the hypervisor or cloud credentials
+type server struct {
+	// createSlots bounds the number of environments being provisioned at
+	// once, since that's what exhausts the host's capacity
+	createSlots chan struct{}
+	listenAddr  string
+	metrics     *serveMetrics
+	// token is the bearer token the callers must send, unless they have a
+	// client certificate signed by the server's --tls-ca
+	token string
+
+	// locks are the locks of the environments with requests in flight,
+	// shared by those requests so tests can act on several machines at once
+	locksMu sync.Mutex
+	locks   map[string]*heldLock
+}
+
+// heldLock is the lock of an environment, and how many requests use it
+type heldLock struct {
+	lock  *machines.ClusterLock
+	users int
+}
+
+// lockEnvironment looks up the environment after locking it like the
+// commands do, for no other testkit process to pause, remove or use it while
+// the request works on it. The returned func releases the lock
+func (s *server) lockEnvironment(name string) (*machines.Environment, func(), error) {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	held, ok := s.locks[name]
+	var env *machines.Environment
+	var err error
+	if ok {
+		env, err = findEnvironment(name)
+	} else {
+		held = &heldLock{}
+		env, held.lock, err = lockEnvironment(name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.locks == nil {
+		s.locks = map[string]*heldLock{}
+	}
+	s.locks[name] = held
+	held.users++
+	return env, func() {
+		s.locksMu.Lock()
+		defer s.locksMu.Unlock()
+		held.users--
+		if held.users == 0 {
+			held.lock.Unlock()
+			delete(s.locks, name)
+		}
+	}, nil
+}
+
+// lookupStatus is the status of a failure to find or lock an environment
+func lookupStatus(err error) int {
+	if _, ok := err.(machines.ErrLocked); ok {
+		return http.StatusConflict
+	}
+	return http.StatusNotFound
+}
+
+// authorized reports whether the request comes with the server's token or a
+// verified client certificate
+func (s *server) authorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if s.token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// scraped every few seconds, not worth logging
+	if r.URL.Path == "/metrics" && r.Method == http.MethodGet {
+		s.metrics.ServeHTTP(w, r)
+		return
+	}
+	log.Infof("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	// the machines' addresses and commands on them are as good as root on
+	// the machines, so everything but the metrics needs the token or a cert
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("a bearer token or a client certificate is required"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "environments" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.list(w, r)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.create(w, r)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.inspect(w, r, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		s.destroy(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "run" && r.Method == http.MethodPost:
+		s.run(w, r, parts[1], "")
+	case len(parts) == 5 && parts[2] == "machines" && parts[4] == "run" && r.Method == http.MethodPost:
+		s.run(w, r, parts[1], parts[3])
+	case len(parts) == 5 && parts[2] == "machines" && parts[4] == "archive" && r.Method == http.MethodGet:
+		s.archive(w, r, parts[1], parts[3])
+	case len(parts) == 5 && parts[2] == "machines" && parts[4] == "file" && r.Method == http.MethodPut:
+		s.writeFile(w, r, parts[1], parts[3])
+	case len(parts) == 5 && parts[2] == "machines" && r.Method == http.MethodPost:
+		s.machineAction(w, r, parts[1], parts[3], parts[4])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not supported on %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *server) list(w http.ResponseWriter, r *http.Request) {
+	stacks, err := machines.ListEnvironments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := []environmentInfo{}
+	for _, stack := range stacks {
+		res = append(res, newEnvironmentInfo(stack.StackName, stack.Machines))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *server) create(w http.ResponseWriter, r *http.Request) {
+	req := createRequest{Managers: 1, ListenAddr: s.listenAddr}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Linux+req.Windows < 1 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("at least one machine is required"))
+		return
+	}
+
+	s.metrics.provisioning.Add(1)
+	defer s.metrics.provisioning.Add(-1)
+	s.createSlots <- struct{}{}
+	defer func() { <-s.createSlots }()
+
+	start := time.Now()
+	ms, err := createEnvironment(req.Linux, req.Windows, req.Managers, req.NoSwarm, req.ListenAddr)
+	s.metrics.provisionDuration.Observe(time.Since(start).Seconds(), resultLabel(err))
+	go flushTraces()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newEnvironmentInfo(machines.StackName(ms[0]), ms))
+}
+
+// flushTraces sends the spans of the environment just created or destroyed,
+// rather than waiting for the server to exit
+func flushTraces() {
+	if err := trace.Flush(false); err != nil {
+		log.Warnf("Failed to send the traces: %s", err)
+	}
+}
+
+func (s *server) inspect(w http.ResponseWriter, r *http.Request, name string) {
+	env, err := findEnvironment(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newEnvironmentInfo(env.StackName, env.Machines))
+}
+
+func (s *server) destroy(w http.ResponseWriter, r *http.Request, name string) {
+	env, err := findEnvironment(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	info := newEnvironmentInfo(env.StackName, env.Machines)
+	start := time.Now()
+	err = machines.DestroyEnvironment(name)
+	s.metrics.destroyDuration.Observe(time.Since(start).Seconds(), resultLabel(err))
+	go flushTraces()
+	if _, ok := err.(machines.ErrLocked); ok {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// findMachine returns the named machine of the environment, or the first one
+// if no machine name is given
+func findMachine(env *machines.Environment, machineName string) (machines.Machine, error) {
+	if len(env.Machines) == 0 {
+		return nil, fmt.Errorf("%s has no machines", env.StackName)
+	}
+	if machineName == "" {
+		return env.Machines[0], nil
+	}
+	for _, m := range env.Machines {
+		if m.GetName() == machineName {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no machine %s in %s", machineName, env.StackName)
+}
+
+// machineActions are the power operations that can be applied to a single
+// machine, e.g. by tests simulating node failures
+var machineActions = map[string]func(machines.Machine) error{
+	"kill":   machines.Machine.Kill,
+	"start":  machines.Machine.Start,
+	"stop":   machines.Machine.Stop,
+	"pause":  machines.Machine.Pause,
+	"resume": machines.Machine.Resume,
+	"reboot": machines.Machine.Reboot,
+}
+
+func (s *server) machineAction(w http.ResponseWriter, r *http.Request, name, machineName, action string) {
+	fn, ok := machineActions[action]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown machine action %s", action))
+		return
+	}
+	env, unlock, err := s.lockEnvironment(name)
+	if err != nil {
+		writeError(w, lookupStatus(err), err)
+		return
+	}
+	defer unlock()
+	m, err := findMachine(env, machineName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	machines.MachineLog(m).Info(action)
+	err = fn(m)
+	s.metrics.machineActions.Inc(action, resultLabel(err))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newEnvironmentInfo(env.StackName, []machines.Machine{m}).Machines[0])
+}
+
+// archive returns the ?path= directory on the machine as a tar stream
+func (s *server) archive(w http.ResponseWriter, r *http.Request, name, machineName string) {
+	env, err := findEnvironment(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	m, err := findMachine(env, machineName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	data, err := m.TarHostDir(r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Write(data)
+}
+
+// writeFile stores the request body on the machine at ?path=
+func (s *server) writeFile(w http.ResponseWriter, r *http.Request, name, machineName string) {
+	env, unlock, err := s.lockEnvironment(name)
+	if err != nil {
+		writeError(w, lookupStatus(err), err)
+		return
+	}
+	defer unlock()
+	m, err := findMachine(env, machineName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := m.WriteFile(r.URL.Query().Get("path"), r.Body); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"path": r.URL.Query().Get("path")})
+}
+
+// run executes the commands in order on the named machine of the environment
+// (the first one by default), stopping at the first failure
+func (s *server) run(w http.ResponseWriter, r *http.Request, name, machineName string) {
+	req := runRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	env, unlock, err := s.lockEnvironment(name)
+	if err != nil {
+		writeError(w, lookupStatus(err), err)
+		return
+	}
+	defer unlock()
+	m, err := findMachine(env, machineName)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	status := http.StatusOK
+	results := []runResult{}
+	for _, command := range req.Commands {
+		machines.MachineLog(m).Infof("$ %s", command)
+		out, err := m.MachineSSH(command)
+		res := runResult{Command: command, Output: out}
+		if err != nil {
+			res.Error = err.Error()
+			results = append(results, res)
+			status = http.StatusInternalServerError
+			break
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, status, results)
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "manage environments on this host through an HTTP API",
+	Long: `Run a long-lived server exposing environment management as JSON over HTTP:
+
+  GET    /environments             list environments
+  POST   /environments             create one: {"linux": 3, "windows": 0, "managers": 1, "no_swarm": false}
+  GET    /environments/<name>      inspect an environment
+  DELETE /environments/<name>      destroy an environment
+  POST   /environments/<name>/run  run commands on its first machine: {"commands": ["docker info"]}
+  POST   /environments/<name>/machines/<machine>/run
+                                   run commands on a specific machine
+  POST   /environments/<name>/machines/<machine>/<action>
+                                   kill, start, stop, pause, resume or reboot a machine
+  GET    /environments/<name>/machines/<machine>/archive?path=<dir>
+                                   download a directory of the machine as a tar
+  PUT    /environments/<name>/machines/<machine>/file?path=<file>
+                                   upload the request body to the machine
+  GET    /metrics                  provisioning durations, machine counts and
+                                   machine actions, for Prometheus to scrape
+
+Machines are reached with the client certs in the driver's disk directory, so
+remote callers need a copy of those to use the returned DOCKER_HOST.
+
+Every endpoint but /metrics requires either the bearer token in
+TESTKIT_SERVE_TOKEN (or the file given with --token-file), sent as
+"Authorization: Bearer <token>", or a client certificate signed by --tls-ca.
+The server refuses to start without one of them.
+
+Running commands, machine actions and uploads lock the environment like the
+commands do, and fail with 409 while another testkit process holds it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+		addr, _ := cmd.Flags().GetString("addr")
+		swarmListenAddr, _ := cmd.Flags().GetString("listen-addr")
+		maxParallel, err := cmd.Flags().GetInt("max-parallel")
+		if err != nil {
+			return err
+		}
+		if maxParallel < 1 {
+			maxParallel = 1
+		}
+
+		token := os.Getenv("TESTKIT_SERVE_TOKEN")
+		if tokenFile, _ := cmd.Flags().GetString("token-file"); tokenFile != "" {
+			data, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return err
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		tlsCert, _ := cmd.Flags().GetString("tls-cert")
+		tlsKey, _ := cmd.Flags().GetString("tls-key")
+		tlsCA, _ := cmd.Flags().GetString("tls-ca")
+		if token == "" && tlsCA == "" {
+			return errors.New("Set TESTKIT_SERVE_TOKEN, --token-file or --tls-ca, the API must not be open to anyone who can reach it")
+		}
+		if tlsCA != "" && (tlsCert == "" || tlsKey == "") {
+			return errors.New("--tls-ca requires --tls-cert and --tls-key")
+		}
+
+		s := &server{
+			createSlots: make(chan struct{}, maxParallel),
+			listenAddr:  swarmListenAddr,
+			metrics:     newServeMetrics(),
+			token:       token,
+		}
+		if tlsCert == "" {
+			log.Infof("Listening on %s", addr)
+			return http.ListenAndServe(addr, s)
+		}
+		tlsConfig := &tls.Config{}
+		if tlsCA != "" {
+			data, err := ioutil.ReadFile(tlsCA)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return fmt.Errorf("No certificate in %s", tlsCA)
+			}
+			// the token still works for callers without a certificate
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		httpServer := &http.Server{Addr: addr, Handler: s, TLSConfig: tlsConfig}
+		log.Infof("Listening on %s with TLS", addr)
+		return httpServer.ListenAndServeTLS(tlsCert, tlsKey)
+	},
+}
+
+func init() {
+	serveCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+	serveCmd.Flags().String("addr", "127.0.0.1:8080", "address for the API to listen on")
+	serveCmd.Flags().String("token-file", "", "file with the bearer token the callers must send, rather than TESTKIT_SERVE_TOKEN")
+	serveCmd.Flags().String("tls-cert", "", "serve over TLS with this certificate")
+	serveCmd.Flags().String("tls-key", "", "key of --tls-cert")
+	serveCmd.Flags().String("tls-ca", "", "accept the client certificates signed by this CA instead of the token")
+	serveCmd.Flags().String("listen-addr", "0.0.0.0:2377", "passed to swarm init and join")
+	serveCmd.Flags().Int("max-parallel", 1, "maximum number of environments provisioned at once")
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+)
+
+const testToken = "secret"
+
+func newTestServer() *server {
+	return &server{
+		createSlots: make(chan struct{}, 1),
+		metrics:     newServeMetrics(),
+		token:       testToken,
+	}
+}
+
+// serve sends the request to the server, with the token unless it's empty
+func serve(s *server, method, path, body, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestServeToken(t *testing.T) {
+	s := newTestServer()
+	for _, c := range []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer wrong", http.StatusUnauthorized},
+		{"not bearer", "Basic " + testToken, http.StatusUnauthorized},
+		{"empty", "Bearer ", http.StatusUnauthorized},
+		// authorized, so it gets as far as not finding the path
+		{"valid", "Bearer " + testToken, http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/nowhere", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s token: got %d, want %d", c.name, w.Code, c.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s token: no WWW-Authenticate on the 401", c.name)
+		}
+	}
+}
+
+func TestServeNoToken(t *testing.T) {
+	s := newTestServer()
+	s.token = ""
+	if w := serve(s, http.MethodGet, "/environments", "", "anything"); w.Code != http.StatusUnauthorized {
+		t.Errorf("a server without a token let a request in without a certificate, got %d", w.Code)
+	}
+}
+
+// newCert returns a certificate for the name and its key, signed by the
+// parent, or self-signed as a CA if there's none
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServeClientCert(t *testing.T) {
+	ca, caKey, _ := newCert(t, "ca", nil, nil)
+	_, _, client := newCert(t, "client", ca, caKey)
+	otherCA, otherKey, _ := newCert(t, "other ca", nil, nil)
+	_, _, stranger := newCert(t, "stranger", otherCA, otherKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ts := httptest.NewUnstartedServer(newTestServer())
+	ts.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(certs ...tls.Certificate) (int, error) {
+		// the server's certificate is httptest's own, this is about the client's
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+		}}
+		resp, err := client.Get(ts.URL + "/nowhere")
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	// authorized, so it gets as far as not finding the path
+	if status, err := get(client); err != nil || status != http.StatusNotFound {
+		t.Errorf("with a client certificate of the CA: got %d, %v", status, err)
+	}
+	if status, err := get(); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("without a client certificate: got %d, %v", status, err)
+	}
+	if status, err := get(stranger); err == nil && status != http.StatusUnauthorized {
+		t.Errorf("with a client certificate of another CA: got %d", status)
+	}
+}
+
+func TestServeMetricsOpen(t *testing.T) {
+	if w := serve(newTestServer(), http.MethodGet, "/metrics", "", ""); w.Code != http.StatusOK {
+		t.Errorf("/metrics without a token: got %d, want 200", w.Code)
+	}
+}
+
+func TestServeRoutes(t *testing.T) {
+	s := newTestServer()
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodGet, "/nowhere", "", http.StatusNotFound},
+		{http.MethodPut, "/environments", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/environments/e2e/run", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/environments", "{", http.StatusBadRequest},
+		{http.MethodPost, "/environments", `{"linux": 0}`, http.StatusBadRequest},
+		{http.MethodPost, "/environments/e2e/run", "{", http.StatusBadRequest},
+		{http.MethodPost, "/environments/e2e/machines/e2e-1/run", "{", http.StatusBadRequest},
+		{http.MethodPost, "/environments/e2e/machines/e2e-1/explode", "", http.StatusNotFound},
+	} {
+		if w := serve(s, c.method, c.path, c.body, testToken); w.Code != c.status {
+			t.Errorf("%s %s: got %d, want %d: %s", c.method, c.path, w.Code, c.status, w.Body.String())
+		}
+	}
+}
+
+func TestServeLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testkit-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(lockDir string) { machines.LockDir = lockDir }(machines.LockDir)
+	machines.LockDir = dir
+
+	// held by the test as if by a testkit pause, the server's lock is a
+	// different file description so it conflicts like another process's
+	lock, err := machines.LockCluster("e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	s := newTestServer()
+	for _, c := range []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/environments/e2e/run", `{"commands": ["true"]}`},
+		{http.MethodPost, "/environments/e2e/machines/e2e-1/kill", ""},
+		{http.MethodPut, "/environments/e2e/machines/e2e-1/file?path=/tmp/x", "x"},
+	} {
+		if w := serve(s, c.method, c.path, c.body, testToken); w.Code != http.StatusConflict {
+			t.Errorf("%s %s on a locked environment: got %d, want 409: %s", c.method, c.path, w.Code, w.Body.String())
+		}
+	}
+	if len(s.locks) != 0 {
+		t.Errorf("the server kept the locks of %v", s.locks)
+	}
+}
+
+func TestFindMachineEmpty(t *testing.T) {
+	if _, err := findMachine(&machines.Environment{StackName: "e2e"}, ""); err == nil {
+		t.Errorf("found a machine in an environment without any")
+	}
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/shard"
+)
+
+var shardCmd = &cobra.Command{
+	Use:   "shard <environment>...",
+	Short: "split the tests across several environments, run them at once and merge the results",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Environment names missing")
+		}
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		cfg := shard.Config{}
+		flags := cmd.Flags()
+		cfg.Image, _ = flags.GetString("image")
+		cfg.Suite, _ = flags.GetString("suite")
+		cfg.Skip, _ = flags.GetString("skip")
+		cfg.Timings, _ = flags.GetString("timings")
+		cfg.Output, _ = flags.GetString("output")
+		if cfg.Retries, err = flags.GetInt("retries"); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(cfg.Output, 0755); err != nil {
+			return err
+		}
+
+		envs := []*machines.Environment{}
+		for _, name := range args {
+			env, lock, err := lockEnvironment(name)
+			if err != nil {
+				return err
+			}
+			defer lock.Unlock()
+			envs = append(envs, env)
+		}
+		report, err := shard.Run(envs, cfg)
+		if err != nil {
+			return err
+		}
+		for _, s := range report.Shards {
+			log.Infof("%s: %d tests in %s, %d failed", s.Environment, len(s.Tests), s.Duration, len(s.FailedTests))
+		}
+		log.Infof("%d passed, %d failed, %d flaky, %d skipped in %.0fs, results in %s", report.Passed, report.Failed, report.Flaky, report.Skipped, report.Duration, cfg.Output)
+		for _, s := range report.Shards {
+			if !s.Passed {
+				return fmt.Errorf("the shard on %s failed", s.Environment)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	shardCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+	shardCmd.Flags().String("image", "dockerswarm/e2e:latest", "e2e test image to run on the managers")
+	shardCmd.Flags().String("suite", "", "only run tests with one of these comma separated tags")
+	shardCmd.Flags().String("skip", "", "don't run tests with any of these comma separated tags")
+	shardCmd.Flags().Int("retries", 0, "how many more times to run failed tests tagged flaky")
+	shardCmd.Flags().String("timings", "", "results.json of an earlier run, to balance the shards by its durations")
+	shardCmd.Flags().StringP("output", "o", "e2e-results", "directory to write the merged results to")
+}
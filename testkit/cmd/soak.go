@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/soak"
+)
+
+var soakCmd = &cobra.Command{
+	Use:   "soak <environment>",
+	Short: "repeatedly run test suites against an environment to catch slow leaks",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("Environment name missing")
+		}
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+		rand.Seed(time.Now().UnixNano())
+
+		cfg := soak.Config{}
+		flags := cmd.Flags()
+		cfg.Image, _ = flags.GetString("image")
+		cfg.Suite, _ = flags.GetString("suite")
+		cfg.Output, _ = flags.GetString("output")
+		cfg.MetricsAddr, _ = flags.GetString("metrics-addr")
+		cfg.Chaos, _ = flags.GetBool("chaos")
+		if cfg.Duration, err = flags.GetDuration("duration"); err != nil {
+			return err
+		}
+		if cfg.Interval, err = flags.GetDuration("interval"); err != nil {
+			return err
+		}
+
+		env, lock, err := lockEnvironment(args[0])
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+		report, err := soak.Run(env, cfg)
+		if err != nil {
+			return err
+		}
+		if cfg.Output == "" {
+			data, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		}
+		failed := 0
+		for _, iteration := range report.Iterations {
+			if !iteration.Passed {
+				failed++
+			}
+		}
+		log.Infof("%d of %d iterations failed", failed, len(report.Iterations))
+		for name, growth := range report.Growth {
+			log.Infof("%s: dockerd grew by %d KB RSS, %d fds, %d goroutines", name, growth.RSSKB, growth.Fds, growth.Goroutines)
+		}
+		return nil
+	},
+}
+
+func init() {
+	soakCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+	soakCmd.Flags().String("image", "dockerswarm/e2e:latest", "e2e test image to run on a manager")
+	soakCmd.Flags().String("suite", "", "only run tests matching this regular expression")
+	soakCmd.Flags().Duration("duration", 24*time.Hour, "how long to keep running the suites")
+	soakCmd.Flags().Duration("interval", time.Minute, "pause between iterations")
+	soakCmd.Flags().Bool("chaos", false, "kill a random task container before each iteration")
+	soakCmd.Flags().StringP("output", "o", "", "write the JSON report to a file, updated after every iteration")
+	soakCmd.Flags().String("metrics-addr", "", "serve the progress of the run on /metrics at this address, e.g. :9100")
+}
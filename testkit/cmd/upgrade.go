@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/upgrade"
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade-test",
+	Short: "create a cluster on an old engine, roll it to a new one and verify it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		debug, err := cmd.Flags().GetBool("debug")
+		if err != nil {
+			return err
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+		flags := cmd.Flags()
+		cfg := upgrade.Config{}
+		cfg.From, _ = flags.GetString("from")
+		cfg.To, _ = flags.GetString("to")
+		cfg.Image, _ = flags.GetString("image")
+		cfg.Suite, _ = flags.GetString("suite")
+		if cfg.From == "" || cfg.To == "" {
+			return errors.New("Both --from and --to are required")
+		}
+		if cfg.Timeout, err = flags.GetDuration("timeout"); err != nil {
+			return err
+		}
+		nodes, err := flags.GetInt("nodes")
+		if err != nil {
+			return err
+		}
+		if nodes < 1 {
+			return errors.New("--nodes must be at least 1")
+		}
+		listenAddr, _ := flags.GetString("listen-addr")
+		output, _ := flags.GetString("output")
+		preserve, _ := flags.GetBool("preserve")
+
+		ms, err := createEnvironment(nodes, 0, 1, true, listenAddr)
+		if err != nil {
+			return err
+		}
+		env := &machines.Environment{StackName: machines.StackName(ms[0]), Machines: ms}
+		if !preserve {
+			defer func() {
+				log.Infof("Removing %s", env.StackName)
+				if err := machines.DestroyEnvironment(env.StackName); err != nil {
+					log.Warnf("Failed to remove %s: %s", env.StackName, err)
+				}
+			}()
+		}
+
+		// The base image may come with a different engine, so install the
+		// starting version explicitly before forming the swarm
+		errChan := make(chan error, len(ms))
+		for _, m := range ms {
+			go func(m machines.Machine) {
+				errChan <- machines.UpgradeDockerEngine(m, cfg.From)
+			}(m)
+		}
+		for range ms {
+			if err := <-errChan; err != nil {
+				return err
+			}
+		}
+		if err := initSwarm(ms, 1, listenAddr); err != nil {
+			return err
+		}
+
+		res, err := upgrade.Run(env, cfg)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		if output != "" {
+			if err := ioutil.WriteFile(output, data, 0644); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println(string(data))
+		}
+		if !res.SuitesPass {
+			return fmt.Errorf("Verification suites failed after upgrading from %s to %s: %v", cfg.From, cfg.To, res.FailedTests)
+		}
+		return nil
+	},
+}
+
+func init() {
+	upgradeCmd.Flags().BoolP("debug", "d", false, "enable verbose logging")
+	upgradeCmd.Flags().String("from", "", "engine version to create the cluster with, e.g. 17.06")
+	upgradeCmd.Flags().String("to", "", "engine version to upgrade to, e.g. 17.12")
+	upgradeCmd.Flags().Int("nodes", 3, "number of linux machines in the cluster")
+	upgradeCmd.Flags().String("image", "dockerswarm/e2e:latest", "e2e test image used for workloads and verification")
+	upgradeCmd.Flags().String("suite", "", "only run verification tests matching this regular expression")
+	upgradeCmd.Flags().Duration("timeout", 5*time.Minute, "how long to wait for the cluster to converge at each step")
+	upgradeCmd.Flags().String("listen-addr", "0.0.0.0:2377", "passed to swarm init and join")
+	upgradeCmd.Flags().StringP("output", "o", "", "write the JSON result to a file")
+	upgradeCmd.Flags().Bool("preserve", false, "keep the environment around afterwards")
+}
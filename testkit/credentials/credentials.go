@@ -0,0 +1,253 @@
+// Package credentials resolves the secrets of the cloud drivers, like their
+// API keys, so they don't have to be exported in every shell running testkit.
+// A secret named NAME comes from, in order:
+//
+//   - the NAME environment variable
+//   - the file at NAME_FILE, like docker secrets mounted in a CI container
+//   - the encrypted store at StorePath, unlocked by the passphrase in
+//     TESTKIT_CREDENTIALS_KEY
+//
+// The secrets are Secret values, which print as <redacted>, so they don't end
+// up in the logs by accident
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// KeyEnv is the passphrase of the store
+	KeyEnv = "TESTKIT_CREDENTIALS_KEY"
+	// kdfIterations is how many rounds of PBKDF2 derive the store's key
+	kdfIterations = 100000
+)
+
+// StorePath is where the encrypted store is, TESTKIT_CREDENTIALS, or
+// testkit/credentials in the user's configuration directory
+var StorePath string
+
+func init() {
+	LoadEnv()
+}
+
+// LoadEnv reads StorePath from the environment, again if a profile has set it
+// since the package was initialized
+func LoadEnv() {
+	if path := os.Getenv("TESTKIT_CREDENTIALS"); path != "" {
+		StorePath = path
+		return
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	StorePath = filepath.Join(dir, "testkit", "credentials")
+}
+
+// ErrNotFound is returned when a secret is in none of the sources
+var ErrNotFound = errors.New("credential not found")
+
+// Secret is the value of a secret, hidden from fmt and encoding/json
+type Secret string
+
+func (s Secret) String() string {
+	return "<redacted>"
+}
+
+func (s Secret) GoString() string {
+	return `"<redacted>"`
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"<redacted>"`), nil
+}
+
+// Value returns the secret itself, for the driver to use it
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// Lookup returns the named secret, and the source it came from to tell users
+// which one is used. It returns ErrNotFound if none has it
+func Lookup(name string) (Secret, string, error) {
+	if value := os.Getenv(name); value != "" {
+		return Secret(value), "$" + name, nil
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to read %s from %s: %s", name, path, err)
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "" {
+			return "", "", fmt.Errorf("%s is empty", path)
+		}
+		return Secret(value), path, nil
+	}
+	secrets, err := loadStore()
+	if os.IsNotExist(err) {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	value, ok := secrets[name]
+	if !ok {
+		return "", "", ErrNotFound
+	}
+	return Secret(value), StorePath, nil
+}
+
+// Names returns the names of the secrets in the store
+func Names() ([]string, error) {
+	secrets, err := loadStore()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Set stores the secret in the store, creating it if needed
+func Set(name, value string) error {
+	secrets, err := loadStore()
+	if os.IsNotExist(err) {
+		secrets = map[string]string{}
+	} else if err != nil {
+		return err
+	}
+	secrets[name] = value
+	return saveStore(secrets)
+}
+
+// Remove removes the secret from the store
+func Remove(name string) error {
+	secrets, err := loadStore()
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return ErrNotFound
+	}
+	delete(secrets, name)
+	return saveStore(secrets)
+}
+
+// store is the file of the store. Data is the secrets as JSON, sealed with
+// AES-GCM by a key derived from the passphrase and Salt
+type store struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func passphrase() ([]byte, error) {
+	key := os.Getenv(KeyEnv)
+	if key == "" {
+		return nil, fmt.Errorf("%s is encrypted, set %s to its passphrase", StorePath, KeyEnv)
+	}
+	return []byte(key), nil
+}
+
+func newGCM(salt []byte) (cipher.AEAD, error) {
+	key, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(deriveKey(key, salt, kdfIterations))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadStore decrypts the store. Its error satisfies os.IsNotExist if there's
+// no store
+func loadStore() (map[string]string, error) {
+	data, err := ioutil.ReadFile(StorePath)
+	if err != nil {
+		return nil, err
+	}
+	s := store{}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", StorePath, err)
+	}
+	gcm, err := newGCM(s.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, s.Nonce, s.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt %s, is %s right?", StorePath, KeyEnv)
+	}
+	secrets := map[string]string{}
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", StorePath, err)
+	}
+	return secrets, nil
+}
+
+// saveStore encrypts the secrets with a new salt and nonce into the store,
+// readable by the user only
+func saveStore(secrets map[string]string) error {
+	s := store{
+		Salt:  make([]byte, 16),
+		Nonce: make([]byte, 12),
+	}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return err
+	}
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return err
+	}
+	gcm, err := newGCM(s.Salt)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	s.Data = gcm.Seal(nil, s.Nonce, plain, nil)
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(StorePath), 0700); err != nil {
+		return err
+	}
+	tmp := StorePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, StorePath)
+}
+
+// deriveKey derives the store's AES-256 key from the passphrase, with
+// PBKDF2-HMAC-SHA256
+func deriveKey(password, salt []byte, iterations int) []byte {
+	return pbkdf2.Key(password, salt, iterations, 32, sha256.New)
+}
@@ -0,0 +1,57 @@
+package credentials
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDeriveKey checks the store's key derivation against the PBKDF2-HMAC-SHA256
+// test vectors of RFC 7914 section 11, truncated to the 32 bytes of the key
+func TestDeriveKey(t *testing.T) {
+	vectors := []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	}
+	for _, v := range vectors {
+		key := hex.EncodeToString(deriveKey([]byte(v.password), []byte(v.salt), v.iterations))
+		if key != v.key {
+			t.Errorf("deriveKey(%q, %q, %d) = %s, want %s", v.password, v.salt, v.iterations, key, v.key)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testkit-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer LoadEnv()
+	StorePath = filepath.Join(dir, "credentials")
+	os.Setenv(KeyEnv, "passphrase")
+	defer os.Unsetenv(KeyEnv)
+	os.Unsetenv("TESTKIT_TEST_SECRET")
+
+	if err := Set("TESTKIT_TEST_SECRET", "value"); err != nil {
+		t.Fatal(err)
+	}
+	value, source, err := Lookup("TESTKIT_TEST_SECRET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.Value() != "value" || source != StorePath {
+		t.Errorf("Lookup returned %q from %s", value.Value(), source)
+	}
+
+	os.Setenv(KeyEnv, "wrong")
+	if _, _, err := Lookup("TESTKIT_TEST_SECRET"); err == nil {
+		t.Errorf("Lookup decrypted the store with the wrong passphrase")
+	}
+}
@@ -3,27 +3,30 @@ package machines
 import (
 	"bufio"
 	"bytes"
-	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/big"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
+	awscreds "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/cloudflare/cfssl/log"
+	"github.com/docker/docker-e2e/testkit/credentials"
+	"github.com/docker/docker-e2e/testkit/trace"
 	"github.com/docker/docker/client"
 	"github.com/kr/pty"
 )
@@ -39,7 +42,7 @@ var (
 	AWSSecurityGroup = "sg-65ebb41a" // Hardcoded to "testkit" in docker-core us-east-1
 )
 
-func init() {
+func loadAWSEnv() {
 	diskDir := os.Getenv("AWS_DISK_DIR")
 	if diskDir != "" {
 		AWSDiskDir = diskDir
@@ -71,17 +74,113 @@ func init() {
 }
 
 func newSession() *session.Session {
-	return session.Must(session.NewSession(aws.NewConfig().WithRegion(AWSRegion)))
+	config := aws.NewConfig().WithRegion(AWSRegion)
+	return session.Must(session.NewSession(config.WithCredentials(AWSCredentials(config))))
+}
+
+// awsSecrets provides the AWS keys from testkit's credentials, so they can
+// also come from files or the encrypted store
+type awsSecrets struct{}
+
+func (awsSecrets) Retrieve() (awscreds.Value, error) {
+	value := awscreds.Value{ProviderName: "testkit"}
+	id, _, err := credentials.Lookup("AWS_ACCESS_KEY_ID")
+	if err != nil {
+		return value, fmt.Errorf("AWS_ACCESS_KEY_ID: %s", err)
+	}
+	secret, _, err := credentials.Lookup("AWS_SECRET_ACCESS_KEY")
+	if err != nil {
+		return value, fmt.Errorf("AWS_SECRET_ACCESS_KEY: %s", err)
+	}
+	token, _, err := credentials.Lookup("AWS_SESSION_TOKEN")
+	if err != nil && err != credentials.ErrNotFound {
+		return value, fmt.Errorf("AWS_SESSION_TOKEN: %s", err)
+	}
+	value.AccessKeyID = id.Value()
+	value.SecretAccessKey = secret.Value()
+	value.SessionToken = token.Value()
+	return value, nil
+}
+
+func (awsSecrets) IsExpired() bool {
+	return false
+}
+
+// AWSCredentials returns the credentials for the AWS API: testkit's
+// credentials, else the SDK's shared credentials file or the instance's role
+func AWSCredentials(config *aws.Config) *awscreds.Credentials {
+	return awscreds.NewCredentials(&awscreds.ChainProvider{
+		VerboseErrors: true,
+		Providers: []awscreds.Provider{
+			awsSecrets{},
+			&awscreds.SharedCredentialsProvider{},
+			defaults.RemoteCredProvider(*config, defaults.Handlers()),
+		},
+	})
 }
 
 type AWSMachine struct {
-	name       string
-	publicIP   string
-	privateIP  string
-	sshUser    string
-	dockerHost string
-	tlsConfig  *tls.Config
-	isWindows  bool
+	name         string
+	publicIP     string
+	privateIP    string
+	sshUser      string
+	dockerHost   string
+	tlsConfig    *tls.Config
+	isWindows    bool
+	instanceType string
+	launchTime   time.Time
+	stopped      bool
+	accrued      time.Duration
+	stackName    string
+}
+
+// awsAccruedTag is the instance tag with how many seconds the instance ran
+// before it was last paused, as its LaunchTime only covers the current run
+const awsAccruedTag = "testkit-accrued"
+
+func loadAWSTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(AWSDiskDir, "cert.pem"), filepath.Join(AWSDiskDir, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := ioutil.ReadFile(filepath.Join(AWSDiskDir, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caCert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      caCertPool,
+	}, nil
+}
+
+// newAWSMachine wraps a described EC2 instance
+func newAWSMachine(stackName string, instance *ec2.Instance, tlsConfig *tls.Config) *AWSMachine {
+	var accrued time.Duration
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == awsAccruedTag {
+			seconds, _ := strconv.ParseInt(aws.StringValue(tag.Value), 10, 64)
+			accrued = time.Duration(seconds) * time.Second
+		}
+	}
+	state := ""
+	if instance.State != nil {
+		state = aws.StringValue(instance.State.Name)
+	}
+	return &AWSMachine{
+		stackName:    stackName,
+		name:         aws.StringValue(instance.InstanceId),
+		publicIP:     aws.StringValue(instance.PublicIpAddress),
+		privateIP:    aws.StringValue(instance.PrivateIpAddress),
+		sshUser:      AWSSSHUser,
+		dockerHost:   fmt.Sprintf("tcp://%s:2376", aws.StringValue(instance.PublicIpAddress)),
+		tlsConfig:    tlsConfig,
+		instanceType: aws.StringValue(instance.InstanceType),
+		launchTime:   aws.TimeValue(instance.LaunchTime),
+		stopped:      state == ec2.InstanceStateNameStopped || state == ec2.InstanceStateNameStopping,
+		accrued:      accrued,
+	}
 }
 
 func NewAWSMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error) {
@@ -95,23 +194,16 @@ func NewAWSMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 		return nil, nil, err
 	}
 
-	cert, err := tls.LoadX509KeyPair(filepath.Join(AWSDiskDir, "cert.pem"), filepath.Join(AWSDiskDir, "key.pem"))
+	tlsConfig, err := loadAWSTLSConfig()
 	if err != nil {
 		return nil, nil, err
 	}
-	caCert, err := ioutil.ReadFile(filepath.Join(AWSDiskDir, "ca.pem"))
+
+	name, lock, err := newClusterName(nil)
 	if err != nil {
 		return nil, nil, err
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-	}
-
-	id, _ := rand.Int(rand.Reader, big.NewInt(0xffffff))
-	name := fmt.Sprintf("%s-%X", NamePrefix, id)
+	defer lock.Unlock()
 
 	sess := newSession()
 	svc := ec2.New(sess)
@@ -150,17 +242,27 @@ func NewAWSMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 		SecurityGroupIds: []*string{
 			aws.String(AWSSecurityGroup),
 		},
+		// Makes the retries of the call idempotent, for a call that failed
+		// after AWS started the instances not to start them twice
+		ClientToken: aws.String(name),
 	}
 
-	logrus.Infof("Provisioning %d machines...", linuxCount)
+	logger := logrus.WithField(FieldCluster, name)
+	logger.Infof("Provisioning %d machines...", linuxCount)
 	now := time.Now()
-	resp, err := svc.RunInstances(params)
-
+	trace.StartCluster(name, now)
+	var resp *ec2.Reservation
+	err = driverCall("RunInstances", func() error {
+		var err error
+		resp, err = svc.RunInstances(params)
+		return err
+	}, awsTransient)
 	if err != nil {
+		LogPhase(logger, "boot", now, err)
 		return nil, nil, err
 	}
 
-	logrus.Infof("Waiting for instances to come up...")
+	logger.Infof("Waiting for instances to come up...")
 	instanceIDs := []*string{}
 	for _, instance := range resp.Instances {
 		instanceIDs = append(instanceIDs, instance.InstanceId)
@@ -169,13 +271,17 @@ func NewAWSMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 		InstanceIds: instanceIDs,
 	})
 
-	duration := time.Since(now)
-	logrus.Infof("All %d instances are running (duration: %v)", linuxCount, duration)
+	LogPhase(logger, "boot", now, nil)
 
 	// We have to query them again to gather the public IP address and such.
-	reservations, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
-		InstanceIds: instanceIDs,
-	})
+	var reservations *ec2.DescribeInstancesOutput
+	err = driverCall("DescribeInstances", func() error {
+		var err error
+		reservations, err = svc.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: instanceIDs,
+		})
+		return err
+	}, awsTransient)
 	if err != nil {
 		panic(err)
 	}
@@ -183,15 +289,7 @@ func NewAWSMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 	machines := []Machine{}
 	for _, reservation := range reservations.Reservations {
 		for _, instance := range reservation.Instances {
-			m := &AWSMachine{
-				name:       *instance.InstanceId,
-				publicIP:   *instance.PublicIpAddress,
-				privateIP:  *instance.PrivateIpAddress,
-				sshUser:    AWSSSHUser,
-				dockerHost: fmt.Sprintf("tcp://%s:2376", *instance.PublicIpAddress),
-				tlsConfig:  tlsConfig,
-			}
-			machines = append(machines, m)
+			machines = append(machines, newAWSMachine(name, instance, tlsConfig))
 		}
 	}
 
@@ -201,7 +299,9 @@ func NewAWSMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 		wg.Add(1)
 		go func() {
 			m := machine.(*AWSMachine)
+			start := time.Now()
 			m.waitReady()
+			LogPhase(MachineLog(m), "ssh-ready", start, nil)
 			errCh <- m.provision()
 			wg.Done()
 		}()
@@ -217,6 +317,103 @@ func NewAWSMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 	return machines, []Machine{}, nil
 }
 
+// describeAWSEnvironments returns the testkit instances that aren't shutting
+// down, grouped by the environment name stored in their Name tag. Stopped
+// ones are paused and still part of their environment
+func describeAWSEnvironments() (map[string][]*ec2.Instance, error) {
+	svc := ec2.New(newSession())
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:testkit"),
+				Values: []*string{aws.String("true")},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []*string{aws.String("pending"), aws.String("running"), aws.String("stopping"), aws.String("stopped")},
+			},
+		},
+	}
+	res := map[string][]*ec2.Instance{}
+	for {
+		var resp *ec2.DescribeInstancesOutput
+		err := driverCall("DescribeInstances", func() error {
+			var err error
+			resp, err = svc.DescribeInstances(input)
+			return err
+		}, awsTransient)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				for _, tag := range instance.Tags {
+					if aws.StringValue(tag.Key) == "Name" {
+						envName := aws.StringValue(tag.Value)
+						res[envName] = append(res[envName], instance)
+					}
+				}
+			}
+		}
+		if resp.NextToken == nil {
+			return res, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+func AWSListEnvironments() ([]*Environment, error) {
+	instances, err := describeAWSEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	// The certs are only needed to talk to the engines, listing works without them
+	tlsConfig, err := loadAWSTLSConfig()
+	if err != nil {
+		logrus.Debugf("Unable to load certs from %s: %s", AWSDiskDir, err)
+	}
+	envs := []*Environment{}
+	for envName, group := range instances {
+		env := &Environment{StackName: envName}
+		for _, instance := range group {
+			env.Machines = append(env.Machines, newAWSMachine(envName, instance, tlsConfig))
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+func AWSDestroyEnvironment(name string) error {
+	instances, err := describeAWSEnvironments()
+	if err != nil {
+		return err
+	}
+	group, ok := instances[name]
+	if !ok {
+		return fmt.Errorf("unable to find environment %s", name)
+	}
+	instanceIDs := []*string{}
+	for _, instance := range group {
+		instanceIDs = append(instanceIDs, instance.InstanceId)
+	}
+	svc := ec2.New(newSession())
+	if err := driverCall("TerminateInstances", func() error {
+		_, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{
+			InstanceIds: instanceIDs,
+		})
+		return err
+	}, awsTransient); err != nil {
+		return err
+	}
+	for _, id := range instanceIDs {
+		logrus.WithFields(logrus.Fields{
+			FieldCluster: name,
+			FieldMachine: aws.StringValue(id),
+		}).Info("Machine deleted")
+	}
+	return nil
+}
+
 func (m *AWSMachine) waitReady() {
 	for {
 		out, err := m.MachineSSH("uptime")
@@ -232,25 +429,25 @@ func (m *AWSMachine) waitReady() {
 			log.Debugf("Got empty output from the other side... trying again...")
 			time.Sleep(500 * time.Millisecond)
 		} else {
-			log.Debugf("%s has been up %s", m.GetName(), out)
+			MachineLog(m).Debugf("Up %s", out)
 			return
 		}
 	}
 }
 
 func (m *AWSMachine) provision() error {
+	logger := MachineLog(m)
 	now := time.Now()
-	defer func() {
-		logrus.Infof("Provisioning %s completed in %v", m.name, time.Since(now))
-	}()
 
 	out, err := m.MachineSSH(
 		fmt.Sprintf(`sudo hostname "%s"; sudo sed -e 's/.*/%s/' -i /etc/hostname; sudo sed -e 's/127\.0\.1\.1.*/127.0.1.1 %s/' -i /etc/hosts`,
 			m.GetName(), m.GetName(), m.GetName()))
 	if err != nil {
-		logrus.Warnf("Failed to set hostname to %s: %s: %s", m.GetName(), err, out)
+		logger.Warnf("Failed to set hostname: %s: %s", err, out)
 	}
-	return VerifyDockerEngine(m, AWSDiskDir)
+	err = VerifyDockerEngine(m, AWSDiskDir)
+	LogPhase(logger, "provision", now, err)
+	return err
 }
 
 func (m *AWSMachine) GetName() string {
@@ -287,10 +484,111 @@ func (m *AWSMachine) Stop() error {
 	return errors.New("not implemented")
 }
 
+func (m *AWSMachine) Kill() error {
+	return errors.New("not implemented")
+}
+
+// Reboot restarts the machine's OS, returning once it's back up
+func (m *AWSMachine) Reboot() error {
+	return rebootLinux(m)
+}
+
 func (m *AWSMachine) Start() error {
 	return errors.New("not implemented")
 }
 
+// Pause stops the instance, keeping its EBS volume for Resume. EC2 instances
+// can't be suspended like VMs, so the containers go down with the OS
+func (m *AWSMachine) Pause() error {
+	if m.stopped {
+		return nil
+	}
+	svc := ec2.New(newSession())
+	ids := []*string{aws.String(m.name)}
+	if err := driverCall("StopInstances", func() error {
+		_, err := svc.StopInstances(&ec2.StopInstancesInput{
+			InstanceIds: ids,
+		})
+		return err
+	}, awsTransient); err != nil {
+		return err
+	}
+	if err := svc.WaitUntilInstanceStopped(&ec2.DescribeInstancesInput{
+		InstanceIds: ids,
+	}); err != nil {
+		return fmt.Errorf("Failed to wait for %s to stop: %s", m.name, err)
+	}
+	m.stopped = true
+	m.accrued += time.Since(m.launchTime)
+	if err := driverCall("CreateTags", func() error {
+		_, err := svc.CreateTags(&ec2.CreateTagsInput{
+			Resources: ids,
+			Tags: []*ec2.Tag{
+				{
+					Key:   aws.String(awsAccruedTag),
+					Value: aws.String(strconv.FormatInt(int64(m.accrued/time.Second), 10)),
+				},
+			},
+		})
+		return err
+	}, awsTransient); err != nil {
+		return fmt.Errorf("Failed to record the run time of %s: %s", m.name, err)
+	}
+	return nil
+}
+
+// Resume starts the instance stopped by Pause, returning once it's reachable.
+// The instance comes back with a new public IP, so the engine gets a
+// certificate for it
+func (m *AWSMachine) Resume() error {
+	svc := ec2.New(newSession())
+	ids := []*string{aws.String(m.name)}
+	if err := driverCall("StartInstances", func() error {
+		_, err := svc.StartInstances(&ec2.StartInstancesInput{
+			InstanceIds: ids,
+		})
+		return err
+	}, awsTransient); err != nil {
+		return err
+	}
+	if err := svc.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{
+		InstanceIds: ids,
+	}); err != nil {
+		return fmt.Errorf("Failed to wait for %s to start: %s", m.name, err)
+	}
+	var resp *ec2.DescribeInstancesOutput
+	if err := driverCall("DescribeInstances", func() error {
+		var err error
+		resp, err = svc.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: ids,
+		})
+		return err
+	}, awsTransient); err != nil {
+		return err
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("Failed to find %s after starting it", m.name)
+	}
+	oldIP := m.publicIP
+	instance := resp.Reservations[0].Instances[0]
+	m.publicIP = aws.StringValue(instance.PublicIpAddress)
+	m.privateIP = aws.StringValue(instance.PrivateIpAddress)
+	m.dockerHost = fmt.Sprintf("tcp://%s:2376", m.publicIP)
+	m.launchTime = aws.TimeValue(instance.LaunchTime)
+	m.stopped = false
+	m.waitReady()
+	if m.publicIP == oldIP || m.isWindows {
+		return nil
+	}
+	if err := injectLinuxNodeCerts(m, AWSDiskDir); err != nil {
+		return err
+	}
+	if out, err := m.MachineSSH("sudo systemctl restart docker.service"); err != nil {
+		return fmt.Errorf("Failed to restart the engine of %s: %s: %s", m.name, err, out)
+	}
+	return nil
+}
+
 func (m *AWSMachine) GetIP() (string, error) {
 	return m.publicIP, nil
 }
@@ -401,3 +699,29 @@ func (m *AWSMachine) GetConnectionEnv() string {
 func (m *AWSMachine) IsWindows() bool {
 	return m.isWindows
 }
+
+// GetStackName reports the environment the instance was created in
+func (m *AWSMachine) GetStackName() string {
+	return m.stackName
+}
+
+// GetInstanceType reports the EC2 instance type the machine runs on
+func (m *AWSMachine) GetInstanceType() string {
+	return m.instanceType
+}
+
+// GetLaunchTime reports when the EC2 instance was started
+func (m *AWSMachine) GetLaunchTime() time.Time {
+	return m.launchTime
+}
+
+// IsStopped reports whether the EC2 instance is stopped or stopping
+func (m *AWSMachine) IsStopped() bool {
+	return m.stopped
+}
+
+// GetAccruedTime reports how long the EC2 instance ran before it was last
+// paused
+func (m *AWSMachine) GetAccruedTime() time.Duration {
+	return m.accrued
+}
@@ -1,14 +1,12 @@
 package machines
 
 import (
-	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/big"
 	"net/http"
 	"os"
 	"os/exec"
@@ -19,6 +17,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker-e2e/testkit/trace"
 	"github.com/docker/docker/client"
 )
 
@@ -51,7 +50,12 @@ func NewBuildMachines(linuxCount, windowsCount int, dockerRootDir string) ([]Mac
 		return nil, nil, fmt.Errorf("The docker-machine based back-end does not support windows machines")
 	}
 
-	id, _ := rand.Int(rand.Reader, big.NewInt(0xffffff))
+	name, lock, err := newClusterName(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer lock.Unlock()
+	trace.StartCluster(name, time.Now())
 	linuxMachines := []Machine{}
 	var linuxWG sync.WaitGroup
 	fail := false
@@ -63,7 +67,7 @@ func NewBuildMachines(linuxCount, windowsCount int, dockerRootDir string) ([]Mac
 			// Some cloud providers can be a little flaky, so try a few times before we give up
 			verbose := false
 			for r := 0; r < RetryCount; r++ {
-				m, err := buildMachineOnce(fmt.Sprintf("%s-%X-%d", NamePrefix, id, index), dockerRootDir, verbose)
+				m, err := buildMachineOnce(fmt.Sprintf("%s-%d", name, index), dockerRootDir, verbose)
 				if err == nil {
 					linuxRes <- m
 					return
@@ -96,8 +100,7 @@ func NewBuildMachines(linuxCount, windowsCount int, dockerRootDir string) ([]Mac
 }
 
 func DockerMachineListEnvironments() ([]*Environment, error) {
-	cmd := exec.Command("docker-machine", "ls", "-q")
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("docker-machine", "ls", "-q")
 	if err != nil {
 		log.Error(string(out))
 		return nil, err
@@ -130,8 +133,7 @@ func DockerMachineListEnvironments() ([]*Environment, error) {
 }
 
 func DockerMachineDestroyEnvironment(name string) error {
-	cmd := exec.Command("docker-machine", "ls", "-q")
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("docker-machine", "ls", "-q")
 	if err != nil {
 		log.Error(string(out))
 		return err
@@ -140,8 +142,7 @@ func DockerMachineDestroyEnvironment(name string) error {
 	for _, line := range strings.Split(string(out), "\n") {
 		match := re.FindStringSubmatch(line)
 		if match != nil {
-			cmd = exec.Command("docker-machine", "rm", "-f", line)
-			out, err := cmd.CombinedOutput()
+			out, err := runDriverCommand("docker-machine", "rm", "-f", line)
 			if err != nil {
 				log.Error(string(out))
 				// TODO Should we try force?
@@ -188,17 +189,18 @@ func buildMachineOnce(name string, dockerRootDir string, verbose bool) (Machine,
 
 	args = append(args, m.name)
 
-	log.Infof("Creating new test VM: %s", m.name)
+	logger := MachineLog(m)
+	logger.Info("Creating new test VM")
+	start := time.Now()
 	cmd := exec.Command("docker-machine", args...)
 	out, err := cmd.CombinedOutput()
+	LogPhase(logger, "create", start, err)
 	if err != nil {
-		log.Error(err)
-		log.Error(string(out))
+		logger.Error(string(out))
 		// If something went wrong, make sure to clean up after ourselves
 		_ = m.Remove()
 		return nil, err
 	}
-	log.Infof("Created new test VM: %s", m.name)
 	err = m.gatherMachineDetails()
 	if err != nil {
 		// If something went wrong, make sure to clean up after ourselves
@@ -221,9 +223,9 @@ func buildMachineOnce(name string, dockerRootDir string, verbose bool) (Machine,
 			return nil, err
 		}
 	}
-	log.Infof("%s internal IP: %s", m.name, m.internalip)
+	logger.Infof("Internal IP: %s", m.internalip)
 
-	log.Infof("Host: %s", m.dockerHost)
+	logger.Infof("Host: %s", m.dockerHost)
 	return m, nil
 }
 
@@ -343,8 +345,7 @@ func (m *BuildMachine) Remove() error {
 		log.Info("Machine already deleted")
 		return nil
 	}
-	cmd := exec.Command("docker-machine", "rm", "-f", m.name)
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("docker-machine", "rm", "-f", m.name)
 	if err != nil {
 		log.Error(string(out))
 		// TODO Should we try force?
@@ -365,6 +366,22 @@ func (m *BuildMachine) Stop() error {
 	return nil
 }
 
+// Kill powers off the machine without a clean shutdown
+func (m *BuildMachine) Kill() error {
+	cmd := exec.Command("docker-machine", "kill", m.name)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Error(string(out))
+		return err
+	}
+	return nil
+}
+
+// Reboot restarts the machine's OS, returning once it's back up
+func (m *BuildMachine) Reboot() error {
+	return rebootLinux(m)
+}
+
 func (m *BuildMachine) Start() error {
 	cmd := exec.Command("docker-machine", "start", m.name)
 	out, err := cmd.CombinedOutput()
@@ -375,6 +392,15 @@ func (m *BuildMachine) Start() error {
 	return nil
 }
 
+// docker-machine has no notion of suspending a machine, only stop/start
+func (m *BuildMachine) Pause() error {
+	return fmt.Errorf("The docker-machine based back-end does not support pausing machines")
+}
+
+func (m *BuildMachine) Resume() error {
+	return fmt.Errorf("The docker-machine based back-end does not support pausing machines")
+}
+
 // Return the public IP of the machine
 func (m *BuildMachine) GetIP() (string, error) {
 	return m.ip, nil
@@ -1,9 +1,11 @@
 package machines
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -15,8 +17,20 @@ import (
 	"github.com/cloudflare/cfssl/signer/local"
 )
 
+// caLock serializes CA generation so environments created in parallel all end
+// up signed by the same CA. ca.lock in the directory does the same for the
+// other testkit processes on the host
+var caLock sync.Mutex
+
 // VerifyCA makes sure there's a CA present in the specified dir
 func VerifyCA(rootCADir string) error {
+	caLock.Lock()
+	defer caLock.Unlock()
+	f, err := flock(filepath.Join(rootCADir, "ca.lock"), true)
+	if err != nil {
+		return fmt.Errorf("Failed to lock the CA in %s: %s", rootCADir, err)
+	}
+	defer f.Close()
 	caFile := filepath.Join(rootCADir, "ca.pem")
 	if _, err := os.Stat(caFile); err == nil {
 		// If we can stat it, assume we're good
@@ -0,0 +1,94 @@
+package machines
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// AWSHourlyPrices holds the on-demand USD/hour price of the instance
+	// types we commonly run (us-east-1, linux).  Set AWS_HOURLY_PRICE to
+	// override the price for whatever AWS_INSTANCE_TYPE is in use.
+	AWSHourlyPrices = map[string]float64{
+		"t2.nano":    0.0058,
+		"t2.micro":   0.0116,
+		"t2.small":   0.023,
+		"t2.medium":  0.0464,
+		"t2.large":   0.0928,
+		"t2.xlarge":  0.1856,
+		"t2.2xlarge": 0.3712,
+		"m4.large":   0.10,
+		"m4.xlarge":  0.20,
+		"m4.2xlarge": 0.40,
+		"m4.4xlarge": 0.80,
+		"c4.large":   0.10,
+		"c4.xlarge":  0.199,
+		"c4.2xlarge": 0.398,
+		"r4.large":   0.133,
+		"r4.xlarge":  0.266,
+	}
+)
+
+func hourlyPrice(instanceType string) (float64, bool) {
+	if price := os.Getenv("AWS_HOURLY_PRICE"); price != "" && instanceType == AWSInstanceType {
+		if p, err := strconv.ParseFloat(price, 64); err == nil {
+			return p, true
+		}
+	}
+	price, ok := AWSHourlyPrices[instanceType]
+	return price, ok
+}
+
+// Billable is implemented by machines backed by a metered cloud instance.
+// Its LaunchTime is when the current run started, and AccruedTime how long
+// it ran before, across pauses
+type Billable interface {
+	GetInstanceType() string
+	GetLaunchTime() time.Time
+	IsStopped() bool
+	GetAccruedTime() time.Duration
+}
+
+// BilledTime returns how long the machine has been billed for, leaving out
+// the time it was stopped
+func BilledTime(b Billable) time.Duration {
+	billed := b.GetAccruedTime()
+	if !b.IsStopped() {
+		billed += time.Since(b.GetLaunchTime())
+	}
+	return billed
+}
+
+// EstimatedCost returns the estimated spend in USD for the machine since it
+// was created, not counting the time it was paused.  The second return is
+// false if the machine isn't billable or the price of its instance type is
+// unknown.
+func EstimatedCost(m Machine) (float64, bool) {
+	b, ok := m.(Billable)
+	if !ok || b.GetLaunchTime().IsZero() {
+		return 0, false
+	}
+	price, ok := hourlyPrice(b.GetInstanceType())
+	if !ok {
+		return 0, false
+	}
+	return BilledTime(b).Hours() * price, true
+}
+
+// EstimatedCost returns the estimated spend in USD for all the billable
+// machines in the environment.  The second return is false if none of the
+// machines could be priced.
+func (e *Environment) EstimatedCost() (float64, bool) {
+	var (
+		total float64
+		found bool
+	)
+	for _, m := range e.Machines {
+		if cost, ok := EstimatedCost(m); ok {
+			total += cost
+			found = true
+		}
+	}
+	return total, found
+}
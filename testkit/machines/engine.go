@@ -0,0 +1,249 @@
+package machines
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A developer-built dockerd can replace the one of the released packages on
+// the Linux machines, for engine developers to run the e2e tests against their
+// branch. The packages are still installed (or already on the base disk) for
+// the rest of the engine, like containerd, runc and the init scripts
+var (
+	// EngineBinary is the path or the http(s) URL of the dockerd to install,
+	// ENGINE_BINARY
+	EngineBinary string
+	// EngineCommit is the commit of EngineRepo to build the dockerd to install
+	// from, in a container of its development image on the local engine,
+	// ENGINE_COMMIT
+	EngineCommit string
+	// EngineRepo is the git repository to build EngineCommit from,
+	// ENGINE_REPO
+	EngineRepo = "https://github.com/moby/moby.git"
+	// EngineBuildDir is where the downloaded and built engines are kept, the
+	// built ones for later runs to reuse them
+	EngineBuildDir = filepath.Join(os.TempDir(), "testkit-engines")
+)
+
+func loadEngineEnv() {
+	EngineBinary = os.Getenv("ENGINE_BINARY")
+	EngineCommit = os.Getenv("ENGINE_COMMIT")
+	if repo := os.Getenv("ENGINE_REPO"); repo != "" {
+		EngineRepo = repo
+	}
+}
+
+var (
+	engineOnce sync.Once
+	// enginePath and engineErr are the outcome of fetching or building the
+	// dockerd, for all the machines to share rather than each retrying a
+	// failed build
+	enginePath string
+	engineErr  error
+)
+
+// customEngine returns the local path of the developer's dockerd, downloading
+// or building it the first time, or "" if the packaged one is to be used
+func customEngine() (string, error) {
+	engineOnce.Do(func() {
+		enginePath, engineErr = fetchEngine()
+	})
+	return enginePath, engineErr
+}
+
+// fetchEngine gets the dockerd ENGINE_BINARY or ENGINE_COMMIT ask for
+func fetchEngine() (string, error) {
+	switch {
+	case EngineCommit != "" && EngineBinary != "":
+		return "", fmt.Errorf("ENGINE_BINARY and ENGINE_COMMIT can't both be set")
+	case EngineCommit != "":
+		return buildEngine(EngineRepo, EngineCommit)
+	case strings.HasPrefix(EngineBinary, "http://") || strings.HasPrefix(EngineBinary, "https://"):
+		return downloadEngine(EngineBinary)
+	case EngineBinary != "":
+		if _, err := os.Stat(EngineBinary); err != nil {
+			return "", err
+		}
+		return EngineBinary, nil
+	}
+	return "", nil
+}
+
+// downloadEngine downloads the dockerd at the URL, to a path of its own that
+// the next download of the URL replaces
+func downloadEngine(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("Failed to download the engine from %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed to download the engine from %s: %s", url, resp.Status)
+	}
+	if err := os.MkdirAll(EngineBuildDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(EngineBuildDir, "dockerd-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to download the engine from %s: %s", url, err)
+	}
+	dockerd := filepath.Join(EngineBuildDir, fmt.Sprintf("dockerd-%x", sha256.Sum256([]byte(url))))
+	if err := os.Rename(f.Name(), dockerd); err != nil {
+		return "", err
+	}
+	log.Infof("Downloaded the engine from %s", url)
+	return dockerd, nil
+}
+
+var (
+	// fullCommit matches a complete commit SHA, which can't move like a
+	// branch
+	fullCommit = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	// shortCommit matches an abbreviated one, which can't either
+	shortCommit = regexp.MustCompile(`^[0-9a-f]{7,39}$`)
+)
+
+// resolveCommit returns the SHA of the ref in the repository, with git
+// rev-parse for a local repository and git ls-remote for a remote one, so a
+// branch is built again once it moves. ls-remote only knows refs, so an
+// abbreviated SHA of a remote repository is used as is
+func resolveCommit(repo, ref string) (string, error) {
+	if fullCommit.MatchString(ref) {
+		return ref, nil
+	}
+	var out []byte
+	var err error
+	if fi, statErr := os.Stat(repo); statErr == nil && fi.IsDir() {
+		out, err = exec.Command("git", "-C", repo, "rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	} else {
+		out, err = exec.Command("git", "ls-remote", repo, ref).Output()
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve %s in %s: %s", ref, repo, err)
+	}
+	if fields := strings.Fields(string(out)); len(fields) > 0 {
+		return fields[0], nil
+	}
+	if shortCommit.MatchString(ref) {
+		return ref, nil
+	}
+	return "", fmt.Errorf("Failed to resolve %s in %s", ref, repo)
+}
+
+// invalidTag matches what can't be in an image tag
+var invalidTag = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// buildEngine builds dockerd at the commit of the repository like the
+// engine's Makefile does, building its development image and running
+// hack/make.sh binary in it, and returns the path of the dockerd. A commit
+// already built is reused
+func buildEngine(repo, ref string) (string, error) {
+	commit, err := resolveCommit(repo, ref)
+	if err != nil {
+		return "", err
+	}
+	if commit != ref {
+		log.Debugf("Resolved %s to %s", ref, commit)
+	}
+	dir := filepath.Join(EngineBuildDir, invalidTag.ReplaceAllString(commit, "_"))
+	dockerd := filepath.Join(dir, "dockerd")
+	if _, err := os.Stat(dockerd); err == nil {
+		log.Infof("Using the engine built from %s at %s", commit, dockerd)
+		return dockerd, nil
+	}
+	bundles := filepath.Join(dir, "bundles")
+	if err := os.MkdirAll(bundles, 0755); err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	logger := log.WithField("commit", commit)
+	logger.Infof("Building the engine from %s at %s, this takes a while...", repo, commit)
+	image := "testkit-engine-dev:" + invalidTag.ReplaceAllString(commit, "_")
+	out, err := exec.Command("docker", "build", "-t", image, repo+"#"+commit).CombinedOutput()
+	if err == nil {
+		out, err = exec.Command("docker", "run", "--rm", "--privileged",
+			"-v", bundles+":/go/src/github.com/docker/docker/bundles",
+			image, "hack/make.sh", "binary").CombinedOutput()
+	}
+	if err != nil {
+		log.Debug(string(out))
+		err = fmt.Errorf("Failed to build the engine at %s: %s: %s", commit, err, lastLines(string(out), 10))
+		LogPhase(logger, "engine-build", start, err)
+		return "", err
+	}
+
+	// The bundles have the binary as <version>/binary-daemon/dockerd-<version>,
+	// and dockerd linking to it
+	built := ""
+	filepath.Walk(bundles, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Name() == "dockerd" && filepath.Base(filepath.Dir(path)) == "binary-daemon" {
+			built = path
+		}
+		return nil
+	})
+	if built == "" {
+		err = fmt.Errorf("Failed to find binary-daemon/dockerd in the bundles of %s", commit)
+	} else if built, err = filepath.EvalSymlinks(built); err == nil {
+		err = os.Rename(built, dockerd)
+	}
+	LogPhase(logger, "engine-build", start, err)
+	if err != nil {
+		return "", err
+	}
+	return dockerd, nil
+}
+
+// lastLines returns the last count lines of the output, where the error of a
+// build is
+func lastLines(out string, count int) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) > count {
+		lines = lines[len(lines)-count:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// installCustomEngine replaces the machine's dockerd with the one at path,
+// stopping the engine. It's up to the caller to start it again
+func installCustomEngine(m Machine, path string) error {
+	start := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = m.WriteFile("/tmp/dockerd", f)
+	if err == nil {
+		var out string
+		out, err = m.MachineSSH("sudo systemctl stop docker.service; sudo install -m 0755 /tmp/dockerd $(command -v dockerd || echo /usr/bin/dockerd) && rm -f /tmp/dockerd")
+		if err != nil {
+			err = fmt.Errorf("%s: %s", err, out)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("Failed to install %s on %s: %s", path, m.GetName(), err)
+	}
+	LogPhase(MachineLog(m), "engine-binary", start, err)
+	return err
+}
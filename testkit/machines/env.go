@@ -0,0 +1,24 @@
+package machines
+
+import (
+	"os"
+)
+
+func init() {
+	LoadEnv()
+}
+
+// LoadEnv reads the settings of the drivers from the environment variables,
+// again if a profile has set some since the package was initialized
+func LoadEnv() {
+	NamePrefix = os.Getenv("MACHINE_PREFIX") + "E2E"
+	EngineInstallURL = os.Getenv("ENGINE_INSTALL_URL")
+	EngineInstallWinURL = os.Getenv("ENGINE_INSTALL_WIN_URL")
+	EngineInstallCMD = os.Getenv("ENGINE_INSTALL_CMD")
+	loadAWSEnv()
+	loadVirshEnv()
+	loadVBoxEnv()
+	loadLockEnv()
+	loadRetryEnv()
+	loadEngineEnv()
+}
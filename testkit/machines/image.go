@@ -0,0 +1,205 @@
+package machines
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+)
+
+// ImageTimeout bounds building the e2e image and copying it to a machine,
+// which fetch and move a few hundred MB
+var ImageTimeout = 30 * time.Minute
+
+// streamMessage is a line of the progress the engine streams back while
+// building or loading an image
+type streamMessage struct {
+	Stream string `json:"stream"`
+	Error  string `json:"error"`
+}
+
+// readStream consumes the progress stream, returning the error it reports
+func readStream(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg streamMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+		if msg.Stream != "" {
+			log.Debug(msg.Stream)
+		}
+	}
+}
+
+// tarDir archives the directory for use as a build context
+func tarDir(dir string) (io.ReadCloser, error) {
+	if _, err := os.Stat(filepath.Join(dir, "Dockerfile")); err != nil {
+		return nil, fmt.Errorf("%s is not a build context: %s", dir, err)
+	}
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// BuildImage builds the image in the build context directory on the machine's
+// engine and tags it, returning its ID
+func BuildImage(m Machine, dir, tag string) (string, error) {
+	buildContext, err := tarDir(dir)
+	if err != nil {
+		return "", err
+	}
+	defer buildContext.Close()
+	c, err := m.GetEngineAPIWithTimeout(ImageTimeout)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Building %s from %s on %s", tag, dir, m.GetName())
+	resp, err := c.ImageBuild(context.TODO(), buildContext, types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to build %s on %s: %s", tag, m.GetName(), err)
+	}
+	err = readStream(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("Failed to build %s on %s: %s", tag, m.GetName(), err)
+	}
+	img, _, err := c.ImageInspectWithRaw(context.TODO(), tag)
+	if err != nil {
+		return "", err
+	}
+	return img.ID, nil
+}
+
+// DistributeImage copies the image from the machine it was built on to the
+// other Linux machines with docker save and load, so that every node runs the
+// exact same image without a registry. It fails unless the image has the same
+// ID everywhere afterwards
+func DistributeImage(from Machine, to []Machine, image string) error {
+	c, err := from.GetEngineAPIWithTimeout(ImageTimeout)
+	if err != nil {
+		return err
+	}
+	img, _, err := c.ImageInspectWithRaw(context.TODO(), image)
+	if err != nil {
+		return err
+	}
+
+	// save it once, the loads read it back in parallel
+	f, err := ioutil.TempFile("", "e2e-image")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	r, err := c.ImageSave(context.TODO(), []string{image})
+	if err != nil {
+		return fmt.Errorf("Failed to save %s on %s: %s", image, from.GetName(), err)
+	}
+	_, err = io.Copy(f, r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to save %s on %s: %s", image, from.GetName(), err)
+	}
+
+	errChan := make(chan error, len(to))
+	count := 0
+	for _, m := range to {
+		if m.GetName() == from.GetName() || m.IsWindows() {
+			continue
+		}
+		count++
+		go func(m Machine) {
+			errChan <- loadImage(m, f.Name(), image, img.ID)
+		}(m)
+	}
+	var lastErr error
+	for i := 0; i < count; i++ {
+		if err := <-errChan; err != nil {
+			log.Error(err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// loadImage loads the saved image on the machine and checks it got the ID
+func loadImage(m Machine, path, image, id string) error {
+	c, err := m.GetEngineAPIWithTimeout(ImageTimeout)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Infof("Loading %s on %s", image, m.GetName())
+	resp, err := c.ImageLoad(context.TODO(), f, true)
+	if err != nil {
+		return fmt.Errorf("Failed to load %s on %s: %s", image, m.GetName(), err)
+	}
+	err = readStream(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to load %s on %s: %s", image, m.GetName(), err)
+	}
+	img, _, err := c.ImageInspectWithRaw(context.TODO(), image)
+	if err != nil {
+		return err
+	}
+	if img.ID != id {
+		return fmt.Errorf("%s is %s on %s, expected %s", image, img.ID, m.GetName(), id)
+	}
+	return nil
+}
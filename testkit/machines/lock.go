@@ -0,0 +1,184 @@
+package machines
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// LockDir is where testkit processes sharing a host keep their locks, so
+// parallel CI jobs on one hypervisor don't pick the same environment name or
+// destroy an environment another one is creating or using. Every environment
+// created on the host has a record there, <name>.json, saying which process
+// holds it, locked with flock on <name>.lock while a process works on it
+var LockDir = filepath.Join(os.TempDir(), "testkit-locks")
+
+func loadLockEnv() {
+	if dir := os.Getenv("TESTKIT_LOCK_DIR"); dir != "" {
+		LockDir = dir
+	}
+}
+
+// LockRecord is what the lock record of an environment says about the
+// process that last locked it
+type LockRecord struct {
+	Name    string    `json:"name"`
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+// ClusterLock is a lock on an environment held by this process
+type ClusterLock struct {
+	name string
+	f    *os.File
+}
+
+// ErrLocked is returned when another process holds the lock of an environment
+type ErrLocked struct {
+	Record LockRecord
+}
+
+func (e ErrLocked) Error() string {
+	return fmt.Sprintf("environment %s is locked by pid %d on %s (%s) since %s",
+		e.Record.Name, e.Record.PID, e.Record.Host, e.Record.Command, e.Record.Since.Format(time.RFC3339))
+}
+
+// flock locks the file at path, creating it if needed, and returns it open.
+// Unless wait is set, it fails right away if another process holds the lock
+func flock(path string, wait bool) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockHost takes the lock of the whole host, for the short critical sections
+// like picking a name, and returns the function to release it
+func lockHost() (func(), error) {
+	f, err := flock(filepath.Join(LockDir, "host.lock"), true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock %s: %s", LockDir, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+func recordPath(name string) string {
+	return filepath.Join(LockDir, name+".json")
+}
+
+// readRecord reads the lock record of the environment
+func readRecord(name string) (LockRecord, error) {
+	record := LockRecord{Name: name}
+	data, err := ioutil.ReadFile(recordPath(name))
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// LockCluster locks the environment for this process, failing with ErrLocked
+// if another process holds it. The lock is released when the process exits,
+// even if it dies without calling Unlock
+func LockCluster(name string) (*ClusterLock, error) {
+	f, err := flock(filepath.Join(LockDir, name+".lock"), false)
+	if err == syscall.EWOULDBLOCK {
+		record, _ := readRecord(name)
+		return nil, ErrLocked{record}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock environment %s: %s", name, err)
+	}
+	host, _ := os.Hostname()
+	record := LockRecord{
+		Name:    name,
+		PID:     os.Getpid(),
+		Host:    host,
+		Command: strings.Join(os.Args, " "),
+		Since:   time.Now(),
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(recordPath(name), data, 0644)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to write the lock record of %s: %s", name, err)
+	}
+	return &ClusterLock{name: name, f: f}, nil
+}
+
+// Unlock releases the lock, leaving the record for the name to stay taken
+func (l *ClusterLock) Unlock() error {
+	return l.f.Close()
+}
+
+// Release releases the lock and removes the record, once the environment is
+// gone. The lock file stays: another process may have it open, waiting to
+// lock it, and would then hold a lock on a file no new opener sees
+func (l *ClusterLock) Release() error {
+	os.Remove(recordPath(l.name))
+	return l.f.Close()
+}
+
+// newClusterName picks a name for a new environment that no other process on
+// the host has picked, and locks it. inUse reports whether the driver already
+// has machines by that name, if it can tell
+func newClusterName(inUse func(name string) bool) (string, *ClusterLock, error) {
+	unlock, err := lockHost()
+	if err != nil {
+		return "", nil, err
+	}
+	defer unlock()
+	for i := 0; i < 10; i++ {
+		id, _ := rand.Int(rand.Reader, big.NewInt(0xffffff))
+		name := fmt.Sprintf("%s-%X", NamePrefix, id)
+		if _, err := os.Stat(recordPath(name)); err == nil {
+			continue
+		}
+		if inUse != nil && inUse(name) {
+			continue
+		}
+		lock, err := LockCluster(name)
+		if err != nil {
+			return "", nil, err
+		}
+		log.WithField(FieldCluster, name).Debug("Locked the name of the new environment")
+		return name, lock, nil
+	}
+	return "", nil, fmt.Errorf("Failed to find a free environment name")
+}
+
+// belongsTo reports whether any of the machine names is one of the
+// environment's, named <cluster>-<index>
+func belongsTo(names []string, cluster string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, cluster+"-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package machines
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/docker-e2e/testkit/trace"
+)
+
+// The fields of the structured logs, the same across the commands so the logs
+// of parallel provisioning can be indexed and queried in CI log systems
+const (
+	// FieldCluster is the environment the log is about
+	FieldCluster = "cluster"
+	// FieldMachine is the machine the log is about
+	FieldMachine = "machine"
+	// FieldPhase is the step of the machine's or environment's life, like
+	// create, provision or destroy
+	FieldPhase = "phase"
+	// FieldDuration is how long the phase took, in seconds
+	FieldDuration = "duration"
+)
+
+// SetLogFormat makes logrus write its logs as text, its default, or as one
+// JSON object per line
+func SetLogFormat(format string) error {
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format %q, must be text or json", format)
+	}
+	return nil
+}
+
+// MachineLog returns a logger with the fields of the machine
+func MachineLog(m Machine) *log.Entry {
+	return log.WithFields(log.Fields{
+		FieldCluster: StackName(m),
+		FieldMachine: m.GetName(),
+	})
+}
+
+// LogPhase logs that a phase started at start is over, with how long it took
+// and its error if it failed, and records it as a span of the entry's cluster
+// when tracing
+func LogPhase(entry *log.Entry, phase string, start time.Time, err error) {
+	cluster, _ := entry.Data[FieldCluster].(string)
+	tags := map[string]string{}
+	if machine, ok := entry.Data[FieldMachine].(string); ok {
+		tags[FieldMachine] = machine
+	}
+	trace.Record(cluster, phase, start, tags, err)
+
+	entry = entry.WithFields(log.Fields{
+		FieldPhase:    phase,
+		FieldDuration: time.Since(start).Seconds(),
+	})
+	if err != nil {
+		entry.WithError(err).Errorf("%s failed", phase)
+		return
+	}
+	entry.Infof("%s done", phase)
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -23,7 +24,7 @@ import (
 
 var (
 	// NamePrefix denotes the machine prefix for the test.
-	NamePrefix = os.Getenv("MACHINE_PREFIX") + "E2E"
+	NamePrefix string
 	// Timeout denotes the timeout on the docker client.
 	Timeout = 180 * time.Second
 	// BusyboxImage denotes the busybox image string.
@@ -42,7 +43,11 @@ type Machine interface {
 	GetEngineAPIWithTimeout(timeout time.Duration) (*client.Client, error)
 	Remove() error
 	Stop() error
+	Kill() error
 	Start() error
+	Reboot() error
+	Pause() error
+	Resume() error
 	GetIP() (string, error)
 	GetInternalIP() (string, error)
 	CatHostFile(hostPath string) ([]byte, error)
@@ -59,6 +64,26 @@ type Environment struct {
 	Machines  []Machine
 }
 
+// GetManager returns the first machine in the environment that is acting as a
+// swarm manager
+func (e *Environment) GetManager() (Machine, error) {
+	for _, m := range e.Machines {
+		cli, err := m.GetEngineAPI()
+		if err != nil {
+			return nil, err
+		}
+		info, err := cli.Info(context.TODO())
+		if err != nil {
+			log.Debugf("Failed to get info from %s: %s", m.GetName(), err)
+			continue
+		}
+		if info.Swarm.ControlAvailable {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no swarm manager found in %s", e.StackName)
+}
+
 // GetTestMachines uses docker-machine to create a test engine which can then be used for integration tests (try RetryCount times)
 func GetTestMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error) {
 	return GetTestMachinesWithDockerRootDir(linuxCount, windowsCount, "")
@@ -79,18 +104,77 @@ func GetTestMachinesWithDockerRootDir(linuxCount int, windowsCount int, dockerRo
 	}
 }
 
+// rebootLinux reboots the machine from inside the OS, returning once it has
+// come back up with a new boot ID
+func rebootLinux(m Machine) error {
+	if m.IsWindows() {
+		return fmt.Errorf("reboot is not implemented for windows machines")
+	}
+	out, err := m.MachineSSH("cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return fmt.Errorf("Failed to get the boot ID of %s: %s: %s", m.GetName(), err, out)
+	}
+	bootID := strings.TrimSpace(out)
+	// the connection drops as the machine goes down, so ignore the result
+	m.MachineSSH("sudo systemctl reboot")
+
+	// TODO - make the timeout configurable
+	err = PollTimeout(5*time.Minute, 2*time.Second, func() (bool, error) {
+		out, err := m.MachineSSH("cat /proc/sys/kernel/random/boot_id")
+		return err == nil && strings.TrimSpace(out) != "" && strings.TrimSpace(out) != bootID, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Timed out waiting for %s to reboot", m.GetName())
+	}
+	return nil
+}
+
+var machineIndexRegex = regexp.MustCompile(`-[0-9]+$`)
+
+// StackName returns the name of the environment the machine belongs to
+func StackName(m Machine) string {
+	if s, ok := m.(interface {
+		GetStackName() string
+	}); ok {
+		return s.GetStackName()
+	}
+	// Everything else is named <stack>-<index>
+	return machineIndexRegex.ReplaceAllString(m.GetName(), "")
+}
+
 func ListEnvironments() ([]*Environment, error) {
-	if os.Getenv("MACHINE_DRIVER") == "virsh" {
+	switch os.Getenv("MACHINE_DRIVER") {
+	case "virsh":
 		return VirshListEnvironments()
+	case "aws":
+		return AWSListEnvironments()
+	default:
+		return DockerMachineListEnvironments()
 	}
-	return DockerMachineListEnvironments()
 }
 
+// DestroyEnvironment destroys the machines of the environment, unless another
+// testkit process on the host holds its lock
 func DestroyEnvironment(name string) error {
-	if os.Getenv("MACHINE_DRIVER") == "virsh" {
-		return VirshDestroyEnvironment(name)
+	lock, err := LockCluster(name)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	switch os.Getenv("MACHINE_DRIVER") {
+	case "virsh":
+		err = VirshDestroyEnvironment(name)
+	case "aws":
+		err = AWSDestroyEnvironment(name)
+	default:
+		err = DockerMachineDestroyEnvironment(name)
+	}
+	LogPhase(log.WithField(FieldCluster, name), "destroy", start, err)
+	if err != nil {
+		lock.Unlock()
+		return err
 	}
-	return DockerMachineDestroyEnvironment(name)
+	return lock.Release()
 }
 
 // HostDirManifest Return a manifest of the files on the host in the directory (using find $hostpath)
@@ -0,0 +1,40 @@
+package machines
+
+import (
+	"context"
+	"time"
+)
+
+// Condition is checked by Poll. It returns true once whatever is being waited
+// on has happened, or an error to give up straight away
+type Condition func() (bool, error)
+
+// Poll checks condition every interval until it's met, returns an error, or
+// ctx is done, in which case ctx's error is returned. The condition runs on
+// the calling goroutine, so nothing is left behind once Poll returns, but a
+// check that blocks holds Poll up until it comes back
+func Poll(ctx context.Context, interval time.Duration, condition Condition) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		done, err := condition()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// PollTimeout is Poll giving up after timeout
+func PollTimeout(timeout, interval time.Duration, condition Condition) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Poll(ctx, interval, condition)
+}
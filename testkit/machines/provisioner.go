@@ -13,9 +13,9 @@ import (
 )
 
 var (
-	EngineInstallURL    = os.Getenv("ENGINE_INSTALL_URL")
-	EngineInstallWinURL = os.Getenv("ENGINE_INSTALL_WIN_URL")
-	EngineInstallCMD    = os.Getenv("ENGINE_INSTALL_CMD")
+	EngineInstallURL    string
+	EngineInstallWinURL string
+	EngineInstallCMD    string
 	TCPPortList         = []int{
 		// Product ports
 		443, 2377, 2376, 4789, 7946, 12382, 12386, 12383, 12379, 12380, 12376, 12381, 12385, 12384, 12387,
@@ -105,12 +105,44 @@ func injectLinuxNodeCerts(m Machine, localCertDir string) error {
 	return nil
 }
 
+// exposeDaemonTCP adds the TCP listener to the daemon's systemd unit, leaving
+// it alone if a previous install already did
+func exposeDaemonTCP(m Machine) error {
+	// BLECH!  This'll need some refinement to handle different variants...
+	out, err := m.MachineSSH("systemctl show --property=FragmentPath docker 2>&1 | grep FragmentPath | cut -f2 -d=")
+	if err != nil {
+		return fmt.Errorf("Couldn't figure out the systemctl config for docker daemon - need to add suport for this distro...: %s: %s", err, out)
+	}
+	cfgFile := strings.TrimSpace(out)
+
+	out, err = m.MachineSSH(`grep -q tcp://0.0.0.0:2376 ` + cfgFile + ` || sudo sed -i -e 's|^ExecStart=\(.*\)$|ExecStart=\1 -H unix:// -H tcp://0.0.0.0:2376|g' ` + cfgFile)
+	if err != nil {
+		return fmt.Errorf("Failed to update config file: %s: %s", err, out)
+	}
+	out, err = m.MachineSSH("sudo systemctl daemon-reload")
+	if err != nil {
+		return fmt.Errorf("Couldn't restart docker daemon...: %s: %s", err, out)
+	}
+	return nil
+}
+
 // VerifyDockerEngine makes sure the machine has docker installed, and if not
 // will install the docker daemon
 func VerifyDockerEngine(m Machine, localCertDir string) error {
-	log.Debugf("Verifying or installing docker engine on %s", m.GetName())
+	logger := MachineLog(m)
+	logger.Debug("Verifying or installing docker engine")
+	start := time.Now()
+
+	// Fetched or built before the timeout starts, as building takes a while
+	customPath, err := customEngine()
+	if err != nil {
+		LogPhase(logger, "engine", start, err)
+		return err
+	}
 
-	resChan := make(chan error)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute) // TODO - make configurable
+	defer cancel()
+	resChan := make(chan error, 1)
 
 	go func(m Machine) {
 		// First check to see if docker is already installed
@@ -200,22 +232,9 @@ func VerifyDockerEngine(m Machine, localCertDir string) error {
 			time.Sleep(500 * time.Millisecond)
 
 			// But we're not done :-(
-			// BLECH!  This'll need some refinement to handle different variants...
-			out, err = m.MachineSSH("systemctl show --property=FragmentPath docker 2>&1 | grep FragmentPath | cut -f2 -d=")
-			if err != nil {
-				resChan <- fmt.Errorf("Couldn't figure out the systemctl config for docker daemon - need to add suport for this distro...: %s: %s", err, out)
-				return
-			}
-			cfgFile := strings.TrimSpace(out)
-
-			out, err = m.MachineSSH(`sudo sed -i -e 's|^ExecStart=\(.*\)$|ExecStart=\1 -H unix:// -H tcp://0.0.0.0:2376|g' ` + cfgFile)
-			if err != nil {
-				resChan <- fmt.Errorf("Failed to update config file: %s: %s", err, out)
-				return
-			}
-			out, err = m.MachineSSH("sudo systemctl daemon-reload")
+			err = exposeDaemonTCP(m)
 			if err != nil {
-				resChan <- fmt.Errorf("Couldn't restart docker daemon...: %s: %s", err, out)
+				resChan <- err
 				return
 			}
 			// Check to see if firewalld is enabled, and if so, punch a hole
@@ -258,6 +277,12 @@ func VerifyDockerEngine(m Machine, localCertDir string) error {
 					log.Debug("Firewall restarted: %s %s", out, err)
 				}
 			}
+			if customPath != "" {
+				if err := installCustomEngine(m, customPath); err != nil {
+					resChan <- err
+					return
+				}
+			}
 			out, err = m.MachineSSH("sudo systemctl restart docker.service")
 			if err != nil {
 				resChan <- fmt.Errorf("Couldn't restart docker daemon...: %s: %s", err, out)
@@ -271,6 +296,13 @@ func VerifyDockerEngine(m Machine, localCertDir string) error {
 				return
 			}
 
+			if customPath != "" {
+				if err := installCustomEngine(m, customPath); err != nil {
+					resChan <- err
+					return
+				}
+			}
+
 			// Make sure to bounce the daemon so it has the right hostname and certs
 			out, err := m.MachineSSH("sudo systemctl restart docker.service")
 			if err != nil {
@@ -279,35 +311,42 @@ func VerifyDockerEngine(m Machine, localCertDir string) error {
 			}
 		}
 		// Now wait for the daemon to start responding...
-		for {
+		err = Poll(ctx, 500*time.Millisecond, func() (bool, error) {
 			ver, err := getServerVersion(m)
-			if err == nil {
-				log.Infof("Succesfully installed engine %s on %s", ver, m.GetName())
-				break
+			if err != nil {
+				return false, nil
 			}
-			time.Sleep(500 * time.Millisecond)
+			logger.Infof("Succesfully installed engine %s", ver)
+			return true, nil
+		})
+		if err != nil {
+			resChan <- err
+			return
 		}
-		log.Debugf("engine on %s is ready", m.GetName())
+		logger.Debug("engine is ready")
 		resChan <- nil
 
 	}(m)
 
-	timer := time.NewTimer(5 * time.Minute) // TODO - make configurable
+	var res error
 	select {
-	case res := <-resChan:
-		return res
-	case <-timer.C:
-		return fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
+	case res = <-resChan:
+	case <-ctx.Done():
+		res = fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
 	}
-
-	return nil
+	LogPhase(logger, "engine", start, res)
+	return res
 }
 
 // VerifyDockerEngineWindows makes sure the machine has docker installed, and if not
 // will install the docker daemon
 func VerifyDockerEngineWindows(m Machine, localCertDir string) error {
-	log.Debugf("Verifying or installing docker engine on windows machine %s", m.GetName())
+	logger := MachineLog(m)
+	logger.Debug("Verifying or installing docker engine on windows")
+	start := time.Now()
 
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute) // TODO - make configurable
+	defer cancel()
 	resChan := make(chan error, 1)
 
 	ip, err := m.GetIP()
@@ -322,7 +361,7 @@ func VerifyDockerEngineWindows(m Machine, localCertDir string) error {
 	go func(m Machine) {
 
 		// First check to see if docker is already installed
-		ver, err := getServerVersion(m)
+		_, err := getServerVersion(m)
 		if err != nil {
 			// If the engine's not installed, then they have to specify CMD or URL (fail fast if not specified)
 			if EngineInstallWinURL == "" {
@@ -449,29 +488,83 @@ func VerifyDockerEngineWindows(m Machine, localCertDir string) error {
 			}
 
 			// Now wait for the daemon to start responding...
-			for {
-				ver, err = getServerVersion(m)
-				if err == nil {
-					log.Infof("Succesfully installed engine %s on %s", ver, m.GetName())
-					break
-				} else {
+			err = Poll(ctx, 500*time.Millisecond, func() (bool, error) {
+				ver, err := getServerVersion(m)
+				if err != nil {
 					log.Debugf("Error getting version: %s", err)
+					return false, nil
 				}
-				time.Sleep(500 * time.Millisecond)
+				logger.Infof("Succesfully installed engine %s", ver)
+				return true, nil
+			})
+			if err != nil {
+				resChan <- err
+				return
 			}
 		}
-		log.Debugf("engine on %s is ready", m.GetName())
+		logger.Debug("engine is ready")
 		resChan <- nil
 
 	}(m)
 
-	timer := time.NewTimer(2 * time.Minute) // TODO - make configurable
+	var res error
 	select {
-	case res := <-resChan:
-		return res
-	case <-timer.C:
-		return fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
+	case res = <-resChan:
+	case <-ctx.Done():
+		res = fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
+	}
+	LogPhase(logger, "engine", start, res)
+	return res
+}
+
+// EngineVersionInstallCMD installs a specific engine version when given the
+// version, e.g. "17.06"
+func EngineVersionInstallCMD(version string) string {
+	if tmpl := os.Getenv("ENGINE_VERSION_INSTALL_CMD"); tmpl != "" {
+		return fmt.Sprintf(tmpl, version)
 	}
+	return fmt.Sprintf("curl -fsSL https://get.docker.com | VERSION=%s sh", version)
+}
 
+// UpgradeDockerEngine installs the given engine version over whatever the
+// machine currently runs and waits for the daemon to report it. Swarm state
+// is left in place, so this works for in-place upgrades and downgrades.
+func UpgradeDockerEngine(m Machine, version string) error {
+	if m.IsWindows() {
+		return fmt.Errorf("Upgrading the engine on windows machine %s is not supported", m.GetName())
+	}
+	logger := MachineLog(m)
+	logger.Debugf("Installing engine %s", version)
+	out, err := m.MachineSSH(EngineVersionInstallCMD(version))
+	if err != nil {
+		logger.Info(out)
+		return fmt.Errorf("Failed to install engine %s on %s: %s", version, m.GetName(), err)
+	}
+	// The package may have replaced the unit file
+	err = exposeDaemonTCP(m)
+	if err != nil {
+		return err
+	}
+	out, err = m.MachineSSH("sudo systemctl restart docker.service")
+	if err != nil {
+		return fmt.Errorf("Couldn't restart docker daemon...: %s: %s", err, out)
+	}
+
+	var lastErr error
+	err = PollTimeout(5*time.Minute, 500*time.Millisecond, func() (bool, error) {
+		ver, err := getServerVersion(m)
+		if err == nil {
+			if strings.HasPrefix(ver, version) {
+				logger.Infof("Succesfully installed engine %s", ver)
+				return true, nil
+			}
+			err = fmt.Errorf("engine reports version %s", ver)
+		}
+		lastErr = err
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Engine %s on %s did not come up within timeout: %s", version, m.GetName(), lastErr)
+	}
 	return nil
 }
@@ -0,0 +1,142 @@
+package machines
+
+import (
+	"math/rand"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// The calls the drivers make to their back-end to create, describe and delete
+// machines go through driverCall, which retries the ones that failed for a
+// reason that goes away, like a cloud API throttling or libvirt busy with
+// another VM, rather than abort a whole creation. The calls are also limited
+// to a rate for the whole process, as creating many environments in parallel
+// is what gets them throttled in the first place
+var (
+	// DriverRetries is how many times a call is retried, TESTKIT_DRIVER_RETRIES
+	DriverRetries = 5
+	// DriverBackoff is how long to wait before the first retry, doubled for
+	// every next one up to DriverMaxBackoff. The waits are jittered
+	DriverBackoff    = time.Second
+	DriverMaxBackoff = 30 * time.Second
+	// DriverRate is how many calls per second the drivers make at most,
+	// TESTKIT_DRIVER_RATE
+	DriverRate = 5.0
+)
+
+func loadRetryEnv() {
+	if retries, err := strconv.Atoi(os.Getenv("TESTKIT_DRIVER_RETRIES")); err == nil && retries >= 0 {
+		DriverRetries = retries
+	}
+	if rate, err := strconv.ParseFloat(os.Getenv("TESTKIT_DRIVER_RATE"), 64); err == nil && rate > 0 {
+		DriverRate = rate
+	}
+}
+
+var (
+	rateMu sync.Mutex
+	// nextCall is when the next call can be made
+	nextCall time.Time
+	// jitter is seeded for parallel testkit processes not to wait the same
+	jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// waitRate waits for the turn of the next call
+func waitRate() {
+	rateMu.Lock()
+	now := time.Now()
+	if nextCall.Before(now) {
+		nextCall = now
+	}
+	wait := nextCall.Sub(now)
+	nextCall = nextCall.Add(time.Duration(float64(time.Second) / DriverRate))
+	rateMu.Unlock()
+	time.Sleep(wait)
+}
+
+// backoff returns how long to wait before the retry, a random duration up to
+// the exponential backoff so parallel callers don't retry all at once
+func backoff(retry int) time.Duration {
+	max := DriverBackoff << uint(retry)
+	if max <= 0 || max > DriverMaxBackoff {
+		max = DriverMaxBackoff
+	}
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	return time.Duration(jitter.Int63n(int64(max))) + max/10
+}
+
+// driverCall makes the call named op, retrying it while it fails with an
+// error transient reports as one to retry
+func driverCall(op string, call func() error, transient func(error) bool) error {
+	var err error
+	for retry := 0; ; retry++ {
+		waitRate()
+		err = call()
+		if err == nil || !transient(err) || retry >= DriverRetries {
+			return err
+		}
+		wait := backoff(retry)
+		log.WithError(err).Debugf("%s failed, retrying in %s", op, wait)
+		time.Sleep(wait)
+	}
+}
+
+// commandError is the failure of a command, with its output
+type commandError struct {
+	err error
+	out []byte
+}
+
+func (e commandError) Error() string {
+	return e.err.Error()
+}
+
+// transientOutput matches the output of virsh, VBoxManage and docker-machine
+// failing for a reason that goes away
+var transientOutput = regexp.MustCompile(`(?i)cannot acquire state change lock|failed to connect socket|resource (temporarily unavailable|busy)|timed out during operation|connection reset|is locked by a session|E_ACCESSDENIED|VBOX_E_INVALID_OBJECT_STATE|i/o timeout|RequestLimitExceeded|Throttling`)
+
+// runDriverCommand runs a command of the driver's back-end through
+// driverCall, returning its combined output like exec's CombinedOutput
+func runDriverCommand(name string, args ...string) ([]byte, error) {
+	var out []byte
+	err := driverCall(name+" "+args[0], func() error {
+		var err error
+		out, err = exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			return commandError{err, out}
+		}
+		return nil
+	}, func(err error) bool {
+		cmdErr, ok := err.(commandError)
+		return ok && transientOutput.Match(cmdErr.out)
+	})
+	if cmdErr, ok := err.(commandError); ok {
+		return out, cmdErr.err
+	}
+	return out, err
+}
+
+// awsTransient reports whether an AWS API call failed for a reason that goes
+// away: throttling, or an error on AWS's side
+func awsTransient(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "RequestLimitExceeded", "Throttling", "ThrottlingException", "InternalError", "ServiceUnavailable", "Unavailable", "RequestTimeout":
+		return true
+	}
+	return false
+}
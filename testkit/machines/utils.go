@@ -10,8 +10,7 @@ import (
 )
 
 func getMACAddress(vmname string) (string, error) {
-	cmd := exec.Command("VBoxManage", "showvminfo", vmname, "--machinereadable")
-	data, err := cmd.CombinedOutput()
+	data, err := runDriverCommand("VBoxManage", "showvminfo", vmname, "--machinereadable")
 	out := strings.TrimSpace(string(data))
 	if err != nil {
 		return "", err
@@ -45,8 +44,7 @@ func getMACAddress(vmname string) (string, error) {
 
 }
 func generateIPs() ([]string, error) {
-	cmd := exec.Command("VBoxManage", "list", "dhcpservers")
-	data, err := cmd.CombinedOutput()
+	data, err := runDriverCommand("VBoxManage", "list", "dhcpservers")
 	out := strings.TrimSpace(string(data))
 	if err != nil {
 		return nil, err
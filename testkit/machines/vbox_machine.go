@@ -3,13 +3,12 @@ package machines
 import (
 	"bufio"
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/big"
 	"net/http"
 	"os"
 	"os/exec"
@@ -23,6 +22,7 @@ import (
 	"net"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker-e2e/testkit/trace"
 	"github.com/docker/docker/client"
 	"github.com/kr/pty"
 )
@@ -55,7 +55,7 @@ type VBoxMachine struct {
 	DiskCtrl    string
 }
 
-func init() {
+func loadVBoxEnv() {
 	VBoxDiskDir = os.Getenv("VBOX_DISK_DIR")
 	baseOSLinux := os.Getenv("VBOX_OS_LINUX")
 	if baseOSLinux != "" {
@@ -68,8 +68,7 @@ func init() {
 }
 
 func getVBoxActiveMachines() []string {
-	cmd := exec.Command(vbm, "list", "runningvms")
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand(vbm, "list", "runningvms")
 	if err != nil {
 		log.Info("Failed to get list - assuming no VMs: %s", err)
 	}
@@ -117,20 +116,33 @@ func NewVBoxMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 		sshKeyPath = ""
 	}
 
+	// other testkit processes on the host could be creating VMs too
+	name, lock, err := newClusterName(func(name string) bool {
+		return belongsTo(getVBoxActiveMachines(), name)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
 	timer := time.NewTimer(10 * time.Minute) // TODO - make configurable
-	errChan := make(chan error)
-	resChan := make(chan []*VBoxMachine)
+	// buffered for the creation to finish, and release the name, even once
+	// it timed out
+	errChan := make(chan error, 1)
+	resChan := make(chan []*VBoxMachine, 1)
 
 	go func() {
+		// the name stays locked until the creation is over, not only until
+		// the timeout
+		defer lock.Unlock()
 		log.Debugf("Attempting %s machine creation for %d nodes", VBoxOSLinux, linuxCount)
-		id, _ := rand.Int(rand.Reader, big.NewInt(0xffffff))
+		trace.StartCluster(name, time.Now())
 		linuxMachines := []*VBoxMachine{}
 		windowsMachines := []*VBoxMachine{}
 
 		index := 0
 		for ; index < linuxCount; index++ {
 			m := &VBoxMachine{
-				MachineName: fmt.Sprintf("%s-%X-%d", NamePrefix, id, index),
+				MachineName: fmt.Sprintf("%s-%d", name, index),
 				BaseDisk:    baseOSLinux,
 				CPUCount:    1,        // TODO - make configurable
 				Memory:      2048,     // TODO - make configurable
@@ -175,7 +187,7 @@ func NewVBoxMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error)
 		log.Debugf("Creating %d windows VMs based on %s", windowsCount, VBoxOSWindows)
 		for ; index-linuxCount < windowsCount; index++ {
 			m := &VBoxMachine{
-				MachineName: fmt.Sprintf("%s-%X-%d", NamePrefix, id, index),
+				MachineName: fmt.Sprintf("%s-%d", name, index),
 				BaseDisk:    baseOSWindows,
 				CPUCount:    1,        // TODO - make configurable
 				Memory:      2048,     // TODO - make configurable
@@ -327,39 +339,34 @@ func (m *VBoxMachine) convertDisk() error {
 func (m *VBoxMachine) define() error {
 	log.Debugf("Creating vm %s", m.MachineName)
 
-	cmd := exec.Command(vbm, "createvm", "--name", m.MachineName, "--register")
-	data, err := cmd.CombinedOutput()
+	data, err := runDriverCommand(vbm, "createvm", "--name", m.MachineName, "--register")
 	out := strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to createvm %s: %s: %s", m.MachineName, err, out)
 	}
 
 	log.Debugf("Setting OS type to %s", m.OSType)
-	cmd = exec.Command(vbm, "modifyvm", m.MachineName, "--ostype", m.OSType)
-	data, err = cmd.CombinedOutput()
+	data, err = runDriverCommand(vbm, "modifyvm", m.MachineName, "--ostype", m.OSType)
 	out = strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to change vm ostype %s: %s: %s: %s", m.MachineName, m.OSType, err, out)
 	}
 
-	cmd = exec.Command(vbm, "modifyvm", m.MachineName, "--memory", strconv.Itoa(m.Memory))
-	data, err = cmd.CombinedOutput()
+	data, err = runDriverCommand(vbm, "modifyvm", m.MachineName, "--memory", strconv.Itoa(m.Memory))
 	out = strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to change vm memory %s: %s: %s:", m.MachineName, err, out)
 	}
 
 	diskName := strings.ToUpper(m.DiskType)
-	cmd = exec.Command(vbm, "storagectl", m.MachineName, "--name", diskName, "--add", m.DiskType, "--controller", m.DiskCtrl, "--bootable", "on")
-	data, err = cmd.CombinedOutput()
+	data, err = runDriverCommand(vbm, "storagectl", m.MachineName, "--name", diskName, "--add", m.DiskType, "--controller", m.DiskCtrl, "--bootable", "on")
 	out = strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to add vm storage ctl %s: %s: %s", m.MachineName, err, out)
 	}
 
 	log.Debugf("Attaching storage at %s", m.DiskPath)
-	cmd = exec.Command(vbm, "storageattach", m.MachineName, "--storagectl", diskName, "--port", "0", "--device", "0", "--type", "hdd", "--medium", m.DiskPath)
-	data, err = cmd.CombinedOutput()
+	data, err = runDriverCommand(vbm, "storageattach", m.MachineName, "--storagectl", diskName, "--port", "0", "--device", "0", "--type", "hdd", "--medium", m.DiskPath)
 	out = strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to attach vm storage %s: %s: %s: %s", m.MachineName, m.DiskPath, err, out)
@@ -367,8 +374,7 @@ func (m *VBoxMachine) define() error {
 
 	if m.OSType == VBoxOSTypeWindows {
 
-		cmd = exec.Command(vbm, "modifyvm", m.MachineName, "--ioapic", "on")
-		data, err = cmd.CombinedOutput()
+		data, err = runDriverCommand(vbm, "modifyvm", m.MachineName, "--ioapic", "on")
 		out = strings.TrimSpace(string(data))
 		if err != nil {
 			return fmt.Errorf("Failed to turn on ioapic %s: %s: %s", m.MachineName, err, out)
@@ -377,15 +383,13 @@ func (m *VBoxMachine) define() error {
 
 	log.Debug("Setting network")
 
-	cmd = exec.Command(vbm, "modifyvm", m.MachineName, "--nic1", "nat", "--nictype1", m.NICType, "--cableconnected1", "on")
-	data, err = cmd.CombinedOutput()
+	data, err = runDriverCommand(vbm, "modifyvm", m.MachineName, "--nic1", "nat", "--nictype1", m.NICType, "--cableconnected1", "on")
 	out = strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to set up network (nat) %s: %s: %s", m.MachineName, err, out)
 	}
 
-	cmd = exec.Command(vbm, "modifyvm", m.MachineName, "--nic2", "hostonly", "--nictype2", m.NICType, "--hostonlyadapter2", "vboxnet0", "--cableconnected2", "on")
-	data, err = cmd.CombinedOutput()
+	data, err = runDriverCommand(vbm, "modifyvm", m.MachineName, "--nic2", "hostonly", "--nictype2", m.NICType, "--hostonlyadapter2", "vboxnet0", "--cableconnected2", "on")
 	out = strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to set up network (hostonly) %s: %s: %s", m.MachineName, err, out)
@@ -446,8 +450,7 @@ func (m *VBoxMachine) Remove() error {
 		m.Kill()
 	}
 
-	cmd := exec.Command(vbm, "unregistervm", m.MachineName, "--delete")
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand(vbm, "unregistervm", m.MachineName, "--delete")
 	if err != nil {
 		log.Error(string(out))
 		return err
@@ -471,8 +474,7 @@ func (m *VBoxMachine) RemoveAndPreserveDisk() error {
 		m.Stop()
 	}
 
-	cmd := exec.Command(vbm, "unregistervm", m.MachineName)
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand(vbm, "unregistervm", m.MachineName)
 	if err != nil {
 		log.Error(string(out))
 		return err
@@ -488,10 +490,29 @@ func (m *VBoxMachine) RemoveAndPreserveDisk() error {
 // Stop gracefully shuts down the machine
 func (m *VBoxMachine) Stop() error {
 	//TODO: make it gracefully shutdown
-	cmd := exec.Command(vbm, "controlvm", m.MachineName, "poweroff")
+	out, err := runDriverCommand(vbm, "controlvm", m.MachineName, "poweroff")
+	//out, err := runDriverCommand(vbm, "controlvm", m.MachineName, "acpipowerbutton")
+	if err != nil {
+		log.Error(string(out))
+		return err
+	}
+	return nil
+}
+
+// Pause suspends the virtual machine, keeping its memory state so it can be
+// resumed later
+func (m *VBoxMachine) Pause() error {
+	out, err := runDriverCommand(vbm, "controlvm", m.MachineName, "pause")
+	if err != nil {
+		log.Error(string(out))
+		return err
+	}
+	return nil
+}
 
-	//cmd := exec.Command(vbm, "controlvm", m.MachineName, "acpipowerbutton")
-	out, err := cmd.CombinedOutput()
+// Resume continues a previously paused virtual machine
+func (m *VBoxMachine) Resume() error {
+	out, err := runDriverCommand(vbm, "controlvm", m.MachineName, "resume")
 	if err != nil {
 		log.Error(string(out))
 		return err
@@ -502,48 +523,37 @@ func (m *VBoxMachine) Stop() error {
 // Kill forcefully stops the virtual machine (likely to corrupt the machine, so
 // do not use this if you intend to start the machine again)
 func (m *VBoxMachine) Kill() error {
-	cmd := exec.Command(vbm, "controlvm", m.MachineName, "poweroff")
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand(vbm, "controlvm", m.MachineName, "poweroff")
 	if err != nil {
 		log.Error(string(out))
 		return err
 	}
 
 	// Make sure it's stopped before returning...
-	resChan := make(chan error)
-
-	go func(m *VBoxMachine) {
-		for {
-			if !m.IsRunning() {
-				resChan <- nil
-				return
-			}
-			time.Sleep(500 * time.Millisecond)
-		}
-	}(m)
-
-	timer := time.NewTimer(1 * time.Minute) // TODO - make configurable
-	select {
-	case res := <-resChan:
-		log.Debugf("Got %v on resChan", res)
-		return res
-	case <-timer.C:
+	// TODO - make the timeout configurable
+	err = PollTimeout(1*time.Minute, 500*time.Millisecond, func() (bool, error) {
+		return !m.IsRunning(), nil
+	})
+	if err != nil {
 		return fmt.Errorf("Unable to kill docker engine on %s within timeout", m.MachineName)
 	}
+	return nil
+}
+
+// Reboot restarts the machine's OS, returning once it's back up
+func (m *VBoxMachine) Reboot() error {
+	return rebootLinux(m)
 }
 
 // Start powers on the VM
 func (m *VBoxMachine) Start() error {
 
-	cmd := exec.Command(vbm, "startvm", m.MachineName, "--type", "headless")
-	data, err := cmd.CombinedOutput()
+	data, err := runDriverCommand(vbm, "startvm", m.MachineName, "--type", "headless")
 	out := strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to start vm %s: %s: %s", m.MachineName, err, out)
 	}
 
-	resChan := make(chan error)
-
 	ips, err := generateIPs()
 	if err != nil {
 		return err
@@ -556,60 +566,59 @@ func (m *VBoxMachine) Start() error {
 	}
 	log.Debugf("MAC address for %s is %s", m.GetName(), macAddress)
 
-	go func(m *VBoxMachine) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second) // TODO - make configurable
+	defer cancel()
 
-		log.Debugf("Waiting for IP to appear for %s", m.GetName())
-		for {
-			// Dial to all the IPs that is configured in vboxnet0.
-			for _, ip := range ips {
-				conn, err := net.DialTimeout("tcp", ip+":22", time.Duration(1)*time.Millisecond)
-				if err == nil {
-					conn.Close()
-				}
-			}
-
-			ip, err := findIPFromMAC(macAddress)
+	log.Debugf("Waiting for IP to appear for %s", m.GetName())
+	err = Poll(ctx, 1*time.Second, func() (bool, error) {
+		// Dial to all the IPs that is configured in vboxnet0.
+		for _, ip := range ips {
+			conn, err := net.DialTimeout("tcp", ip+":22", time.Duration(1)*time.Millisecond)
 			if err == nil {
-				m.ip = ip
-				m.internalip = ip
-				m.dockerHost = fmt.Sprintf("tcp://%s:2376", ip)
-				break
-			}
-
-			time.Sleep(1 * time.Second)
-		}
-		log.Debugf("Machine %s has IP %s", m.GetName(), m.ip)
-
-		// Loop until we can ssh in
-		for {
-			out, err := m.MachineSSH("uptime")
-			if err != nil && strings.Contains(out, "is not recognized as an internal or external command") {
-				log.Info("Detected windows image booted")
-				// TODO would be nice to give some basic "uptime" info... but that's kinda kludgy in windows...
-				m.isWindows = true
-				break
-			} else if err != nil {
-				//log.Debugf("XXX Failed to ssh to %s: %s: %s", m.GetName(), err, out)
-				time.Sleep(500 * time.Millisecond)
-			} else if strings.TrimSpace(out) == "" {
-				log.Debugf("Got empty output from the other side... trying again...")
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				log.Debugf("%s has been up %s", m.GetName(), out)
-				break
+				conn.Close()
 			}
 		}
 
-		resChan <- nil
-	}(m)
+		ip, err := findIPFromMAC(macAddress)
+		if err != nil {
+			return false, nil
+		}
+		m.ip = ip
+		m.internalip = ip
+		m.dockerHost = fmt.Sprintf("tcp://%s:2376", ip)
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
+	}
+	log.Debugf("Machine %s has IP %s", m.GetName(), m.ip)
 
-	timer := time.NewTimer(60 * time.Second) // TODO - make configurable
-	select {
-	case res := <-resChan:
-		return res
-	case <-timer.C:
+	// Loop until we can ssh in
+	err = Poll(ctx, 500*time.Millisecond, m.sshReady)
+	if err != nil {
 		return fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
 	}
+	return nil
+}
+
+// sshReady reports whether the machine has booted far enough to run commands
+// over ssh, noting whether it turned out to be windows
+func (m *VBoxMachine) sshReady() (bool, error) {
+	out, err := m.MachineSSH("uptime")
+	if err != nil && strings.Contains(out, "is not recognized as an internal or external command") {
+		log.Info("Detected windows image booted")
+		// TODO would be nice to give some basic "uptime" info... but that's kinda kludgy in windows...
+		m.isWindows = true
+		return true, nil
+	} else if err != nil {
+		//log.Debugf("XXX Failed to ssh to %s: %s: %s", m.GetName(), err, out)
+		return false, nil
+	} else if strings.TrimSpace(out) == "" {
+		log.Debugf("Got empty output from the other side... trying again...")
+		return false, nil
+	}
+	log.Debugf("%s has been up %s", m.GetName(), out)
+	return true, nil
 }
 
 // Return the public IP of the machine
@@ -3,13 +3,12 @@ package machines
 import (
 	"bufio"
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/big"
 	"net/http"
 	"os"
 	"os/exec"
@@ -23,6 +22,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker-e2e/testkit/trace"
 	"github.com/docker/docker/client"
 	"github.com/kr/pty"
 )
@@ -31,6 +31,9 @@ var (
 	VirshDiskDir   = "/e2e"
 	VirshOSLinux   = "ubuntu16.04"
 	VirshOSWindows = "winnanors1"
+	// VirshCPUCount and VirshMemory, in MB, size the VMs
+	VirshCPUCount = 1
+	VirshMemory   = 2048
 )
 
 const (
@@ -78,11 +81,17 @@ type VirshMachine struct {
 	NICType     string
 }
 
-func init() {
+func loadVirshEnv() {
 	diskDir := os.Getenv("VIRSH_DISK_DIR")
 	if diskDir != "" {
 		VirshDiskDir = diskDir
 	}
+	if cpus, err := strconv.Atoi(os.Getenv("VIRSH_CPUS")); err == nil && cpus > 0 {
+		VirshCPUCount = cpus
+	}
+	if memory, err := strconv.Atoi(os.Getenv("VIRSH_MEMORY")); err == nil && memory > 0 {
+		VirshMemory = memory
+	}
 	baseOSLinux := os.Getenv("VIRSH_OS_LINUX")
 	if baseOSLinux != "" {
 		VirshOSLinux = baseOSLinux
@@ -94,12 +103,12 @@ func init() {
 }
 
 func getActiveMachines() []string {
-	cmd := exec.Command("virsh", "-q", "list")
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("virsh", "-q", "list")
 	if err != nil {
 		log.Info("Failed to get list - assuming no VMs: %s", err)
 	}
-	nameRegex := regexp.MustCompile(`\s+(\S+)\s+running`)
+	// Paused machines are still part of their environment, so include them
+	nameRegex := regexp.MustCompile(`\s+(\S+)\s+(running|paused)`)
 	machines := []string{}
 	for _, line := range strings.Split(string(out), "\n") {
 		line = strings.TrimSpace(line)
@@ -142,36 +151,41 @@ func NewVirshMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error
 		sshKeyPath = ""
 	}
 
+	// other testkit processes on the host could be creating VMs too
+	name, lock, err := newClusterName(func(name string) bool {
+		return belongsTo(getActiveMachines(), name)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
 	timer := time.NewTimer(5 * time.Minute) // TODO - make configurable
-	errChan := make(chan error)
-	resChan := make(chan []*VirshMachine)
+	// buffered for the creation to finish, and release the name, even once
+	// it timed out
+	errChan := make(chan error, 1)
+	resChan := make(chan []*VirshMachine, 1)
 
 	go func() {
+		// the name stays locked until the creation is over, not only until
+		// the timeout
+		defer lock.Unlock()
 		log.Infof("Creating %d linux VMs based on %s", linuxCount, VirshOSLinux)
-		id, _ := rand.Int(rand.Reader, big.NewInt(0xffffff))
+		trace.StartCluster(name, time.Now())
 		linuxMachines := []*VirshMachine{}
 		windowsMachines := []*VirshMachine{}
 		index := 0
 		for ; index < linuxCount; index++ {
 			m := &VirshMachine{
-				MachineName: fmt.Sprintf("%s-%X-%d", NamePrefix, id, index),
+				MachineName: fmt.Sprintf("%s-%d", name, index),
 				BaseDisk:    baseOSLinux,
-				CPUCount:    1,        // TODO - make configurable
-				Memory:      2048,     // TODO - make configurable
+				CPUCount:    VirshCPUCount,
+				Memory:      VirshMemory,
 				sshUser:     "docker", // TODO - make configurable
 				sshKeyPath:  sshKeyPath,
 				DiskType:    "virtio",
 				NICType:     "virtio",
 			}
-			if err := m.cloneDisk(); err != nil {
-				errChan <- err
-				return
-			}
-			if err := m.define(); err != nil {
-				errChan <- err
-				return
-			}
-			if err := m.Start(); err != nil {
+			if err := m.create(); err != nil {
 				errChan <- err
 				return
 			}
@@ -196,24 +210,16 @@ func NewVirshMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error
 		log.Infof("Creating %d windows VMs based on %s", windowsCount, VirshOSWindows)
 		for ; index-linuxCount < windowsCount; index++ {
 			m := &VirshMachine{
-				MachineName: fmt.Sprintf("%s-%X-%d", NamePrefix, id, index),
+				MachineName: fmt.Sprintf("%s-%d", name, index),
 				BaseDisk:    baseOSWindows,
-				CPUCount:    1,        // TODO - make configurable
-				Memory:      2048,     // TODO - make configurable
+				CPUCount:    VirshCPUCount,
+				Memory:      VirshMemory,
 				sshUser:     "docker", // TODO - make configurable
 				sshKeyPath:  sshKeyPath,
 				DiskType:    "ide",
 				NICType:     "e1000",
 			}
-			if err := m.cloneDisk(); err != nil {
-				errChan <- err
-				return
-			}
-			if err := m.define(); err != nil {
-				errChan <- err
-				return
-			}
-			if err := m.Start(); err != nil {
+			if err := m.create(); err != nil {
 				errChan <- err
 				return
 			}
@@ -244,14 +250,17 @@ func NewVirshMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error
 			wg.Add(1)
 			go func(m *VirshMachine) {
 				var result error
+				logger := MachineLog(m)
+				start := time.Now()
 				// Set the hostname
 				out, err := m.MachineSSH(
 					fmt.Sprintf(`sudo hostname "%s"; sudo sed -e 's/.*/%s/' -i /etc/hostname; sudo sed -e 's/127\.0\.1\.1.*/127.0.1.1 %s/' -i /etc/hosts`,
 						m.GetName(), m.GetName(), m.GetName()))
 				if err != nil {
-					log.Warnf("Failed to set hostname to %s: %s: %s", m.GetName(), err, out)
+					logger.Warnf("Failed to set hostname: %s: %s", err, out)
 				}
 				result = VerifyDockerEngine(m, VirshDiskDir)
+				LogPhase(logger, "provision", start, result)
 
 				machineErrChan <- result
 				wg.Done()
@@ -262,10 +271,12 @@ func NewVirshMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error
 			wg.Add(1)
 			go func(m *VirshMachine) {
 				var result error
+				logger := MachineLog(m)
+				start := time.Now()
 				out, err := m.MachineSSH(
 					fmt.Sprintf(`powershell rename-computer -newname "%s" -restart`, m.GetName()))
 				if err != nil {
-					log.Warnf("Failed to set hostname to %s: %s: %s", m.GetName(), err, out)
+					logger.Warnf("Failed to set hostname: %s: %s", err, out)
 				}
 				time.Sleep(10 * time.Second)
 				// Loop until we can ssh in
@@ -281,6 +292,7 @@ func NewVirshMachines(linuxCount, windowsCount int) ([]Machine, []Machine, error
 					}
 				}
 				result = VerifyDockerEngineWindows(m, VirshDiskDir)
+				LogPhase(logger, "provision", start, result)
 				machineErrChan <- result
 				wg.Done()
 			}(m)
@@ -353,8 +365,7 @@ func VirshListEnvironments() ([]*Environment, error) {
 func (m *VirshMachine) gatherMachineDetails() error {
 	m.GetIP()
 	// TODO - consider taking the plunge and parsing all the gory XML...
-	cmd := exec.Command("virsh", "vcpucount", m.MachineName, "--current")
-	data, err := cmd.CombinedOutput()
+	data, err := runDriverCommand("virsh", "vcpucount", m.MachineName, "--current")
 	out := strings.TrimSpace(string(data))
 	if err != nil {
 		log.Warnf("Failed to gather CPU count %s: %s: %s", m.MachineName, err, out)
@@ -362,8 +373,7 @@ func (m *VirshMachine) gatherMachineDetails() error {
 		m.CPUCount, err = strconv.Atoi(out)
 	}
 
-	cmd = exec.Command("virsh", "domblklist", m.MachineName)
-	data, err = cmd.CombinedOutput()
+	data, err = runDriverCommand("virsh", "domblklist", m.MachineName)
 	if err != nil {
 		log.Warnf("Failed to gather disk info %s: %s: %s", m.MachineName, err, out)
 	} else {
@@ -389,13 +399,11 @@ func VirshDestroyEnvironment(name string) error {
 		match := re.FindStringSubmatch(line)
 		if match != nil {
 			diskPath := filepath.Join(VirshDiskDir, line+".qcow2") // XXX Potentially fragile
-			cmd := exec.Command("virsh", "destroy", line)
-			out, err := cmd.CombinedOutput()
+			out, err := runDriverCommand("virsh", "destroy", line)
 			if err != nil {
 				log.Warn(string(out))
 			}
-			cmd = exec.Command("virsh", "undefine", "--storage", diskPath, line)
-			out, err = cmd.CombinedOutput()
+			out, err = runDriverCommand("virsh", "undefine", "--storage", diskPath, line)
 			if err != nil {
 				log.Error(string(out))
 				return err
@@ -404,12 +412,33 @@ func VirshDestroyEnvironment(name string) error {
 			// If the disk still exists, nuke it, but ignore errors
 			os.Remove(diskPath)
 
-			log.Infof("Machine %s deleted", line)
+			log.WithFields(log.Fields{
+				FieldCluster: name,
+				FieldMachine: line,
+			}).Info("Machine deleted")
 		}
 	}
 	return nil
 }
 
+// create clones the machine's disk, then defines and starts the VM
+func (m *VirshMachine) create() error {
+	logger := MachineLog(m)
+	start := time.Now()
+	err := m.cloneDisk()
+	LogPhase(logger, "clone", start, err)
+	if err == nil {
+		defined := time.Now()
+		err = m.define()
+		LogPhase(logger, "define", defined, err)
+	}
+	if err == nil {
+		err = m.Start()
+	}
+	LogPhase(logger, "create", start, err)
+	return err
+}
+
 func (m *VirshMachine) cloneDisk() error {
 	dir := path.Dir(m.BaseDisk)
 	linkedCloneName := filepath.Join(dir, m.MachineName+".qcow2")
@@ -448,8 +477,7 @@ func (m *VirshMachine) define() error {
 	}
 	defer os.Remove(defFile)
 
-	cmd := exec.Command("virsh", "define", defFile)
-	data, err := cmd.CombinedOutput()
+	data, err := runDriverCommand("virsh", "define", defFile)
 	out := strings.TrimSpace(string(data))
 	if err != nil {
 		return fmt.Errorf("Failed to create %s: %s: %s", m.MachineName, err, out)
@@ -508,8 +536,7 @@ func (m *VirshMachine) Remove() error {
 		m.Kill()
 	}
 
-	cmd := exec.Command("virsh", "undefine", "--storage", m.DiskPath, m.MachineName)
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("virsh", "undefine", "--storage", m.DiskPath, m.MachineName)
 	if err != nil {
 		log.Error(string(out))
 		return err
@@ -533,8 +560,7 @@ func (m *VirshMachine) RemoveAndPreserveDisk() error {
 		m.Stop()
 	}
 
-	cmd := exec.Command("virsh", "undefine", m.MachineName)
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("virsh", "undefine", m.MachineName)
 	if err != nil {
 		log.Error(string(out))
 		return err
@@ -549,8 +575,28 @@ func (m *VirshMachine) RemoveAndPreserveDisk() error {
 
 // Stop gracefully shuts down the machine
 func (m *VirshMachine) Stop() error {
-	cmd := exec.Command("virsh", "shutdown", m.MachineName)
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("virsh", "shutdown", m.MachineName)
+	if err != nil {
+		log.Error(string(out))
+		return err
+	}
+	return nil
+}
+
+// Pause suspends the virtual machine, keeping its memory state so it can be
+// resumed later
+func (m *VirshMachine) Pause() error {
+	out, err := runDriverCommand("virsh", "suspend", m.MachineName)
+	if err != nil {
+		log.Error(string(out))
+		return err
+	}
+	return nil
+}
+
+// Resume continues a previously paused virtual machine
+func (m *VirshMachine) Resume() error {
+	out, err := runDriverCommand("virsh", "resume", m.MachineName)
 	if err != nil {
 		log.Error(string(out))
 		return err
@@ -561,110 +607,118 @@ func (m *VirshMachine) Stop() error {
 // Kill forcefully stops the virtual machine (likely to corrupt the machine, so
 // do not use this if you intend to start the machine again)
 func (m *VirshMachine) Kill() error {
-	cmd := exec.Command("virsh", "destroy", m.MachineName)
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("virsh", "destroy", m.MachineName)
 	if err != nil {
 		log.Error(string(out))
 		return err
 	}
 
 	// Make sure it's stopped before returning...
-	resChan := make(chan error)
-
-	go func(m *VirshMachine) {
-		for {
-			if !m.IsRunning() {
-				resChan <- nil
-				return
-			}
-			time.Sleep(500 * time.Millisecond)
-		}
-	}(m)
-
-	timer := time.NewTimer(1 * time.Minute) // TODO - make configurable
-	select {
-	case res := <-resChan:
-		log.Debugf("Got %v on resChan", res)
-		return res
-	case <-timer.C:
+	// TODO - make the timeout configurable
+	err = PollTimeout(1*time.Minute, 500*time.Millisecond, func() (bool, error) {
+		return !m.IsRunning(), nil
+	})
+	if err != nil {
 		return fmt.Errorf("Unable to kill docker engine on %s within timeout", m.MachineName)
 	}
+	return nil
+}
+
+// Reboot restarts the machine's OS, returning once it's back up
+func (m *VirshMachine) Reboot() error {
+	return rebootLinux(m)
 }
 
 // Start powers on the VM
 func (m *VirshMachine) Start() error {
-	cmd := exec.Command("virsh", "start", m.MachineName)
-	out, err := cmd.CombinedOutput()
+	out, err := runDriverCommand("virsh", "start", m.MachineName)
 	if err != nil {
 		log.Error(string(out))
 		return err
 	}
-	resChan := make(chan error)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second) // TODO - make configurable
+	defer cancel()
+	logger := MachineLog(m)
+
 	// wait for it to power on (by checking virsh -q domifaddr m.GetName())
-	go func(m *VirshMachine) {
-		log.Debugf("Waiting for IP to appear for %s", m.GetName())
-		m.GetIP()
-		log.Debugf("Machine %s has IP %s", m.GetName(), m.ip)
-
-		// Loop until we can ssh in
-		for {
-			out, err := m.MachineSSH("uptime")
-			if err != nil && strings.Contains(out, "is not recognized as an internal or external command") {
-				log.Debug("Detected windows image booted")
-				// TODO would be nice to give some basic "uptime" info... but that's kinda kludgy in windows...
-				m.isWindows = true
-				break
-			} else if err != nil {
-				//log.Debugf("XXX Failed to ssh to %s: %s: %s", m.GetName(), err, out)
-				time.Sleep(500 * time.Millisecond)
-			} else if strings.TrimSpace(out) == "" {
-				log.Debugf("Got empty output from the other side... trying again...")
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				log.Debugf("%s has been up %s", m.GetName(), out)
-				break
-			}
+	logger.Debug("Waiting for IP to appear")
+	start := time.Now()
+	if m.ip == "" {
+		if err := Poll(ctx, 1*time.Second, m.lookupIP); err != nil {
+			err = fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
+			LogPhase(logger, "boot", start, err)
+			return err
 		}
+	}
+	LogPhase(logger, "boot", start, nil)
+	logger.Debugf("Has IP %s", m.ip)
 
-		resChan <- nil
-	}(m)
-
-	timer := time.NewTimer(60 * time.Second) // TODO - make configurable
-	select {
-	case res := <-resChan:
-		return res
-	case <-timer.C:
-		return fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
+	// Loop until we can ssh in
+	start = time.Now()
+	err = Poll(ctx, 500*time.Millisecond, m.sshReady)
+	if err != nil {
+		err = fmt.Errorf("Unable to verify docker engine on %s within timeout", m.GetName())
 	}
+	LogPhase(logger, "ssh-ready", start, err)
+	return err
+}
+
+// sshReady reports whether the machine has booted far enough to run commands
+// over ssh, noting whether it turned out to be windows
+func (m *VirshMachine) sshReady() (bool, error) {
+	out, err := m.MachineSSH("uptime")
+	if err != nil && strings.Contains(out, "is not recognized as an internal or external command") {
+		log.Debug("Detected windows image booted")
+		// TODO would be nice to give some basic "uptime" info... but that's kinda kludgy in windows...
+		m.isWindows = true
+		return true, nil
+	} else if err != nil {
+		//log.Debugf("XXX Failed to ssh to %s: %s: %s", m.GetName(), err, out)
+		return false, nil
+	} else if strings.TrimSpace(out) == "" {
+		log.Debugf("Got empty output from the other side... trying again...")
+		return false, nil
+	}
+	log.Debugf("%s has been up %s", m.GetName(), out)
+	return true, nil
 }
 
 // Return the public IP of the machine
 func (m *VirshMachine) GetIP() (string, error) {
-	for m.ip == "" { // TODO timeout if this hangs indefinitely...
-		ipRegex := regexp.MustCompile(`ipv4\s+([^/]+)`)
-		cmd := exec.Command("virsh", "-q", "domifaddr", m.GetName())
-		data, err := cmd.CombinedOutput()
-		out := strings.TrimSpace(string(data))
-		if err == nil {
-			lines := strings.Split(string(out), "\n")
-
-			if len(lines) > 0 {
-				matches := ipRegex.FindStringSubmatch(lines[0])
-				if len(matches) > 0 {
-					ip := matches[1]
-					m.ip = ip
-					m.internalip = ip
-					m.dockerHost = fmt.Sprintf("tcp://%s:2376", ip)
-					// TODO validate the IP looks good
-					break
-				}
-			}
-		}
-		time.Sleep(1 * time.Second)
+	if m.ip != "" {
+		return m.ip, nil
+	}
+	// TODO - make the timeout configurable
+	if err := PollTimeout(5*time.Minute, 1*time.Second, m.lookupIP); err != nil {
+		return "", fmt.Errorf("Unable to find the IP of %s within timeout", m.GetName())
 	}
 	return m.ip, nil
 }
 
+// lookupIP reports whether libvirt knows the machine's address yet, recording
+// it if so
+func (m *VirshMachine) lookupIP() (bool, error) {
+	ipRegex := regexp.MustCompile(`ipv4\s+([^/]+)`)
+	data, err := runDriverCommand("virsh", "-q", "domifaddr", m.GetName())
+	out := strings.TrimSpace(string(data))
+	if err != nil {
+		return false, nil
+	}
+	lines := strings.Split(string(out), "\n")
+	if len(lines) > 0 {
+		matches := ipRegex.FindStringSubmatch(lines[0])
+		if len(matches) > 0 {
+			ip := matches[1]
+			m.ip = ip
+			m.internalip = ip
+			m.dockerHost = fmt.Sprintf("tcp://%s:2376", ip)
+			// TODO validate the IP looks good
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Get the internal IP (useful for join operations)
 func (m *VirshMachine) GetInternalIP() (string, error) {
 	return m.internalip, nil
@@ -0,0 +1,268 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Registry holds the metrics of a long-running testkit command and serves
+// them in the Prometheus text format, for labs to scrape testkit and chart it
+// in Grafana. Only what testkit needs is implemented: counters, gauges and
+// histograms, with labels
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	onScrape []func()
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// family is a metric along with all its series, one per set of label values
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is the value of a metric for one set of label values. Histograms
+// use counts, sum and count rather than value
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) add(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+// get returns the series of the label values, creating it if needed. It
+// panics if the number of values doesn't match the labels, which is a bug in
+// the caller
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", f.name, f.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string{}, values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	f *family
+}
+
+// NewCounter adds a counter with the labels
+func (r *Registry) NewCounter(name, help string, labels ...string) Counter {
+	return Counter{r.add(name, help, "counter", nil, labels)}
+}
+
+// Add adds v, which can't be negative, to the series of the label values
+func (c Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can't go down", c.f.name))
+	}
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(values).value += v
+}
+
+// Inc adds 1 to the series of the label values
+func (c Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	f *family
+}
+
+// NewGauge adds a gauge with the labels
+func (r *Registry) NewGauge(name, help string, labels ...string) Gauge {
+	return Gauge{r.add(name, help, "gauge", nil, labels)}
+}
+
+// Set sets the series of the label values to v
+func (g Gauge) Set(v float64, values ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(values).value = v
+}
+
+// Add adds v to the series of the label values
+func (g Gauge) Add(v float64, values ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(values).value += v
+}
+
+// Reset drops all the series, for gauges set from scratch on every scrape
+func (g Gauge) Reset() {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.series = map[string]*series{}
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	f *family
+}
+
+// NewHistogram adds a histogram with the upper bounds of its buckets, in
+// increasing order, and the labels
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) Histogram {
+	return Histogram{r.add(name, help, "histogram", buckets, labels)}
+}
+
+// Observe adds v to the series of the label values
+func (h Histogram) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(values)
+	for i, upper := range h.f.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// OnScrape registers a function to run before the metrics are written, to
+// update the ones that are cheaper to look up than to keep track of
+func (r *Registry) OnScrape(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onScrape = append(r.onScrape, f)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	onScrape := append([]func(){}, r.onScrape...)
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+	for _, f := range onScrape {
+		f()
+	}
+	buf := &bytes.Buffer{}
+	for _, f := range families {
+		f.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.Replace(f.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	keys := []string{}
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labelPairs(f.labels, s.values, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelPairs(f.labels, s.values, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelPairs(f.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labelPairs(f.labels, s.values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labelPairs(f.labels, s.values, "", ""), s.count)
+	}
+}
+
+// labelValueEscaper escapes label values like the text format expects
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats the labels with their values, and the extra one if its
+// name isn't empty
+func labelPairs(labels, values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, label := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, labelValueEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ServeHTTP serves the metrics, for Prometheus to scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := r.WriteTo(w); err != nil {
+		log.Warnf("Failed to write the metrics: %s", err)
+	}
+}
+
+// Serve serves the metrics on /metrics at the address in the background, for
+// the commands that don't serve an API already
+func (r *Registry) Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	go func() {
+		log.Infof("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("Failed to serve the metrics: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,273 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/docker/docker-e2e/testkit/bench"
+)
+
+// Files looked for when a run is given as a directory: the results.json the
+// tests or testkit shard write, and the output of testkit bench
+const (
+	ResultsFile = "results.json"
+	BenchFile   = "bench.json"
+)
+
+// Run is what's compared of a run, either of which may be missing
+type Run struct {
+	Tests map[string]string
+	Bench *bench.Result
+}
+
+// TestChange is a test whose status changed between the runs. Baseline is
+// empty if the test didn't run in the baseline
+type TestChange struct {
+	Name     string `json:"name"`
+	Baseline string `json:"baseline,omitempty"`
+	Current  string `json:"current"`
+}
+
+// MetricChange compares a benchmark metric between the runs, by its mean
+type MetricChange struct {
+	Metric   string  `json:"metric"`
+	Baseline float64 `json:"baseline_mean_ms"`
+	Current  float64 `json:"current_mean_ms"`
+	// Change is how much slower the current run is, 0.1 being 10%
+	Change float64 `json:"change"`
+	// T is Welch's t statistic of the difference, 0 when either run has no
+	// variance to test it against and only the threshold applies
+	T           float64 `json:"t,omitempty"`
+	Significant bool    `json:"significant"`
+}
+
+// Diff is how the current run compares to the baseline. Only NewFailures and
+// the Regressions make it a regression
+type Diff struct {
+	NewFailures []TestChange   `json:"new_failures"`
+	NewFlaky    []TestChange   `json:"new_flaky"`
+	Fixed       []TestChange   `json:"fixed"`
+	Metrics     []MetricChange `json:"metrics"`
+	Regressions []MetricChange `json:"regressions"`
+}
+
+// Regressed returns whether the current run is worse than the baseline
+func (d *Diff) Regressed() bool {
+	return len(d.NewFailures) > 0 || len(d.Regressions) > 0
+}
+
+// Load reads a run from a results.json or bench.json file, or from a
+// directory with either or both of them
+func Load(path string) (*Run, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	run := &Run{}
+	if !info.IsDir() {
+		if err := run.load(path); err != nil {
+			return nil, err
+		}
+		return run, nil
+	}
+	found := false
+	for _, file := range []string{ResultsFile, BenchFile} {
+		err := run.load(filepath.Join(path, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("neither %s nor %s in %s", ResultsFile, BenchFile, path)
+	}
+	return run, nil
+}
+
+// load reads a file into the run, telling the test results from the
+// benchmark results by their fields
+func (r *Run) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if _, ok := fields["tests"]; ok {
+		var results struct {
+			Tests []struct {
+				Name   string `json:"name"`
+				Status string `json:"status"`
+			} `json:"tests"`
+		}
+		if err := json.Unmarshal(data, &results); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		r.Tests = map[string]string{}
+		for _, t := range results.Tests {
+			r.Tests[t.Name] = t.Status
+		}
+		return nil
+	}
+	if _, ok := fields["create_to_converge"]; ok {
+		r.Bench = &bench.Result{}
+		if err := json.Unmarshal(data, r.Bench); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is neither test nor benchmark results", path)
+}
+
+// Compare diffs the current run against the baseline. A metric is a
+// regression when its mean is more than threshold slower, 0.1 being 10%, and
+// Welch's t-test says the slowdown is significant at 95% confidence
+func Compare(baseline, current *Run, threshold float64) (*Diff, error) {
+	if (baseline.Tests == nil) != (current.Tests == nil) || (baseline.Bench == nil) != (current.Bench == nil) {
+		return nil, fmt.Errorf("the runs don't have the same results to compare")
+	}
+	d := &Diff{
+		NewFailures: []TestChange{},
+		NewFlaky:    []TestChange{},
+		Fixed:       []TestChange{},
+		Metrics:     []MetricChange{},
+		Regressions: []MetricChange{},
+	}
+	names := []string{}
+	for name := range current.Tests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		change := TestChange{Name: name, Baseline: baseline.Tests[name], Current: current.Tests[name]}
+		switch {
+		case change.Current == "fail" && change.Baseline != "fail":
+			d.NewFailures = append(d.NewFailures, change)
+		case change.Current == "flaky" && change.Baseline == "pass":
+			d.NewFlaky = append(d.NewFlaky, change)
+		case change.Current == "pass" && change.Baseline == "fail":
+			d.Fixed = append(d.Fixed, change)
+		}
+	}
+
+	if current.Bench == nil {
+		return d, nil
+	}
+	metrics := []metric{
+		{"image_pull", baseline.Bench.ImagePull, current.Bench.ImagePull},
+		{"create_to_converge", baseline.Bench.CreateToConverge, current.Bench.CreateToConverge},
+		{"scale_up", baseline.Bench.ScaleUp, current.Bench.ScaleUp},
+		{"scale_down", baseline.Bench.ScaleDown, current.Bench.ScaleDown},
+		{"lb_request", baseline.Bench.LBRequest, current.Bench.LBRequest},
+	}
+	// the Go benchmarks only report their means, so only the threshold
+	// applies to them
+	goBaseline := map[string]bench.GoBenchmark{}
+	for _, g := range baseline.Bench.GoBenchmarks {
+		goBaseline[g.Name] = g
+	}
+	for _, g := range current.Bench.GoBenchmarks {
+		base, ok := goBaseline[g.Name]
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, metric{g.Name, goStats(base.Iterations, base.NsPerOp), goStats(g.Iterations, g.NsPerOp)})
+		names := []string{}
+		for name := range g.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if ns, ok := base.Metrics[name]; ok {
+				metrics = append(metrics, metric{g.Name + "/" + name, goStats(base.Iterations, ns), goStats(g.Iterations, g.Metrics[name])})
+			}
+		}
+	}
+	for _, m := range metrics {
+		if m.baseline.Samples == 0 || m.current.Samples == 0 {
+			continue
+		}
+		change := compareStats(m.name, m.baseline, m.current, threshold)
+		d.Metrics = append(d.Metrics, change)
+		if change.Significant {
+			d.Regressions = append(d.Regressions, change)
+		}
+	}
+	return d, nil
+}
+
+// metric is a benchmark metric of both runs
+type metric struct {
+	name              string
+	baseline, current bench.Stats
+}
+
+// goStats turns a Go benchmark's mean into stats without a deviation
+func goStats(iterations int, nsPerOp float64) bench.Stats {
+	return bench.Stats{Samples: iterations, Mean: nsPerOp / float64(time.Millisecond)}
+}
+
+// compareStats compares the means of a metric, testing the difference when
+// both runs have variance to test it against
+func compareStats(name string, baseline, current bench.Stats, threshold float64) MetricChange {
+	change := MetricChange{
+		Metric:   name,
+		Baseline: baseline.Mean,
+		Current:  current.Mean,
+	}
+	if baseline.Mean > 0 {
+		change.Change = (current.Mean - baseline.Mean) / baseline.Mean
+	}
+	if change.Change <= threshold {
+		return change
+	}
+	// older baselines don't have a standard deviation, and a single sample
+	// has none
+	if baseline.StdDev == 0 || current.StdDev == 0 || baseline.Samples < 2 || current.Samples < 2 {
+		change.Significant = true
+		return change
+	}
+	vb := baseline.StdDev * baseline.StdDev / float64(baseline.Samples)
+	vc := current.StdDev * current.StdDev / float64(current.Samples)
+	change.T = (current.Mean - baseline.Mean) / math.Sqrt(vb+vc)
+	df := (vb + vc) * (vb + vc) / (vb*vb/float64(baseline.Samples-1) + vc*vc/float64(current.Samples-1))
+	change.Significant = change.T > tCritical(df)
+	return change
+}
+
+// tTable is the one-sided 95% critical value of Student's t distribution for
+// 1 to 30 degrees of freedom
+var tTable = []float64{
+	6.314, 2.920, 2.353, 2.132, 2.015, 1.943, 1.895, 1.860, 1.833, 1.812,
+	1.796, 1.782, 1.771, 1.761, 1.753, 1.746, 1.740, 1.734, 1.729, 1.725,
+	1.721, 1.717, 1.714, 1.711, 1.708, 1.706, 1.703, 1.701, 1.699, 1.697,
+}
+
+// tCritical returns the one-sided 95% critical value for the degrees of
+// freedom, rounded down to be conservative
+func tCritical(df float64) float64 {
+	switch {
+	case df < 1:
+		return tTable[0]
+	case df <= 30:
+		return tTable[int(df)-1]
+	case df <= 40:
+		return tTable[29]
+	case df <= 60:
+		return 1.684
+	case df <= 120:
+		return 1.671
+	}
+	return 1.658
+}
@@ -0,0 +1,374 @@
+package shard
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/soak"
+)
+
+// reportDir is where the shards write their results on their manager
+const reportDir = "/tmp/e2e-shard"
+
+// defaultMinutes is how long a test is assumed to take when there are no
+// timings for it, by whether it's tagged slow
+var defaultMinutes = map[bool]float64{false: 1, true: 10}
+
+// Config describes a sharded run
+type Config struct {
+	Image string `json:"image"`
+	// Suite and Skip are the tags passed to the tests' -suite and -skip
+	Suite string `json:"suite"`
+	Skip  string `json:"skip"`
+	// Retries is passed to the tests' -retries
+	Retries int `json:"retries"`
+	// Timings is the results.json of an earlier run, to balance the shards
+	// by how long their tests took then
+	Timings string `json:"timings,omitempty"`
+	// Output is the directory the merged results go in
+	Output string `json:"-"`
+}
+
+// test is a test to run, with how long it's expected to take
+type test struct {
+	name    string
+	tags    []string
+	minutes float64
+}
+
+// Shard is the part of the run that went to one environment
+type Shard struct {
+	Environment string        `json:"environment"`
+	Tests       []string      `json:"tests"`
+	Estimate    float64       `json:"estimate_minutes"`
+	Duration    time.Duration `json:"duration"`
+	Passed      bool          `json:"passed"`
+	FailedTests []string      `json:"failed_tests,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// Report is the merged results of all the shards, in the shape of the
+// results.json every shard writes, with the shards' own alongside
+type Report struct {
+	Start    time.Time                `json:"start"`
+	Duration float64                  `json:"duration"`
+	Passed   int                      `json:"passed"`
+	Failed   int                      `json:"failed"`
+	Skipped  int                      `json:"skipped"`
+	Flaky    int                      `json:"flaky"`
+	Shards   []*Shard                 `json:"shards"`
+	Tests    []map[string]interface{} `json:"tests"`
+}
+
+// shardResults is the part of a shard's results.json that gets merged
+type shardResults struct {
+	Tests []map[string]interface{} `json:"tests"`
+}
+
+// Run lists the selected tests, splits them across the environments so that
+// every shard takes about as long, runs the shards on the environments at the
+// same time and merges what they report into the output directory
+func Run(envs []*machines.Environment, cfg Config) (*Report, error) {
+	if len(envs) == 0 {
+		return nil, fmt.Errorf("no environment to run the tests on")
+	}
+	tests, err := listTests(envs[0], cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("no test has tags %q without %q", cfg.Suite, cfg.Skip)
+	}
+	if cfg.Timings != "" {
+		if err := loadTimings(cfg.Timings, tests); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &Report{
+		Start:  time.Now(),
+		Shards: split(envs, tests),
+		Tests:  []map[string]interface{}{},
+	}
+	var wg sync.WaitGroup
+	for i, s := range report.Shards {
+		if len(s.Tests) == 0 {
+			s.Passed = true
+			continue
+		}
+		wg.Add(1)
+		go func(env *machines.Environment, s *Shard) {
+			defer wg.Done()
+			if err := runShard(env, s, cfg); err != nil {
+				log.Errorf("Shard on %s: %s", env.StackName, err)
+				s.Error = err.Error()
+			}
+		}(envs[i], s)
+	}
+	wg.Wait()
+	report.Duration = time.Since(report.Start).Seconds()
+
+	for _, s := range report.Shards {
+		if len(s.Tests) == 0 {
+			continue
+		}
+		results, err := readResults(cfg.Output, s.Environment)
+		if err != nil {
+			log.Warnf("No results from the shard on %s: %s", s.Environment, err)
+			continue
+		}
+		for _, t := range results.Tests {
+			if artifact, ok := t["artifact"].(string); ok {
+				t["artifact"] = filepath.Join("shards", s.Environment, artifact)
+			}
+			t["environment"] = s.Environment
+			switch t["status"] {
+			case "pass":
+				report.Passed++
+			case "fail":
+				report.Failed++
+			case "skip":
+				report.Skipped++
+			case "flaky":
+				report.Flaky++
+			}
+			report.Tests = append(report.Tests, t)
+		}
+	}
+	if cfg.Output != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(cfg.Output, "results.json"), data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// testCommand runs the test binary of the image on the environment with the
+// arguments, with its results written to reportDir
+func testCommand(image, cluster string, args ...string) string {
+	command := []string{
+		"docker", "run", "--rm", "--net=host",
+		"-v", "/var/run/docker.sock:/var/run/docker.sock",
+		"-v", reportDir + ":/report", "-e", "E2E_REPORT_DIR=/report",
+	}
+	command = append(command, soak.TraceFlags(cluster)...)
+	command = append(command, image, soak.TestBinary)
+	return strings.Join(append(command, args...), " ")
+}
+
+// listTests asks the test binary on the environment's manager which tests
+// the tags select
+func listTests(env *machines.Environment, cfg Config) ([]*test, error) {
+	manager, err := env.GetManager()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"docker", "run", "--rm", cfg.Image, soak.TestBinary, "-list"}
+	if cfg.Suite != "" {
+		args = append(args, fmt.Sprintf("-suite '%s'", cfg.Suite))
+	}
+	if cfg.Skip != "" {
+		args = append(args, fmt.Sprintf("-skip '%s'", cfg.Skip))
+	}
+	out, err := manager.MachineSSH(strings.Join(args, " "))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the tests on %s: %s: %s", manager.GetName(), err, out)
+	}
+	tests := []*test{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "\t")
+		if !strings.HasPrefix(fields[0], "Test") {
+			continue
+		}
+		t := &test{name: fields[0]}
+		if len(fields) > 1 && fields[1] != "" {
+			t.tags = strings.Split(fields[1], ",")
+		}
+		t.minutes = defaultMinutes[t.hasTag("slow")]
+		tests = append(tests, t)
+	}
+	return tests, nil
+}
+
+// loadTimings sets how long the tests are expected to take from the
+// results.json of an earlier run
+func loadTimings(path string, tests []*test) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var results struct {
+		Tests []struct {
+			Name     string  `json:"name"`
+			Duration float64 `json:"duration"`
+		} `json:"tests"`
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	durations := map[string]float64{}
+	for _, t := range results.Tests {
+		durations[t.Name] = t.Duration
+	}
+	for _, t := range tests {
+		if d, ok := durations[t.name]; ok && d > 0 {
+			t.minutes = d / 60
+		}
+	}
+	return nil
+}
+
+// byMinutes sorts tests longest first
+type byMinutes []*test
+
+func (b byMinutes) Len() int           { return len(b) }
+func (b byMinutes) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byMinutes) Less(i, j int) bool { return b[i].minutes > b[j].minutes }
+
+func (t *test) hasTag(tag string) bool {
+	for _, other := range t.tags {
+		if other == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// split deals the tests out longest first, each to the shard that has the
+// least to do so far. Tests that need Windows nodes only go to environments
+// that have some, if there are any
+func split(envs []*machines.Environment, tests []*test) []*Shard {
+	shards := make([]*Shard, len(envs))
+	windows := map[int]bool{}
+	for i, env := range envs {
+		shards[i] = &Shard{Environment: env.StackName, Tests: []string{}}
+		for _, m := range env.Machines {
+			if m.IsWindows() {
+				windows[i] = true
+			}
+		}
+	}
+	sorted := append(byMinutes{}, tests...)
+	sort.Stable(sorted)
+	for _, t := range sorted {
+		needsWindows := t.hasTag("windows") && len(windows) > 0
+		best := -1
+		for i, s := range shards {
+			if needsWindows && !windows[i] {
+				continue
+			}
+			if best == -1 || s.Estimate < shards[best].Estimate {
+				best = i
+			}
+		}
+		shards[best].Tests = append(shards[best].Tests, t.name)
+		shards[best].Estimate += t.minutes
+	}
+	return shards
+}
+
+// runShard runs the shard's tests on the environment's manager and copies
+// the results it wrote to shards/<environment> in the output directory
+func runShard(env *machines.Environment, s *Shard, cfg Config) error {
+	manager, err := env.GetManager()
+	if err != nil {
+		return err
+	}
+	if out, err := manager.MachineSSH(fmt.Sprintf("sudo rm -rf %s && mkdir -p %s", reportDir, reportDir)); err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	sort.Strings(s.Tests)
+	args := []string{fmt.Sprintf("-test.run '^(%s)$'", strings.Join(s.Tests, "|"))}
+	if cfg.Retries > 0 {
+		args = append(args, fmt.Sprintf("-retries %d", cfg.Retries))
+	}
+	log.Infof("Running %d tests on %s, about %.0f minutes", len(s.Tests), env.StackName, s.Estimate)
+	start := time.Now()
+	out, err := manager.MachineSSH(testCommand(cfg.Image, env.StackName, args...))
+	s.Duration = time.Since(start)
+	s.Passed = err == nil
+	s.FailedTests = soak.FailedTests(out)
+	log.Infof("Shard on %s done in %s, %d tests failed", env.StackName, s.Duration, len(s.FailedTests))
+	if cfg.Output == "" {
+		return nil
+	}
+	dir := filepath.Join(cfg.Output, "shards", env.StackName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "output.log"), []byte(out), 0644); err != nil {
+		return err
+	}
+	data, err := manager.TarHostDir(reportDir)
+	if err != nil {
+		return fmt.Errorf("Failed to copy the results from %s: %s", manager.GetName(), err)
+	}
+	return untar(data, dir)
+}
+
+// readResults reads the results.json the shard on the environment wrote
+func readResults(output, env string) (*shardResults, error) {
+	if output == "" {
+		return nil, fmt.Errorf("no output directory")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(output, "shards", env, "results.json"))
+	if err != nil {
+		return nil, err
+	}
+	results := &shardResults{}
+	if err := json.Unmarshal(data, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// untar extracts the archive into the directory
+func untar(data []byte, dir string) error {
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package soak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/metrics"
+	"github.com/docker/docker-e2e/testkit/trace"
+)
+
+// TestBinary is where the e2e image keeps the compiled test suite
+const TestBinary = "/go/src/github.com/docker/docker-e2e/tests/tests.test"
+
+var failRegex = regexp.MustCompile(`--- FAIL: (\S+)`)
+
+// Config describes a soak run
+type Config struct {
+	Image    string        `json:"image"`
+	Suite    string        `json:"suite"`
+	Duration time.Duration `json:"duration"`
+	Interval time.Duration `json:"interval"`
+	Chaos    bool          `json:"chaos"`
+	// Output, if set, is rewritten with the report after every iteration
+	Output string `json:"-"`
+	// MetricsAddr, if set, is where the progress of the run is served on
+	// /metrics for Prometheus to scrape
+	MetricsAddr string `json:"-"`
+}
+
+// soakMetrics are the metrics of a soak run
+type soakMetrics struct {
+	*metrics.Registry
+	iterations        metrics.Counter
+	iterationDuration metrics.Histogram
+	testFailures      metrics.Counter
+	rss               metrics.Gauge
+	fds               metrics.Gauge
+	goroutines        metrics.Gauge
+}
+
+func newMetrics() *soakMetrics {
+	r := metrics.NewRegistry()
+	m := &soakMetrics{
+		Registry:          r,
+		iterations:        r.NewCounter("testkit_soak_iterations_total", "Iterations of the suites, by result.", "result"),
+		iterationDuration: r.NewHistogram("testkit_soak_iteration_duration_seconds", "How long an iteration of the suites took.", []float64{60, 120, 300, 600, 1200, 1800, 3600, 7200}),
+		testFailures:      r.NewCounter("testkit_soak_test_failures_total", "Failures of every test over the run.", "test"),
+		rss:               r.NewGauge("testkit_soak_dockerd_rss_kilobytes", "Resident memory of dockerd, on Linux machines.", "machine"),
+		fds:               r.NewGauge("testkit_soak_dockerd_fds", "Open file descriptors of dockerd.", "machine"),
+		goroutines:        r.NewGauge("testkit_soak_dockerd_goroutines", "Goroutines of dockerd.", "machine"),
+	}
+	m.iterations.Add(0, "pass")
+	m.iterations.Add(0, "fail")
+	return m
+}
+
+// Iteration records one run of the selected suites
+type Iteration struct {
+	Start       time.Time     `json:"start"`
+	Duration    time.Duration `json:"duration"`
+	Passed      bool          `json:"passed"`
+	FailedTests []string      `json:"failed_tests,omitempty"`
+	Chaos       string        `json:"chaos,omitempty"`
+}
+
+// Sample is a point in time measurement of a daemon's resource usage
+type Sample struct {
+	Time       time.Time `json:"time"`
+	Machine    string    `json:"machine"`
+	RSSKB      int       `json:"rss_kb,omitempty"`
+	Fds        int       `json:"fds"`
+	Goroutines int       `json:"goroutines"`
+}
+
+// Growth is the change in a daemon's resource usage over the whole run
+type Growth struct {
+	RSSKB      int `json:"rss_kb"`
+	Fds        int `json:"fds"`
+	Goroutines int `json:"goroutines"`
+}
+
+// Report accumulates the results of a soak run
+type Report struct {
+	Environment string            `json:"environment"`
+	Config      Config            `json:"config"`
+	Start       time.Time         `json:"start"`
+	Iterations  []Iteration       `json:"iterations"`
+	Failures    map[string]int    `json:"failures"`
+	Samples     []Sample          `json:"samples"`
+	Growth      map[string]Growth `json:"growth"`
+}
+
+func (r *Report) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Run repeatedly runs the suites against the environment until the duration
+// has elapsed
+func Run(env *machines.Environment, cfg Config) (*Report, error) {
+	manager, err := env.GetManager()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{
+		Environment: env.StackName,
+		Config:      cfg,
+		Start:       time.Now(),
+		Iterations:  []Iteration{},
+		Failures:    map[string]int{},
+		Samples:     []Sample{},
+		Growth:      map[string]Growth{},
+	}
+	progress := newMetrics()
+	if cfg.MetricsAddr != "" {
+		progress.Serve(cfg.MetricsAddr)
+	}
+	first := map[string]Sample{}
+	deadline := report.Start.Add(cfg.Duration)
+	for i := 1; time.Now().Before(deadline); i++ {
+		for _, m := range env.Machines {
+			s, err := sample(m)
+			if err != nil {
+				machines.MachineLog(m).Warnf("Failed to sample: %s", err)
+				continue
+			}
+			report.Samples = append(report.Samples, s)
+			if !m.IsWindows() {
+				progress.rss.Set(float64(s.RSSKB), s.Machine)
+			}
+			progress.fds.Set(float64(s.Fds), s.Machine)
+			progress.goroutines.Set(float64(s.Goroutines), s.Machine)
+			if f, ok := first[m.GetName()]; ok {
+				report.Growth[m.GetName()] = Growth{
+					RSSKB:      s.RSSKB - f.RSSKB,
+					Fds:        s.Fds - f.Fds,
+					Goroutines: s.Goroutines - f.Goroutines,
+				}
+			} else {
+				first[m.GetName()] = s
+			}
+		}
+
+		iteration := Iteration{Start: time.Now()}
+		if cfg.Chaos {
+			iteration.Chaos = killRandomTask(env)
+		}
+		log.Infof("Soak iteration %d (%v remaining)", i, deadline.Sub(iteration.Start))
+		out, err := manager.MachineSSH(TestCommand(cfg.Image, cfg.Suite, TraceFlags(env.StackName)...))
+		iteration.Duration = time.Since(iteration.Start)
+		iteration.Passed = err == nil
+		iteration.FailedTests = FailedTests(out)
+		for _, name := range iteration.FailedTests {
+			report.Failures[name]++
+			progress.testFailures.Inc(name)
+		}
+		progress.iterationDuration.Observe(iteration.Duration.Seconds())
+		if iteration.Passed {
+			progress.iterations.Inc("pass")
+		} else {
+			progress.iterations.Inc("fail")
+		}
+		if !iteration.Passed {
+			log.Warnf("Iteration %d failed: %v", i, iteration.FailedTests)
+			log.Debug(out)
+		}
+		report.Iterations = append(report.Iterations, iteration)
+
+		if cfg.Output != "" {
+			if err := report.write(cfg.Output); err != nil {
+				log.Warnf("Failed to write report to %s: %s", cfg.Output, err)
+			}
+		}
+		if time.Now().Add(cfg.Interval).After(deadline) {
+			break
+		}
+		time.Sleep(cfg.Interval)
+	}
+	return report, nil
+}
+
+// TestCommand runs the image's test binary against the local daemon, limited
+// to the tests matching suite if it's set, with the extra docker run flags
+func TestCommand(image, suite string, flags ...string) string {
+	args := []string{
+		"docker", "run", "--rm", "--net=host",
+		"-v", "/var/run/docker.sock:/var/run/docker.sock",
+	}
+	args = append(args, flags...)
+	args = append(args, image, TestBinary, "-test.v")
+	if suite != "" {
+		args = append(args, fmt.Sprintf("-test.run '%s'", suite))
+	}
+	return strings.Join(args, " ")
+}
+
+// TraceFlags returns the docker run flags for the tests to send the spans of
+// every test to the collector, in the trace of the environment, when tracing
+func TraceFlags(cluster string) []string {
+	endpoint := trace.Endpoint()
+	if endpoint == "" {
+		return nil
+	}
+	return []string{
+		"-e", "E2E_TRACE_URL=" + endpoint,
+		"-e", "E2E_TRACE_PARENT=" + trace.Parent(cluster),
+	}
+}
+
+// FailedTests picks the names of the failed tests out of the test binary's
+// output
+func FailedTests(out string) []string {
+	failed := []string{}
+	for _, match := range failRegex.FindAllStringSubmatch(out, -1) {
+		failed = append(failed, match[1])
+	}
+	return failed
+}
+
+// sample gathers the daemon's file descriptor and goroutine counts from the
+// engine, plus its resident memory on linux hosts
+func sample(m machines.Machine) (Sample, error) {
+	s := Sample{Time: time.Now(), Machine: m.GetName()}
+	cli, err := m.GetEngineAPI()
+	if err != nil {
+		return s, err
+	}
+	info, err := cli.Info(context.TODO())
+	if err != nil {
+		return s, err
+	}
+	s.Fds = info.NFd
+	s.Goroutines = info.NGoroutines
+	if !m.IsWindows() {
+		out, err := m.MachineSSH("ps -o rss= -C dockerd")
+		if err != nil {
+			machines.MachineLog(m).Debugf("Failed to get dockerd memory: %s: %s", err, out)
+		} else if rss, err := strconv.Atoi(strings.TrimSpace(out)); err == nil {
+			s.RSSKB = rss
+		}
+	}
+	return s, nil
+}
+
+// killRandomTask kills one swarm task container on a random machine, and
+// returns a description of what was killed
+func killRandomTask(env *machines.Environment) string {
+	m := env.Machines[rand.Intn(len(env.Machines))]
+	cli, err := m.GetEngineAPI()
+	if err != nil {
+		log.Warnf("Chaos: failed to get engine for %s: %s", m.GetName(), err)
+		return ""
+	}
+	args := filters.NewArgs()
+	args.Add("label", "com.docker.swarm.task.id")
+	containers, err := cli.ContainerList(context.TODO(), types.ContainerListOptions{Filters: args})
+	if err != nil || len(containers) == 0 {
+		log.Debugf("Chaos: no tasks to kill on %s", m.GetName())
+		return ""
+	}
+	c := containers[rand.Intn(len(containers))]
+	if err := cli.ContainerKill(context.TODO(), c.ID, "KILL"); err != nil {
+		log.Warnf("Chaos: failed to kill %s on %s: %s", c.ID, m.GetName(), err)
+		return ""
+	}
+	desc := fmt.Sprintf("killed task container %s on %s", c.ID[:12], m.GetName())
+	log.Info("Chaos: " + desc)
+	return desc
+}
@@ -0,0 +1,187 @@
+// Package trace records where the time goes while testkit creates an environment,
+// as spans sent to Jaeger through the Zipkin-compatible endpoint of its
+// collector, e.g. http://jaeger:9411/api/v2/spans. Every environment gets a
+// trace of its own, whose ID comes from its name, so the spans of every
+// command working on it end up together, under a root span covering its
+// creation. Nothing is recorded until SetEndpoint is called
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServiceName is the service the spans are reported under
+const ServiceName = "testkit"
+
+// span is a span in the Zipkin v2 JSON format
+type span struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint endpoint          `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type endpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+var (
+	mu        sync.Mutex
+	collector string
+	pending   []span
+	// clusters holds when the environments being created started, until
+	// their root span is recorded
+	clusters = map[string]time.Time{}
+)
+
+// SetEndpoint sends the spans to the collector at url, or stops recording
+// them if it's empty
+func SetEndpoint(url string) {
+	mu.Lock()
+	defer mu.Unlock()
+	collector = url
+}
+
+// Endpoint returns the URL of the collector, empty if spans aren't being
+// recorded
+func Endpoint() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return collector
+}
+
+// ids returns the trace ID of the environment and the ID of its root span
+func ids(cluster string) (string, string) {
+	sum := sha256.Sum256([]byte("testkit/" + cluster))
+	return hex.EncodeToString(sum[:16]), hex.EncodeToString(sum[16:24])
+}
+
+// Parent returns the trace ID of the environment and the ID of its root span
+// as <trace>-<span>, for the tests run on it to add their spans to its trace
+func Parent(cluster string) string {
+	traceID, rootID := ids(cluster)
+	return traceID + "-" + rootID
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Record records a span of the environment, under its root span, that started
+// at start and ends now. The tags, like the machine, are added to the span,
+// along with the error if it failed
+func Record(cluster, name string, start time.Time, tags map[string]string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if collector == "" || cluster == "" {
+		return
+	}
+	traceID, rootID := ids(cluster)
+	s := span{
+		TraceID:       traceID,
+		ID:            newID(),
+		ParentID:      rootID,
+		Name:          name,
+		Timestamp:     start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(time.Since(start) / time.Microsecond),
+		LocalEndpoint: endpoint{ServiceName},
+		Tags:          map[string]string{"cluster": cluster},
+	}
+	for k, v := range tags {
+		s.Tags[k] = v
+	}
+	if err != nil {
+		s.Tags["error"] = err.Error()
+	}
+	pending = append(pending, s)
+}
+
+// StartCluster starts the root span of an environment being created
+func StartCluster(cluster string, start time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	if collector == "" {
+		return
+	}
+	clusters[cluster] = start
+}
+
+// FinishCluster records the root span of the environment once it has been
+// created. The spans recorded later, e.g. when it's destroyed, still go under
+// it
+func FinishCluster(cluster string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	finishCluster(cluster, err)
+}
+
+func finishCluster(cluster string, err error) {
+	start, ok := clusters[cluster]
+	if !ok {
+		return
+	}
+	delete(clusters, cluster)
+	traceID, rootID := ids(cluster)
+	s := span{
+		TraceID:       traceID,
+		ID:            rootID,
+		Name:          "environment",
+		Timestamp:     start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(time.Since(start) / time.Microsecond),
+		LocalEndpoint: endpoint{ServiceName},
+		Tags:          map[string]string{"cluster": cluster},
+	}
+	if err != nil {
+		s.Tags["error"] = err.Error()
+	}
+	pending = append(pending, s)
+}
+
+// Flush sends the spans recorded so far to the collector. With all set, the
+// root spans of the environments that weren't finished are recorded first,
+// for when the command is exiting
+func Flush(all bool) error {
+	mu.Lock()
+	if all {
+		for cluster := range clusters {
+			finishCluster(cluster, nil)
+		}
+	}
+	spans, url := pending, collector
+	pending = nil
+	mu.Unlock()
+	if url == "" || len(spans) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("sending %d spans to %s failed: %s: %s", len(spans), url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,490 @@
+package upgrade
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+
+	"github.com/docker/docker-e2e/testkit/bench"
+	"github.com/docker/docker-e2e/testkit/machines"
+	"github.com/docker/docker-e2e/testkit/soak"
+)
+
+// Label is applied to every object deployed before the upgrade
+const Label = "testkit-upgrade"
+
+const (
+	networkName       = "upgrade-net"
+	secretName        = "upgrade-secret"
+	replicatedService = "upgrade-replicated"
+	globalService     = "upgrade-global"
+	// mixedService is created and removed again while the cluster runs
+	// both engine versions
+	mixedService = "upgrade-mixed"
+)
+
+// Config describes an upgrade run
+type Config struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Image string `json:"image"`
+	Suite string `json:"suite"`
+	// Timeout bounds every individual converge wait
+	Timeout time.Duration `json:"timeout"`
+}
+
+// NodeUpgrade records the upgrade of a single node
+type NodeUpgrade struct {
+	Name     string        `json:"name"`
+	Manager  bool          `json:"manager"`
+	Before   string        `json:"before"`
+	After    string        `json:"after"`
+	Duration time.Duration `json:"duration"`
+	// MixedVersion is set when the cluster still had nodes on the old
+	// engine after this one was upgraded, and passed the mixed version
+	// checks
+	MixedVersion bool `json:"mixed_version"`
+}
+
+// Result is the outcome of an upgrade run
+type Result struct {
+	Environment string        `json:"environment"`
+	Config      Config        `json:"config"`
+	Nodes       []NodeUpgrade `json:"nodes"`
+	SuitesPass  bool          `json:"suites_pass"`
+	FailedTests []string      `json:"failed_tests,omitempty"`
+	SuiteOutput string        `json:"suite_output,omitempty"`
+}
+
+// Run deploys representative workloads to a swarm running the old engine,
+// upgrades the nodes one at a time, then checks that the workloads survived
+// and runs the verification suites
+func Run(env *machines.Environment, cfg Config) (*Result, error) {
+	res := &Result{Environment: env.StackName, Config: cfg, Nodes: []NodeUpgrade{}}
+	manager, err := env.GetManager()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := manager.GetEngineAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Deploying workloads to %s", env.StackName)
+	if err := deploy(cli, len(env.Machines), cfg); err != nil {
+		return nil, fmt.Errorf("failed to deploy workloads: %s", err)
+	}
+	if err := verify(cli, len(env.Machines), cfg); err != nil {
+		return nil, fmt.Errorf("workloads unhealthy before the upgrade: %s", err)
+	}
+	store, err := captureStore(cli)
+	if err != nil {
+		return nil, err
+	}
+
+	// Managers go first, so the control plane is never older than the workers
+	ordered := []machines.Machine{}
+	workers := []machines.Machine{}
+	for _, m := range env.Machines {
+		info, err := getNode(cli, m)
+		if err != nil {
+			return nil, err
+		}
+		if info.Spec.Role == swarm.NodeRoleManager {
+			ordered = append(ordered, m)
+		} else {
+			workers = append(workers, m)
+		}
+	}
+	ordered = append(ordered, workers...)
+
+	for _, m := range ordered {
+		node, err := upgradeNode(manager, m, cfg)
+		if err != nil {
+			return nil, err
+		}
+		// The manager's daemon may have just been restarted
+		if cli, err = manager.GetEngineAPI(); err != nil {
+			return nil, err
+		}
+		if err := verify(cli, len(env.Machines), cfg); err != nil {
+			return nil, fmt.Errorf("workloads unhealthy after upgrading %s: %s", m.GetName(), err)
+		}
+		if err := checkStore(cli, store); err != nil {
+			return nil, fmt.Errorf("swarm state changed after upgrading %s: %s", m.GetName(), err)
+		}
+		mixed, err := mixedVersions(cli)
+		if err != nil {
+			return nil, err
+		}
+		if mixed {
+			if err := mixedVersionCheck(cli, len(env.Machines), cfg); err != nil {
+				return nil, fmt.Errorf("mixed version cluster broken after upgrading %s: %s", m.GetName(), err)
+			}
+			node.MixedVersion = true
+		}
+		res.Nodes = append(res.Nodes, node)
+	}
+
+	log.Infof("Running verification suites on %s", manager.GetName())
+	out, err := manager.MachineSSH(soak.TestCommand(cfg.Image, cfg.Suite, soak.TraceFlags(env.StackName)...))
+	res.SuitesPass = err == nil
+	res.FailedTests = soak.FailedTests(out)
+	if !res.SuitesPass {
+		res.SuiteOutput = out
+	}
+
+	if err := cleanup(cli); err != nil {
+		log.Warnf("Failed to clean up workloads: %s", err)
+	}
+	return res, nil
+}
+
+func deploy(cli *client.Client, nodes int, cfg Config) error {
+	// Don't trip over a previous aborted run
+	if err := cleanup(cli); err != nil {
+		return err
+	}
+	labels := map[string]string{Label: "true"}
+	_, err := cli.NetworkCreate(context.TODO(), networkName, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "overlay",
+		Attachable:     true,
+		Labels:         labels,
+	})
+	if err != nil {
+		return err
+	}
+	secret, err := cli.SecretCreate(context.TODO(), swarm.SecretSpec{
+		Annotations: swarm.Annotations{Name: secretName, Labels: labels},
+		Data:        []byte("survives the upgrade"),
+	})
+	if err != nil {
+		return err
+	}
+
+	replicas := uint64(nodes)
+	specs := []swarm.ServiceSpec{
+		serviceSpec(replicatedService, cfg.Image, secret.ID, swarm.ServiceMode{
+			Replicated: &swarm.ReplicatedService{Replicas: &replicas},
+		}),
+		serviceSpec(globalService, cfg.Image, secret.ID, swarm.ServiceMode{
+			Global: &swarm.GlobalService{},
+		}),
+	}
+	for _, spec := range specs {
+		if _, err := cli.ServiceCreate(context.TODO(), spec, types.ServiceCreateOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serviceSpec(name, image, secretID string, mode swarm.ServiceMode) swarm.ServiceSpec {
+	spec := swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name:   name,
+			Labels: map[string]string{Label: "true"},
+		},
+		TaskTemplate: swarm.TaskSpec{
+			ContainerSpec: swarm.ContainerSpec{
+				Image:   image,
+				Command: []string{"util", "test-server"},
+				Secrets: []*swarm.SecretReference{
+					{
+						SecretID:   secretID,
+						SecretName: secretName,
+						File: &swarm.SecretReferenceFileTarget{
+							Name: secretName,
+							UID:  "0",
+							GID:  "0",
+							Mode: 0444,
+						},
+					},
+				},
+			},
+			Networks: []swarm.NetworkAttachmentConfig{{Target: networkName}},
+		},
+		Mode: mode,
+	}
+	if mode.Replicated != nil {
+		spec.EndpointSpec = &swarm.EndpointSpec{
+			Ports: []swarm.PortConfig{
+				{
+					Protocol:   swarm.PortConfigProtocolTCP,
+					TargetPort: 80,
+				},
+			},
+		}
+	}
+	return spec
+}
+
+// verify checks that everything deploy created is still present and that
+// both services have all their tasks running
+func verify(cli *client.Client, nodes int, cfg Config) error {
+	if _, err := cli.NetworkInspect(context.TODO(), networkName, false); err != nil {
+		return err
+	}
+	if _, _, err := cli.SecretInspectWithRaw(context.TODO(), secretName); err != nil {
+		return err
+	}
+	for _, name := range []string{replicatedService, globalService} {
+		service, _, err := cli.ServiceInspectWithRaw(context.TODO(), name, types.ServiceInspectOptions{})
+		if err != nil {
+			return err
+		}
+		if err := bench.WaitForReplicas(cli, service.ID, uint64(nodes), cfg.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeState identifies everything deploy put in the raft store, so that
+// objects lost or recreated during the upgrade show up as changed IDs
+type storeState struct {
+	ClusterID string
+	Objects   map[string]string
+}
+
+func captureStore(cli *client.Client) (storeState, error) {
+	state := storeState{Objects: map[string]string{}}
+	sw, err := cli.SwarmInspect(context.TODO())
+	if err != nil {
+		return state, err
+	}
+	state.ClusterID = sw.ID
+	nw, err := cli.NetworkInspect(context.TODO(), networkName, false)
+	if err != nil {
+		return state, err
+	}
+	state.Objects["network/"+networkName] = nw.ID
+	secret, _, err := cli.SecretInspectWithRaw(context.TODO(), secretName)
+	if err != nil {
+		return state, err
+	}
+	state.Objects["secret/"+secretName] = fmt.Sprintf("%s@%d", secret.ID, secret.Version.Index)
+	for _, name := range []string{replicatedService, globalService} {
+		service, _, err := cli.ServiceInspectWithRaw(context.TODO(), name, types.ServiceInspectOptions{})
+		if err != nil {
+			return state, err
+		}
+		state.Objects["service/"+name] = fmt.Sprintf("%s@%d", service.ID, service.Version.Index)
+	}
+	return state, nil
+}
+
+// checkStore compares the store against the state captured before the upgrade
+func checkStore(cli *client.Client, before storeState) error {
+	after, err := captureStore(cli)
+	if err != nil {
+		return err
+	}
+	if after.ClusterID != before.ClusterID {
+		return fmt.Errorf("cluster ID changed from %s to %s", before.ClusterID, after.ClusterID)
+	}
+	for key, id := range before.Objects {
+		if after.Objects[key] != id {
+			return fmt.Errorf("%s changed from %s to %s", key, id, after.Objects[key])
+		}
+	}
+	return nil
+}
+
+// mixedVersions reports whether the ready nodes are running more than one
+// engine version
+func mixedVersions(cli *client.Client) (bool, error) {
+	nodes, err := cli.NodeList(context.TODO(), types.NodeListOptions{})
+	if err != nil {
+		return false, err
+	}
+	versions := map[string]bool{}
+	for _, node := range nodes {
+		if node.Status.State == swarm.NodeStateReady {
+			versions[node.Description.Engine.EngineVersion] = true
+		}
+	}
+	return len(versions) > 1, nil
+}
+
+// mixedVersionCheck makes sure the control plane still works across engine
+// versions: every manager is reachable under a single leader, and a new
+// service using the existing network and secret can be scheduled on nodes of
+// both versions and removed again
+func mixedVersionCheck(cli *client.Client, nodes int, cfg Config) error {
+	all, err := cli.NodeList(context.TODO(), types.NodeListOptions{})
+	if err != nil {
+		return err
+	}
+	leaders := 0
+	for _, node := range all {
+		if node.ManagerStatus == nil {
+			continue
+		}
+		if node.ManagerStatus.Reachability != swarm.ReachabilityReachable {
+			return fmt.Errorf("manager %s is %s", node.Description.Hostname, node.ManagerStatus.Reachability)
+		}
+		if node.ManagerStatus.Leader {
+			leaders++
+		}
+	}
+	if leaders != 1 {
+		return fmt.Errorf("found %d leaders", leaders)
+	}
+
+	secret, _, err := cli.SecretInspectWithRaw(context.TODO(), secretName)
+	if err != nil {
+		return err
+	}
+	spec := serviceSpec(mixedService, cfg.Image, secret.ID, swarm.ServiceMode{
+		Global: &swarm.GlobalService{},
+	})
+	service, err := cli.ServiceCreate(context.TODO(), spec, types.ServiceCreateOptions{})
+	if err != nil {
+		return err
+	}
+	if err := bench.WaitForReplicas(cli, service.ID, uint64(nodes), cfg.Timeout); err != nil {
+		cli.ServiceRemove(context.TODO(), service.ID)
+		return err
+	}
+	if err := cli.ServiceRemove(context.TODO(), service.ID); err != nil {
+		return err
+	}
+	return bench.WaitForReplicas(cli, service.ID, 0, cfg.Timeout)
+}
+
+func cleanup(cli *client.Client) error {
+	args := filters.NewArgs()
+	args.Add("label", Label)
+	services, err := cli.ServiceList(context.TODO(), types.ServiceListOptions{Filters: args})
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if err := cli.ServiceRemove(context.TODO(), service.ID); err != nil {
+			return err
+		}
+	}
+	// Wait for the tasks to go away, otherwise the secret and network are
+	// still in use
+	for _, service := range services {
+		if err := bench.WaitForReplicas(cli, service.ID, 0, time.Minute); err != nil {
+			return err
+		}
+	}
+	secrets, err := cli.SecretList(context.TODO(), types.SecretListOptions{Filters: args})
+	if err != nil {
+		return err
+	}
+	for _, secret := range secrets {
+		if err := cli.SecretRemove(context.TODO(), secret.ID); err != nil {
+			return err
+		}
+	}
+	networks, err := cli.NetworkList(context.TODO(), types.NetworkListOptions{Filters: args})
+	if err != nil {
+		return err
+	}
+	for _, network := range networks {
+		if err := cli.NetworkRemove(context.TODO(), network.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNode finds the swarm node backed by the machine, relying on the
+// provisioner naming hosts after their machines
+func getNode(cli *client.Client, m machines.Machine) (swarm.Node, error) {
+	nodes, err := cli.NodeList(context.TODO(), types.NodeListOptions{})
+	if err != nil {
+		return swarm.Node{}, err
+	}
+	for _, node := range nodes {
+		if node.Description.Hostname == m.GetName() {
+			return node, nil
+		}
+	}
+	return swarm.Node{}, fmt.Errorf("no swarm node found for machine %s", m.GetName())
+}
+
+func setAvailability(manager, m machines.Machine, availability swarm.NodeAvailability) error {
+	cli, err := manager.GetEngineAPI()
+	if err != nil {
+		return err
+	}
+	node, err := getNode(cli, m)
+	if err != nil {
+		return err
+	}
+	node.Spec.Availability = availability
+	return cli.NodeUpdate(context.TODO(), node.ID, node.Version, node.Spec)
+}
+
+// upgradeNode drains the node, upgrades its engine and puts it back into
+// service
+func upgradeNode(manager, m machines.Machine, cfg Config) (NodeUpgrade, error) {
+	start := time.Now()
+	res := NodeUpgrade{Name: m.GetName()}
+	cli, err := manager.GetEngineAPI()
+	if err != nil {
+		return res, err
+	}
+	node, err := getNode(cli, m)
+	if err != nil {
+		return res, err
+	}
+	res.Manager = node.Spec.Role == swarm.NodeRoleManager
+	res.Before = node.Description.Engine.EngineVersion
+
+	log.Infof("Upgrading %s from %s to %s", m.GetName(), res.Before, cfg.To)
+	if err := setAvailability(manager, m, swarm.NodeAvailabilityDrain); err != nil {
+		return res, fmt.Errorf("failed to drain %s: %s", m.GetName(), err)
+	}
+	if err := machines.UpgradeDockerEngine(m, cfg.To); err != nil {
+		return res, err
+	}
+	if err := waitForReady(manager, m, cfg.Timeout); err != nil {
+		return res, err
+	}
+	if err := setAvailability(manager, m, swarm.NodeAvailabilityActive); err != nil {
+		return res, fmt.Errorf("failed to reactivate %s: %s", m.GetName(), err)
+	}
+
+	if cli, err = manager.GetEngineAPI(); err != nil {
+		return res, err
+	}
+	if node, err = getNode(cli, m); err != nil {
+		return res, err
+	}
+	res.After = node.Description.Engine.EngineVersion
+	res.Duration = time.Since(start)
+	return res, nil
+}
+
+// waitForReady polls until the swarm sees the node as ready again
+func waitForReady(manager, m machines.Machine, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		cli, err := manager.GetEngineAPI()
+		if err != nil {
+			lastErr = err
+		} else if node, err := getNode(cli, m); err != nil {
+			lastErr = err
+		} else if node.Status.State == swarm.NodeStateReady {
+			return nil
+		} else {
+			lastErr = fmt.Errorf("node is %s", node.Status.State)
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%s did not rejoin the swarm within %v: %s", m.GetName(), timeout, lastErr)
+}
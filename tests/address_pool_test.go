@@ -0,0 +1,165 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/client"
+)
+
+const (
+	// daemonJSONPath is where the engines on the machines read their config
+	daemonJSONPath = "/etc/docker/daemon.json"
+	// addressPoolBase and addressPoolSize make up the default address pool
+	// the engines are configured with, small subnets so many fit
+	addressPoolBase = "10.251.0.0/16"
+	addressPoolSize = 26
+	// addressPoolNetworks is how many networks are created on every node
+	addressPoolNetworks = 20
+)
+
+// restartEngine restarts the engine on the machine, and waits for its node to
+// be back in the cluster
+func restartEngine(ctx context.Context, cli *client.Client, m *Machines, machine, nodeID string) error {
+	out, err := m.Run(machine, "sudo systemctl restart docker")
+	if err != nil {
+		return fmt.Errorf("restarting the engine on %s: %s: %s", machine, err, out)
+	}
+	ctx, cancel := WithTimeout(ctx, recoveryWindow)
+	defer cancel()
+	return WaitForConvergeBackoff(ctx, DefaultBackoff, nodeReadyCheck(ctx, cli, nodeID))
+}
+
+// setDaemonConfig sets the key in the daemon.json of the machine, returning
+// the file as it was so that it can be put back
+func setDaemonConfig(m *Machines, machine, key string, value interface{}) ([]byte, error) {
+	out, err := m.Run(machine, fmt.Sprintf("sudo cat %s 2>/dev/null || true", daemonJSONPath))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, out)
+	}
+	original := []byte(out)
+	config := map[string]interface{}{}
+	if strings.TrimSpace(out) != "" {
+		if err := json.Unmarshal(original, &config); err != nil {
+			return nil, fmt.Errorf("parsing %s on %s: %s", daemonJSONPath, machine, err)
+		}
+	}
+	config[key] = value
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return original, m.WriteFile(machine, daemonJSONPath, data)
+}
+
+// localNetworkSubnets returns the subnets of every network the engine on the
+// machine has, keyed by network name
+func localNetworkSubnets(m *Machines, machine string) (map[string][]string, error) {
+	out, err := m.Run(machine, "sudo docker network inspect --format '{{.Name}}{{range .IPAM.Config}} {{.Subnet}}{{end}}' $(sudo docker network ls -q)")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, out)
+	}
+	subnets := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		subnets[fields[0]] = fields[1:]
+	}
+	return subnets, nil
+}
+
+// TestDefaultAddressPools configures a default address pool in the daemon.json
+// of every node but the local one, creates networks without a subnet on each
+// of them, and checks the subnets all come out of the pool at its size,
+// without overlapping each other or any other network on the node
+func TestDefaultAddressPools(t *testing.T) {
+	name := "TestDefaultAddressPools"
+	testContext, cancel := NewTestContext(name, 20*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CaptureFailure(t, cli, name)
+	machines := GetMachines(t)
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	_, pool, err := net.ParseCIDR(addressPoolBase)
+	require.NoError(t, err)
+
+	// restarting the local engine would take the tests down with it
+	nodes, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	hosts := map[string]string{}
+	for _, node := range nodes {
+		if node.ID != info.Swarm.NodeID {
+			hosts[node.ID] = node.Description.Hostname
+		}
+	}
+	if len(hosts) == 0 {
+		t.Skip("no linux node other than the local one")
+	}
+
+	pools := []map[string]interface{}{{"base": addressPoolBase, "size": addressPoolSize}}
+	for id, host := range hosts {
+		original, err := setDaemonConfig(machines, host, "default-address-pools", pools)
+		require.NoError(t, err)
+		defer func(id, host string) {
+			if err := machines.WriteFile(host, daemonJSONPath, original); err != nil {
+				t.Logf("Failed to restore %s on %s: %s", daemonJSONPath, host, err)
+				return
+			}
+			if err := restartEngine(context.Background(), cli, machines, host, id); err != nil {
+				t.Log(err)
+			}
+		}(id, host)
+		// one at a time, so the managers keep quorum
+		require.NoError(t, restartEngine(testContext, cli, machines, host, id))
+	}
+
+	prefix := getUniqueName(name)
+	for _, host := range hosts {
+		defer machines.Run(host, fmt.Sprintf("sudo docker network ls -q --filter name=%s | xargs -r sudo docker network rm", prefix))
+		commands := []string{}
+		for i := 0; i < addressPoolNetworks; i++ {
+			commands = append(commands, fmt.Sprintf("sudo docker network create %s-%d", prefix, i))
+		}
+		out, err := machines.Run(host, commands...)
+		require.NoError(t, err, "creating networks on %s: %s", host, out)
+
+		subnets, err := localNetworkSubnets(machines, host)
+		require.NoError(t, err)
+		nets := map[string]*net.IPNet{}
+		created := 0
+		for nwName, cidrs := range subnets {
+			for _, cidr := range cidrs {
+				_, subnet, err := net.ParseCIDR(cidr)
+				require.NoError(t, err, "network %s on %s", nwName, host)
+				for other, otherNet := range nets {
+					require.False(t, subnet.Contains(otherNet.IP) || otherNet.Contains(subnet.IP),
+						"%s of %s overlaps %s of %s on %s", subnet, nwName, otherNet, other, host)
+				}
+				nets[nwName+" "+cidr] = subnet
+				if !strings.HasPrefix(nwName, prefix) {
+					continue
+				}
+				created++
+				ones, _ := subnet.Mask.Size()
+				require.True(t, pool.Contains(subnet.IP), "%s of %s on %s isn't from %s", subnet, nwName, host, addressPoolBase)
+				require.Equal(t, addressPoolSize, ones, "%s of %s on %s isn't a /%d", subnet, nwName, host, addressPoolSize)
+			}
+		}
+		require.Equal(t, addressPoolNetworks, created, "networks with a subnet on %s", host)
+		t.Logf("%s allocated %d subnets out of %s", host, created, addressPoolBase)
+	}
+}
@@ -0,0 +1,275 @@
+package dockere2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// engineLogLines is how much of the engine log of every machine is
+	// captured
+	engineLogLines = 500
+	// engineExcerptLines is how much of the engine log of a node a failed
+	// wait shows at most, the last lines of the wait
+	engineExcerptLines = 100
+)
+
+// artifactDir returns the directory the artifacts of the test go in, under the
+// report directory
+func artifactDir(test string) string {
+	return filepath.Join(os.Getenv(ReportDirEnv), "artifacts", artifactName(test))
+}
+
+// CaptureFailure saves the state of the cluster as the test sees it when it
+// has failed, so that it can be looked into after the run: the test's services
+// and all of their tasks, the nodes, the networks and, when machine control is
+// available, the tail of every engine's log. It only does anything when the
+// results are being written, see ReportDirEnv.
+//
+// Tests defer it right after their cleanup, so that it runs before it, with
+// name being both the test name and the label of the test's services:
+//
+//	defer CleanTestServices(testContext, cli, name)
+//	defer CaptureFailure(t, cli, name)
+func CaptureFailure(t *testing.T, cli *client.Client, name string) {
+	if !t.Failed() || os.Getenv(ReportDirEnv) == "" {
+		return
+	}
+	// the test's own context may be what ran out
+	ctx, cancel := WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	dir := artifactDir(name)
+	if err := os.MkdirAll(filepath.Join(dir, "engine"), 0755); err != nil {
+		t.Logf("Not capturing artifacts: %s", err)
+		return
+	}
+	save := func(file string, v interface{}) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, file), data, 0644)
+		}
+		if err != nil {
+			t.Logf("Failed to save %s: %s", file, err)
+		}
+	}
+
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{Filters: GetTestFilter(name)})
+	if err != nil {
+		t.Logf("Failed to list the services: %s", err)
+	}
+	save("services.json", services)
+	tasks := map[string][]swarm.Task{}
+	for _, service := range services {
+		f := filters.NewArgs()
+		f.Add("service", service.ID)
+		list, err := cli.TaskList(ctx, types.TaskListOptions{Filters: f})
+		if err != nil {
+			t.Logf("Failed to list the tasks of %s: %s", service.Spec.Name, err)
+			continue
+		}
+		tasks[service.Spec.Name] = list
+	}
+	save("tasks.json", tasks)
+
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		t.Logf("Failed to list the nodes: %s", err)
+	}
+	save("nodes.json", nodes)
+
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		t.Logf("Failed to list the networks: %s", err)
+	}
+	inspected := []types.NetworkResource{}
+	for _, nw := range networks {
+		full, err := cli.NetworkInspect(ctx, nw.ID, false)
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		inspected = append(inspected, full)
+	}
+	save("networks.json", inspected)
+
+	m := LookupMachines()
+	if m == nil {
+		return
+	}
+	for _, node := range nodes {
+		host := node.Description.Hostname
+		out := engineLog(m, node, time.Time{}, time.Time{}, engineLogLines)
+		if err := ioutil.WriteFile(filepath.Join(dir, "engine", host+".log"), []byte(out), 0644); err != nil {
+			t.Logf("Failed to save the engine log of %s: %s", host, err)
+		}
+	}
+}
+
+// engineLog returns the last lines of the engine log of the node, only from
+// between since and until if they're set, with the error if it couldn't all
+// be read
+func engineLog(m *Machines, node swarm.Node, since, until time.Time, lines int) string {
+	command := fmt.Sprintf("sudo journalctl -u docker --no-pager -n %d", lines)
+	if !since.IsZero() {
+		// the hosts may not be in our time zone, epoch seconds don't care
+		command += fmt.Sprintf(" --since @%d --until @%d", since.Unix(), until.Unix()+1)
+	}
+	if node.Description.Platform.OS == "windows" {
+		window := ""
+		if !since.IsZero() {
+			window = fmt.Sprintf(" -After ([DateTime]::Parse('%s')) -Before ([DateTime]::Parse('%s'))", since.UTC().Format(time.RFC3339), until.Add(time.Second).UTC().Format(time.RFC3339))
+		}
+		command = fmt.Sprintf("powershell -Command \"Get-EventLog -LogName Application -Source docker -Newest %d%s | Format-List\"", lines, window)
+	}
+	out, err := m.Run(node.Description.Hostname, command)
+	if err != nil {
+		out = fmt.Sprintf("%s\n%s", out, err)
+	}
+	return out
+}
+
+// involvedNodes returns the nodes the tasks of the services the failed wait
+// was about were assigned to
+func (e *ConvergeError) involvedNodes(ctx context.Context) []swarm.Node {
+	nodes := []swarm.Node{}
+	seen := map[string]bool{}
+	for serviceID, cli := range e.services {
+		f := filters.NewArgs()
+		f.Add("service", serviceID)
+		tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: f})
+		if err != nil {
+			Logger(ctx).WithError(err).Warn("failed to list the tasks of a failed wait")
+			continue
+		}
+		for _, task := range tasks {
+			// tasks that were never scheduled have no node
+			if task.NodeID == "" || seen[task.NodeID] {
+				continue
+			}
+			seen[task.NodeID] = true
+			node, _, err := cli.NodeInspectWithRaw(ctx, task.NodeID)
+			if err != nil {
+				Logger(ctx).WithError(err).Warn("failed to inspect a node of a failed wait")
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// diagnose gathers what can tell why the wait that started at since failed
+// from the nodes it was about: their engine logs during the wait, when machine
+// control is available, and if it timed out the goroutine stacks of their
+// engines, as artifacts of the test ctx belongs to when the results are being
+// written
+func (e *ConvergeError) diagnose(ctx context.Context, since time.Time) {
+	if len(e.services) == 0 {
+		return
+	}
+	test, _ := ctx.Value(testNameKey{}).(string)
+	// a wait the test aborted itself isn't stuck
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	m := LookupMachines()
+	until := time.Now()
+	// the wait's own context is what ran out
+	ctx, cancel := WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	nodes := e.involvedNodes(ctx)
+	if m != nil {
+		e.EngineLogs = map[string]string{}
+		for _, node := range nodes {
+			e.EngineLogs[node.Description.Hostname] = engineLog(m, node, since, until, engineExcerptLines)
+		}
+	}
+	if timedOut && test != "" && os.Getenv(ReportDirEnv) != "" {
+		e.StackDumps = captureStacks(ctx, m, test, nodes, since)
+	}
+}
+
+// captureStacks saves the goroutine stacks of the nodes' engines in the
+// stacks directory of the test's artifacts, and returns the files. They're
+// read from the engine's debug endpoint, which needs the engine in debug
+// mode, or with machine control by having a Linux engine dump them on
+// SIGUSR1. since tells the dumps of the test's failed waits apart
+func captureStacks(ctx context.Context, m *Machines, test string, nodes []swarm.Node, since time.Time) []string {
+	dir := filepath.Join(artifactDir(test), "stacks")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		Logger(ctx).WithError(err).Warn("not capturing the engine stacks")
+		return nil
+	}
+	files := []string{}
+	for _, node := range nodes {
+		host := node.Description.Hostname
+		stacks, err := engineStacks(ctx, node)
+		if err != nil && m != nil && node.Description.Platform.OS == "linux" {
+			Logger(ctx).WithField("node", host).WithError(err).Debug("no stacks from the debug endpoint, signaling the engine")
+			stacks, err = signalStacks(m, node)
+		}
+		if err != nil {
+			Logger(ctx).WithField("node", host).WithError(err).Warn("failed to capture the engine stacks")
+			continue
+		}
+		file := filepath.Join(dir, fmt.Sprintf("%s-%d.txt", host, since.Unix()))
+		if err := ioutil.WriteFile(file, []byte(stacks), 0644); err != nil {
+			Logger(ctx).WithField("node", host).WithError(err).Warn("failed to save the engine stacks")
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// engineStacks reads the goroutine stacks of the node's engine from its debug
+// endpoint
+func engineStacks(ctx context.Context, node swarm.Node) (string, error) {
+	httpClient, err := nodeHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s:2376/debug/pprof/goroutine?debug=2", node.Status.Addr), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("debug endpoint answered %s, is the engine in debug mode?", resp.Status)
+	}
+	return string(body), nil
+}
+
+// signalStacks has the node's engine dump its goroutine stacks with SIGUSR1
+// and reads the dump, which the engine writes to its run directory
+func signalStacks(m *Machines, node swarm.Node) (string, error) {
+	host := node.Description.Hostname
+	if out, err := m.Run(host, "sudo pkill -USR1 -x dockerd"); err != nil {
+		return "", fmt.Errorf("signaling the engine: %s: %s", err, out)
+	}
+	// the engine writes the dump in the background
+	time.Sleep(2 * time.Second)
+	out, err := m.Run(host, "sudo sh -c 'cat \"$(ls -t /var/run/docker/goroutine-stacks-*.log | head -n 1)\"'")
+	if err != nil {
+		return "", fmt.Errorf("reading the dump: %s: %s", err, out)
+	}
+	return out, nil
+}
@@ -0,0 +1,305 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// setAutolock turns manager autolock on or off
+func setAutolock(ctx context.Context, cli *client.Client, enabled bool, flags swarm.UpdateFlags) error {
+	sw, err := cli.SwarmInspect(ctx)
+	if err != nil {
+		return err
+	}
+	sw.Spec.EncryptionConfig.AutoLockManagers = enabled
+	return cli.SwarmUpdate(ctx, sw.Version, sw.Spec, flags)
+}
+
+// localNodeState returns the swarm state the engine on machine reports for
+// itself, e.g. "active" or "locked"
+func localNodeState(m *Machines, machine string) (string, error) {
+	out, err := m.Run(machine, "sudo docker info --format '{{.Swarm.LocalNodeState}}'")
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, out)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// restartLocked restarts the engine on machine and waits for it to come back
+// locked
+func restartLocked(t *testing.T, ctx context.Context, m *Machines, machine string) {
+	out, err := m.Run(machine, "sudo systemctl restart docker")
+	require.NoError(t, err, out)
+	ctx, cancel := WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		state, err := localNodeState(m, machine)
+		if err != nil {
+			return err
+		}
+		if state != string(swarm.LocalNodeStateLocked) {
+			return fmt.Errorf("%s is %s", machine, state)
+		}
+		return nil
+	})
+	require.NoError(t, err, "manager should be locked after a restart")
+}
+
+// unlock feeds key to `docker swarm unlock` on machine
+func unlock(m *Machines, machine, key string) error {
+	out, err := m.Run(machine, fmt.Sprintf("echo %s | sudo docker swarm unlock", key))
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, out)
+	}
+	return nil
+}
+
+// TestSwarmAutolock enables autolock, restarts another manager and checks it
+// stays locked until it's given the unlock key, then rotates the key and
+// checks only the new one is accepted
+func TestSwarmAutolock(t *testing.T) {
+	testContext, cancel := NewTestContext("TestSwarmAutolock", 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CaptureFailure(t, cli, "TestSwarmAutolock")
+	machines := GetMachines(t)
+
+	managers, self, err := GetManagers(testContext, cli)
+	require.NoError(t, err)
+	if len(managers) < 3 {
+		t.Skipf("restarting a manager needs at least 3 managers to keep quorum, the cluster has %d", len(managers))
+	}
+	target := ""
+	for _, node := range managers {
+		if node.Description.Hostname != self {
+			target = node.Description.Hostname
+			break
+		}
+	}
+
+	require.NoError(t, setAutolock(testContext, cli, true, swarm.UpdateFlags{}))
+	defer func() {
+		// leave the cluster unlocked for everyone else
+		if err := setAutolock(testContext, cli, false, swarm.UpdateFlags{}); err != nil {
+			t.Logf("Failed to disable autolock: %s", err)
+		}
+	}()
+	key, err := cli.SwarmGetUnlockKey(testContext)
+	require.NoError(t, err)
+	require.NotEmpty(t, key.UnlockKey)
+	currentKey := key.UnlockKey
+	defer func() {
+		// don't leave the manager locked if the test fails halfway
+		if state, err := localNodeState(machines, target); err == nil && state == string(swarm.LocalNodeStateLocked) {
+			unlock(machines, target, currentKey)
+		}
+	}()
+
+	t.Logf("Restarting %s with autolock enabled", target)
+	restartLocked(t, testContext, machines, target)
+	// it doesn't unlock by itself
+	time.Sleep(10 * time.Second)
+	state, err := localNodeState(machines, target)
+	require.NoError(t, err)
+	require.Equal(t, string(swarm.LocalNodeStateLocked), state)
+
+	require.Error(t, unlock(machines, target, "SWMKEY-1-notthekey"), "unlock with a bad key should fail")
+	require.NoError(t, unlock(machines, target, key.UnlockKey))
+	state, err = localNodeState(machines, target)
+	require.NoError(t, err)
+	require.Equal(t, string(swarm.LocalNodeStateActive), state)
+
+	t.Log("Rotating the unlock key")
+	require.NoError(t, setAutolock(testContext, cli, true, swarm.UpdateFlags{RotateManagerUnlockKey: true}))
+	newKey, err := cli.SwarmGetUnlockKey(testContext)
+	require.NoError(t, err)
+	require.NotEqual(t, key.UnlockKey, newKey.UnlockKey, "unlock key should have changed")
+	currentKey = newKey.UnlockKey
+
+	restartLocked(t, testContext, machines, target)
+	require.Error(t, unlock(machines, target, key.UnlockKey), "the old key should no longer unlock the manager")
+	require.NoError(t, unlock(machines, target, newKey.UnlockKey))
+	state, err = localNodeState(machines, target)
+	require.NoError(t, err)
+	require.Equal(t, string(swarm.LocalNodeStateActive), state)
+}
+
+// spareWorkers returns up to max ready linux workers other than the local node
+func spareWorkers(ctx context.Context, cli *client.Client, max int) ([]swarm.Node, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	spare := []swarm.Node{}
+	for _, node := range nodes {
+		if len(spare) == max {
+			break
+		}
+		if node.ID == info.Swarm.NodeID || node.ManagerStatus != nil {
+			continue
+		}
+		if node.Status.State == swarm.NodeStateReady && node.Description.Platform.OS == "linux" {
+			spare = append(spare, node)
+		}
+	}
+	return spare, nil
+}
+
+// TestSwarmAutolockRebootAll reboots every manager of an autolocked cluster
+// at once, checks the cluster stays unavailable until the managers are
+// unlocked, and that services and networks are all back afterwards. The
+// cluster under test can't lose all of its managers, so up to three spare
+// workers are taken out of it to form a cluster of their own.
+func TestSwarmAutolockRebootAll(t *testing.T) {
+	name := "TestSwarmAutolockRebootAll"
+	testContext, cancel := NewTestContext(name, 30*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CaptureFailure(t, cli, name)
+	machines := GetMachines(t)
+
+	workers, err := spareWorkers(testContext, cli, 3)
+	require.NoError(t, err)
+	if len(workers) == 0 {
+		t.Skip("no spare linux worker in the cluster")
+	}
+	swarmInfo, err := cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	require.NotEmpty(t, info.Swarm.RemoteManagers)
+	managerAddr := info.Swarm.RemoteManagers[0].Addr
+
+	hosts := []string{}
+	for _, worker := range workers {
+		hosts = append(hosts, worker.Description.Hostname)
+	}
+	first := hosts[0]
+	run := func(host string, commands ...string) string {
+		out, err := machines.Run(host, commands...)
+		require.NoError(t, err, "%s: %s", host, out)
+		return strings.TrimSpace(out)
+	}
+	// converge on the output of a command on one of the managers
+	waitFor := func(host, command, expected string) {
+		ctx, cancel := WithTimeout(testContext, 3*time.Minute)
+		defer cancel()
+		err := WaitForConverge(ctx, 2*time.Second, func() error {
+			out, err := machines.Run(host, command)
+			if err != nil {
+				return fmt.Errorf("%s: %s", err, out)
+			}
+			if strings.TrimSpace(out) != expected {
+				return fmt.Errorf("%s returned %q, expected %q", command, strings.TrimSpace(out), expected)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	t.Logf("Moving %v into a swarm of their own", hosts)
+	var key string
+	for _, host := range hosts {
+		run(host, "sudo docker swarm leave --force")
+	}
+	defer func() {
+		// put the workers back where they were
+		for _, host := range hosts {
+			if state, err := localNodeState(machines, host); err == nil && state == string(swarm.LocalNodeStateLocked) {
+				unlock(machines, host, key)
+			}
+			machines.Run(host, "sudo docker swarm leave --force")
+			out, err := machines.Run(host, fmt.Sprintf("sudo docker swarm join --token %s %s", swarmInfo.JoinTokens.Worker, managerAddr))
+			if err != nil {
+				t.Logf("Failed to rejoin %s to the cluster: %s: %s", host, err, out)
+			}
+		}
+		for _, worker := range workers {
+			cli.NodeRemove(context.Background(), worker.ID, types.NodeRemoveOptions{Force: true})
+		}
+	}()
+	run(first, fmt.Sprintf("sudo docker swarm init --autolock --advertise-addr %s", workers[0].Status.Addr))
+	key = run(first, "sudo docker swarm unlock-key -q")
+	joinToken := run(first, "sudo docker swarm join-token -q manager")
+	for i, host := range hosts[1:] {
+		run(host, fmt.Sprintf("sudo docker swarm join --advertise-addr %s --token %s %s:2377", workers[i+1].Status.Addr, joinToken, workers[0].Status.Addr))
+	}
+	waitFor(first, "sudo docker node ls --filter role=manager --format '{{.Status}}' | grep -c Ready", fmt.Sprint(len(hosts)))
+
+	networkName := getUniqueName(name + "Network")
+	serviceName := getUniqueName(name + "Service")
+	run(first,
+		fmt.Sprintf("sudo docker network create --driver overlay %s", networkName),
+		fmt.Sprintf("sudo docker service create --name %s --replicas 2 --network %s %s util test-server",
+			serviceName, networkName, GetSelfImage(testContext, cli)),
+	)
+	replicasCommand := fmt.Sprintf("sudo docker service ls --filter name=%s --format '{{.Replicas}}'", serviceName)
+	waitFor(first, replicasCommand, "2/2")
+
+	t.Logf("Rebooting %v at once", hosts)
+	errs := make(chan error, len(hosts))
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if err := machines.Reboot(host); err != nil {
+				errs <- fmt.Errorf("%s: %s", host, err)
+			}
+		}(host)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// nothing is served until the managers are unlocked
+	for _, host := range hosts {
+		waitFor(host, "sudo docker info --format '{{.Swarm.LocalNodeState}}'", string(swarm.LocalNodeStateLocked))
+		out, err := machines.Run(host, "sudo docker service ls")
+		require.Error(t, err, "%s served requests while locked: %s", host, out)
+	}
+	time.Sleep(10 * time.Second)
+	for _, host := range hosts {
+		state, err := localNodeState(machines, host)
+		require.NoError(t, err)
+		require.Equal(t, string(swarm.LocalNodeStateLocked), state, "%s unlocked by itself", host)
+	}
+
+	for i, host := range hosts {
+		t.Logf("Unlocking %s", host)
+		require.NoError(t, unlock(machines, host, key))
+		waitFor(host, "sudo docker info --format '{{.Swarm.LocalNodeState}}'", string(swarm.LocalNodeStateActive))
+		// a single manager of three has no quorum to serve anything
+		if len(hosts) == 3 && i == 0 {
+			out, err := machines.Run(host, "sudo docker service ls")
+			require.Error(t, err, "%s served requests without quorum: %s", host, out)
+		}
+	}
+
+	for _, host := range hosts {
+		waitFor(host, "sudo docker node ls --filter role=manager --format '{{.Status}}' | grep -c Ready", fmt.Sprint(len(hosts)))
+	}
+	waitFor(first, replicasCommand, "2/2")
+	waitFor(first, fmt.Sprintf("sudo docker network ls --filter name=%s --format '{{.Name}}'", networkName), networkName)
+}
@@ -0,0 +1,124 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+)
+
+// TestSwarmBackupRestore follows the documented disaster recovery procedure:
+// back up a manager's /var/lib/docker/swarm, lose the swarm state, then
+// restore the backup and recover with --force-new-cluster. Doing this to the
+// cluster under test would take every other test down with it, so a spare
+// worker is temporarily turned into a single node swarm of its own.
+func TestSwarmBackupRestore(t *testing.T) {
+	name := "TestSwarmBackupRestore"
+	testContext, cancel := NewTestContext(name, 20*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CaptureFailure(t, cli, name)
+	machines := GetMachines(t)
+
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	host := worker.Description.Hostname
+	addr := worker.Status.Addr
+	swarmInfo, err := cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	require.NotEmpty(t, info.Swarm.RemoteManagers)
+	managerAddr := info.Swarm.RemoteManagers[0].Addr
+
+	run := func(commands ...string) string {
+		out, err := machines.Run(host, commands...)
+		require.NoError(t, err, "%s: %s", host, out)
+		return strings.TrimSpace(out)
+	}
+	// converge on the output of a command on the worker
+	waitFor := func(command, expected string) {
+		ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+		defer cancel()
+		err := WaitForConverge(ctx, 2*time.Second, func() error {
+			out, err := machines.Run(host, command)
+			if err != nil {
+				return fmt.Errorf("%s: %s", err, out)
+			}
+			if strings.TrimSpace(out) != expected {
+				return fmt.Errorf("%s returned %q, expected %q", command, strings.TrimSpace(out), expected)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	t.Logf("Moving %s into a swarm of its own", host)
+	run("sudo docker swarm leave --force")
+	defer func() {
+		// put the worker back where it was
+		machines.Run(host, "sudo docker swarm leave --force")
+		out, err := machines.Run(host, fmt.Sprintf("sudo docker swarm join --token %s %s", swarmInfo.JoinTokens.Worker, managerAddr))
+		if err != nil {
+			t.Logf("Failed to rejoin %s to the cluster: %s: %s", host, err, out)
+		}
+		cli.NodeRemove(context.Background(), worker.ID, types.NodeRemoveOptions{Force: true})
+	}()
+	run(fmt.Sprintf("sudo docker swarm init --advertise-addr %s", addr))
+
+	secretName := getUniqueName(name + "Secret")
+	networkName := getUniqueName(name + "Network")
+	serviceName := getUniqueName(name + "Service")
+	run(
+		fmt.Sprintf("echo -n backup | sudo docker secret create %s -", secretName),
+		fmt.Sprintf("sudo docker network create --driver overlay %s", networkName),
+		fmt.Sprintf("sudo docker service create --name %s --replicas 2 --secret %s --network %s %s util test-server",
+			serviceName, secretName, networkName, GetSelfImage(testContext, cli)),
+	)
+	replicasCommand := fmt.Sprintf("sudo docker service ls --filter name=%s --format '{{.Replicas}}'", serviceName)
+	waitFor(replicasCommand, "2/2")
+
+	// the archive is taken through the engine, so it has to stay up; the
+	// cluster is idle at this point, which keeps the raft state consistent
+	t.Logf("Backing up the swarm state of %s", host)
+	backup, err := machines.Archive(host, "/var/lib/docker/swarm")
+	require.NoError(t, err)
+	require.NotEmpty(t, backup)
+
+	t.Logf("Destroying the swarm state of %s", host)
+	run(
+		"sudo docker swarm leave --force",
+		"sudo systemctl stop docker",
+		"sudo rm -rf /var/lib/docker/swarm",
+		"sudo systemctl start docker",
+	)
+	waitFor("sudo docker info --format '{{.Swarm.LocalNodeState}}'", "inactive")
+
+	t.Logf("Restoring the swarm state of %s", host)
+	require.NoError(t, machines.WriteFile(host, "/tmp/swarm-backup.tar", backup))
+	run(
+		"sudo systemctl stop docker",
+		"sudo mkdir -p /var/lib/docker/swarm",
+		"sudo tar -xf /tmp/swarm-backup.tar -C /var/lib/docker/swarm",
+		"rm -f /tmp/swarm-backup.tar",
+		"sudo systemctl start docker",
+	)
+	waitFor("sudo docker info --format '{{.Swarm.LocalNodeState}}'", "active")
+	run(fmt.Sprintf("sudo docker swarm init --force-new-cluster --advertise-addr %s", addr))
+
+	// everything created before the backup survived
+	waitFor(replicasCommand, "2/2")
+	waitFor(fmt.Sprintf("sudo docker secret ls --filter name=%s --format '{{.Name}}'", secretName), secretName)
+	waitFor(fmt.Sprintf("sudo docker network ls --filter name=%s --format '{{.Name}}'", networkName), networkName)
+}
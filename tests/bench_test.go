@@ -0,0 +1,238 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// benchScaleTo is how many replicas BenchmarkServiceScale scales to
+	benchScaleTo = 50
+	// benchPoll is how often the benchmarks look at the tasks, which bounds
+	// how precise their timings are
+	benchPoll = 50 * time.Millisecond
+)
+
+// benchMetrics collects the timings of the steps of every op, to report them
+// along with ns/op. They're logged as
+//
+//	metric <name> <value> ns/op
+//
+// which benchmarks always print, for testkit bench to pick up
+type benchMetrics struct {
+	b      *testing.B
+	totals map[string]time.Duration
+}
+
+func newBenchMetrics(b *testing.B) *benchMetrics {
+	return &benchMetrics{b: b, totals: map[string]time.Duration{}}
+}
+
+// add adds the time a step of an op took
+func (m *benchMetrics) add(name string, d time.Duration) {
+	m.totals[name] += d
+}
+
+// report logs the mean of every step over the ops
+func (m *benchMetrics) report() {
+	names := []string{}
+	for name := range m.totals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.b.Logf("metric %s %d ns/op", name, int64(m.totals[name])/int64(m.b.N))
+	}
+}
+
+// benchSetup returns a client and a context for the benchmark
+func benchSetup(b *testing.B, name string) (*client.Client, context.Context, context.CancelFunc) {
+	cli, err := GetClient()
+	if err != nil {
+		b.Fatalf("Client creation failed: %s", err)
+	}
+	ctx, cancel := NewTestContext(name, 30*time.Minute)
+	return cli, ctx, cancel
+}
+
+// runningTasks counts the service's running tasks, and those a node has been
+// assigned
+func runningTasks(ctx context.Context, cli *client.Client, serviceID string) (running, assigned int, err error) {
+	tasks, err := GetServiceTasks(ctx, cli, serviceID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, task := range tasks {
+		if task.NodeID != "" {
+			assigned++
+		}
+		if task.Status.State == swarm.TaskStateRunning {
+			running++
+		}
+	}
+	return running, assigned, nil
+}
+
+// removeBenchService removes the service and waits for its tasks to be gone,
+// so that they don't weigh on the next op
+func removeBenchService(b *testing.B, ctx context.Context, cli *client.Client, serviceID string) {
+	if err := cli.ServiceRemove(ctx, serviceID); err != nil {
+		b.Fatalf("Failed to remove service %s: %s", serviceID, err)
+	}
+	err := WaitForConverge(ctx, time.Second, func() error {
+		tasks, err := GetServiceTasks(ctx, cli, serviceID)
+		if err != nil {
+			return err
+		}
+		if len(tasks) > 0 {
+			return fmt.Errorf("%d tasks left", len(tasks))
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("Tasks of service %s weren't removed: %s", serviceID, err)
+	}
+}
+
+// BenchmarkServiceCreate measures how long a service takes from being created
+// to having its task running, and reports when the task was scheduled
+func BenchmarkServiceCreate(b *testing.B) {
+	name := "BenchmarkServiceCreate"
+	cli, ctx, cancel := benchSetup(b, name)
+	defer cancel()
+	defer CleanTestServices(context.Background(), cli, name)
+	if err := ensureImage(ctx, cli, GetSelfImage(ctx, cli)); err != nil {
+		b.Fatalf("Failed to pull the image: %s", err)
+	}
+	metrics := newBenchMetrics(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		spec := NewServiceSpec(ctx, cli, fmt.Sprintf("%s-%d", name, i)).Label(name).Unpublished().Build()
+		start := time.Now()
+		service, err := CreateService(ctx, cli, spec)
+		if err != nil {
+			b.Fatalf("Failed to create service: %s", err)
+		}
+		metrics.add("api", time.Since(start))
+		scheduled := false
+		err = WaitForConverge(ctx, benchPoll, func() error {
+			running, assigned, err := runningTasks(ctx, cli, service.ID)
+			if err != nil {
+				return err
+			}
+			if assigned > 0 && !scheduled {
+				scheduled = true
+				metrics.add("scheduled", time.Since(start))
+			}
+			if running == 0 {
+				return fmt.Errorf("no task running yet")
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("Service didn't converge: %s", err)
+		}
+
+		b.StopTimer()
+		removeBenchService(b, ctx, cli, service.ID)
+		b.StartTimer()
+	}
+	b.StopTimer()
+	metrics.report()
+}
+
+// BenchmarkServiceScale measures how long a service takes to go from 1 to
+// benchScaleTo running tasks, and reports when the first new one was running
+func BenchmarkServiceScale(b *testing.B) {
+	name := "BenchmarkServiceScale"
+	cli, ctx, cancel := benchSetup(b, name)
+	defer cancel()
+	defer CleanTestServices(context.Background(), cli, name)
+	if err := ensureImage(ctx, cli, GetSelfImage(ctx, cli)); err != nil {
+		b.Fatalf("Failed to pull the image: %s", err)
+	}
+	metrics := newBenchMetrics(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		spec := NewServiceSpec(ctx, cli, fmt.Sprintf("%s-%d", name, i)).Label(name).Unpublished().Build()
+		service, err := CreateService(ctx, cli, spec)
+		if err != nil {
+			b.Fatalf("Failed to create service: %s", err)
+		}
+		if err := WaitForConverge(ctx, benchPoll, ScaleCheck(service.ID, cli)(ctx, 1)); err != nil {
+			b.Fatalf("Service didn't converge: %s", err)
+		}
+		b.StartTimer()
+
+		start := time.Now()
+		if err := scaleService(ctx, cli, service.ID, benchScaleTo); err != nil {
+			b.Fatalf("Failed to scale service: %s", err)
+		}
+		first := false
+		err = WaitForConverge(ctx, benchPoll, func() error {
+			running, _, err := runningTasks(ctx, cli, service.ID)
+			if err != nil {
+				return err
+			}
+			if running > 1 && !first {
+				first = true
+				metrics.add("first_running", time.Since(start))
+			}
+			if running != benchScaleTo {
+				return fmt.Errorf("%d of %d tasks running", running, benchScaleTo)
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("Service didn't scale: %s", err)
+		}
+
+		b.StopTimer()
+		removeBenchService(b, ctx, cli, service.ID)
+		b.StartTimer()
+	}
+	b.StopTimer()
+	metrics.report()
+}
+
+// BenchmarkNetworkCreate measures how long creating an overlay network takes,
+// and reports how long removing it took
+func BenchmarkNetworkCreate(b *testing.B) {
+	name := "BenchmarkNetworkCreate"
+	cli, ctx, cancel := benchSetup(b, name)
+	defer cancel()
+	defer CleanupAll(context.Background(), cli, UUID(), name)
+	metrics := newBenchMetrics(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nw, err := cli.NetworkCreate(ctx, getUniqueName(fmt.Sprintf("%s-%d", name, i)), types.NetworkCreate{
+			Driver:         "overlay",
+			CheckDuplicate: true,
+			Labels:         testLabels(name),
+		})
+		if err != nil {
+			b.Fatalf("Failed to create network: %s", err)
+		}
+
+		b.StopTimer()
+		start := time.Now()
+		if err := cli.NetworkRemove(ctx, nw.ID); err != nil {
+			b.Fatalf("Failed to remove network: %s", err)
+		}
+		metrics.add("remove", time.Since(start))
+		b.StartTimer()
+	}
+	b.StopTimer()
+	metrics.report()
+}
@@ -0,0 +1,159 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// rotateCA starts a root CA rotation, returning the root being replaced
+func rotateCA(t *testing.T, ctx context.Context, cli *client.Client) string {
+	sw, err := cli.SwarmInspect(ctx)
+	require.NoError(t, err)
+	oldRoot := sw.ClusterInfo.TLSInfo.TrustRoot
+	sw.Spec.CAConfig.ForceRotate++
+	err = cli.SwarmUpdate(ctx, sw.Version, sw.Spec, swarm.UpdateFlags{})
+	require.NoError(t, err, "Error starting CA rotation")
+	return oldRoot
+}
+
+// caRotationCheck returns a check that passes once the rotation away from
+// oldRoot has finished and every ready node trusts the new root
+func caRotationCheck(ctx context.Context, cli *client.Client, oldRoot string) func() error {
+	return func() error {
+		sw, err := cli.SwarmInspect(ctx)
+		if err != nil {
+			return err
+		}
+		if sw.RootRotationInProgress {
+			return fmt.Errorf("root rotation still in progress")
+		}
+		newRoot := sw.ClusterInfo.TLSInfo.TrustRoot
+		if newRoot == oldRoot {
+			return fmt.Errorf("cluster still has the old root")
+		}
+		nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if node.Status.State != swarm.NodeStateReady {
+				continue
+			}
+			if node.Description.TLSInfo.TrustRoot != newRoot {
+				return fmt.Errorf("node %s does not trust the new root yet", node.Description.Hostname)
+			}
+		}
+		return nil
+	}
+}
+
+// runningTaskIDs returns the IDs of the service's running tasks
+func runningTaskIDs(ctx context.Context, cli *client.Client, serviceID string) (map[string]bool, error) {
+	tasks, err := GetServiceTasks(ctx, cli, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning {
+			ids[task.ID] = true
+		}
+	}
+	return ids, nil
+}
+
+// TestCARotation rotates the cluster root CA and checks that every node ends
+// up trusting the new root without disturbing the running tasks
+func TestCARotation(t *testing.T) {
+	name := "TestCARotation"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).Replicas(uint64(replicas)).Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+	before, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+
+	oldRoot := rotateCA(t, testContext, cli)
+
+	ctx, cancel = WithTimeout(testContext, 5*time.Minute)
+	defer cancel()
+	rotated := caRotationCheck(ctx, cli, oldRoot)
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		// the same tasks have to keep running for the whole rotation
+		running, err := runningTaskIDs(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		for id := range before {
+			if !running[id] {
+				return fmt.Errorf("task %s stopped during the rotation", id)
+			}
+		}
+		return rotated()
+	})
+	require.NoError(t, err)
+
+	// and a task can't have stopped in between the last two polls
+	running, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+	require.Equal(t, before, running, "tasks should not be restarted by a CA rotation")
+}
+
+// TestCARotationNodeRestart restarts a worker's engine while the root is being
+// rotated, so it reconnects with a certificate issued by the old root, and
+// checks it is let back in and ends up on the new root
+func TestCARotationNodeRestart(t *testing.T) {
+	testContext, cancel := NewTestContext("TestCARotationNodeRestart", 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	host := worker.Description.Hostname
+
+	oldRoot := rotateCA(t, testContext, cli)
+	t.Logf("Restarting the engine on %s", host)
+	out, err := machines.Run(host, "sudo systemctl restart docker")
+	require.NoError(t, err, out)
+
+	ctx, cancel := WithTimeout(testContext, 5*time.Minute)
+	defer cancel()
+	rotated := caRotationCheck(ctx, cli, oldRoot)
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, worker.ID)
+		if err != nil {
+			return err
+		}
+		if node.Status.State != swarm.NodeStateReady {
+			return fmt.Errorf("%s is %s", host, node.Status.State)
+		}
+		return rotated()
+	})
+	require.NoError(t, err, "worker did not rejoin during the rotation")
+}
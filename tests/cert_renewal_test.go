@@ -0,0 +1,204 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// certRenewalExpiry is the shortest node certificate expiry swarm
+	// accepts. Nodes renew somewhere between half and 80% of the way through
+	certRenewalExpiry = time.Hour
+	// certRenewalCycles is how many times every node has to renew
+	certRenewalCycles = 2
+	// nodeCertPath is where the engine keeps its swarm node certificate
+	nodeCertPath = "/var/lib/docker/swarm/certificates/swarm-node.crt"
+)
+
+// nodeCertExpiry returns the expiry date of the machine's node certificate
+func nodeCertExpiry(m *Machines, machine string) (string, error) {
+	out, err := m.Run(machine, "sudo openssl x509 -noout -enddate -in "+nodeCertPath)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, out)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// setCertExpiry changes the expiry of the node certificates the cluster issues
+func setCertExpiry(ctx context.Context, cli *client.Client, expiry time.Duration) error {
+	sw, err := cli.SwarmInspect(ctx)
+	if err != nil {
+		return err
+	}
+	sw.Spec.CAConfig.NodeCertExpiry = expiry
+	return cli.SwarmUpdate(ctx, sw.Version, sw.Spec, swarm.UpdateFlags{})
+}
+
+// nodeFlapWatcher records every time a node that was ready is seen otherwise
+type nodeFlapWatcher struct {
+	mu     sync.Mutex
+	flaps  []string
+	errors int
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// watchNodeFlaps polls the node list, also keeping the API busy in the
+// process, until stop is called
+func watchNodeFlaps(ctx context.Context, cli *client.Client, ready map[string]string) *nodeFlapWatcher {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &nodeFlapWatcher{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+			nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+			w.mu.Lock()
+			if err != nil {
+				w.errors++
+			}
+			for _, node := range nodes {
+				if _, ok := ready[node.ID]; ok && node.Status.State != swarm.NodeStateReady {
+					w.flaps = append(w.flaps, fmt.Sprintf("%s %s at %s", ready[node.ID], node.Status.State, time.Now().Format(time.RFC3339)))
+				}
+			}
+			w.mu.Unlock()
+		}
+	}()
+	return w
+}
+
+// stop stops watching, returning the flaps seen and the number of failed
+// node list calls
+func (w *nodeFlapWatcher) stop() ([]string, int) {
+	w.cancel()
+	<-w.done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flaps, w.errors
+}
+
+// TestCertRenewalUnderLoad sets the shortest node certificate expiry, then
+// keeps traffic going through a service and the API until every node it can
+// reach has renewed its certificate a few times, checking no task was
+// restarted, no node went down and no request failed along the way
+func TestCertRenewalUnderLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping certificate renewal cycles in short mode")
+	}
+	name := "TestCertRenewalUnderLoad"
+	// the first renewal can take the whole 80% of the current expiry
+	testContext, cancel := NewTestContext(name, time.Duration(certRenewalCycles+1)*certRenewalExpiry)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	sw, err := cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	originalExpiry := sw.Spec.CAConfig.NodeCertExpiry
+	require.NoError(t, setCertExpiry(testContext, cli, certRenewalExpiry))
+	defer func() {
+		if err := setCertExpiry(context.Background(), cli, originalExpiry); err != nil {
+			t.Logf("Failed to restore the certificate expiry to %s: %s", originalExpiry, err)
+		}
+	}()
+
+	linux, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	ready := map[string]string{}
+	expiries := map[string]string{}
+	renewals := map[string]int{}
+	for _, node := range linux {
+		host := node.Description.Hostname
+		ready[node.ID] = host
+		expiries[host], err = nodeCertExpiry(machines, host)
+		require.NoError(t, err)
+	}
+
+	replicas := len(linux)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+	before, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	poller := pollContent(testContext, endpoint, fmt.Sprintf(":%v", published), "/etc/hostname")
+	watcher := watchNodeFlaps(testContext, cli, ready)
+
+	// the current certificates were issued with the old expiry, so the
+	// first renewal may be a long way off
+	start := time.Now()
+	ctx, cancel = context.WithCancel(testContext)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Minute, func() error {
+		running, err := runningTaskIDs(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		for id := range before {
+			if !running[id] {
+				// no point waiting for the renewals any longer
+				cancel()
+				return fmt.Errorf("task %s stopped", id)
+			}
+		}
+		pending := []string{}
+		for host, expiry := range expiries {
+			current, err := nodeCertExpiry(machines, host)
+			if err != nil {
+				return err
+			}
+			if current != expiry {
+				renewals[host]++
+				expiries[host] = current
+				t.Logf("%s renewed its certificate after %s, %s", host, time.Since(start), current)
+			}
+			if renewals[host] < certRenewalCycles {
+				pending = append(pending, host)
+			}
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%v haven't renewed %d times yet: %v", pending, certRenewalCycles, renewals)
+		}
+		return nil
+	})
+	_, _, failures := poller.stop()
+	flaps, apiErrors := watcher.stop()
+	require.NoError(t, err)
+	require.Empty(t, flaps, "nodes went down during the renewals")
+	require.Zero(t, apiErrors, "node list calls failed during the renewals")
+	require.Empty(t, failures, "requests to the service failed during the renewals")
+
+	running, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+	require.Equal(t, before, running, "tasks should not be restarted by certificate renewals")
+}
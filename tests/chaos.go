@@ -0,0 +1,232 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// recoveryWindow bounds how long a node gets to come back and have its tasks
+// running again after a daemon restart
+const recoveryWindow = 2 * time.Minute
+
+// nodeReadyCheck returns a check that passes once the node is ready
+func nodeReadyCheck(ctx context.Context, cli *client.Client, nodeID string) func() error {
+	return func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, nodeID)
+		if err != nil {
+			return err
+		}
+		if node.Status.State != swarm.NodeStateReady {
+			return fmt.Errorf("%s is %s", node.Description.Hostname, node.Status.State)
+		}
+		return nil
+	}
+}
+
+// isolate partitions the group of nodes from every other node of the cluster,
+// leaving the group able to reach itself. The returned function heals it
+func isolate(ctx context.Context, cli *client.Client, m *Machines, group []swarm.Node) (func(), error) {
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	inGroup := map[string]bool{}
+	for _, node := range group {
+		inGroup[node.ID] = true
+	}
+	peers := []string{}
+	for _, node := range nodes {
+		if !inGroup[node.ID] {
+			peers = append(peers, node.Status.Addr)
+		}
+	}
+	heal := func() {
+		for _, node := range group {
+			m.Heal(node.Description.Hostname)
+		}
+	}
+	for _, node := range group {
+		if err := m.Partition(node.Description.Hostname, peers); err != nil {
+			heal()
+			return nil, err
+		}
+	}
+	return heal, nil
+}
+
+// managersHealthyCheck returns a check that passes once every manager is
+// reachable and there's a single leader
+func managersHealthyCheck(ctx context.Context, cli *client.Client) func() error {
+	return func() error {
+		managers, _, err := GetManagers(ctx, cli)
+		if err != nil {
+			return err
+		}
+		for _, node := range managers {
+			if node.ManagerStatus.Reachability != swarm.ReachabilityReachable {
+				return fmt.Errorf("%s is %s", node.Description.Hostname, node.ManagerStatus.Reachability)
+			}
+		}
+		_, err = GetLeader(ctx, cli)
+		return err
+	}
+}
+
+// Chaos injects failures into the cluster from inside a test, so that it can
+// interleave them with its own checks, and undoes them once the test is done:
+//
+//	chaos := NewChaos(t, cli, name)
+//	defer chaos.Cleanup(testContext)
+//
+// Restarting engines and partitioning need machine control, and skip the test
+// without it
+type Chaos struct {
+	t   *testing.T
+	cli *client.Client
+
+	mu sync.Mutex
+	// rand chooses what to break, seeded for the test so that a run can be
+	// replayed, see SeedEnv
+	rand *rand.Rand
+	// undo holds what puts the cluster back together, in the order the
+	// failures were injected
+	undo []func(ctx context.Context) error
+}
+
+// NewChaos returns the chaos of the named test
+func NewChaos(t *testing.T, cli *client.Client, name string) *Chaos {
+	return &Chaos{t: t, cli: cli, rand: TestRand(name)}
+}
+
+// onCleanup registers what undoes a failure
+func (c *Chaos) onCleanup(undo func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.undo = append(c.undo, undo)
+}
+
+// Cleanup undoes the failures injected, latest first, and waits for the
+// cluster to recover from them. It only logs what it couldn't undo, so that
+// the test's own failure stays the one reported
+func (c *Chaos) Cleanup(ctx context.Context) {
+	c.mu.Lock()
+	undo := c.undo
+	c.undo = nil
+	c.mu.Unlock()
+	// the test's own context may be what ran out
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = WithTimeout(context.Background(), recoveryWindow)
+		defer cancel()
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](ctx); err != nil {
+			c.t.Logf("Cluster didn't recover from chaos: %s", err)
+		}
+	}
+}
+
+// KillRandomTask kills the container of one of the service's running tasks,
+// chosen at random, and returns the task. The orchestrator replaces it, so
+// there's nothing to undo
+func (c *Chaos) KillRandomTask(ctx context.Context, serviceID string) (swarm.Task, error) {
+	tasks, err := GetServiceTasks(ctx, c.cli, serviceID)
+	if err != nil {
+		return swarm.Task{}, err
+	}
+	running := []swarm.Task{}
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning && task.Status.ContainerStatus.ContainerID != "" {
+			running = append(running, task)
+		}
+	}
+	if len(running) == 0 {
+		return swarm.Task{}, fmt.Errorf("service %s has no running task to kill", serviceID)
+	}
+	// the tasks come back in no particular order, the slots are the same
+	// from one run to the next
+	sort.Sort(bySlot(running))
+	c.mu.Lock()
+	task := running[c.rand.Intn(len(running))]
+	c.mu.Unlock()
+	nodeCli, err := GetCluster(c.t).ClientForNode(ctx, task.NodeID)
+	if err != nil {
+		return task, err
+	}
+	if err := nodeCli.ContainerKill(ctx, task.Status.ContainerStatus.ContainerID, "KILL"); err != nil {
+		return task, fmt.Errorf("killing task %s: %s", task.ID, err)
+	}
+	Logger(ctx).WithField("task", task.ID).WithField("node", task.NodeID).Info("chaos killed a task")
+	return task, nil
+}
+
+// RestartDaemonOn restarts the engine of the node, without waiting for it to
+// come back. Cleanup waits for the node to be ready again
+func (c *Chaos) RestartDaemonOn(ctx context.Context, node swarm.Node) error {
+	m := GetMachines(c.t)
+	host := node.Description.Hostname
+	command := "sudo systemctl restart docker"
+	if node.Description.Platform.OS == "windows" {
+		command = "powershell -Command Restart-Service docker"
+	}
+	c.onCleanup(func(ctx context.Context) error {
+		ctx, cancel := WithTimeout(ctx, recoveryWindow)
+		defer cancel()
+		return WaitForConvergeBackoff(ctx, DefaultBackoff, nodeReadyCheck(ctx, c.cli, node.ID))
+	})
+	out, err := m.Run(host, command)
+	if err != nil {
+		return fmt.Errorf("restarting the engine on %s: %s: %s", host, err, out)
+	}
+	Logger(ctx).WithField("node", host).Info("chaos restarted an engine")
+	return nil
+}
+
+// PartitionManagers cuts a minority of the Linux managers, never the local
+// one, off from the rest of the cluster, and returns them. The majority keeps
+// quorum. Cleanup heals the partition and waits for the managers to be
+// healthy again. It skips the test with fewer than 3 managers
+func (c *Chaos) PartitionManagers(ctx context.Context) ([]swarm.Node, error) {
+	m := GetMachines(c.t)
+	managers, self, err := GetManagers(ctx, c.cli)
+	if err != nil {
+		return nil, err
+	}
+	if len(managers) < 3 {
+		c.t.Skipf("partitioning managers needs at least 3 of them, the cluster has %d", len(managers))
+	}
+	minority := []swarm.Node{}
+	for _, node := range managers {
+		if len(minority) < (len(managers)-1)/2 && node.Description.Hostname != self && node.Description.Platform.OS == "linux" {
+			minority = append(minority, node)
+		}
+	}
+	if len(minority) == 0 {
+		return nil, fmt.Errorf("no linux manager other than the local node to partition")
+	}
+	heal, err := isolate(ctx, c.cli, m, minority)
+	if err != nil {
+		return nil, err
+	}
+	c.onCleanup(func(ctx context.Context) error {
+		heal()
+		ctx, cancel := WithTimeout(ctx, recoveryWindow)
+		defer cancel()
+		return WaitForConverge(ctx, time.Second, managersHealthyCheck(ctx, c.cli))
+	})
+	hosts := []string{}
+	for _, node := range minority {
+		hosts = append(hosts, node.Description.Hostname)
+	}
+	Logger(ctx).WithField("nodes", hosts).Info("chaos partitioned managers")
+	return minority, nil
+}
@@ -0,0 +1,48 @@
+package dockere2e
+
+import (
+	// basic imports
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+)
+
+// TestChaosTaskKill kills tasks of a service one after the other, checking
+// after each one that it was replaced and the service is back to all of its
+// replicas
+func TestChaosTaskKill(t *testing.T) {
+	t.Parallel()
+	name := "TestChaosTaskKill"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	chaos := NewChaos(t, cli, name)
+
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).Replicas(uint64(replicas)).Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+	defer chaos.Cleanup(testContext)
+
+	scaleCheck := ScaleCheck(service.ID, cli)
+	ctx, cancel := WithTimeout(testContext, time.Minute)
+	defer cancel()
+	require.NoError(t, WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas)))
+
+	for i := 0; i < replicas; i++ {
+		killed, err := chaos.KillRandomTask(testContext, service.ID)
+		require.NoError(t, err)
+		ctx, cancel := WithTimeout(testContext, time.Minute)
+		err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+		cancel()
+		require.NoError(t, err, "service did not recover from losing task %s", killed.ID)
+		running, err := runningTaskIDs(testContext, cli, service.ID)
+		require.NoError(t, err)
+		require.False(t, running[killed.ID], "task %s should have been replaced", killed.ID)
+	}
+}
@@ -0,0 +1,164 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// churnWorkers is how many goroutines hammer the managers at once
+	churnWorkers = 8
+	// churnRounds is how many services and networks each worker goes through
+	churnRounds = 5
+)
+
+// managerClients returns a client for every manager that can be reached,
+// using cli for the local one
+func managerClients(t *testing.T, ctx context.Context, cli *client.Client) []*client.Client {
+	managers, self, err := GetManagers(ctx, cli)
+	require.NoError(t, err)
+	clients := []*client.Client{cli}
+	for _, node := range managers {
+		if node.Description.Hostname == self {
+			continue
+		}
+		managerCli, err := GetNodeClient(node)
+		if err != nil {
+			t.Logf("Not sending requests to %s: %s", node.Description.Hostname, err)
+			continue
+		}
+		clients = append(clients, managerCli)
+	}
+	return clients
+}
+
+// churnRound creates a network and a service on it, updates the service a
+// couple of times, then removes both again
+func churnRound(ctx context.Context, cli *client.Client, name string, worker, round int) error {
+	objName := fmt.Sprintf("%s-%d-%d", name, worker, round)
+	nwName := getUniqueName(objName)
+	_, err := cli.NetworkCreate(ctx, nwName, types.NetworkCreate{
+		Driver:         "overlay",
+		CheckDuplicate: true,
+		Labels:         testLabels(name),
+	})
+	if err != nil {
+		return fmt.Errorf("creating network %s: %s", nwName, err)
+	}
+
+	spec := NewServiceSpec(ctx, cli, objName).
+		Network(nwName).
+		Label(name).
+		Build()
+	service, err := CreateService(ctx, cli, spec)
+	if err != nil {
+		return fmt.Errorf("creating service %s: %s", spec.Name, err)
+	}
+	for _, replicas := range []uint64{3, 2} {
+		// the version can be bumped by the orchestrator in between, so
+		// conflicts are retried
+		err = WaitForConverge(ctx, 100*time.Millisecond, func() error {
+			return scaleService(ctx, cli, service.ID, replicas)
+		})
+		if err != nil {
+			return fmt.Errorf("scaling service %s: %s", spec.Name, err)
+		}
+	}
+	if err := cli.ServiceRemove(ctx, service.ID); err != nil {
+		return fmt.Errorf("removing service %s: %s", spec.Name, err)
+	}
+	// the network is in use until the tasks are gone
+	err = WaitForConverge(ctx, time.Second, func() error {
+		return cli.NetworkRemove(ctx, nwName)
+	})
+	if err != nil {
+		return fmt.Errorf("removing network %s: %s", nwName, err)
+	}
+	return nil
+}
+
+// TestServiceChurn creates, updates and removes services and networks from
+// several goroutines at once, spread over the managers, and checks the
+// cluster stays healthy and nothing is left behind
+func TestServiceChurn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping service churn in short mode")
+	}
+	name := "TestServiceChurn"
+	testContext, cancel := NewTestContext(name, 15*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	// a manager running short while it churns shows up in the node samples
+	stats := SampleStats(testContext, cli, name)
+	defer stats.Stop()
+
+	clients := managerClients(t, testContext, cli)
+	t.Logf("Churning through %d managers", len(clients))
+
+	ctx, cancel := WithTimeout(testContext, 10*time.Minute)
+	defer cancel()
+	errs := make(chan error, churnWorkers*churnRounds)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < churnWorkers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for round := 0; round < churnRounds; round++ {
+				managerCli := clients[(worker+round)%len(clients)]
+				if err := churnRound(ctx, managerCli, name, worker, round); err != nil {
+					errs <- fmt.Errorf("worker %d round %d: %s", worker, round, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	failures := []string{}
+	for err := range errs {
+		failures = append(failures, err.Error())
+	}
+	require.Empty(t, failures)
+	t.Logf("%d services churned in %s", churnWorkers*churnRounds, time.Since(start))
+
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	require.NoError(t, WaitForConverge(ctx, time.Second, managersHealthyCheck(ctx, cli)))
+
+	// every manager has to agree nothing is left
+	for _, managerCli := range clients {
+		err = WaitForConverge(ctx, time.Second, func() error {
+			services, err := managerCli.ServiceList(ctx, types.ServiceListOptions{Filters: GetTestFilter(name)})
+			if err != nil {
+				return err
+			}
+			if len(services) > 0 {
+				return fmt.Errorf("%d services left behind", len(services))
+			}
+			networks, err := managerCli.NetworkList(ctx, types.NetworkListOptions{Filters: GetTestFilter(name)})
+			if err != nil {
+				return err
+			}
+			if len(networks) > 0 {
+				return fmt.Errorf("%d networks left behind", len(networks))
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
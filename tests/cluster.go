@@ -0,0 +1,142 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// Cluster is the swarm under test, discovered once by TestMain so that tests
+// can talk to the engine of a particular node without each of them working
+// out which node is which. Roles, leadership and addresses change during the
+// run, so the helpers look the nodes up again, only the clients are kept
+type Cluster struct {
+	// Self is the ID of the node the tests run on, which is a manager
+	Self string
+	// Nodes are the nodes as they were when the run started
+	Nodes []swarm.Node
+
+	cli *client.Client
+	mu  sync.Mutex
+	// clients for the other engines, by address
+	clients map[string]*client.Client
+}
+
+// cluster is set by TestMain, and left nil if the discovery failed
+var cluster *Cluster
+
+// DiscoverCluster finds the nodes of the swarm the local manager belongs to
+func DiscoverCluster(ctx context.Context, cli *client.Client) (*Cluster, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Swarm.ControlAvailable {
+		return nil, fmt.Errorf("the local node isn't a swarm manager")
+	}
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{
+		Self:    info.Swarm.NodeID,
+		Nodes:   nodes,
+		cli:     cli,
+		clients: map[string]*client.Client{},
+	}, nil
+}
+
+// GetCluster returns the cluster discovered by TestMain, failing the test if
+// there isn't one
+func GetCluster(t *testing.T) *Cluster {
+	if cluster == nil {
+		t.Fatal("the cluster wasn't discovered when the run started")
+	}
+	return cluster
+}
+
+// String describes the cluster as it was discovered
+func (c *Cluster) String() string {
+	managers, workers := 0, 0
+	for _, node := range c.Nodes {
+		if node.Spec.Role == swarm.NodeRoleManager {
+			managers++
+		} else {
+			workers++
+		}
+	}
+	return fmt.Sprintf("%d managers and %d workers", managers, workers)
+}
+
+// clientFor returns a client for the node's engine, the local one for the
+// node the tests run on
+func (c *Cluster) clientFor(node swarm.Node) (*client.Client, error) {
+	if node.ID == c.Self {
+		return c.cli, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cli, ok := c.clients[node.Status.Addr]; ok {
+		return cli, nil
+	}
+	cli, err := GetNodeClient(node)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", node.Description.Hostname, err)
+	}
+	c.clients[node.Status.Addr] = cli
+	return cli, nil
+}
+
+// ManagerClient returns a client for the local manager, the same as
+// GetClient
+func (c *Cluster) ManagerClient() *client.Client {
+	return c.cli
+}
+
+// LeaderClient returns a client for the current leader and the leader itself
+func (c *Cluster) LeaderClient(ctx context.Context) (*client.Client, swarm.Node, error) {
+	leader, err := GetLeader(ctx, c.cli)
+	if err != nil {
+		return nil, swarm.Node{}, err
+	}
+	cli, err := c.clientFor(leader)
+	return cli, leader, err
+}
+
+// ClientForNode returns a client for the engine of the node with the ID
+func (c *Cluster) ClientForNode(ctx context.Context, id string) (*client.Client, error) {
+	node, _, err := c.cli.NodeInspectWithRaw(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.clientFor(node)
+}
+
+// WorkerClients returns clients for the engines of the ready workers, keyed
+// by node ID. Workers that can't be reached are left out, with the last error
+// returned alongside the rest
+func (c *Cluster) WorkerClients(ctx context.Context) (map[string]*client.Client, error) {
+	nodes, err := c.cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	clients := map[string]*client.Client{}
+	var lastErr error
+	for _, node := range nodes {
+		if node.Spec.Role != swarm.NodeRoleWorker || node.Status.State != swarm.NodeStateReady {
+			continue
+		}
+		cli, err := c.clientFor(node)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		clients[node.ID] = cli
+	}
+	return clients, lastErr
+}
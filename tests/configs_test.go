@@ -0,0 +1,231 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// configTarget is where the config tests mount their configs. Unlike secrets,
+// configs can be mounted anywhere in the container.
+const configTarget = "/etc/e2e/config.txt"
+
+// configReference mounts the config at configTarget with the given ownership
+// and permissions
+func configReference(id, name, uid, gid string, mode os.FileMode) *swarm.ConfigReference {
+	return &swarm.ConfigReference{
+		ConfigID:   id,
+		ConfigName: name,
+		File: &swarm.ConfigReferenceFileTarget{
+			Name: configTarget,
+			UID:  uid,
+			GID:  gid,
+			Mode: mode,
+		},
+	}
+}
+
+// cleanConfigTest removes the test's services, then its configs once the
+// tasks using them are gone
+func cleanConfigTest(ctx context.Context, cli *client.Client, name string) {
+	CleanTestServices(ctx, cli, name)
+	waitCtx, cancel := WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	WaitForConverge(waitCtx, time.Second, func() error {
+		return CleanTestConfigs(waitCtx, cli, name)
+	})
+}
+
+// TestConfigsServiceFile checks that a config is mounted at its target path
+// with the requested ownership and permissions
+func TestConfigsServiceFile(t *testing.T) {
+	t.Parallel()
+	name := "TestConfigsServiceFile"
+	RequiresAPIVersion(t, "1.30")
+	testContext, cancel := NewTestContext(name, 2*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanConfigTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	data := "key = value\n"
+	configSpec := CannedConfigSpec(name, []byte(data))
+	config, err := cli.ConfigCreate(testContext, configSpec)
+	require.NoError(t, err, "Error creating config")
+
+	// unlike secrets, config data is returned by inspect
+	inspected, _, err := cli.ConfigInspectWithRaw(testContext, config.ID)
+	require.NoError(t, err, "Error inspecting config")
+	require.Equal(t, data, string(inspected.Spec.Data))
+
+	var replicas uint64 = 2
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(replicas).
+		Config(configReference(config.ID, configSpec.Name, "1000", "1000", 0640)).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, int(replicas)))
+	require.NoError(t, err)
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+
+	seen := map[string]*fileInfo{}
+	err = WaitForConverge(ctx, time.Second, func() error {
+		info, err := getFile(ctx, endpoint, port, configTarget)
+		if err != nil {
+			return err
+		}
+		seen[info.Hostname] = info
+		if len(seen) < int(replicas) {
+			return fmt.Errorf("only %d of %d tasks answered", len(seen), replicas)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	for host, info := range seen {
+		require.Equal(t, data, info.Content, "wrong config content in %s", host)
+		require.Equal(t, 1000, info.UID, "wrong config owner in %s", host)
+		require.Equal(t, 1000, info.GID, "wrong config group in %s", host)
+		require.Equal(t, "-rw-r-----", info.Mode.String(), "wrong config mode in %s", host)
+	}
+}
+
+// TestConfigsRotate swaps a service's config with a slow rolling update, and
+// checks that tasks which haven't been updated yet keep the old config while
+// the replacements get the new one
+func TestConfigsRotate(t *testing.T) {
+	t.Parallel()
+	name := "TestConfigsRotate"
+	RequiresAPIVersion(t, "1.30")
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanConfigTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	oldSpec := CannedConfigSpec(name+"Old", []byte("old"), name)
+	oldConfig, err := cli.ConfigCreate(testContext, oldSpec)
+	require.NoError(t, err, "Error creating config")
+	newSpec := CannedConfigSpec(name+"New", []byte("new"), name)
+	newConfig, err := cli.ConfigCreate(testContext, newSpec)
+	require.NoError(t, err, "Error creating config")
+
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Config(configReference(oldConfig.ID, oldSpec.Name, "0", "0", 0444)).
+		// one task at a time, with enough of a gap to observe the mixed state
+		UpdateConfig(swarm.UpdateConfig{
+			Parallelism: 1,
+			Delay:       10 * time.Second,
+		}).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ContainerSpec.Configs = []*swarm.ConfigReference{
+		configReference(newConfig.ID, newSpec.Name, "0", "0", 0444),
+	}
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+
+	// content seen from each task, which must never change for a given task
+	contents := map[string]string{}
+	var conflict error
+	mixed := false
+
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 500*time.Millisecond, func() error {
+		tasks, err := GetServiceTasks(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		oldTasks, newTasks := 0, 0
+		for _, task := range tasks {
+			if task.Status.State != swarm.TaskStateRunning || len(task.Spec.ContainerSpec.Configs) == 0 {
+				continue
+			}
+			switch task.Spec.ContainerSpec.Configs[0].ConfigID {
+			case oldConfig.ID:
+				oldTasks++
+			case newConfig.ID:
+				newTasks++
+			}
+		}
+		if oldTasks > 0 && newTasks > 0 {
+			mixed = true
+		}
+
+		// tasks come and go during the update, so ignore failed requests
+		for i := 0; i < 2*replicas; i++ {
+			info, err := getFile(ctx, endpoint, port, configTarget)
+			if err != nil {
+				continue
+			}
+			if previous, ok := contents[info.Hostname]; ok && previous != info.Content {
+				conflict = fmt.Errorf("task %s changed config from %q to %q", info.Hostname, previous, info.Content)
+				cancel()
+				return conflict
+			}
+			contents[info.Hostname] = info.Content
+		}
+
+		if newTasks != replicas || oldTasks != 0 {
+			return fmt.Errorf("%d of %d tasks updated, %d still on the old config", newTasks, replicas, oldTasks)
+		}
+		return nil
+	})
+	require.NoError(t, conflict)
+	require.NoError(t, err)
+	require.True(t, mixed, "never saw old and new tasks running side by side")
+
+	// with the update finished, every task serves the new config
+	ctx, cancel = WithTimeout(testContext, 30*time.Second)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		for i := 0; i < 2*replicas; i++ {
+			info, err := getFile(ctx, endpoint, port, configTarget)
+			if err != nil {
+				return err
+			}
+			if info.Content != "new" {
+				return fmt.Errorf("task %s still has config %q", info.Hostname, info.Content)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
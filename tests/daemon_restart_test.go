@@ -0,0 +1,75 @@
+package dockere2e
+
+import (
+	// basic imports
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+)
+
+// TestDaemonRestart restarts the engine on a worker running a service's tasks,
+// and checks the tasks survive the restart if the engine has live-restore
+// enabled, or are replaced otherwise, with the node back to ready within the
+// recovery window either way
+func TestDaemonRestart(t *testing.T) {
+	name := "TestDaemonRestart"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	host := worker.Description.Hostname
+	out, err := machines.Run(host, "sudo docker info --format '{{.LiveRestoreEnabled}}'")
+	require.NoError(t, err, out)
+	liveRestore := strings.TrimSpace(out) == "true"
+	t.Logf("Live restore on %s: %v", host, liveRestore)
+
+	replicas := 2
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.id == " + worker.ID).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+	before, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+
+	t.Logf("Restarting the engine on %s", host)
+	start := time.Now()
+	out, err = machines.Run(host, "sudo systemctl restart docker")
+	require.NoError(t, err, out)
+
+	ctx, cancel = WithTimeout(testContext, recoveryWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, nodeReadyCheck(ctx, cli, worker.ID))
+	require.NoError(t, err, "%s did not come back within %s", host, recoveryWindow)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err, "tasks did not recover within %s", recoveryWindow)
+	t.Logf("Recovered after %s", time.Since(start))
+
+	after, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+	if liveRestore {
+		require.Equal(t, before, after, "live-restore should keep the tasks running through the restart")
+		return
+	}
+	for id := range before {
+		require.False(t, after[id], "task %s should have been replaced after the restart", id)
+	}
+}
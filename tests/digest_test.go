@@ -0,0 +1,165 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// pinnedDigest returns the digest the service's image is pinned to
+func pinnedDigest(ctx context.Context, cli *client.Client, serviceID string) (string, error) {
+	service, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return "", err
+	}
+	image := service.Spec.TaskTemplate.ContainerSpec.Image
+	i := strings.LastIndex(image, "@")
+	if i < 0 {
+		return "", fmt.Errorf("service image %s isn't pinned to a digest", image)
+	}
+	return image[i+1:], nil
+}
+
+// digestCheck returns a check that passes once replicas tasks are running the
+// image pinned to digest, and no task is running anything else
+func digestCheck(ctx context.Context, cli *client.Client, serviceID, digest string, replicas int) func() error {
+	return func() error {
+		tasks, err := GetServiceTasks(ctx, cli, serviceID)
+		if err != nil {
+			return err
+		}
+		running := 0
+		for _, task := range tasks {
+			image := task.Spec.ContainerSpec.Image
+			if !strings.HasSuffix(image, "@"+digest) {
+				return fmt.Errorf("task %s runs %s, expected digest %s", task.ID, image, digest)
+			}
+			if task.Status.State == swarm.TaskStateRunning {
+				running++
+			}
+		}
+		if running != replicas {
+			return fmt.Errorf("%d of %d tasks running", running, replicas)
+		}
+		return nil
+	}
+}
+
+// sameImageCheck inspects the containers of the service's tasks, requiring
+// them all to have been created from the same image
+func sameImageCheck(t *testing.T, ctx context.Context, cli *client.Client, serviceID string) string {
+	images := map[string]bool{}
+	var image string
+	inspectTaskContainers(t, ctx, cli, serviceID, func(c types.ContainerJSON) {
+		images[c.Image] = true
+		image = c.Image
+	})
+	require.Len(t, images, 1, "tasks were created from different images: %v", images)
+	return image
+}
+
+// rebuildSelfImage commits a copy of the image the tests run in with an extra
+// label, giving an image that runs the same but has a different digest
+func rebuildSelfImage(ctx context.Context, cli *client.Client, label string) (string, error) {
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image: GetSelfImage(ctx, cli),
+		Cmd:   []string{"true"},
+	}, nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer cli.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+	committed, err := cli.ContainerCommit(ctx, created.ID, types.ContainerCommitOptions{
+		Changes: []string{fmt.Sprintf("LABEL %s=%s", label, UUID())},
+	})
+	if err != nil {
+		return "", err
+	}
+	return committed.ID, nil
+}
+
+// TestServiceDigestPinning deploys a service from a tag in the registry, and
+// checks the tag is resolved to a digest that every task runs. The tag is then
+// pushed again with a different image, and the service has to keep running the
+// old digest, even when scaled, until it's explicitly updated to the tag
+func TestServiceDigestPinning(t *testing.T) {
+	name := "TestServiceDigestPinning"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanSecretTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	linux, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	registry := startRegistry(t, testContext, cli, name, "e2e", "digest")
+	defer registry.Remove(testContext)
+	auth, err := registryAuth(registry.Addr, "e2e", "digest")
+	require.NoError(t, err)
+	tag, err := registry.Push(testContext, "pinned", auth)
+	require.NoError(t, err, "Error pushing to the registry")
+
+	replicas := len(linux)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Image(tag).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateServiceWithOptions(testContext, cli, spec, types.ServiceCreateOptions{EncodedRegistryAuth: auth})
+	require.NoError(t, err, "Error creating service")
+	first, err := pinnedDigest(testContext, cli, service.ID)
+	require.NoError(t, err, "tag wasn't resolved on create")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, digestCheck(ctx, cli, service.ID, first, replicas))
+	require.NoError(t, err)
+	firstImage := sameImageCheck(t, testContext, cli, service.ID)
+
+	// move the tag to a different image
+	rebuilt, err := rebuildSelfImage(testContext, cli, "e2e.digest")
+	require.NoError(t, err, "Error building a new image")
+	defer cli.ImageRemove(context.Background(), rebuilt, types.ImageRemoveOptions{Force: true})
+	_, err = registry.PushImage(testContext, rebuilt, "pinned", auth)
+	require.NoError(t, err, "Error pushing to the registry")
+
+	// scaling up places new tasks, which must still get the pinned image
+	replicas = 2 * len(linux)
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 100*time.Millisecond, func() error {
+		return scaleService(ctx, cli, service.ID, uint64(replicas))
+	})
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, digestCheck(ctx, cli, service.ID, first, replicas))
+	require.NoError(t, err, "retagged image was picked up without an update")
+	require.Equal(t, firstImage, sameImageCheck(t, testContext, cli, service.ID))
+
+	// updating the service to the tag resolves it again
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ContainerSpec.Image = tag
+	full.Spec.UpdateConfig = &swarm.UpdateConfig{Parallelism: uint64(replicas)}
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{EncodedRegistryAuth: auth})
+	require.NoError(t, err)
+	second, err := pinnedDigest(testContext, cli, service.ID)
+	require.NoError(t, err, "tag wasn't resolved on update")
+	require.NotEqual(t, first, second, "update didn't pick up the retagged image")
+	ctx, cancel = WithTimeout(testContext, 3*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, digestCheck(ctx, cli, service.ID, second, replicas))
+	require.NoError(t, err)
+	require.NotEqual(t, firstImage, sameImageCheck(t, testContext, cli, service.ID))
+}
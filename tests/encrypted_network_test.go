@@ -0,0 +1,176 @@
+package dockere2e
+
+import (
+	// basic imports
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// vxlanIDOption is the overlay driver option holding a network's VXLAN IDs
+const vxlanIDOption = "com.docker.network.driver.overlay.vxlanid_list"
+
+// taskNetworkAddrs returns the addresses the running tasks have on the
+// network, along with the nodes they're on
+func taskNetworkAddrs(tasks []swarm.Task, networkID string) ([]string, map[string]bool) {
+	addrs := []string{}
+	nodes := map[string]bool{}
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		for _, attachment := range task.NetworksAttachments {
+			if attachment.Network.ID != networkID {
+				continue
+			}
+			for _, addr := range attachment.Addresses {
+				// addresses come with the network's prefix length
+				addrs = append(addrs, strings.Split(addr, "/")[0])
+			}
+			nodes[task.NodeID] = true
+		}
+	}
+	return addrs, nodes
+}
+
+// capturePackets counts up to limit packets matching filter on the machine
+// within the given number of seconds
+func capturePackets(m *Machines, machine, filter string, seconds, limit int) (int, error) {
+	out, err := m.Run(machine, fmt.Sprintf("sudo timeout %d tcpdump -nn -i any -c %d '%s' 2>/dev/null | wc -l", seconds, limit, filter))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err, out)
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// TestNetworkEncryptedOverlay runs tasks across nodes on an encrypted overlay,
+// checks they can all reach each other, and captures traffic on one of the
+// hosts to make sure it crosses the wire as ESP rather than plain VXLAN
+func TestNetworkEncryptedOverlay(t *testing.T) {
+	name := "TestNetworkEncryptedOverlay"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	if len(nodes) < 2 {
+		t.Skip("the data path can only be checked between at least 2 nodes")
+	}
+
+	nwName := getUniqueName(name)
+	nc := types.NetworkCreate{
+		Driver:         "overlay",
+		CheckDuplicate: true,
+		Labels:         testLabels(name),
+		Options:        map[string]string{"encrypted": ""},
+	}
+	nw, err := cli.NetworkCreate(testContext, nwName, nc)
+	require.NoError(t, err, "Error creating overlay network %s", nwName)
+
+	replicas := len(nodes)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwName).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	addrs, taskNodes := taskNetworkAddrs(tasks, nw.ID)
+	require.Len(t, addrs, replicas, "every task should have an address on %s", nwName)
+	if len(taskNodes) < 2 {
+		t.Skip("all tasks were scheduled on the same node")
+	}
+	// capture on a host running one of the tasks
+	captureNode := ""
+	for _, node := range nodes {
+		if taskNodes[node.ID] {
+			captureNode = node.Description.Hostname
+			break
+		}
+	}
+
+	network, err := cli.NetworkInspect(testContext, nw.ID, false)
+	require.NoError(t, err)
+	vxlanID, err := strconv.Atoi(strings.Split(network.Options[vxlanIDOption], ",")[0])
+	require.NoError(t, err, "no VXLAN ID on %s: %v", nwName, network.Options)
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+	targets := []string{}
+	for _, addr := range addrs {
+		targets = append(targets, "http://"+addr+":80/")
+	}
+	reachAll := func() error {
+		results, err := fanout(ctx, endpoint, port, targets)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if !strings.Contains(result, ":200:") {
+				return fmt.Errorf("task unreachable over %s: %s", nwName, result)
+			}
+		}
+		return nil
+	}
+	err = WaitForConverge(ctx, time.Second, reachAll)
+	require.NoError(t, err)
+
+	// keep traffic flowing between the tasks while the host is captured. The
+	// routing mesh carries the fanout request itself over the unencrypted
+	// ingress network, so only VXLAN frames with this network's ID count
+	t.Logf("Capturing the data path on %s", captureNode)
+	var esp, plain int
+	var espErr, plainErr error
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		esp, espErr = capturePackets(machines, captureNode, "esp", 20, 20)
+	}()
+	go func() {
+		defer wg.Done()
+		plain, plainErr = capturePackets(machines, captureNode, fmt.Sprintf("udp port 4789 and (udp[12:4] >> 8) = %d", vxlanID), 20, 20)
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(200 * time.Millisecond):
+				reachAll()
+			}
+		}
+	}()
+	require.NoError(t, espErr)
+	require.NoError(t, plainErr)
+	require.NotZero(t, esp, "no ESP traffic seen on %s", captureNode)
+	require.Zero(t, plain, "plaintext VXLAN traffic for %s seen on %s", nwName, captureNode)
+}
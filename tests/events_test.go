@@ -0,0 +1,204 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+)
+
+// eventRecorder collects the events an engine streams
+type eventRecorder struct {
+	mu       sync.Mutex
+	messages []events.Message
+	err      error
+}
+
+// recordEvents subscribes to the engine's events until ctx is done
+func recordEvents(ctx context.Context, cli *client.Client) *eventRecorder {
+	r := &eventRecorder{}
+	messages, errs := cli.Events(ctx, types.EventsOptions{})
+	go func() {
+		for {
+			select {
+			case m := <-messages:
+				r.mu.Lock()
+				r.messages = append(r.messages, m)
+				r.mu.Unlock()
+			case err := <-errs:
+				r.mu.Lock()
+				if ctx.Err() == nil {
+					r.err = err
+				}
+				r.mu.Unlock()
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// count returns how many of the recorded events match
+func (r *eventRecorder) count(match func(events.Message) bool) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return 0, fmt.Errorf("event stream failed: %s", r.err)
+	}
+	n := 0
+	for _, m := range r.messages {
+		if match(m) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// waitFor waits until at least n recorded events match. The timeout is kept
+// short, an event taking longer than that means the stream has stalled
+func (r *eventRecorder) waitFor(ctx context.Context, n int, description string, match func(events.Message) bool) error {
+	ctx, cancel := WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return WaitForConverge(ctx, 100*time.Millisecond, func() error {
+		seen, err := r.count(match)
+		if err != nil {
+			return err
+		}
+		if seen < n {
+			return fmt.Errorf("saw %d %s events, expected %d", seen, description, n)
+		}
+		return nil
+	})
+}
+
+// serviceEvent matches the service's events with the given action
+func serviceEvent(serviceID, action string) func(events.Message) bool {
+	return func(m events.Message) bool {
+		return m.Type == events.ServiceEventType && m.Action == action && m.Actor.ID == serviceID
+	}
+}
+
+// taskContainerEvent matches the events of the service's task containers with
+// the given action, which carry the task labels
+func taskContainerEvent(serviceID, action string) func(events.Message) bool {
+	return func(m events.Message) bool {
+		return m.Type == events.ContainerEventType && m.Action == action &&
+			m.Actor.Attributes["com.docker.swarm.service.id"] == serviceID &&
+			m.Actor.Attributes["com.docker.swarm.task.id"] != ""
+	}
+}
+
+// ingressConnectEvent matches the service's task containers being connected to
+// the ingress network. It's only safe to call from count, which holds the lock
+func ingressConnectEvent(r *eventRecorder, serviceID string) func(events.Message) bool {
+	return func(m events.Message) bool {
+		if m.Type != events.NetworkEventType || m.Action != "connect" || m.Actor.Attributes["name"] != "ingress" {
+			return false
+		}
+		// connect events only name the container, so match it against the
+		// task containers that were created
+		for _, c := range r.messages {
+			if taskContainerEvent(serviceID, "create")(c) && c.Actor.ID == m.Actor.Attributes["container"] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// TestEventsStream subscribes to the events of the local manager and, if it
+// can reach one, a worker, then creates, scales and removes services and
+// checks the expected events arrive with the right attributes
+func TestEventsStream(t *testing.T) {
+	name := "TestEventsStream"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	streamCtx, stopStreams := context.WithCancel(testContext)
+	defer stopStreams()
+	manager := recordEvents(streamCtx, cli)
+	var worker *eventRecorder
+	if node, err := GetSpareWorker(testContext, cli); err != nil {
+		t.Logf("Only checking the manager's events: %s", err)
+	} else if workerCli, err := GetNodeClient(node); err != nil {
+		t.Logf("Only checking the manager's events: %s", err)
+	} else {
+		worker = recordEvents(streamCtx, workerCli)
+	}
+
+	// a global service puts a task container on every node
+	globalSpec := NewServiceSpec(testContext, cli, name+"Global").
+		Label(name).
+		Global().
+		Constraint("node.platform.os == linux").
+		Build()
+	global, err := CreateService(testContext, cli, globalSpec)
+	require.NoError(t, err, "Error creating service")
+
+	require.NoError(t, manager.waitFor(testContext, 1, "service create", serviceEvent(global.ID, "create")))
+	created, err := manager.count(serviceEvent(global.ID, "create"))
+	require.NoError(t, err)
+	require.Equal(t, 1, created, "service create should only be reported once")
+	for _, r := range []*eventRecorder{manager, worker} {
+		if r == nil {
+			continue
+		}
+		require.NoError(t, r.waitFor(testContext, 1, "task container start", taskContainerEvent(global.ID, "start")))
+		require.NoError(t, r.waitFor(testContext, 1, "ingress connect", ingressConnectEvent(r, global.ID)))
+	}
+
+	// a replicated service on the local node is scaled up
+	scaledSpec := NewServiceSpec(testContext, cli, name+"Scaled").
+		Label(name).
+		Constraint("node.id == " + info.Swarm.NodeID).
+		Build()
+	scaled, err := CreateService(testContext, cli, scaledSpec)
+	require.NoError(t, err, "Error creating service")
+	require.NoError(t, manager.waitFor(testContext, 1, "task container start", taskContainerEvent(scaled.ID, "start")))
+
+	full, _, err := cli.ServiceInspectWithRaw(testContext, scaled.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	var replicas uint64 = 3
+	full.Spec.Mode.Replicated.Replicas = &replicas
+	_, err = cli.ServiceUpdate(testContext, scaled.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, manager.waitFor(testContext, 1, "service update", serviceEvent(scaled.ID, "update")))
+	require.NoError(t, manager.waitFor(testContext, int(replicas), "task container start", taskContainerEvent(scaled.ID, "start")))
+
+	// removal is reported too, and the containers go away everywhere
+	require.NoError(t, CleanTestServices(testContext, cli, name))
+	require.NoError(t, manager.waitFor(testContext, 1, "service remove", serviceEvent(global.ID, "remove")))
+	require.NoError(t, manager.waitFor(testContext, 1, "service remove", serviceEvent(scaled.ID, "remove")))
+	require.NoError(t, manager.waitFor(testContext, int(replicas), "task container destroy", taskContainerEvent(scaled.ID, "destroy")))
+	for _, r := range []*eventRecorder{manager, worker} {
+		if r == nil {
+			continue
+		}
+		require.NoError(t, r.waitFor(testContext, 1, "task container destroy", taskContainerEvent(global.ID, "destroy")))
+	}
+
+	// the service events carry the service's name
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for _, m := range manager.messages {
+		if m.Type == events.ServiceEventType && m.Actor.ID == global.ID {
+			require.Equal(t, globalSpec.Name, m.Actor.Attributes["name"], "%s event has the wrong name", m.Action)
+		}
+	}
+}
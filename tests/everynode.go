@@ -0,0 +1,160 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// NodeCheck is an assertion about a node, made against its own engine
+type NodeCheck func(ctx context.Context, node swarm.Node, cli *client.Client) error
+
+// NodeErrors are the failures of a NodeCheck run on every node, by hostname
+type NodeErrors map[string]error
+
+func (e NodeErrors) Error() string {
+	hosts := []string{}
+	for host := range e {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	failures := []string{}
+	for _, host := range hosts {
+		failures = append(failures, fmt.Sprintf("%s: %s", host, e[host]))
+	}
+	return fmt.Sprintf("%d nodes failed: %s", len(hosts), strings.Join(failures, "; "))
+}
+
+// unreachableError is the failure of a node whose engine couldn't be reached
+// to run the check
+type unreachableError struct {
+	err error
+}
+
+func (e unreachableError) Error() string {
+	return fmt.Sprintf("engine unreachable: %s", e.err)
+}
+
+// OnEveryNode runs the check against the engine of every ready node at once,
+// cli's for the local one, and returns NodeErrors with the nodes it failed
+// on, or nil if it passed on all of them. Asking the manager alone misses
+// what's left on the other nodes, like the containers of removed tasks. The
+// nodes whose engine can't be reached fail too, see IgnoreUnreachable
+func OnEveryNode(ctx context.Context, cli *client.Client, check NodeCheck) error {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return err
+	}
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return err
+	}
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed = NodeErrors{}
+	)
+	for _, node := range nodes {
+		if node.Status.State != swarm.NodeStateReady {
+			continue
+		}
+		wg.Add(1)
+		go func(node swarm.Node) {
+			defer wg.Done()
+			nodeCli := cli
+			var err error
+			if node.ID != info.Swarm.NodeID {
+				nodeCli, err = GetNodeClient(node)
+				if err != nil {
+					err = unreachableError{err}
+				}
+			}
+			if err == nil {
+				err = check(ctx, node, nodeCli)
+			}
+			if err != nil {
+				mu.Lock()
+				failed[node.Description.Hostname] = err
+				mu.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// IgnoreUnreachable returns the error of OnEveryNode without the nodes whose
+// engine couldn't be reached, for the checks that make do with the nodes that
+// can be, logging those left out
+func IgnoreUnreachable(ctx context.Context, err error) error {
+	failed, ok := err.(NodeErrors)
+	if !ok {
+		return err
+	}
+	reached := NodeErrors{}
+	for host, err := range failed {
+		if _, ok := err.(unreachableError); ok {
+			Logger(ctx).WithField("node", host).WithError(err).Warn("node left out of the check")
+			continue
+		}
+		reached[host] = err
+	}
+	if len(reached) > 0 {
+		return reached
+	}
+	return nil
+}
+
+// NetworkOnNode returns a check that passes if the network is on the node
+func NetworkOnNode(name string) NodeCheck {
+	return func(ctx context.Context, node swarm.Node, cli *client.Client) error {
+		_, err := cli.NetworkInspect(ctx, name, false)
+		return err
+	}
+}
+
+// NoNetworkOnNode returns a check that passes if the network isn't on the
+// node, or no longer is
+func NoNetworkOnNode(name string) NodeCheck {
+	return func(ctx context.Context, node swarm.Node, cli *client.Client) error {
+		if _, err := cli.NetworkInspect(ctx, name, false); err == nil {
+			return fmt.Errorf("network %s is still there", name)
+		}
+		return nil
+	}
+}
+
+// NoContainers returns a check that passes if the node has no container,
+// running or not, matching the filter
+func NoContainers(f filters.Args) NodeCheck {
+	return func(ctx context.Context, node swarm.Node, cli *client.Client) error {
+		containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: f})
+		if err != nil {
+			return err
+		}
+		if len(containers) > 0 {
+			names := []string{}
+			for _, c := range containers {
+				names = append(names, strings.Join(c.Names, ","))
+			}
+			return fmt.Errorf("%d containers left: %s", len(containers), strings.Join(names, " "))
+		}
+		return nil
+	}
+}
+
+// NoContainersLabeled is NoContainers for the containers of this run with all
+// the labels, like those of a test
+func NoContainersLabeled(labels ...string) NodeCheck {
+	return NoContainers(GetTestFilter(labels...))
+}
@@ -0,0 +1,142 @@
+package dockere2e
+
+import (
+	// basic imports
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// execInTask runs cmd in the container, feeding it stdin, and returns what it
+// wrote to stdout and stderr along with its exit code
+func execInTask(ctx context.Context, cli *client.Client, containerID string, cmd []string, stdin string) (string, string, int, error) {
+	config := types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	exec, err := cli.ContainerExecCreate(ctx, containerID, config)
+	if err != nil {
+		return "", "", 0, err
+	}
+	resp, err := cli.ContainerExecAttach(ctx, exec.ID, config)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer resp.Close()
+	if _, err := resp.Conn.Write([]byte(stdin)); err != nil {
+		return "", "", 0, err
+	}
+	if err := resp.CloseWrite(); err != nil {
+		return "", "", 0, err
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	// without a tty, both streams come multiplexed over the connection
+	if _, err := stdcopy.StdCopy(stdout, stderr, resp.Reader); err != nil {
+		return "", "", 0, err
+	}
+
+	// the exit code shows up shortly after the streams close
+	var exitCode int
+	err = WaitForConverge(ctx, 100*time.Millisecond, func() error {
+		inspect, err := cli.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return err
+		}
+		if inspect.Running {
+			return fmt.Errorf("exec %s still running", exec.ID)
+		}
+		exitCode = inspect.ExitCode
+		return nil
+	})
+	return stdout.String(), stderr.String(), exitCode, err
+}
+
+// TestExecIntoTasks finds the container of every task of a service on its
+// node and execs into it, checking the streams and exit codes come through
+func TestExecIntoTasks(t *testing.T) {
+	t.Parallel()
+	name := "TestExecIntoTasks"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	linux := map[string]swarm.Node{}
+	for _, node := range nodes {
+		if node.Description.Platform.OS == "linux" && node.Status.State == swarm.NodeStateReady {
+			linux[node.ID] = node
+		}
+	}
+
+	replicas := len(linux)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		node := linux[task.NodeID]
+		containerID := task.Status.ContainerStatus.ContainerID
+		nodeCli := cli
+		if task.NodeID != info.Swarm.NodeID {
+			nodeCli, err = GetNodeClient(node)
+			if err != nil {
+				// the local tasks can still be covered
+				t.Logf("Skipping the task on %s: %s", node.Description.Hostname, err)
+				continue
+			}
+		}
+
+		// stdin is streamed through to the process and back out
+		input := fmt.Sprintf("hello from %s\n", name)
+		stdout, stderr, exitCode, err := execInTask(ctx, nodeCli, containerID, []string{"cat"}, input)
+		require.NoError(t, err, "exec into %s on %s", containerID, node.Description.Hostname)
+		require.Equal(t, input, stdout)
+		require.Empty(t, stderr)
+		require.Zero(t, exitCode)
+
+		// stderr and the exit code come back separately
+		stdout, stderr, exitCode, err = execInTask(ctx, nodeCli, containerID, []string{"sh", "-c", "echo out; echo err >&2; exit 3"}, "")
+		require.NoError(t, err, "exec into %s on %s", containerID, node.Description.Hostname)
+		require.Equal(t, "out\n", stdout)
+		require.Equal(t, "err\n", stderr)
+		require.Equal(t, 3, exitCode)
+
+		// and the exec runs in the task's container, not some other one
+		stdout, _, _, err = execInTask(ctx, nodeCli, containerID, []string{"hostname"}, "")
+		require.NoError(t, err)
+		require.Equal(t, containerID[:12]+"\n", stdout)
+	}
+}
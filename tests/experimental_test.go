@@ -0,0 +1,155 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/swarm/runtime"
+	"github.com/docker/docker/api/types/versions"
+	"github.com/docker/docker/client"
+)
+
+// experimentalMinAPI is the first API version with plugin services, which
+// managers only accept in experimental mode. Experimental mode itself became
+// a daemon option rather than a separate build in 1.25
+const experimentalMinAPI = "1.30"
+
+// setExperimental sets experimental mode in the daemon.json of the manager and
+// restarts its engine, waiting until it can take swarm requests again. It
+// returns the file as it was so that it can be put back
+func setExperimental(ctx context.Context, cli, managerCli *client.Client, m *Machines, manager swarm.Node, enabled bool) ([]byte, error) {
+	host := manager.Description.Hostname
+	original, err := setDaemonConfig(m, host, "experimental", enabled)
+	if err != nil {
+		return nil, err
+	}
+	if err := restartEngine(ctx, cli, m, host, manager.ID); err != nil {
+		return original, err
+	}
+	ctx, cancel := WithTimeout(ctx, recoveryWindow)
+	defer cancel()
+	return original, WaitForConvergeBackoff(ctx, DefaultBackoff, func() error {
+		info, err := managerCli.Info(ctx)
+		if err != nil {
+			return err
+		}
+		if !info.Swarm.ControlAvailable {
+			return fmt.Errorf("%s isn't acting as a manager yet", host)
+		}
+		if info.ExperimentalBuild != enabled {
+			return fmt.Errorf("%s has experimental %v", host, info.ExperimentalBuild)
+		}
+		return nil
+	})
+}
+
+// pluginServiceSpec returns a spec for a plugin service that can't be
+// scheduled anywhere, so creating it doesn't install anything
+func pluginServiceSpec(name string) swarm.ServiceSpec {
+	return swarm.ServiceSpec{
+		Annotations: swarm.Annotations{
+			Name:   getUniqueName(name),
+			Labels: testLabels(name),
+		},
+		TaskTemplate: swarm.TaskSpec{
+			Runtime: swarm.RuntimePlugin,
+			PluginSpec: &runtime.PluginSpec{
+				Name:   "e2e-experimental",
+				Remote: defaultNetworkPlugin,
+			},
+			Placement: &swarm.Placement{Constraints: []string{"node.labels.e2e.nowhere == " + name}},
+		},
+	}
+}
+
+// TestExperimentalGating turns experimental mode off and then on in the
+// daemon.json of a manager, checking that it only accepts plugin services
+// while it's on. The local manager can't be restarted, so the test talks to
+// another one, and needs at least 3 managers to keep quorum. Engines too old
+// to enable experimental mode in daemon.json, or without plugin services, are
+// skipped
+func TestExperimentalGating(t *testing.T) {
+	name := "TestExperimentalGating"
+	testContext, cancel := NewTestContext(name, 15*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	managers, self, err := GetManagers(testContext, cli)
+	require.NoError(t, err)
+	if len(managers) < 3 {
+		t.Skipf("restarting a manager needs at least 3 managers to keep quorum, the cluster has %d", len(managers))
+	}
+	var target *swarm.Node
+	for i, node := range managers {
+		if node.Description.Hostname != self && !node.ManagerStatus.Leader && node.Description.Platform.OS == "linux" {
+			target = &managers[i]
+			break
+		}
+	}
+	if target == nil {
+		t.Skip("no manager other than the leader and the local node")
+	}
+	host := target.Description.Hostname
+	managerCli, err := GetNodeClient(*target)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	version, err := managerCli.ServerVersion(testContext)
+	require.NoError(t, err)
+	if versions.LessThan(version.APIVersion, experimentalMinAPI) {
+		t.Skipf("%s runs API %s, experimental gating needs %s", host, version.APIVersion, experimentalMinAPI)
+	}
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	t.Logf("Disabling experimental mode on %s", host)
+	original, err := setExperimental(testContext, cli, managerCli, machines, *target, false)
+	defer func() {
+		if original == nil {
+			return
+		}
+		if err := machines.WriteFile(host, daemonJSONPath, original); err != nil {
+			t.Logf("Failed to restore %s on %s: %s", daemonJSONPath, host, err)
+			return
+		}
+		if err := restartEngine(context.Background(), cli, machines, host, target.ID); err != nil {
+			t.Log(err)
+		}
+	}()
+	require.NoError(t, err)
+	_, err = CreateService(testContext, managerCli, pluginServiceSpec(name))
+	require.Error(t, err, "%s accepted a plugin service without experimental mode", host)
+	require.Contains(t, err.Error(), "experimental")
+
+	t.Logf("Enabling experimental mode on %s", host)
+	_, err = setExperimental(testContext, cli, managerCli, machines, *target, true)
+	require.NoError(t, err)
+	version, err = managerCli.ServerVersion(testContext)
+	require.NoError(t, err)
+	require.True(t, version.Experimental, "%s doesn't report experimental mode in its version", host)
+	service, err := CreateService(testContext, managerCli, pluginServiceSpec(name))
+	require.NoError(t, err, "%s rejected a plugin service in experimental mode", host)
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	require.Equal(t, swarm.RuntimePlugin, full.Spec.TaskTemplate.Runtime)
+
+	// the gate is on the manager taking the request, the rest of the cluster
+	// is left as it was
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	if !info.ExperimentalBuild {
+		_, err = CreateService(testContext, cli, pluginServiceSpec(name))
+		require.Error(t, err, "the local manager accepted a plugin service without experimental mode")
+	}
+}
@@ -0,0 +1,244 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// listTestServiceIDs returns the IDs of the test's services as seen by cli
+func listTestServiceIDs(ctx context.Context, cli *client.Client, name string) ([]string, error) {
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{Filters: GetTestFilter(name)})
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, service := range services {
+		ids = append(ids, service.ID)
+	}
+	return ids, nil
+}
+
+// remoteServiceIDs lists the test's services through the CLI on another
+// manager, to compare its copy of the object store with the local one
+func remoteServiceIDs(m *Machines, machine, name string) ([]string, error) {
+	out, err := m.Run(machine, fmt.Sprintf("sudo docker service ls -q --filter label=uuid=%s --filter label=%s | tr '\\n' ' '", UUID(), name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, out)
+	}
+	return strings.Fields(out), nil
+}
+
+// setRole promotes or demotes the node through cli, waiting for the change to
+// be reflected in its manager status
+func setRole(ctx context.Context, cli *client.Client, id string, role swarm.NodeRole) error {
+	node, _, err := cli.NodeInspectWithRaw(ctx, id)
+	if err != nil {
+		return err
+	}
+	node.Spec.Role = role
+	if err := cli.NodeUpdate(ctx, id, node.Version, node.Spec); err != nil {
+		return err
+	}
+	return WaitForConverge(ctx, 2*time.Second, func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, id)
+		if err != nil {
+			return err
+		}
+		if role == swarm.NodeRoleWorker && node.ManagerStatus != nil {
+			return fmt.Errorf("%s is still a manager", node.Description.Hostname)
+		}
+		if role == swarm.NodeRoleManager && (node.ManagerStatus == nil || node.ManagerStatus.Reachability != swarm.ReachabilityReachable) {
+			return fmt.Errorf("%s is not a reachable manager yet", node.Description.Hostname)
+		}
+		return nil
+	})
+}
+
+// handOverLeadership makes another manager the leader when the tests run on
+// the leader, which they can't kill without killing themselves. It's driven
+// from the engine of another manager: demoting the local node there makes the
+// leader hand over, and the local node is promoted back as a follower
+func handOverLeadership(ctx context.Context, cli *client.Client, managers []swarm.Node, self string) (swarm.Node, error) {
+	var peer *swarm.Node
+	for i, node := range managers {
+		if node.Description.Hostname != self && node.ManagerStatus.Reachability == swarm.ReachabilityReachable {
+			peer = &managers[i]
+			break
+		}
+	}
+	if peer == nil {
+		return swarm.Node{}, fmt.Errorf("no other reachable manager to hand leadership over to")
+	}
+	peerCli, err := GetNodeClient(*peer)
+	if err != nil {
+		return swarm.Node{}, err
+	}
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return swarm.Node{}, err
+	}
+	selfID := info.Swarm.NodeID
+
+	if err := setRole(ctx, peerCli, selfID, swarm.NodeRoleWorker); err != nil {
+		return swarm.Node{}, fmt.Errorf("demoting %s: %s", self, err)
+	}
+	if err := setRole(ctx, peerCli, selfID, swarm.NodeRoleManager); err != nil {
+		return swarm.Node{}, fmt.Errorf("promoting %s back: %s", self, err)
+	}
+	// the local engine answers as a manager again once it caught up
+	var leader swarm.Node
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		leader, err = GetLeader(ctx, cli)
+		if err != nil {
+			return err
+		}
+		if leader.ID == selfID {
+			return fmt.Errorf("%s is still the leader", self)
+		}
+		return nil
+	})
+	return leader, err
+}
+
+// TestManagerLeaderFailover kills the leader of a 3 manager cluster, checks
+// that a new leader takes over and keeps scheduling, and that the old leader
+// comes back as a follower with the same view of the cluster
+func TestManagerLeaderFailover(t *testing.T) {
+	name := "TestManagerLeaderFailover"
+	testContext, cancel := NewTestContext(name, 15*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	managers, self, err := GetManagers(testContext, cli)
+	require.NoError(t, err)
+	if len(managers) < 3 {
+		t.Skipf("failover needs at least 3 managers, the cluster has %d", len(managers))
+	}
+	leader, err := GetLeader(testContext, cli)
+	require.NoError(t, err)
+	if leader.Description.Hostname == self {
+		t.Logf("The tests are running on the leader %s, handing leadership over to another manager", self)
+		ctx, cancel := WithTimeout(testContext, 5*time.Minute)
+		leader, err = handOverLeadership(ctx, cli, managers, self)
+		cancel()
+		require.NoError(t, err)
+	}
+	oldLeader := leader.Description.Hostname
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	before := NewServiceSpec(testContext, cli, name+"Before").
+		Replicas(2).
+		Label(name).
+		Build()
+	beforeService, err := CreateService(testContext, cli, before)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(beforeService.ID, cli)(ctx, 2))
+	require.NoError(t, err)
+
+	t.Logf("Killing leader %s", oldLeader)
+	require.NoError(t, machines.Kill(oldLeader))
+	killed := true
+	defer func() {
+		// don't leave the cluster short of a manager if the test fails
+		if killed {
+			machines.Start(oldLeader)
+		}
+	}()
+
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		newLeader, err := GetLeader(ctx, cli)
+		if err != nil {
+			return err
+		}
+		if newLeader.ID == leader.ID {
+			return fmt.Errorf("%s is still the leader", oldLeader)
+		}
+		return nil
+	})
+	require.NoError(t, err, "no new leader was elected")
+
+	// the new leader can still schedule work
+	after := NewServiceSpec(testContext, cli, name+"After").
+		Replicas(3).
+		Label(name).
+		Build()
+	afterService, err := CreateService(testContext, cli, after)
+	require.NoError(t, err, "Error creating service with the leader down")
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(afterService.ID, cli)(ctx, 3))
+	require.NoError(t, err)
+	// the tasks that ran on the old leader get rescheduled too
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(beforeService.ID, cli)(ctx, 2))
+	require.NoError(t, err)
+
+	t.Logf("Restarting %s", oldLeader)
+	require.NoError(t, machines.Start(oldLeader))
+	killed = false
+
+	ctx, cancel = WithTimeout(testContext, 5*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, leader.ID)
+		if err != nil {
+			return err
+		}
+		if node.Status.State != swarm.NodeStateReady {
+			return fmt.Errorf("%s is %s", oldLeader, node.Status.State)
+		}
+		if node.ManagerStatus == nil || node.ManagerStatus.Reachability != swarm.ReachabilityReachable {
+			return fmt.Errorf("%s is not a reachable manager yet", oldLeader)
+		}
+		return nil
+	})
+	require.NoError(t, err, "old leader did not rejoin")
+	node, _, err := cli.NodeInspectWithRaw(testContext, leader.ID)
+	require.NoError(t, err)
+	require.False(t, node.ManagerStatus.Leader, "old leader should rejoin as a follower")
+
+	// the old leader caught up with everything created while it was down
+	local, err := listTestServiceIDs(testContext, cli, name)
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		remote, err := remoteServiceIDs(machines, oldLeader, name)
+		if err != nil {
+			return err
+		}
+		if len(remote) != len(local) {
+			return fmt.Errorf("%s sees %d services, expected %d", oldLeader, len(remote), len(local))
+		}
+		for _, id := range local {
+			found := false
+			for _, r := range remote {
+				// the CLI truncates IDs
+				if strings.HasPrefix(id, r) {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s is missing service %s", oldLeader, id)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
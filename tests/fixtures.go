@@ -0,0 +1,134 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// SuiteFixture is what the tests of a suite share, set up once per run by the
+// first of them to ask for it rather than by every test:
+//
+//	suite := UseSuite(t, TagNetwork)
+//	spec := NewServiceSpec(testContext, cli, name).Network(suite.Network).Build()
+//
+// The tests put their own labels on what they attach to the fixture, so
+// CleanupAll of a test leaves it alone. It's torn down once the run is done,
+// and between the iterations of a loop, see tearDownSuites
+type SuiteFixture struct {
+	// Tag is the suite, one of the tags of suites.go
+	Tag string
+	// Network is the name of an attachable overlay network for the suite's
+	// services and containers, and NetworkID its ID
+	Network   string
+	NetworkID string
+	// Image is the util image, already pulled on every node that could be
+	// reached
+	Image string
+}
+
+// suiteSetup is the setup of a suite's fixture, done once. A setup that
+// failed fails every test that asks for the fixture, without retrying it
+type suiteSetup struct {
+	once    sync.Once
+	fixture *SuiteFixture
+	err     error
+}
+
+var (
+	suitesMu sync.Mutex
+	suites   = map[string]*suiteSetup{}
+)
+
+// suiteLabel is the label of what a suite's fixture created
+func suiteLabel(tag string) string {
+	return "suite-" + tag
+}
+
+// UseSuite returns the fixture of the suite, setting it up if no test of the
+// suite has yet. It fails the test if the fixture couldn't be set up
+func UseSuite(t *testing.T, tag string) *SuiteFixture {
+	suitesMu.Lock()
+	setup, ok := suites[tag]
+	if !ok {
+		setup = &suiteSetup{}
+		suites[tag] = setup
+	}
+	suitesMu.Unlock()
+
+	setup.once.Do(func() {
+		cli, err := GetClient()
+		if err != nil {
+			setup.err = err
+			return
+		}
+		// pulling the image can take a while, give it the time it needs
+		// rather than take it from the first test's
+		ctx, cancel := WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		setup.fixture, setup.err = setUpSuite(ctx, cli, tag)
+	})
+	if setup.err != nil {
+		t.Fatalf("Setting up the %s suite failed: %s", tag, setup.err)
+	}
+	return setup.fixture
+}
+
+// setUpSuite creates the suite's network and pulls the image on every node
+func setUpSuite(ctx context.Context, cli *client.Client, tag string) (*SuiteFixture, error) {
+	fixture := &SuiteFixture{
+		Tag:     tag,
+		Network: getUniqueName(suiteLabel(tag)),
+		Image:   GetSelfImage(ctx, cli),
+	}
+	nw, err := cli.NetworkCreate(ctx, fixture.Network, types.NetworkCreate{
+		Driver:         "overlay",
+		CheckDuplicate: true,
+		Attachable:     true,
+		Labels:         testLabels(suiteLabel(tag)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating network %s: %s", fixture.Network, err)
+	}
+	fixture.NetworkID = nw.ID
+
+	if err := ensureImage(ctx, cli, fixture.Image); err != nil {
+		return nil, fmt.Errorf("pulling %s: %s", fixture.Image, err)
+	}
+	// the other nodes would pull it anyway when they get a task, this only
+	// gets it out of the way of the tests' timeouts. A node that can't be
+	// reached or can't pull it is left to do it then
+	clients, err := GetNodeClients(ctx, cli)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Not pulling the image on every node for the %s suite: %s\n", tag, err)
+	}
+	for _, nodeCli := range clients {
+		if nodeCli == cli {
+			continue
+		}
+		if err := ensureImage(ctx, nodeCli, GetSelfImage(ctx, nodeCli)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error pulling the image for the %s suite: %s\n", tag, err)
+		}
+	}
+	return fixture, nil
+}
+
+// tearDownSuites removes what the suites' fixtures created and forgets them,
+// for the next tests asking for one to set it up again
+func tearDownSuites(ctx context.Context, cli *client.Client) {
+	suitesMu.Lock()
+	torn := suites
+	suites = map[string]*suiteSetup{}
+	suitesMu.Unlock()
+	for tag := range torn {
+		if err := CleanupAll(ctx, cli, UUID(), suiteLabel(tag)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error tearing down the %s suite: %s\n", tag, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// healthFlap is how long the flapping tasks stay healthy, then unhealthy
+	healthFlap = 10 * time.Second
+	// healthFlapFor is how long the tasks keep flapping before steadying
+	healthFlapFor = 90 * time.Second
+	// healthRestartDelay is the delay the restart policy puts between a task
+	// failing and its replacement starting
+	healthRestartDelay = 5 * time.Second
+)
+
+// slotHistory returns the service's tasks grouped by slot, oldest first
+func slotHistory(ctx context.Context, cli *client.Client, serviceID string) (map[int][]swarm.Task, error) {
+	filter := GetTestFilter()
+	filter.Add("service", serviceID)
+	tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: filter})
+	if err != nil {
+		return nil, err
+	}
+	slots := map[int][]swarm.Task{}
+	for _, task := range tasks {
+		slots[task.Slot] = append(slots[task.Slot], task)
+	}
+	for _, history := range slots {
+		sort.Sort(byCreation(history))
+	}
+	return slots, nil
+}
+
+// TestHealthcheckFlapping runs a service whose health flaps until a deadline,
+// checking unhealthy tasks are failed and replaced no sooner than the restart
+// delay, that the failures show up in the task history of every slot, and
+// that the service settles with healthy tasks once the flapping stops.
+// Swarm waits the same delay before every restart, rather than backing off
+// further each time, so only the lower bound is checked
+func TestHealthcheckFlapping(t *testing.T) {
+	name := "TestHealthcheckFlapping"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 2
+	until := time.Now().Add(healthFlapFor)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Command(
+			"util", "test-server",
+			"--health-flap", healthFlap.String(),
+			"--unhealthy-until", until.Format(time.RFC3339),
+		).
+		Build()
+	spec.TaskTemplate.ContainerSpec.Healthcheck = &container.HealthConfig{
+		Test:     []string{"CMD", "util", "health-check"},
+		Interval: time.Second,
+		Timeout:  time.Second,
+		Retries:  2,
+	}
+	delay := healthRestartDelay
+	spec.TaskTemplate.RestartPolicy = &swarm.RestartPolicy{
+		Condition: swarm.RestartPolicyConditionAny,
+		Delay:     &delay,
+	}
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	// wait out the flapping, plus enough for the last unhealthy tasks to be
+	// replaced and the new ones to pass their first checks
+	ctx, cancel := WithTimeout(testContext, healthFlapFor+3*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		if time.Now().Before(until) {
+			return fmt.Errorf("tasks are still flapping")
+		}
+		return ScaleCheck(service.ID, cli)(ctx, replicas)()
+	})
+	require.NoError(t, err)
+
+	slots, err := slotHistory(testContext, cli, service.ID)
+	require.NoError(t, err)
+	require.Len(t, slots, replicas)
+	for slot, history := range slots {
+		var failures []swarm.Task
+		for _, task := range history {
+			if task.Status.State == swarm.TaskStateFailed {
+				failures = append(failures, task)
+			}
+		}
+		// the history is trimmed, so there may be fewer failures than
+		// restarts, but the tasks flapped long enough for a few
+		t.Logf("slot %d: %d tasks, %d failed", slot, len(history), len(failures))
+		require.True(t, len(failures) >= 2, "slot %d has only %d failed tasks", slot, len(failures))
+		for i, task := range failures {
+			require.Contains(t, strings.ToLower(task.Status.Err), "unhealthy", "task %s failed for the wrong reason", task.ID)
+			if i == 0 {
+				continue
+			}
+			gap := task.Status.Timestamp.Sub(failures[i-1].Status.Timestamp)
+			require.True(t, gap >= healthRestartDelay, "slot %d restarted after %s, less than the %s delay", slot, gap, healthRestartDelay)
+		}
+	}
+
+	// with the health steady, the running tasks have to stay put
+	before, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+	time.Sleep(3 * healthFlap)
+	after, err := runningTaskIDs(testContext, cli, service.ID)
+	require.NoError(t, err)
+	require.Equal(t, before, after, "tasks were restarted after the health steadied")
+	inspectTaskContainers(t, testContext, cli, service.ID, func(c types.ContainerJSON) {
+		require.NotNil(t, c.State.Health, "container %s has no health status", c.ID)
+		require.Equal(t, "healthy", c.State.Health.Status, "container %s", c.ID)
+	})
+}
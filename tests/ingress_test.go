@@ -0,0 +1,209 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// ingressSubnet and ingressMTU are what the custom ingress is created with
+	ingressSubnet = "10.254.0.0/24"
+	ingressMTU    = "1400"
+	// ingressSandbox is the namespace holding each node's ingress endpoint
+	ingressSandbox = "/var/run/docker/netns/ingress_sbox"
+	mtuOption      = "com.docker.network.driver.mtu"
+)
+
+// getIngress returns the cluster's ingress network, if it has one
+func getIngress(ctx context.Context, cli *client.Client) (*types.NetworkResource, error) {
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, nw := range networks {
+		if nw.Ingress {
+			full, err := cli.NetworkInspect(ctx, nw.ID, false)
+			if err != nil {
+				return nil, err
+			}
+			return &full, nil
+		}
+	}
+	return nil, nil
+}
+
+// replaceIngress removes the current ingress network and creates a new one
+// from nc. Removal is asynchronous on the nodes, so the create is retried
+// until the old network has gone
+func replaceIngress(ctx context.Context, cli *client.Client, name string, nc types.NetworkCreate) error {
+	nc.Ingress = true
+	return WaitForConverge(ctx, 2*time.Second, func() error {
+		ingress, err := getIngress(ctx, cli)
+		if err != nil {
+			return err
+		}
+		if ingress != nil {
+			if err := cli.NetworkRemove(ctx, ingress.ID); err != nil {
+				return err
+			}
+		}
+		_, err = cli.NetworkCreate(ctx, name, nc)
+		return err
+	})
+}
+
+// ingressCreateFrom returns the create request that reproduces nw
+func ingressCreateFrom(nw *types.NetworkResource) types.NetworkCreate {
+	options := map[string]string{}
+	for k, v := range nw.Options {
+		// allocated by the manager, not part of the request
+		if k != vxlanIDOption {
+			options[k] = v
+		}
+	}
+	ipam := nw.IPAM
+	return types.NetworkCreate{
+		Driver:  nw.Driver,
+		IPAM:    &ipam,
+		Options: options,
+		Labels:  nw.Labels,
+	}
+}
+
+// TestNetworkIngressCustomize replaces the ingress network with one using a
+// custom subnet and MTU, and checks published services work through every
+// node afterwards without the old ingress leaving anything behind
+func TestNetworkIngressCustomize(t *testing.T) {
+	name := "TestNetworkIngressCustomize"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	// ingress can only be removed while nothing publishes ports on it
+	services, err := cli.ServiceList(testContext, types.ServiceListOptions{})
+	require.NoError(t, err)
+	for _, service := range services {
+		for _, port := range service.Endpoint.Ports {
+			if port.PublishMode == swarm.PortConfigPublishModeIngress {
+				t.Skipf("service %s publishes port %d on the ingress network", service.Spec.Name, port.PublishedPort)
+			}
+		}
+	}
+
+	original, err := getIngress(testContext, cli)
+	require.NoError(t, err)
+	require.NotNil(t, original, "cluster has no ingress network")
+	_, customSubnet, err := net.ParseCIDR(ingressSubnet)
+	require.NoError(t, err)
+
+	t.Logf("Replacing ingress %s with a custom one", original.Name)
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = replaceIngress(ctx, cli, original.Name, types.NetworkCreate{
+		Driver:  "overlay",
+		IPAM:    &network.IPAM{Config: []network.IPAMConfig{{Subnet: ingressSubnet}}},
+		Options: map[string]string{mtuOption: ingressMTU},
+	})
+	require.NoError(t, err)
+	defer func() {
+		// put the original ingress back for the other tests
+		ctx, cancel := NewTestContext(name, 2*time.Minute)
+		defer cancel()
+		if err := replaceIngress(ctx, cli, original.Name, ingressCreateFrom(original)); err != nil {
+			t.Logf("Failed to restore the original ingress network: %s", err)
+		}
+	}()
+	defer func() {
+		CaptureFailure(t, cli, name)
+		CleanTestServices(testContext, cli, name)
+		// Wait for the tasks to be removed before replacing the network
+		time.Sleep(3 * time.Second)
+	}()
+
+	custom, err := getIngress(testContext, cli)
+	require.NoError(t, err)
+	require.NotNil(t, custom)
+	require.Equal(t, ingressMTU, custom.Options[mtuOption])
+
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).Replicas(uint64(replicas)).Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	addrs, _ := taskNetworkAddrs(tasks, custom.ID)
+	require.Len(t, addrs, replicas, "every task should be on the new ingress")
+	for _, addr := range addrs {
+		require.True(t, customSubnet.Contains(net.ParseIP(addr)), "task address %s outside of %s", addr, ingressSubnet)
+	}
+
+	// the published port works through the routing mesh on every node
+	_, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	ips, err := GetNodeIps(testContext, cli)
+	require.NoError(t, err)
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	for _, ip := range ips {
+		u := fmt.Sprintf("http://%s:%d/", ip, published)
+		err = WaitForConverge(ctx, time.Second, func() error {
+			resp, err := httpClient.Get(u)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("%s returned %d", u, resp.StatusCode)
+			}
+			return nil
+		})
+		require.NoError(t, err, "published port unreachable through %s", ip)
+	}
+
+	// the ingress endpoints in the hosts' sandboxes should only have the new
+	// network's addresses and MTU, anything else was left over from the old
+	// ingress
+	machines := LookupMachines()
+	if machines == nil {
+		t.Logf("Skipping the sandbox checks, set %s and %s to inspect the hosts", TestkitURLEnv, EnvironmentEnv)
+		return
+	}
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	for _, node := range nodes {
+		if node.Description.Platform.OS != "linux" || node.Status.State != swarm.NodeStateReady {
+			continue
+		}
+		host := node.Description.Hostname
+		out, err := machines.Run(host, fmt.Sprintf("sudo nsenter --net=%s ip -o -4 addr show dev eth0 | awk '{print $4}' | tr '\\n' ' '", ingressSandbox))
+		require.NoError(t, err, "%s: %s", host, out)
+		for _, addr := range strings.Fields(out) {
+			ip, _, err := net.ParseCIDR(addr)
+			require.NoError(t, err, "%s: %s", host, out)
+			require.True(t, customSubnet.Contains(ip), "%s has stale ingress address %s", host, addr)
+		}
+		out, err = machines.Run(host, fmt.Sprintf("sudo nsenter --net=%s ip -o link show eth0", ingressSandbox))
+		require.NoError(t, err, "%s: %s", host, out)
+		require.Contains(t, out, "mtu "+ingressMTU, "%s ingress endpoint has the wrong MTU", host)
+	}
+}
@@ -0,0 +1,148 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// joinedNodeCheck returns a check that passes once a node with the hostname,
+// other than the ones in stale, is ready in the given role, storing its ID
+func joinedNodeCheck(ctx context.Context, cli *client.Client, hostname string, role swarm.NodeRole, stale map[string]bool, id *string) func() error {
+	return func() error {
+		nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if node.Description.Hostname != hostname || stale[node.ID] {
+				continue
+			}
+			if node.Status.State != swarm.NodeStateReady || node.Spec.Role != role {
+				return fmt.Errorf("%s is %s as a %s", hostname, node.Status.State, node.Spec.Role)
+			}
+			*id = node.ID
+			return nil
+		}
+		return fmt.Errorf("%s hasn't joined", hostname)
+	}
+}
+
+// TestSwarmJoinTokenRotation rotates the join tokens, and checks a spare
+// worker taken out of the cluster can't get back in with the old tokens of
+// either role, but can with the new ones
+func TestSwarmJoinTokenRotation(t *testing.T) {
+	testContext, cancel := NewTestContext("TestSwarmJoinTokenRotation", 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CaptureFailure(t, cli, "TestSwarmJoinTokenRotation")
+	machines := GetMachines(t)
+
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	host := worker.Description.Hostname
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	require.NotEmpty(t, info.Swarm.RemoteManagers)
+	managerAddr := info.Swarm.RemoteManagers[0].Addr
+
+	join := func(token string) (string, error) {
+		return machines.Run(host, fmt.Sprintf("sudo docker swarm join --token %s %s", token, managerAddr))
+	}
+	leave := func() {
+		out, err := machines.Run(host, "sudo docker swarm leave --force")
+		require.NoError(t, err, "%s: %s", host, out)
+	}
+
+	// every node ID the machine had in the cluster, to clean up afterwards
+	stale := map[string]bool{worker.ID: true}
+	t.Logf("Taking %s out of the cluster", host)
+	leave()
+	defer func() {
+		// put the worker back with whatever the worker token is now
+		machines.Run(host, "sudo docker swarm leave --force")
+		sw, err := cli.SwarmInspect(context.Background())
+		if err != nil {
+			t.Logf("Failed to rejoin %s to the cluster: %s", host, err)
+		} else if out, err := join(sw.JoinTokens.Worker); err != nil {
+			t.Logf("Failed to rejoin %s to the cluster: %s: %s", host, err, out)
+		}
+		for id := range stale {
+			cli.NodeRemove(context.Background(), id, types.NodeRemoveOptions{Force: true})
+		}
+	}()
+
+	sw, err := cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	old := sw.JoinTokens
+	err = cli.SwarmUpdate(testContext, sw.Version, sw.Spec, swarm.UpdateFlags{
+		RotateWorkerToken:  true,
+		RotateManagerToken: true,
+	})
+	require.NoError(t, err)
+	sw, err = cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	rotated := sw.JoinTokens
+	require.NotEqual(t, old.Worker, rotated.Worker, "worker token wasn't rotated")
+	require.NotEqual(t, old.Manager, rotated.Manager, "manager token wasn't rotated")
+
+	for _, token := range []string{old.Worker, old.Manager} {
+		out, err := join(token)
+		require.Error(t, err, "%s joined with an old token: %s", host, out)
+		state, err := localNodeState(machines, host)
+		require.NoError(t, err)
+		require.Equal(t, "inactive", state, "%s isn't out of the swarm after a rejected join", host)
+	}
+
+	roles := []struct {
+		role  swarm.NodeRole
+		token string
+	}{
+		{swarm.NodeRoleWorker, rotated.Worker},
+		{swarm.NodeRoleManager, rotated.Manager},
+	}
+	for _, r := range roles {
+		out, err := join(r.token)
+		require.NoError(t, err, "%s couldn't join as a %s with the new token: %s", host, r.role, out)
+		ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+		defer cancel()
+		var id string
+		err = WaitForConverge(ctx, 2*time.Second, joinedNodeCheck(ctx, cli, host, r.role, stale, &id))
+		require.NoError(t, err)
+		stale[id] = true
+
+		if r.role == swarm.NodeRoleManager {
+			// demote before leaving, so the cluster doesn't count a missing
+			// manager against its quorum
+			node, _, err := cli.NodeInspectWithRaw(testContext, id)
+			require.NoError(t, err)
+			node.Spec.Role = swarm.NodeRoleWorker
+			require.NoError(t, cli.NodeUpdate(testContext, id, node.Version, node.Spec))
+			err = WaitForConverge(ctx, 2*time.Second, func() error {
+				node, _, err := cli.NodeInspectWithRaw(ctx, id)
+				if err != nil {
+					return err
+				}
+				if node.ManagerStatus != nil {
+					return fmt.Errorf("%s is still a manager", host)
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		}
+		leave()
+	}
+}
@@ -0,0 +1,298 @@
+package dockere2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The load balancer tests don't only check that every task gets requests,
+// they also fail when the routing mesh gets slow or drops requests, with
+// thresholds that can be set for the cluster. The latency threshold is scaled
+// like the timeouts are, see TimeoutMultiplierEnv
+const (
+	// LBP99Env is the highest the 99th percentile of the request latency may
+	// be, 1s by default
+	LBP99Env = "E2E_LB_P99"
+	// LBErrorRateEnv is the highest percentage of requests that may fail, 1
+	// by default
+	LBErrorRateEnv = "E2E_LB_ERROR_RATE"
+)
+
+const (
+	defaultLBP99       = time.Second
+	defaultLBErrorRate = 1.0
+)
+
+// latencyBuckets are the upper bounds of the buckets of the latency
+// histogram, the last bucket has everything slower
+var latencyBuckets = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+// lbThresholds returns the highest p99 latency and error rate allowed
+func lbThresholds() (time.Duration, float64, error) {
+	p99, errorRate := defaultLBP99, defaultLBErrorRate
+	if value := os.Getenv(LBP99Env); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return 0, 0, fmt.Errorf("%s must be a positive duration, not %q", LBP99Env, value)
+		}
+		p99 = d
+	}
+	if value := os.Getenv(LBErrorRateEnv); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 100 {
+			return 0, 0, fmt.Errorf("%s must be a percentage, not %q", LBErrorRateEnv, value)
+		}
+		errorRate = rate
+	}
+	return p99, errorRate, nil
+}
+
+// checkLBThresholds makes sure the thresholds are valid, for TestMain to fail
+// fast rather than have them silently ignored
+func checkLBThresholds() error {
+	_, _, err := lbThresholds()
+	return err
+}
+
+// LoadGenerator sends requests to an HTTP endpoint from several workers
+// until it's stopped, keeping track of which tasks answered and how fast
+type LoadGenerator struct {
+	url    string
+	client *http.Client
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+	hosts     map[string]int
+}
+
+// LoadResult is what a LoadGenerator measured
+type LoadResult struct {
+	Requests  int             `json:"requests"`
+	Errors    int             `json:"errors"`
+	Hosts     map[string]int  `json:"hosts"`
+	P50       time.Duration   `json:"p50"`
+	P90       time.Duration   `json:"p90"`
+	P99       time.Duration   `json:"p99"`
+	Histogram []LatencyBucket `json:"histogram"`
+}
+
+// LatencyBucket counts the requests answered in at most UpTo, and more than
+// the bucket before it. The last bucket has no upper bound, and UpTo 0
+type LatencyBucket struct {
+	UpTo  time.Duration `json:"up_to"`
+	Count int           `json:"count"`
+}
+
+// GenerateLoad starts sending requests to the URL from the workers, each
+// waiting a moment between requests so as not to starve the rest of the test
+func GenerateLoad(ctx context.Context, url string, workers int) *LoadGenerator {
+	l := &LoadGenerator{
+		url:    url,
+		client: &http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Second},
+		stop:   make(chan struct{}),
+		hosts:  map[string]int{},
+	}
+	for i := 0; i < workers; i++ {
+		l.wg.Add(1)
+		go l.run(ctx)
+	}
+	return l
+}
+
+// run sends requests until the generator is stopped or the context is done
+func (l *LoadGenerator) run(ctx context.Context) {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.stop:
+			return
+		default:
+		}
+		l.request(ctx)
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// request sends one request and records how it went
+func (l *LoadGenerator) request(ctx context.Context) {
+	start := time.Now()
+	host, err := l.get()
+	latency := time.Since(start)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		Logger(ctx).WithError(err).Debug("request to the published port failed")
+		l.errors++
+		return
+	}
+	Logger(ctx).WithField("task", host).Debug("request answered")
+	l.latencies = append(l.latencies, latency)
+	l.hosts[host]++
+}
+
+// get requests the URL, returning the task that answered. The util test
+// server puts it in the Host header, other servers answer with it
+func (l *LoadGenerator) get() (string, error) {
+	resp, err := l.client.Get(l.url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	if host := resp.Header.Get("Host"); host != "" {
+		return host, nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Hosts returns how many requests every task answered so far
+func (l *LoadGenerator) Hosts() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	hosts := map[string]int{}
+	for host, n := range l.hosts {
+		hosts[host] = n
+	}
+	return hosts
+}
+
+// Requests returns how many requests were sent so far
+func (l *LoadGenerator) Requests() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.latencies) + l.errors
+}
+
+// Reset forgets what was measured so far, e.g. once the routing mesh has
+// warmed up
+func (l *LoadGenerator) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.latencies = nil
+	l.errors = 0
+	l.hosts = map[string]int{}
+}
+
+// Stop stops sending requests and returns what was measured
+func (l *LoadGenerator) Stop() LoadResult {
+	select {
+	case <-l.stop:
+	default:
+		close(l.stop)
+	}
+	l.wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := LoadResult{
+		Requests: len(l.latencies) + l.errors,
+		Errors:   l.errors,
+		Hosts:    l.hosts,
+	}
+	sorted := append([]time.Duration{}, l.latencies...)
+	sort.Sort(durations(sorted))
+	if len(sorted) > 0 {
+		percentile := func(p float64) time.Duration {
+			return sorted[int(p*float64(len(sorted)-1))]
+		}
+		result.P50, result.P90, result.P99 = percentile(0.50), percentile(0.90), percentile(0.99)
+	}
+	for _, upTo := range latencyBuckets {
+		result.Histogram = append(result.Histogram, LatencyBucket{UpTo: upTo})
+	}
+	result.Histogram = append(result.Histogram, LatencyBucket{})
+	for _, latency := range sorted {
+		i := sort.Search(len(latencyBuckets), func(i int) bool { return latency <= latencyBuckets[i] })
+		result.Histogram[i].Count++
+	}
+	return result
+}
+
+// durations sorts latencies, fastest first
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// ErrorRate returns the percentage of the requests that failed
+func (r LoadResult) ErrorRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return 100 * float64(r.Errors) / float64(r.Requests)
+}
+
+func (r LoadResult) String() string {
+	return fmt.Sprintf("%d requests, %d failed (%.2f%%), latency p50 %s, p90 %s, p99 %s",
+		r.Requests, r.Errors, r.ErrorRate(), truncMillis(r.P50), truncMillis(r.P90), truncMillis(r.P99))
+}
+
+// Check returns an error if the latency or the error rate are above the
+// thresholds, the latency one scaled for the test the context belongs to.
+// When the results are being written, the histogram of the test goes in
+// load/<test>.json in the report directory
+func (r LoadResult) Check(ctx context.Context) error {
+	r.save(ctx)
+	maxP99, maxErrorRate, err := lbThresholds()
+	if err != nil {
+		return err
+	}
+	maxP99 = Scale(ctx, maxP99)
+	problems := []string{}
+	if r.P99 > maxP99 {
+		problems = append(problems, fmt.Sprintf("p99 latency %s is above %s", truncMillis(r.P99), maxP99))
+	}
+	if rate := r.ErrorRate(); rate > maxErrorRate {
+		problems = append(problems, fmt.Sprintf("error rate %.2f%% is above %.2f%%", rate, maxErrorRate))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %s", r, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// save writes the result to the report directory, if there is one
+func (r LoadResult) save(ctx context.Context) {
+	dir := os.Getenv(ReportDirEnv)
+	name, ok := ctx.Value(testNameKey{}).(string)
+	if dir == "" || !ok {
+		return
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(dir, "load"), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "load", artifactName(name)+".json"), data, 0644)
+	}
+	if err != nil {
+		Logger(ctx).WithError(err).Warn("failed to save the load results")
+	}
+}
@@ -0,0 +1,85 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The harness logs what the tests are doing as they go, e.g. when services are
+// created and how long their waits took, to stderr so that it doesn't get in
+// the way of the test output. Every event carries the name of the test its
+// context came from, so the log of a parallel run can be split up by test
+const (
+	// LogFormatEnv is "json" for one JSON object per event, for CI to index,
+	// rather than lines of text
+	LogFormatEnv = "E2E_LOG_FORMAT"
+	// LogLevelEnv is the lowest level logged, info by default. The progress
+	// events are info, the checks of each wait debug
+	LogLevelEnv = "E2E_LOG_LEVEL"
+)
+
+var logger = newLogger()
+
+// testNameKey is the context key of the name of the test
+type testNameKey struct{}
+
+func newLogger() *logrus.Logger {
+	l := logrus.New()
+	l.Out = os.Stderr
+	l.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	if os.Getenv(LogFormatEnv) == "json" {
+		l.Formatter = &logrus.JSONFormatter{}
+	}
+	if level, err := logrus.ParseLevel(os.Getenv(LogLevelEnv)); err == nil {
+		l.Level = level
+	}
+	return l
+}
+
+// checkLogging makes sure the logging settings are valid, for TestMain to
+// fail fast rather than have them silently ignored
+func checkLogging() error {
+	if format := os.Getenv(LogFormatEnv); format != "" && format != "json" && format != "text" {
+		return fmt.Errorf("%s must be json or text, not %q", LogFormatEnv, format)
+	}
+	if level := os.Getenv(LogLevelEnv); level != "" {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return fmt.Errorf("%s: %s", LogLevelEnv, err)
+		}
+	}
+	return nil
+}
+
+// Logger returns the harness logger, with the name of the test the context
+// belongs to and where in the tests it's being called from
+func Logger(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logger)
+	if name, ok := ctx.Value(testNameKey{}).(string); ok {
+		entry = entry.WithField("test", name)
+	}
+	if at := testCaller(); at != "" {
+		entry = entry.WithField("at", at)
+	}
+	return entry
+}
+
+// testCaller returns the file and line of the innermost call from a test
+// file, so that events logged by helpers point at the test using them
+func testCaller() string {
+	for skip := 2; skip < 16; skip++ {
+		_, file, line, ok := runtime.Caller(skip)
+		if !ok {
+			break
+		}
+		if strings.HasSuffix(file, "_test.go") {
+			return fmt.Sprintf("%s:%d", filepath.Base(file), line)
+		}
+	}
+	return ""
+}
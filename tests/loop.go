@@ -0,0 +1,189 @@
+package dockere2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// LoopEnv turns on loop mode, and is how long to keep running the selected
+// tests for, e.g. 2h. Every iteration runs all of them once, and the harness
+// counts how often each one failed and watches the engines grow, to reproduce
+// races too rare to show up in a single run. Flaky tests aren't retried in
+// loop mode, since every failure counts
+const LoopEnv = "E2E_LOOP"
+
+// loopDuration returns how long to loop for, 0 if loop mode is off
+func loopDuration() (time.Duration, error) {
+	value := os.Getenv(LoopEnv)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, not %q", LoopEnv, value)
+	}
+	return d, nil
+}
+
+// checkLoop makes sure the loop duration is valid, for TestMain to fail fast
+// rather than have it silently ignored
+func checkLoop() error {
+	_, err := loopDuration()
+	return err
+}
+
+// loopTest is how a test did over the iterations
+type loopTest struct {
+	Iterations  int     `json:"iterations"`
+	Failures    int     `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+	// LastFailure is the output of the last failed iteration, since only the
+	// last iteration makes it into the rest of the results
+	LastFailure []string `json:"last_failure,omitempty"`
+}
+
+// engineSample is the resource usage of a node's engine at one point
+type engineSample struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+	Fds        int       `json:"fds"`
+	// RSSKB is only sampled on Linux nodes with machine control
+	RSSKB int `json:"rss_kb,omitempty"`
+}
+
+// loopReport is what loop.json in the report directory holds
+type loopReport struct {
+	Start      time.Time                 `json:"start"`
+	Duration   float64                   `json:"duration"`
+	Iterations int                       `json:"iterations"`
+	Tests      map[string]*loopTest      `json:"tests"`
+	Engines    map[string][]engineSample `json:"engines"`
+}
+
+// runLoop runs the tests over and over until the duration is up, and returns
+// the exit code for the whole loop. The reporter is left with the results of
+// the last iteration
+func runLoop(m *testing.M, reporter *Reporter, cli *client.Client, d time.Duration) int {
+	report := &loopReport{
+		Start:   time.Now(),
+		Tests:   map[string]*loopTest{},
+		Engines: map[string][]engineSample{},
+	}
+	deadline := report.Start.Add(d)
+	sampleEngines(cli, report)
+	exit := 0
+	for {
+		reporter.Reset()
+		if m.Run() != 0 {
+			exit = 1
+		}
+		report.Iterations++
+		for name, result := range reporter.Results() {
+			if result.Status == "skip" {
+				continue
+			}
+			test, ok := report.Tests[name]
+			if !ok {
+				test = &loopTest{}
+				report.Tests[name] = test
+			}
+			test.Iterations++
+			if result.Status == "fail" {
+				test.Failures++
+				test.LastFailure = result.Output
+			}
+			test.FailureRate = float64(test.Failures) / float64(test.Iterations)
+		}
+		sampleEngines(cli, report)
+		if time.Now().After(deadline) {
+			break
+		}
+		fmt.Printf("Loop iteration %d done, %s left\n", report.Iterations, truncMillis(deadline.Sub(time.Now())))
+
+		// whatever a failed iteration left behind shouldn't fail the next
+		// and that includes the suites' fixtures, set up again as needed
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		tearDownSuites(ctx, cli)
+		CleanupAll(ctx, cli, UUID())
+		cancel()
+	}
+	report.Duration = time.Since(report.Start).Seconds()
+
+	printLoop(report)
+	if dir := os.Getenv(ReportDirEnv); dir != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, "loop.json"), data, 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing the loop results: %s\n", err)
+		}
+	}
+	return exit
+}
+
+// sampleEngines adds a sample of every engine that can be reached
+func sampleEngines(cli *client.Client, report *loopReport) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	clients, err := GetNodeClients(ctx, cli)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Not sampling every engine: %s\n", err)
+	}
+	machines := LookupMachines()
+	for _, nodeCli := range clients {
+		info, err := nodeCli.Info(ctx)
+		if err != nil {
+			continue
+		}
+		sample := engineSample{
+			Time:       time.Now(),
+			Goroutines: info.NGoroutines,
+			Fds:        info.NFd,
+		}
+		if machines != nil && info.OSType == "linux" {
+			out, err := machines.Run(info.Name, "ps -o rss= -C dockerd")
+			if err == nil {
+				sample.RSSKB, _ = strconv.Atoi(strings.TrimSpace(out))
+			}
+		}
+		report.Engines[info.Name] = append(report.Engines[info.Name], sample)
+	}
+}
+
+// printLoop prints the failure rates of the tests that failed at all, and how
+// much every engine grew from the first sample to the last
+func printLoop(report *loopReport) {
+	fmt.Printf("Looped %d times in %s\n", report.Iterations, truncMillis(time.Duration(report.Duration*float64(time.Second))))
+	names := []string{}
+	for name := range report.Tests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if test := report.Tests[name]; test.Failures > 0 {
+			fmt.Printf("%s failed %d of %d times (%.1f%%)\n", name, test.Failures, test.Iterations, 100*test.FailureRate)
+		}
+	}
+	hosts := []string{}
+	for host := range report.Engines {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		samples := report.Engines[host]
+		first, last := samples[0], samples[len(samples)-1]
+		fmt.Printf("%s: engine grew by %d goroutines, %d fds, %d KB RSS\n", host, last.Goroutines-first.Goroutines, last.Fds-first.Fds, last.RSSKB-first.RSSKB)
+	}
+}
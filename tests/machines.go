@@ -0,0 +1,322 @@
+package dockere2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// Some scenarios (power loss, reboots, partitions) can't be produced through
+// the engine API, so tests reach the machines behind the cluster through a
+// `testkit serve` instance running next to the hypervisor or cloud account.
+// Machines are named after the hostnames they were provisioned with, which is
+// also what swarm reports as the node hostname.
+const (
+	// TestkitURLEnv points at the testkit server, e.g. http://labhost:8080
+	TestkitURLEnv = "E2E_TESTKIT_URL"
+	// TestkitTokenEnv is the bearer token of the testkit server, its
+	// TESTKIT_SERVE_TOKEN
+	TestkitTokenEnv = "E2E_TESTKIT_TOKEN"
+	// EnvironmentEnv names the testkit environment the cluster belongs to
+	EnvironmentEnv = "E2E_ENVIRONMENT"
+	// NodeCertPathEnv is a directory with the ca.pem, cert.pem and key.pem
+	// testkit generated for the environment, for talking to the engines of
+	// the other nodes on port 2376
+	NodeCertPathEnv = "E2E_NODE_CERT_PATH"
+)
+
+// Machines controls the machines of the environment under test
+type Machines struct {
+	url         string
+	environment string
+	token       string
+	client      *http.Client
+}
+
+// GetMachines returns the controller for the environment under test, skipping
+// the test if the harness wasn't given one
+func GetMachines(t *testing.T) *Machines {
+	m := LookupMachines()
+	if m == nil {
+		t.Skipf("machine control not available, set %s and %s to run this test", TestkitURLEnv, EnvironmentEnv)
+	}
+	return m
+}
+
+// LookupMachines returns the controller for the environment under test, or
+// nil if there isn't one, for tests that only use it for extra checks
+func LookupMachines() *Machines {
+	testkitURL := os.Getenv(TestkitURLEnv)
+	environment := os.Getenv(EnvironmentEnv)
+	if testkitURL == "" || environment == "" {
+		return nil
+	}
+	return &Machines{
+		url:         strings.TrimRight(testkitURL, "/"),
+		environment: environment,
+		token:       os.Getenv(TestkitTokenEnv),
+		// power operations wait for the machine to come back
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// request sends the request to the environment's path on the testkit server,
+// returning the response body along with an error for any non-200 status
+func (m *Machines) request(method, path, contentType string, body io.Reader) ([]byte, error) {
+	u := fmt.Sprintf("%s/environments/%s%s", m.url, m.environment, path)
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if m.token != "" {
+		req.Header.Set("Authorization", "Bearer "+m.token)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return respData, fmt.Errorf("%s %s returned %d: %s", method, u, resp.StatusCode, strings.TrimSpace(string(respData)))
+	}
+	return respData, nil
+}
+
+func (m *Machines) post(path string, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	respData, err := m.request(http.MethodPost, path, "application/json", bytes.NewReader(data))
+	if result != nil && respData != nil {
+		// run returns its results even when a command fails
+		json.Unmarshal(respData, result)
+	}
+	return err
+}
+
+func (m *Machines) action(machine, action string) error {
+	return m.post("/machines/"+machine+"/"+action, struct{}{}, nil)
+}
+
+// Kill powers off the machine without a clean shutdown
+func (m *Machines) Kill(machine string) error {
+	return m.action(machine, "kill")
+}
+
+// Start boots a stopped or killed machine, returning once it's reachable
+func (m *Machines) Start(machine string) error {
+	return m.action(machine, "start")
+}
+
+// Reboot restarts the machine's OS, returning once it's back up
+func (m *Machines) Reboot(machine string) error {
+	return m.action(machine, "reboot")
+}
+
+// Run executes the commands on the machine, returning the combined output
+func (m *Machines) Run(machine string, commands ...string) (string, error) {
+	results := []struct {
+		Output string `json:"output"`
+		Error  string `json:"error"`
+	}{}
+	err := m.post("/machines/"+machine+"/run", map[string][]string{"commands": commands}, &results)
+	outputs := []string{}
+	for _, r := range results {
+		outputs = append(outputs, r.Output)
+	}
+	return strings.Join(outputs, "\n"), err
+}
+
+// Archive returns the contents of a directory on the machine as a tar
+func (m *Machines) Archive(machine, dir string) ([]byte, error) {
+	return m.request(http.MethodGet, "/machines/"+machine+"/archive?path="+url.QueryEscape(dir), "", nil)
+}
+
+// WriteFile stores data in a file on the machine
+func (m *Machines) WriteFile(machine, path string, data []byte) error {
+	_, err := m.request(http.MethodPut, "/machines/"+machine+"/file?path="+url.QueryEscape(path), "application/octet-stream", bytes.NewReader(data))
+	return err
+}
+
+// partitionChain holds the rules Partition adds, so Heal can flush them
+// without touching the ones docker manages
+const partitionChain = "E2E-PARTITION"
+
+// Partition drops all traffic between the machine and the peer addresses
+// until Heal is called. The testkit server keeps reaching the machine, as
+// long as it isn't one of the peers
+func (m *Machines) Partition(machine string, peers []string) error {
+	commands := []string{
+		fmt.Sprintf("sudo iptables -N %s || true", partitionChain),
+		fmt.Sprintf("sudo iptables -C INPUT -j %[1]s || sudo iptables -I INPUT -j %[1]s", partitionChain),
+		fmt.Sprintf("sudo iptables -C OUTPUT -j %[1]s || sudo iptables -I OUTPUT -j %[1]s", partitionChain),
+	}
+	for _, peer := range peers {
+		commands = append(commands,
+			fmt.Sprintf("sudo iptables -A %s -s %s -j DROP", partitionChain, peer),
+			fmt.Sprintf("sudo iptables -A %s -d %s -j DROP", partitionChain, peer),
+		)
+	}
+	out, err := m.Run(machine, commands...)
+	if err != nil {
+		return fmt.Errorf("partitioning %s: %s: %s", machine, err, out)
+	}
+	return nil
+}
+
+// Heal removes any partition from the machine
+func (m *Machines) Heal(machine string) error {
+	out, err := m.Run(machine, fmt.Sprintf("sudo iptables -F %s || true", partitionChain))
+	if err != nil {
+		return fmt.Errorf("healing %s: %s: %s", machine, err, out)
+	}
+	return nil
+}
+
+// GetManagers returns the manager nodes of the cluster, and the
+// machine name of the local node, which the tests can't take down
+func GetManagers(ctx context.Context, cli *client.Client) ([]swarm.Node, string, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	managers := []swarm.Node{}
+	self := ""
+	for _, node := range nodes {
+		if node.ID == info.Swarm.NodeID {
+			self = node.Description.Hostname
+		}
+		if node.ManagerStatus != nil {
+			managers = append(managers, node)
+		}
+	}
+	return managers, self, nil
+}
+
+// GetLeader returns the current leader, or an error if there isn't exactly one
+func GetLeader(ctx context.Context, cli *client.Client) (swarm.Node, error) {
+	managers, _, err := GetManagers(ctx, cli)
+	if err != nil {
+		return swarm.Node{}, err
+	}
+	leaders := []swarm.Node{}
+	for _, node := range managers {
+		if node.ManagerStatus.Leader {
+			leaders = append(leaders, node)
+		}
+	}
+	if len(leaders) != 1 {
+		return swarm.Node{}, fmt.Errorf("found %d leaders", len(leaders))
+	}
+	return leaders[0], nil
+}
+
+// GetSpareWorker returns a ready linux worker other than the local node, for
+// tests that need to take a node out of service
+func GetSpareWorker(ctx context.Context, cli *client.Client) (swarm.Node, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return swarm.Node{}, err
+	}
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return swarm.Node{}, err
+	}
+	for _, node := range nodes {
+		if node.ID == info.Swarm.NodeID || node.ManagerStatus != nil {
+			continue
+		}
+		if node.Status.State == swarm.NodeStateReady && node.Description.Platform.OS == "linux" {
+			return node, nil
+		}
+	}
+	return swarm.Node{}, fmt.Errorf("no spare linux worker in the cluster")
+}
+
+// GetNodeClient returns a client for the engine of another node, for the
+// things that only work against the engine running a container
+func GetNodeClient(node swarm.Node) (*client.Client, error) {
+	httpClient, err := nodeHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.NewClient(fmt.Sprintf("tcp://%s:2376", node.Status.Addr), api.DefaultVersion, httpClient, nil)
+}
+
+// nodeHTTPClient returns an HTTP client with the certificates of the engines,
+// for what of their API the engine client doesn't cover
+func nodeHTTPClient() (*http.Client, error) {
+	certPath := os.Getenv(NodeCertPathEnv)
+	if certPath == "" {
+		return nil, fmt.Errorf("set %s to talk to the engines of other nodes", NodeCertPathEnv)
+	}
+	tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+		CAFile:   filepath.Join(certPath, "ca.pem"),
+		CertFile: filepath.Join(certPath, "cert.pem"),
+		KeyFile:  filepath.Join(certPath, "key.pem"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// GetNodeClients returns clients for the engines of every ready node, keyed by
+// node ID, using cli for the local one. Nodes that can't be reached are left
+// out, with the last error returned alongside the rest
+func GetNodeClients(ctx context.Context, cli *client.Client) (map[string]*client.Client, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	clients := map[string]*client.Client{}
+	var lastErr error
+	for _, node := range nodes {
+		if node.Status.State != swarm.NodeStateReady {
+			continue
+		}
+		if node.ID == info.Swarm.NodeID {
+			clients[node.ID] = cli
+			continue
+		}
+		nodeCli, err := GetNodeClient(node)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %s", node.Description.Hostname, err)
+			continue
+		}
+		clients[node.ID] = nodeCli
+	}
+	return clients, lastErr
+}
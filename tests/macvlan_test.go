@@ -0,0 +1,192 @@
+package dockere2e
+
+import (
+	// basic imports
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// Macvlan needs a NIC on every machine that's plugged into a common L2
+// segment, which the environment has to provide on top of the primary network
+const (
+	// MacvlanParentEnv names the secondary NIC, e.g. eth1
+	MacvlanParentEnv = "E2E_MACVLAN_PARENT"
+	// MacvlanSubnetEnv is the subnet of the segment, e.g. 192.168.50.0/24
+	MacvlanSubnetEnv = "E2E_MACVLAN_SUBNET"
+	// MacvlanGatewayEnv is the gateway of the segment
+	MacvlanGatewayEnv = "E2E_MACVLAN_GATEWAY"
+)
+
+// macvlanIPRange carves the i-th /28 out of the subnet, so that the
+// per-node config networks don't hand out the same addresses
+func macvlanIPRange(subnet *net.IPNet, i int) (string, error) {
+	base := subnet.IP.To4()
+	if base == nil {
+		return "", fmt.Errorf("%s is not an IPv4 subnet", subnet)
+	}
+	ones, _ := subnet.Mask.Size()
+	// skip the first block, which holds the gateway and the hosts' own addresses
+	offset := 16 * (i + 1)
+	if ones > 28 || offset+16 > 1<<uint(32-ones) {
+		return "", fmt.Errorf("%s is too small for %d nodes", subnet, i+1)
+	}
+	ip := net.IPv4(base[0], base[1], base[2]+byte(offset/256), base[3]+byte(offset%256))
+	return fmt.Sprintf("%s/28", ip), nil
+}
+
+// TestNetworkMacvlan creates a swarm scoped macvlan network on the machines'
+// secondary NIC, attaches a service and a container to it, and checks the
+// endpoints reach each other directly over the segment and can be reached
+// from the hosts
+func TestNetworkMacvlan(t *testing.T) {
+	name := "TestNetworkMacvlan"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	parent := os.Getenv(MacvlanParentEnv)
+	subnetStr := os.Getenv(MacvlanSubnetEnv)
+	gateway := os.Getenv(MacvlanGatewayEnv)
+	if parent == "" || subnetStr == "" || gateway == "" {
+		t.Skipf("set %s, %s and %s to run macvlan tests", MacvlanParentEnv, MacvlanSubnetEnv, MacvlanGatewayEnv)
+	}
+	_, subnet, err := net.ParseCIDR(subnetStr)
+	require.NoError(t, err)
+
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	linux := []swarm.Node{}
+	for _, node := range nodes {
+		if node.Description.Platform.OS == "linux" && node.Status.State == swarm.NodeStateReady {
+			linux = append(linux, node)
+		}
+	}
+	if len(linux) < 2 {
+		t.Skip("macvlan adjacency can only be checked between at least 2 nodes")
+	}
+
+	// the config networks hold each node's share of the segment, and have to
+	// be created on the nodes themselves
+	configName := getUniqueName(name + "Config")
+	hostnames := map[string]string{}
+	for i, node := range linux {
+		host := node.Description.Hostname
+		hostnames[node.ID] = host
+		ipRange, err := macvlanIPRange(subnet, i)
+		require.NoError(t, err)
+		out, err := machines.Run(host, fmt.Sprintf("sudo docker network create --config-only --subnet %s --gateway %s --ip-range %s -o parent=%s %s",
+			subnetStr, gateway, ipRange, parent, configName))
+		require.NoError(t, err, "%s: %s", host, out)
+		defer machines.Run(host, "sudo docker network rm "+configName)
+	}
+
+	nwName := getUniqueName(name)
+	nc := types.NetworkCreate{
+		Driver:         "macvlan",
+		Scope:          "swarm",
+		CheckDuplicate: true,
+		Labels:         testLabels(name),
+		Attachable:     true,
+		ConfigFrom:     &network.ConfigReference{Network: configName},
+	}
+	nw, err := cli.NetworkCreate(testContext, nwName, nc)
+	require.NoError(t, err, "Error creating macvlan network %s", nwName)
+
+	replicas := len(linux)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwName).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	// a plain container on the same network, next to the tests
+	resp, err := cli.ContainerCreate(testContext,
+		&container.Config{Image: GetSelfImage(testContext, cli), Cmd: []string{"util", "test-server"}, Labels: testLabels(name)},
+		&container.HostConfig{AutoRemove: true},
+		&network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{nwName: {}}},
+		getUniqueName(name+"Container"))
+	require.NoError(t, err)
+	defer cli.ContainerRemove(testContext, resp.ID, types.ContainerRemoveOptions{Force: true})
+	require.NoError(t, cli.ContainerStart(testContext, resp.ID, types.ContainerStartOptions{}))
+	inspect, err := cli.ContainerInspect(testContext, resp.ID)
+	require.NoError(t, err)
+	endpointSettings, ok := inspect.NetworkSettings.Networks[nwName]
+	require.True(t, ok, "container is not attached to %s", nwName)
+	containerAddr := endpointSettings.IPAddress
+	require.True(t, subnet.Contains(net.ParseIP(containerAddr)), "container address %s outside of %s", containerAddr, subnetStr)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	addrs, taskNodes := taskNetworkAddrs(tasks, nw.ID)
+	require.Len(t, addrs, replicas, "every task should have an address on %s", nwName)
+	for _, addr := range addrs {
+		require.True(t, subnet.Contains(net.ParseIP(addr)), "task address %s outside of %s", addr, subnetStr)
+	}
+
+	// L2 adjacency: the tasks reach each other and the container directly
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+	targets := []string{"http://" + containerAddr + ":80/"}
+	for _, addr := range addrs {
+		targets = append(targets, "http://"+addr+":80/")
+	}
+	err = WaitForConverge(ctx, time.Second, func() error {
+		results, err := fanout(ctx, endpoint, port, targets)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if !strings.Contains(result, ":200:") {
+				return fmt.Errorf("endpoint unreachable over %s: %s", nwName, result)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// external reachability: the tasks answer hosts on the segment. A
+	// macvlan endpoint can't talk to its own parent, so use another host
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning || !taskNodes[task.NodeID] {
+			continue
+		}
+		from := ""
+		for id, host := range hostnames {
+			if id != task.NodeID {
+				from = host
+				break
+			}
+		}
+		taskAddrs, _ := taskNetworkAddrs([]swarm.Task{task}, nw.ID)
+		for _, addr := range taskAddrs {
+			out, err := machines.Run(from, fmt.Sprintf("curl -s -m 5 http://%s/", addr))
+			require.NoError(t, err, "%s can't reach %s: %s", from, addr, out)
+			require.Equal(t, "OK", strings.TrimSpace(out))
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -19,6 +20,73 @@ func TestMain(m *testing.M) {
 	// gotta call this at the start or NONE of the flags work
 	flag.Parse()
 
+	if *listFlag {
+		if err := listTests(flag.Lookup("test.run").Value.String()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing tests: %s\n", err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	// narrow the run down to the selected suites
+	run, err := selectTests(flag.Lookup("test.run").Value.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error selecting tests: %s\n", err)
+		os.Exit(2)
+	}
+	if run != "" {
+		flag.Set("test.run", run)
+	}
+	if err := checkTimeoutMultipliers(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error scaling timeouts: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logging: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkStatsInterval(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up stats sampling: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkLoop(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up loop mode: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkLBThresholds(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting the load balancer thresholds: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkSeed(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error seeding the tests: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkUpload(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up the upload of the results: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkMetrics(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up the metrics: %s\n", err)
+		os.Exit(2)
+	}
+	if err := checkTracing(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up the tracing: %s\n", err)
+		os.Exit(2)
+	}
+	loop, _ := loopDuration()
+
+	// the reporter reads the results from the verbose output, which is also
+	// how failed tests are found to retry them, how loop mode counts the
+	// failures, and where the metrics and traces of the tests come from
+	var reporter *Reporter
+	if dir := os.Getenv(ReportDirEnv); dir != "" || *retriesFlag > 0 || loop > 0 || os.Getenv(PushgatewayEnv) != "" || os.Getenv(TraceURLEnv) != "" {
+		flag.Set("test.v", "true")
+		reporter, err = NewReporter(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting the reporter, not writing results or retrying: %s\n", err)
+		}
+	}
+
 	// interrupt and finished handler
 	interrupt := make(chan os.Signal, 1)
 	done := make(chan struct{})
@@ -32,6 +100,14 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	// work out which node is which once, for the tests that target nodes
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	cluster, err = DiscoverCluster(ctx, cli)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error discovering the cluster, tests using it will fail: %s\n", err)
+	}
+
 	var exit int
 	// spin up a goroutine to clean up on interrupt
 	go func() {
@@ -39,14 +115,65 @@ func TestMain(m *testing.M) {
 		case <-interrupt:
 		case <-done:
 		}
-		// after the tests have been run (or canceled) clean up any cruft
-		CleanTestServices(context.Background(), cli)
+		// after the tests have been run (or canceled) clean up any cruft,
+		// giving up before the hard quit below
+		ctx, cancel := context.WithTimeout(context.Background(), 9*time.Second)
+		tearDownSuites(ctx, cli)
+		CleanupAll(ctx, cli, UUID())
+		cancel()
 		os.Exit(exit)
 	}()
 
 	fmt.Printf("Running tests with UUID %v\n", UUID())
+	fmt.Printf("Running tests with seed %d, set %s=%d to replay it\n", Seed(), SeedEnv, Seed())
+	if cluster != nil {
+		fmt.Printf("Running against %s\n", cluster)
+	}
 	// run the tests, save the exit
-	exit = m.Run()
+	if loop > 0 && reporter != nil {
+		exit = runLoop(m, reporter, cli, loop)
+	} else {
+		exit = m.Run()
+	}
+	// run the failed flaky tests again, the run only passes if they were all
+	// that failed and they pass this time
+	for i := 0; reporter != nil && loop == 0 && exit != 0 && i < *retriesFlag; i++ {
+		failed := reporter.Failed()
+		retry := retryable(failed)
+		if len(retry) == 0 {
+			break
+		}
+		fmt.Printf("Retrying %s\n", strings.Join(retry, ", "))
+		reporter.Retry(retry)
+		flag.Set("test.run", "^("+strings.Join(retry, "|")+")$")
+		if m.Run() == 0 && len(retry) == len(failed) {
+			exit = 0
+		}
+	}
+	// write the results before the cleanup exits
+	if reporter != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := reporter.Finish(ctx, cli); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing results to %s: %s\n", os.Getenv(ReportDirEnv), err)
+		}
+		cancel()
+		// whatever was written, before the worker it's on goes away
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Minute)
+		if err := uploadResults(ctx, os.Getenv(ReportDirEnv)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error uploading the results to %s: %s\n", os.Getenv(UploadURLEnv), err)
+		}
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		if err := pushMetrics(ctx, reporter.Summary()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error pushing the metrics to %s: %s\n", os.Getenv(PushgatewayEnv), err)
+		}
+		cancel()
+		ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+		if err := sendTraces(ctx, reporter.Summary()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending the traces to %s: %s\n", os.Getenv(TraceURLEnv), err)
+		}
+		cancel()
+	}
 	// close the done channel to run cleanup
 
 	// signal for cleanup
@@ -0,0 +1,151 @@
+package dockere2e
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PushgatewayEnv is the URL of a Prometheus pushgateway to push the metrics of
+// the run to once it's done, for labs running the tests over and over to
+// chart them in Grafana: how many tests passed, failed, were skipped or were
+// flaky, how long each test took, and how long the waits took to converge.
+// They're pushed under the job e2e, each run replacing the last
+const PushgatewayEnv = "E2E_PUSHGATEWAY_URL"
+
+// convergeBuckets are the upper bounds, in seconds, of the buckets of the
+// convergence latencies
+var convergeBuckets = []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300}
+
+// convergeSeries is the histogram of the waits that ended the same way
+type convergeSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var (
+	convergeMu sync.Mutex
+	// converges holds the convergence latencies of the run, by whether the
+	// wait was met or failed
+	converges = map[string]*convergeSeries{}
+)
+
+// observeConverge records how long a wait took
+func observeConverge(d time.Duration, met bool) {
+	result := "failed"
+	if met {
+		result = "met"
+	}
+	convergeMu.Lock()
+	defer convergeMu.Unlock()
+	s, ok := converges[result]
+	if !ok {
+		s = &convergeSeries{counts: make([]uint64, len(convergeBuckets))}
+		converges[result] = s
+	}
+	for i, upper := range convergeBuckets {
+		if d.Seconds() <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += d.Seconds()
+	s.count++
+}
+
+// checkMetrics makes sure the pushgateway URL is valid, for TestMain to fail
+// fast rather than after the whole run
+func checkMetrics() error {
+	value := os.Getenv(PushgatewayEnv)
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL, not %q", PushgatewayEnv, value)
+	}
+	return nil
+}
+
+// pushMetrics pushes the metrics of the run, if there's a pushgateway to push
+// them to
+func pushMetrics(ctx context.Context, summary runSummary) error {
+	gateway := os.Getenv(PushgatewayEnv)
+	if gateway == "" {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, summary)
+	req, err := http.NewRequest(http.MethodPut, strings.TrimRight(gateway, "/")+"/metrics/job/e2e", buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	return doUpload(ctx, req)
+}
+
+// metricLabelEscaper escapes label values like the text format expects
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the metrics of the run in the Prometheus text format
+func writeMetrics(w *bytes.Buffer, summary runSummary) {
+	family := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	family("e2e_run_timestamp_seconds", "gauge", "When the run finished.")
+	fmt.Fprintf(w, "e2e_run_timestamp_seconds %d\n", time.Now().Unix())
+	family("e2e_run_duration_seconds", "gauge", "How long the run took.")
+	fmt.Fprintf(w, "e2e_run_duration_seconds %g\n", summary.Duration)
+
+	family("e2e_tests", "gauge", "Tests and subtests of the run, by status.")
+	for _, status := range []struct {
+		name  string
+		count int
+	}{{"pass", summary.Passed}, {"fail", summary.Failed}, {"skip", summary.Skipped}, {"flaky", summary.Flaky}} {
+		fmt.Fprintf(w, "e2e_tests{status=%q} %d\n", status.name, status.count)
+	}
+
+	family("e2e_test_duration_seconds", "gauge", "How long every test took, with its status.")
+	tests := append([]*testResult{}, summary.Tests...)
+	sort.Sort(byTestName(tests))
+	for _, test := range tests {
+		// subtests are in their parent's time already
+		if strings.Contains(test.Name, "/") {
+			continue
+		}
+		fmt.Fprintf(w, "e2e_test_duration_seconds{test=\"%s\",status=%q} %g\n", metricLabelEscaper.Replace(test.Name), test.Status, test.Duration)
+	}
+
+	family("e2e_converge_duration_seconds", "histogram", "How long the waits for the cluster to converge took, by whether they were met.")
+	convergeMu.Lock()
+	defer convergeMu.Unlock()
+	results := []string{}
+	for result := range converges {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	for _, result := range results {
+		s := converges[result]
+		for i, upper := range convergeBuckets {
+			fmt.Fprintf(w, "e2e_converge_duration_seconds_bucket{result=%q,le=\"%g\"} %d\n", result, upper, s.counts[i])
+		}
+		fmt.Fprintf(w, "e2e_converge_duration_seconds_bucket{result=%q,le=\"+Inf\"} %d\n", result, s.count)
+		fmt.Fprintf(w, "e2e_converge_duration_seconds_sum{result=%q} %g\n", result, s.sum)
+		fmt.Fprintf(w, "e2e_converge_duration_seconds_count{result=%q} %d\n", result, s.count)
+	}
+}
+
+// byTestName sorts results by test name
+type byTestName []*testResult
+
+func (b byTestName) Len() int           { return len(b) }
+func (b byTestName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byTestName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
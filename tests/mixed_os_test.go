@@ -0,0 +1,139 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// imagePlatforms returns the platforms the image runs on, from the registry
+// if it's there, or from the local copy otherwise, as for the image the tests
+// themselves run in
+func imagePlatforms(ctx context.Context, cli *client.Client, image string) ([]swarm.Platform, error) {
+	if dist, err := cli.DistributionInspect(ctx, image, ""); err == nil && len(dist.Platforms) > 0 {
+		platforms := []swarm.Platform{}
+		for _, p := range dist.Platforms {
+			platforms = append(platforms, swarm.Platform{OS: p.OS, Architecture: p.Architecture})
+		}
+		return platforms, nil
+	}
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	return []swarm.Platform{{OS: inspect.Os, Architecture: inspect.Architecture}}, nil
+}
+
+// TestMixedOSApplication runs a Linux frontend and a Windows backend on one
+// overlay, placed only by the platforms of their images rather than by
+// constraints, and checks every task lands on a node of the right OS and
+// that the frontend reaches the backend across the OSes
+func TestMixedOSApplication(t *testing.T) {
+	t.Parallel()
+	name := "TestMixedOSApplication"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	windowsImage, windows := requireWindows(t, testContext, cli)
+	linux, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	require.NotEmpty(t, linux, "no ready Linux nodes")
+
+	nwName := getUniqueName(name)
+	nw, err := cli.NetworkCreate(testContext, nwName, types.NetworkCreate{Driver: "overlay", CheckDuplicate: true, Labels: testLabels(name)})
+	require.NoError(t, err, "Error creating overlay network %s", nwName)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	backendReplicas := 2 * len(windows)
+	platforms, err := imagePlatforms(testContext, cli, windowsImage)
+	require.NoError(t, err)
+	backendSpec := NewServiceSpec(testContext, cli, name+"Backend").
+		Replicas(uint64(backendReplicas)).
+		Network(nwName).
+		Label(name).
+		Image(windowsImage).
+		// no VIPs or routing mesh on Windows
+		DNSRR().
+		Platforms(platforms...).
+		Build()
+	backend, err := CreateService(testContext, cli, backendSpec)
+	require.NoError(t, err, "Error creating backend service")
+
+	frontendReplicas := 2 * len(linux)
+	platforms, err = imagePlatforms(testContext, cli, GetSelfImage(testContext, cli))
+	require.NoError(t, err)
+	frontendSpec := NewServiceSpec(testContext, cli, name+"Frontend").
+		Replicas(uint64(frontendReplicas)).
+		Network(nwName).
+		Label(name).
+		Platforms(platforms...).
+		Build()
+	frontend, err := CreateService(testContext, cli, frontendSpec)
+	require.NoError(t, err, "Error creating frontend service")
+
+	ctx, cancel := WithTimeout(testContext, windowsConverge)
+	defer cancel()
+	err = WaitForState(ctx, cli, ExpectedState{
+		Services: map[string]int{backend.ID: backendReplicas, frontend.ID: frontendReplicas},
+		Networks: map[string]bool{nwName: true},
+	})
+	require.NoError(t, err)
+
+	// each image only ran on its own OS
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	nodeOS := map[string]string{}
+	for _, node := range nodes {
+		nodeOS[node.ID] = node.Description.Platform.OS
+	}
+	backendTasks, err := GetServiceTasks(testContext, cli, backend.ID)
+	require.NoError(t, err)
+	for _, task := range backendTasks {
+		require.Equal(t, "windows", nodeOS[task.NodeID], "backend task %s", task.ID)
+	}
+	frontendTasks, err := GetServiceTasks(testContext, cli, frontend.ID)
+	require.NoError(t, err)
+	for _, task := range frontendTasks {
+		require.Equal(t, "linux", nodeOS[task.NodeID], "frontend task %s", task.ID)
+	}
+
+	// the frontend reaches every backend task, by address and by name
+	addrs, _ := taskNetworkAddrs(backendTasks, nw.ID)
+	require.Len(t, addrs, backendReplicas, "every backend task should have an address on %s", nwName)
+	targets := []string{}
+	for _, addr := range addrs {
+		targets = append(targets, "http://"+addr+":80/")
+	}
+	targets = append(targets, "http://"+backendSpec.Name+":80/")
+	endpoint, err := nodeIP(linux[0])
+	require.NoError(t, err)
+	_, published, err := getNodeIPPort(testContext, cli, frontend.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+	err = WaitForConverge(ctx, time.Second, func() error {
+		results, err := fanout(ctx, endpoint, port, targets)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if !strings.Contains(result, ":200:") {
+				return fmt.Errorf("backend unreachable from the frontend: %s", result)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,259 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// TestServiceMounts runs a task on every node with a named local volume, a
+// bind mount and a tmpfs, checks the mounts show up in the tasks, that each
+// node keeps its own copy of the volume, and that the volume is released once
+// the service is removed
+func TestServiceMounts(t *testing.T) {
+	name := "TestServiceMounts"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	linux := 0
+	hostnames := map[string]string{}
+	for _, node := range nodes {
+		if node.Description.Platform.OS == "linux" && node.Status.State == swarm.NodeStateReady {
+			linux++
+			hostnames[node.ID] = node.Description.Hostname
+		}
+	}
+
+	volName := getUniqueName(name)
+	spec := NewServiceSpec(testContext, cli, name).
+		Global().
+		Constraint("node.platform.os == linux").
+		Mount(
+			mount.Mount{Type: mount.TypeVolume, Source: volName, Target: "/data"},
+			mount.Mount{Type: mount.TypeBind, Source: "/etc/hostname", Target: "/host/hostname", ReadOnly: true},
+			mount.Mount{Type: mount.TypeTmpfs, Target: "/scratch", TmpfsOptions: &mount.TmpfsOptions{SizeBytes: 16 * 1024 * 1024}},
+		).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, linux))
+	require.NoError(t, err)
+
+	// container hostnames are the short container IDs, which is how requests
+	// are matched to nodes
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	containerNodes := map[string]string{}
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning && len(task.Status.ContainerStatus.ContainerID) >= 12 {
+			containerNodes[task.Status.ContainerStatus.ContainerID[:12]] = task.NodeID
+		}
+	}
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+
+	// write to the volume through the load balancer until every task has
+	// had a write, remembering the last one each got
+	written := map[string]string{}
+	i := 0
+	err = WaitForConverge(ctx, 10*time.Millisecond, func() error {
+		i++
+		data := fmt.Sprintf("%s-%d", name, i)
+		host, err := putFile(ctx, endpoint, port, "/data/"+name, data)
+		if err != nil {
+			return err
+		}
+		written[host] = data
+		if len(written) < linux {
+			return fmt.Errorf("written to %d of %d tasks", len(written), linux)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// then read everything back from every task
+	checked := map[string]bool{}
+	err = WaitForConverge(ctx, 10*time.Millisecond, func() error {
+		info, err := getFile(ctx, endpoint, port, "/data/"+name)
+		if err != nil {
+			return err
+		}
+		if info.Content != written[info.Hostname] {
+			// another node's volume would hold another write
+			return fmt.Errorf("volume in %s holds %q, expected %q", info.Hostname, info.Content, written[info.Hostname])
+		}
+		bind, err := getFile(ctx, endpoint, port, "/host/hostname")
+		if err != nil {
+			return err
+		}
+		node := hostnames[containerNodes[bind.Hostname]]
+		if strings.TrimSpace(bind.Content) != node {
+			return fmt.Errorf("bind mount in %s shows host %q, expected %q", bind.Hostname, strings.TrimSpace(bind.Content), node)
+		}
+		mounts, err := getFile(ctx, endpoint, port, "/proc/mounts")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(mounts.Content, "tmpfs /scratch tmpfs") {
+			return fmt.Errorf("no tmpfs on /scratch in %s: %s", mounts.Hostname, mounts.Content)
+		}
+		checked[info.Hostname] = true
+		checked[bind.Hostname] = true
+		if len(checked) < linux {
+			return fmt.Errorf("checked %d of %d tasks", len(checked), linux)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// removing the service leaves the named volume behind, unused
+	require.NoError(t, CleanTestServices(testContext, cli, name))
+	_, err = cli.VolumeInspect(testContext, volName)
+	require.NoError(t, err, "named volume should outlive the service")
+	err = WaitForConverge(ctx, time.Second, func() error {
+		// fails while a task's container is still being removed
+		return cli.VolumeRemove(ctx, volName, false)
+	})
+	require.NoError(t, err, "volume still in use after removing the service")
+
+	if machines := LookupMachines(); machines != nil {
+		for _, host := range hostnames {
+			machines.Run(host, "sudo docker volume rm "+volName)
+		}
+	}
+}
+
+// anonymousVolume is a volume the engine created for a task's container from
+// a VOLUME in its image
+type anonymousVolume struct {
+	cli         *client.Client
+	containerID string
+}
+
+// anonymousVolumes returns the anonymous volumes of the service's running
+// tasks mounted at target, keyed by volume name
+func anonymousVolumes(t *testing.T, ctx context.Context, cli *client.Client, serviceID, target string) map[string]anonymousVolume {
+	volumes := map[string]anonymousVolume{}
+	withTaskContainers(t, ctx, cli, serviceID, func(nodeCli *client.Client, c types.ContainerJSON) {
+		found := false
+		for _, m := range c.Mounts {
+			if m.Type == mount.TypeVolume && m.Destination == target {
+				volumes[m.Name] = anonymousVolume{cli: nodeCli, containerID: c.ID}
+				found = true
+			}
+		}
+		require.True(t, found, "container %s has no volume at %s", c.ID, target)
+	})
+	return volumes
+}
+
+// TestServiceAnonymousVolumes runs a service from an image declaring a VOLUME,
+// checks every task gets its own anonymous volume on its node, and that a
+// volume only outlives its task for as long as the task's container is kept
+// in the history. Once the service is removed, none of them may be left
+func TestServiceAnonymousVolumes(t *testing.T) {
+	name := "TestServiceAnonymousVolumes"
+	// the registry image declares its storage as a VOLUME
+	target := "/var/lib/registry"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	linux, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	replicas := len(linux)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Image(registryImage).
+		Command().
+		Constraint("node.platform.os == linux").
+		Unpublished().
+		UpdateConfig(swarm.UpdateConfig{Parallelism: uint64(replicas)}).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	first := anonymousVolumes(t, testContext, cli, service.ID, target)
+	require.NotEmpty(t, first, "no task containers could be inspected")
+	for volName, vol := range first {
+		_, err := vol.cli.VolumeInspect(testContext, volName)
+		require.NoError(t, err, "volume of container %s", vol.containerID)
+	}
+
+	// replace every task, which leaves the old containers in the history
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ForceUpdate++
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, updateStateCheck(ctx, cli, service.ID, swarm.UpdateStateCompleted))
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	second := anonymousVolumes(t, testContext, cli, service.ID, target)
+	for volName := range second {
+		_, ok := first[volName]
+		require.False(t, ok, "volume %s was reused by a new task", volName)
+	}
+	// an old volume can stay behind with its stopped container, but not
+	// without it
+	for volName, vol := range first {
+		if _, err := vol.cli.VolumeInspect(testContext, volName); err != nil {
+			continue
+		}
+		_, err := vol.cli.ContainerInspect(testContext, vol.containerID)
+		require.NoError(t, err, "volume %s outlived its container", volName)
+	}
+
+	require.NoError(t, CleanTestServices(testContext, cli, name))
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	all := map[string]anonymousVolume{}
+	for volName, vol := range first {
+		all[volName] = vol
+	}
+	for volName, vol := range second {
+		all[volName] = vol
+	}
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		for volName, vol := range all {
+			if _, err := vol.cli.VolumeInspect(ctx, volName); err == nil {
+				return fmt.Errorf("volume %s of container %s is left on its node", volName, vol.containerID)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err, "anonymous volumes leaked once the service was removed")
+}
@@ -0,0 +1,195 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// overlayMTU is lower than any overlay would pick by itself
+	overlayMTU = 1300
+	// daemonMTU is what the engines are configured with for their bridge
+	daemonMTU = 1400
+	// mtuPayload is big enough for a response to span many packets
+	mtuPayload = 4 << 20
+)
+
+// interfaceMTU returns the MTU of the interface holding the address in the
+// container
+func interfaceMTU(ctx context.Context, cli *client.Client, containerID, addr string) (int, error) {
+	script := fmt.Sprintf("cat /sys/class/net/$(ip -o -4 addr | awk '$4 ~ /^%s\\// {print $2}')/mtu", strings.Replace(addr, ".", "\\.", -1))
+	out, stderr, code, err := execInTask(ctx, cli, containerID, []string{"sh", "-c", script}, "")
+	if err != nil {
+		return 0, err
+	}
+	if code != 0 {
+		return 0, fmt.Errorf("no interface with %s: %s", addr, stderr)
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// fetchPayload has the container request size bytes from the test server at
+// addr, returning how many came back
+func fetchPayload(ctx context.Context, cli *client.Client, containerID, addr string, size int) (int, error) {
+	script := fmt.Sprintf("wget -q -T 10 -O - 'http://%s/payload?size=%d' | wc -c", addr, size)
+	out, stderr, _, err := execInTask(ctx, cli, containerID, []string{"sh", "-c", script}, "")
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err, stderr)
+	}
+	return n, nil
+}
+
+// TestNetworkOverlayMTU creates an overlay with a lower MTU, checks the tasks'
+// interfaces on it use it, and sends large responses between the tasks on
+// every node, which stall if packets are dropped for being too big
+func TestNetworkOverlayMTU(t *testing.T) {
+	name := "TestNetworkOverlayMTU"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	nwName := getUniqueName(name)
+	nw, err := cli.NetworkCreate(testContext, nwName, types.NetworkCreate{
+		Driver:         "overlay",
+		CheckDuplicate: true,
+		Labels:         testLabels(name),
+		Options:        map[string]string{mtuOption: strconv.Itoa(overlayMTU)},
+	})
+	require.NoError(t, err, "Error creating overlay network %s", nwName)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	linux, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	replicas := len(linux)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwName).
+		Constraint("node.platform.os == linux").
+		Unpublished().
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	addrs, nodes := taskNetworkAddrs(tasks, nw.ID)
+	require.Len(t, addrs, replicas)
+	t.Logf("Tasks on %d nodes", len(nodes))
+
+	checked := 0
+	withTaskContainers(t, testContext, cli, service.ID, func(nodeCli *client.Client, c types.ContainerJSON) {
+		settings, ok := c.NetworkSettings.Networks[nwName]
+		require.True(t, ok, "container %s isn't attached to %s", c.ID, nwName)
+		mtu, err := interfaceMTU(testContext, nodeCli, c.ID, settings.IPAddress)
+		require.NoError(t, err)
+		require.Equal(t, overlayMTU, mtu, "MTU of container %s on %s", c.ID, nwName)
+
+		for _, addr := range addrs {
+			if addr == settings.IPAddress {
+				continue
+			}
+			n, err := fetchPayload(testContext, nodeCli, c.ID, addr, mtuPayload)
+			require.NoError(t, err)
+			require.Equal(t, mtuPayload, n, "container %s got a short response from %s", c.ID, addr)
+		}
+		checked++
+	})
+	t.Logf("Checked %d of %d tasks from inside", checked, replicas)
+}
+
+// TestDaemonMTU sets the MTU in the daemon.json of every node but the local
+// one, and checks the default bridge and the containers on it use it, and can
+// still pull large responses from a service through the routing mesh
+func TestDaemonMTU(t *testing.T) {
+	name := "TestDaemonMTU"
+	testContext, cancel := NewTestContext(name, 20*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	// restarting the local engine would take the tests down with it
+	nodes, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	hosts := map[string]string{}
+	for _, node := range nodes {
+		if node.ID != info.Swarm.NodeID {
+			hosts[node.ID] = node.Description.Hostname
+		}
+	}
+	if len(hosts) == 0 {
+		t.Skip("no linux node other than the local one")
+	}
+
+	for id, host := range hosts {
+		original, err := setDaemonConfig(machines, host, "mtu", daemonMTU)
+		require.NoError(t, err)
+		defer func(id, host string) {
+			if err := machines.WriteFile(host, daemonJSONPath, original); err != nil {
+				t.Logf("Failed to restore %s on %s: %s", daemonJSONPath, host, err)
+				return
+			}
+			if err := restartEngine(context.Background(), cli, machines, host, id); err != nil {
+				t.Log(err)
+			}
+		}(id, host)
+		// one at a time, so the managers keep quorum
+		require.NoError(t, restartEngine(testContext, cli, machines, host, id))
+	}
+
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(2).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, 2))
+	require.NoError(t, err)
+	_, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+
+	image := GetSelfImage(testContext, cli)
+	for _, host := range hosts {
+		out, err := machines.Run(host, "cat /sys/class/net/docker0/mtu")
+		require.NoError(t, err, out)
+		require.Equal(t, strconv.Itoa(daemonMTU), strings.TrimSpace(out), "MTU of docker0 on %s", host)
+
+		// the host's own address reaches the service through the mesh
+		out, err = machines.Run(host, fmt.Sprintf(
+			"sudo docker run --rm %s sh -c \"cat /sys/class/net/eth0/mtu; wget -q -T 10 -O - 'http://$(ip route | awk '/default/ {print $3}'):%d/payload?size=%d' | wc -c\"",
+			image, published, mtuPayload))
+		require.NoError(t, err, out)
+		lines := strings.Fields(out)
+		require.Len(t, lines, 2, "unexpected output from %s: %s", host, out)
+		require.Equal(t, strconv.Itoa(daemonMTU), lines[0], "MTU of a container on the default bridge on %s", host)
+		require.Equal(t, strconv.Itoa(mtuPayload), lines[1], "short response through the mesh on %s", host)
+	}
+}
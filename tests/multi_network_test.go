@@ -0,0 +1,222 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// taskReaches execs into the container, checking name resolves to the
+// expected VIP and answers HTTP requests
+func taskReaches(ctx context.Context, cli *client.Client, containerID, name, vip string) error {
+	out, _, code, err := execInTask(ctx, cli, containerID, []string{"nslookup", name}, "")
+	if err != nil {
+		return err
+	}
+	if code != 0 || !strings.Contains(out, vip) {
+		return fmt.Errorf("%s doesn't resolve to %s: %s", name, vip, out)
+	}
+	out, _, code, err = execInTask(ctx, cli, containerID, []string{"wget", "-q", "-O", "-", "-T", "5", "http://" + name}, "")
+	if err != nil {
+		return err
+	}
+	if code != 0 || strings.TrimSpace(out) != "OK" {
+		return fmt.Errorf("request to %s failed: %s", name, out)
+	}
+	return nil
+}
+
+// taskResolves execs into the container, returning whether name resolves
+func taskResolves(ctx context.Context, cli *client.Client, containerID, name string) (bool, error) {
+	_, _, code, err := execInTask(ctx, cli, containerID, []string{"nslookup", name}, "")
+	return code == 0, err
+}
+
+// TestNetworkMultipleAttachments attaches a service to several overlays, each
+// shared with a different peer service, and checks every task has an
+// interface and resolves the peer on each of them, and that traffic flows both
+// ways. One of the networks is then removed from the service, and its new
+// tasks must be gone from it entirely
+func TestNetworkMultipleAttachments(t *testing.T) {
+	name := "TestNetworkMultipleAttachments"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	constraints := []string{"node.platform.os == linux"}
+	networks := []string{}
+	networkIDs := map[string]string{}
+	for i := 0; i < 3; i++ {
+		nwName := getUniqueName(fmt.Sprintf("%s-%d", name, i))
+		nw, err := cli.NetworkCreate(testContext, nwName, types.NetworkCreate{
+			Driver:         "overlay",
+			CheckDuplicate: true,
+			Labels:         testLabels(name),
+		})
+		require.NoError(t, err, "Error creating overlay network %s", nwName)
+		networks = append(networks, nwName)
+		networkIDs[nwName] = nw.ID
+	}
+
+	// a peer on each network, which can only be reached through it
+	peers := map[string]swarm.ServiceSpec{}
+	peerIDs := map[string]string{}
+	for i, nwName := range networks {
+		spec := NewServiceSpec(testContext, cli, fmt.Sprintf("%sPeer%d", name, i)).
+			Network(nwName).
+			Label(name).
+			Constraint(constraints...).
+			Unpublished().
+			Build()
+		service, err := CreateService(testContext, cli, spec)
+		require.NoError(t, err, "Error creating service")
+		peers[nwName] = spec
+		peerIDs[nwName] = service.ID
+	}
+	replicas := 2
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(networks...).
+		Constraint(constraints...).
+		Unpublished().
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	require.NoError(t, WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas)))
+	for _, id := range peerIDs {
+		require.NoError(t, WaitForConverge(ctx, time.Second, ScaleCheck(id, cli)(ctx, 1)))
+	}
+
+	vips := map[string]string{}
+	peerVIPs := map[string]string{}
+	for _, nwName := range networks {
+		vips[nwName], err = serviceVIP(testContext, cli, service.ID, networkIDs[nwName])
+		require.NoError(t, err)
+		peerVIPs[nwName], err = serviceVIP(testContext, cli, peerIDs[nwName], networkIDs[nwName])
+		require.NoError(t, err)
+	}
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	for _, nwName := range networks {
+		addrs, _ := taskNetworkAddrs(tasks, networkIDs[nwName])
+		require.Len(t, addrs, replicas, "tasks should each have an address on %s", nwName)
+	}
+
+	// every task has an interface on every network, and reaches the peer on
+	// each of them
+	checked := 0
+	withTaskContainers(t, testContext, cli, service.ID, func(nodeCli *client.Client, c types.ContainerJSON) {
+		for _, nwName := range networks {
+			settings, ok := c.NetworkSettings.Networks[nwName]
+			require.True(t, ok, "container %s isn't attached to %s", c.ID, nwName)
+			out, _, code, err := execInTask(testContext, nodeCli, c.ID, []string{"ip", "-o", "-4", "addr"}, "")
+			require.NoError(t, err)
+			require.Zero(t, code, out)
+			require.Contains(t, out, settings.IPAddress+"/", "container %s has no interface on %s", c.ID, nwName)
+
+			peer := peers[nwName].Annotations.Name
+			ctx, cancel := WithTimeout(testContext, 30*time.Second)
+			err = WaitForConverge(ctx, time.Second, func() error {
+				return taskReaches(ctx, nodeCli, c.ID, peer, peerVIPs[nwName])
+			})
+			cancel()
+			require.NoError(t, err, "from container %s on %s", c.ID, nwName)
+		}
+		checked++
+	})
+	t.Logf("Checked %d of %d tasks from inside", checked, replicas)
+
+	// and every peer reaches the service over the network they share
+	for _, nwName := range networks {
+		withTaskContainers(t, testContext, cli, peerIDs[nwName], func(nodeCli *client.Client, c types.ContainerJSON) {
+			ctx, cancel := WithTimeout(testContext, 30*time.Second)
+			defer cancel()
+			err := WaitForConverge(ctx, time.Second, func() error {
+				return taskReaches(ctx, nodeCli, c.ID, spec.Annotations.Name, vips[nwName])
+			})
+			require.NoError(t, err, "from the peer on %s", nwName)
+		})
+	}
+
+	// take the service off the last network
+	removed := networks[len(networks)-1]
+	kept := networks[:len(networks)-1]
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.Networks = nil
+	for _, nwName := range kept {
+		full.Spec.TaskTemplate.Networks = append(full.Spec.TaskTemplate.Networks, swarm.NetworkAttachmentConfig{Target: nwName})
+	}
+	full.Spec.UpdateConfig = &swarm.UpdateConfig{Parallelism: uint64(replicas)}
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		tasks, err := GetServiceTasks(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		if addrs, _ := taskNetworkAddrs(tasks, networkIDs[removed]); len(addrs) > 0 {
+			return fmt.Errorf("tasks still have addresses %v on %s", addrs, removed)
+		}
+		for _, nwName := range kept {
+			if addrs, _ := taskNetworkAddrs(tasks, networkIDs[nwName]); len(addrs) != replicas {
+				return fmt.Errorf("%d of %d tasks on %s", len(addrs), replicas, nwName)
+			}
+		}
+		full, _, err := cli.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+		if err != nil {
+			return err
+		}
+		for _, vip := range full.Endpoint.VirtualIPs {
+			if vip.NetworkID == networkIDs[removed] {
+				return fmt.Errorf("service still has VIP %s on %s", vip.Addr, removed)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	withTaskContainers(t, testContext, cli, service.ID, func(nodeCli *client.Client, c types.ContainerJSON) {
+		_, ok := c.NetworkSettings.Networks[removed]
+		require.False(t, ok, "container %s is still attached to %s", c.ID, removed)
+		resolves, err := taskResolves(testContext, nodeCli, c.ID, peers[removed].Annotations.Name)
+		require.NoError(t, err)
+		require.False(t, resolves, "container %s still resolves the peer on %s", c.ID, removed)
+	})
+	withTaskContainers(t, testContext, cli, peerIDs[removed], func(nodeCli *client.Client, c types.ContainerJSON) {
+		ctx, cancel := WithTimeout(testContext, 30*time.Second)
+		defer cancel()
+		err := WaitForConverge(ctx, time.Second, func() error {
+			resolves, err := taskResolves(ctx, nodeCli, c.ID, spec.Annotations.Name)
+			if err != nil {
+				return err
+			}
+			if resolves {
+				return fmt.Errorf("the peer on %s still resolves the service", removed)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,105 @@
+package dockere2e
+
+import (
+	// basic imports
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// TestNetworkAliases gives a service and a container several aliases on an
+// overlay, checks other tasks resolve all of them, and that the records go
+// away when the endpoints leave the network
+func TestNetworkAliases(t *testing.T) {
+	name := "TestNetworkAliases"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	suite := UseSuite(t, TagNetwork)
+	nwName := suite.Network
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	// the resolver does the lookups from inside the network
+	resolverSpec := NewServiceSpec(testContext, cli, name+"Resolver").
+		Command("util", "test-service-discovery").
+		Network(nwName).
+		Label(name).
+		Build()
+	resolver, err := CreateService(testContext, cli, resolverSpec)
+	require.NoError(t, err, "Error creating resolver service")
+
+	serviceAliases := []string{getUniqueName("svc-alias-a"), getUniqueName("svc-alias-b")}
+	targetSpec := NewServiceSpec(testContext, cli, name+"Target").
+		Replicas(2).
+		Label(name).
+		Build()
+	targetSpec.TaskTemplate.Networks = []swarm.NetworkAttachmentConfig{
+		{Target: nwName, Aliases: serviceAliases},
+	}
+	target, err := CreateService(testContext, cli, targetSpec)
+	require.NoError(t, err, "Error creating target service")
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(resolver.ID, cli)
+	require.NoError(t, WaitForConverge(ctx, time.Second, scaleCheck(ctx, 1)))
+	scaleCheck = ScaleCheck(target.ID, cli)
+	require.NoError(t, WaitForConverge(ctx, time.Second, scaleCheck(ctx, 2)))
+
+	containerAliases := []string{getUniqueName("ctr-alias-a"), getUniqueName("ctr-alias-b")}
+	resp, err := cli.ContainerCreate(testContext,
+		&container.Config{Image: suite.Image, Cmd: []string{"util", "test-server"}, Labels: testLabels(name)},
+		&container.HostConfig{AutoRemove: true},
+		&network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{
+			nwName: {Aliases: containerAliases},
+		}},
+		getUniqueName(name+"Container"))
+	require.NoError(t, err)
+	defer cli.ContainerRemove(testContext, resp.ID, types.ContainerRemoveOptions{Force: true})
+	require.NoError(t, cli.ContainerStart(testContext, resp.ID, types.ContainerStartOptions{}))
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, resolver.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+
+	// every service alias resolves to the single VIP, every container alias
+	// to the container
+	ctx, cancel = WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	for _, alias := range append(serviceAliases, containerAliases...) {
+		_, err = waitForDNS(ctx, endpoint, port, dnsA, alias, dnsCount(1))
+		require.NoError(t, err)
+	}
+	vip, err := queryDNS(ctx, endpoint, port, dnsA, serviceAliases[0])
+	require.NoError(t, err)
+	byName, err := queryDNS(ctx, endpoint, port, dnsA, targetSpec.Annotations.Name)
+	require.NoError(t, err)
+	require.Equal(t, byName.Records(), vip.Records(), "aliases should resolve to the service VIP")
+
+	// disconnecting the container drops its aliases
+	err = cli.NetworkDisconnect(testContext, nwName, resp.ID, false)
+	require.NoError(t, err)
+	for _, alias := range containerAliases {
+		_, err = waitForDNS(ctx, endpoint, port, dnsA, alias, dnsCount(0))
+		require.NoError(t, err, "container alias left behind after disconnecting")
+	}
+
+	// and removing the service drops the service's
+	require.NoError(t, cli.ServiceRemove(testContext, target.ID))
+	for _, alias := range serviceAliases {
+		_, err = waitForDNS(ctx, endpoint, port, dnsA, alias, dnsCount(0))
+		require.NoError(t, err, "service alias left behind after removing the service")
+	}
+}
@@ -0,0 +1,213 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// ipamSubnet, ipamGateway and ipamRange are what the custom network is
+	// created with, with tasks only getting addresses from the upper half
+	ipamSubnet  = "10.248.0.0/24"
+	ipamGateway = "10.248.0.254"
+	ipamRange   = "10.248.0.128/25"
+	// ipamOverlap overlaps ipamSubnet
+	ipamOverlap = "10.248.0.0/25"
+)
+
+// ipamNetwork creates an overlay with the labels and the given IPAM config,
+// returning its ID
+func ipamNetwork(ctx context.Context, cli *client.Client, name string, labels map[string]string, config ...network.IPAMConfig) (string, error) {
+	nc := types.NetworkCreate{
+		Driver:         "overlay",
+		CheckDuplicate: true,
+		Labels:         labels,
+	}
+	if len(config) > 0 {
+		nc.IPAM = &network.IPAM{Config: config}
+	}
+	resp, err := cli.NetworkCreate(ctx, name, nc)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// TestNetworkCustomIPAM creates an overlay with an explicit subnet, gateway and
+// IP range, checks the service's VIP and tasks get addresses from them, and
+// that a network overlapping it can't be used
+func TestNetworkCustomIPAM(t *testing.T) {
+	name := "TestNetworkCustomIPAM"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	nwName := getUniqueName(name)
+	nwID, err := ipamNetwork(testContext, cli, nwName, testLabels(name), network.IPAMConfig{
+		Subnet:  ipamSubnet,
+		Gateway: ipamGateway,
+		IPRange: ipamRange,
+	})
+	require.NoError(t, err, "Error creating overlay network %s", nwName)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	nw, err := cli.NetworkInspect(testContext, nwID, false)
+	require.NoError(t, err)
+	require.Len(t, nw.IPAM.Config, 1)
+	require.Equal(t, ipamSubnet, nw.IPAM.Config[0].Subnet)
+	require.Equal(t, ipamGateway, nw.IPAM.Config[0].Gateway)
+	require.Equal(t, ipamRange, nw.IPAM.Config[0].IPRange)
+
+	replicas := 4
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwName).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+
+	_, subnet, err := net.ParseCIDR(ipamSubnet)
+	require.NoError(t, err)
+	_, ipRange, err := net.ParseCIDR(ipamRange)
+	require.NoError(t, err)
+
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	vips := 0
+	for _, vip := range full.Endpoint.VirtualIPs {
+		if vip.NetworkID != nwID {
+			continue
+		}
+		vips++
+		ip, _, err := net.ParseCIDR(vip.Addr)
+		require.NoError(t, err)
+		require.True(t, subnet.Contains(ip), "VIP %s outside of %s", vip.Addr, ipamSubnet)
+		require.NotEqual(t, ipamGateway, ip.String(), "VIP took the gateway address")
+	}
+	require.Equal(t, 1, vips, "service should have a VIP on the network")
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	addrs, _ := taskNetworkAddrs(tasks, nwID)
+	require.Len(t, addrs, replicas)
+	seen := map[string]bool{}
+	for _, addr := range addrs {
+		require.True(t, ipRange.Contains(net.ParseIP(addr)), "task address %s outside of %s", addr, ipamRange)
+		require.NotEqual(t, ipamGateway, addr, "task took the gateway address")
+		require.False(t, seen[addr], "address %s given to two tasks", addr)
+		seen[addr] = true
+	}
+
+	// swarm might only notice the overlap when allocating the network, in
+	// which case nothing can be scheduled on it
+	overlapName := getUniqueName(name + "Overlap")
+	_, err = ipamNetwork(testContext, cli, overlapName, testLabels(name), network.IPAMConfig{Subnet: ipamOverlap})
+	if err != nil {
+		t.Logf("Overlapping network rejected on creation: %s", err)
+		return
+	}
+	overlapSpec := NewServiceSpec(testContext, cli, name+"Overlap").
+		Network(overlapName).
+		Label(name).
+		Build()
+	overlap, err := CreateService(testContext, cli, overlapSpec)
+	if err != nil {
+		t.Logf("Service on the overlapping network rejected: %s", err)
+		return
+	}
+	ctx, cancel = WithTimeout(testContext, 20*time.Second)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(overlap.ID, cli)(ctx, 1))
+	require.Error(t, err, "service on a network overlapping %s shouldn't start", ipamSubnet)
+	// the tasks never got a network attachment, so the network can go as
+	// soon as the service does
+	cli.ServiceRemove(testContext, overlap.ID)
+}
+
+// TestNetworkDefaultAddressPool creates overlays without a subnet, and checks
+// they're each given a distinct one out of the swarm's default address pool
+func TestNetworkDefaultAddressPool(t *testing.T) {
+	name := "TestNetworkDefaultAddressPool"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	sw, err := cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	// swarms initialized without a pool use the engine's default
+	pools := sw.DefaultAddrPool
+	if len(pools) == 0 {
+		pools = []string{"10.0.0.0/8"}
+	}
+	size := int(sw.SubnetSize)
+	if size == 0 {
+		size = 24
+	}
+	poolNets := []*net.IPNet{}
+	for _, pool := range pools {
+		_, poolNet, err := net.ParseCIDR(pool)
+		require.NoError(t, err)
+		poolNets = append(poolNets, poolNet)
+	}
+
+	// overlay subnets are only allocated once a task needs them
+	nwNames := []string{}
+	nwIDs := []string{}
+	for i := 0; i < 3; i++ {
+		nwName := getUniqueName(fmt.Sprintf("%s%d", name, i))
+		nwID, err := ipamNetwork(testContext, cli, nwName, testLabels(name))
+		require.NoError(t, err, "Error creating overlay network %s", nwName)
+		nwNames = append(nwNames, nwName)
+		nwIDs = append(nwIDs, nwID)
+	}
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+	spec := NewServiceSpec(testContext, cli, name).Network(nwNames...).Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, 1))
+	require.NoError(t, err)
+
+	subnets := map[string]string{}
+	for _, nwID := range nwIDs {
+		nw, err := cli.NetworkInspect(testContext, nwID, false)
+		require.NoError(t, err)
+		require.Len(t, nw.IPAM.Config, 1, "network %s should have one subnet", nw.Name)
+		subnet := nw.IPAM.Config[0].Subnet
+		ip, subnetNet, err := net.ParseCIDR(subnet)
+		require.NoError(t, err)
+		ones, _ := subnetNet.Mask.Size()
+		require.Equal(t, size, ones, "subnet %s of %s has the wrong size", subnet, nw.Name)
+		inPool := false
+		for _, poolNet := range poolNets {
+			inPool = inPool || poolNet.Contains(ip)
+		}
+		require.True(t, inPool, "subnet %s of %s is outside of %s", subnet, nw.Name, strings.Join(pools, ", "))
+		require.Empty(t, subnets[subnet], "%s and %s were both given %s", subnets[subnet], nw.Name, subnet)
+		subnets[subnet] = nw.Name
+	}
+}
@@ -0,0 +1,181 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// NetworkPluginEnv names the managed network plugin to test, which has
+	// to be global scoped to back swarm networks
+	NetworkPluginEnv = "E2E_NETWORK_PLUGIN"
+	// NetworkPluginUpgradeEnv is the reference the plugin is upgraded to,
+	// the same one it was installed from by default
+	NetworkPluginUpgradeEnv = "E2E_NETWORK_PLUGIN_UPGRADE"
+	// defaultNetworkPlugin is a global scoped plugin that works without any
+	// configuration
+	defaultNetworkPlugin = "weaveworks/net-plugin:latest_release"
+)
+
+// tasksReachableCheck returns a check that passes once the test servers on
+// the service's tasks can all reach each other over the network
+func tasksReachableCheck(ctx context.Context, cli *client.Client, serviceID, networkID string) func() error {
+	return func() error {
+		tasks, err := GetServiceTasks(ctx, cli, serviceID)
+		if err != nil {
+			return err
+		}
+		addrs, _ := taskNetworkAddrs(tasks, networkID)
+		targets := []string{}
+		for _, addr := range addrs {
+			targets = append(targets, "http://"+addr+":80/")
+		}
+		endpoint, published, err := getNodeIPPort(ctx, cli, serviceID, 80)
+		if err != nil {
+			return err
+		}
+		results, err := fanout(ctx, endpoint, fmt.Sprintf(":%v", published), targets)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			if !strings.Contains(result, ":200:") {
+				return fmt.Errorf("task unreachable over the network: %s", result)
+			}
+		}
+		return nil
+	}
+}
+
+// TestNetworkPluginSwarmScope installs a managed network plugin everywhere,
+// runs a service over a swarm network backed by it, checks the plugin can't
+// be disabled or upgraded from under the network, and then upgrades it on a
+// drained worker and brings the worker's tasks back
+func TestNetworkPluginSwarmScope(t *testing.T) {
+	name := "TestNetworkPluginSwarmScope"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	plugin := os.Getenv(NetworkPluginEnv)
+	if plugin == "" {
+		plugin = defaultNetworkPlugin
+	}
+	upgrade := os.Getenv(NetworkPluginUpgradeEnv)
+	if upgrade == "" {
+		upgrade = plugin
+	}
+	nodes, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	_, self, err := GetManagers(testContext, cli)
+	require.NoError(t, err)
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	host := worker.Description.Hostname
+
+	defer installPlugin(t, testContext, cli, machines, nodes, self, plugin)()
+	nwName := getUniqueName(name)
+	nw, err := cli.NetworkCreate(testContext, nwName, types.NetworkCreate{
+		Driver:         plugin,
+		Scope:          "swarm",
+		CheckDuplicate: true,
+		Labels:         testLabels(name),
+	})
+	require.NoError(t, err, "Error creating %s network %s", plugin, nwName)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+	network, err := cli.NetworkInspect(testContext, nw.ID, false)
+	require.NoError(t, err)
+	require.Equal(t, "swarm", network.Scope)
+
+	replicas := 2 * len(nodes)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwName).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, tasksReachableCheck(ctx, cli, service.ID, nw.ID))
+	require.NoError(t, err)
+
+	// the plugin stays put while the network is in use on the node
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	_, taskNodes := taskNetworkAddrs(tasks, nw.ID)
+	require.True(t, taskNodes[worker.ID], "no task was scheduled on %s", host)
+	out, err := machines.Run(host, "sudo docker plugin disable "+plugin)
+	require.Error(t, err, "disabling %s in use on %s should fail: %s", plugin, host, out)
+	out, err = machines.Run(host, fmt.Sprintf("sudo docker plugin upgrade --grant-all-permissions --skip-remote-check %s %s", plugin, upgrade))
+	require.Error(t, err, "upgrading enabled %s on %s should fail: %s", plugin, host, out)
+
+	// drain the worker, upgrade the plugin and let it have tasks again
+	require.NoError(t, setAvailability(testContext, cli, worker.ID, swarm.NodeAvailabilityDrain))
+	defer setAvailability(testContext, cli, worker.ID, swarm.NodeAvailabilityActive)
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	// the network goes away from the worker with its last task, and the
+	// plugin can be disabled then
+	err = WaitForConverge(ctx, time.Second, func() error {
+		out, err := machines.Run(host, "sudo docker plugin disable "+plugin)
+		if err != nil && !strings.Contains(out, "already disabled") {
+			return fmt.Errorf("disabling %s on %s: %s: %s", plugin, host, err, out)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	out, err = machines.Run(host,
+		fmt.Sprintf("sudo docker plugin upgrade --grant-all-permissions --skip-remote-check %s %s", plugin, upgrade),
+		"sudo docker plugin enable "+plugin,
+	)
+	require.NoError(t, err, "upgrading %s on %s: %s", plugin, host, out)
+	require.NoError(t, setAvailability(testContext, cli, worker.ID, swarm.NodeAvailabilityActive))
+
+	// force a redeploy, so the tasks spread back onto the worker
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ForceUpdate++
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, func() error {
+		if err := scaleCheck(ctx, replicas)(); err != nil {
+			return err
+		}
+		tasks, err := GetServiceTasks(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if task.NodeID == worker.ID && task.Spec.ForceUpdate == full.Spec.TaskTemplate.ForceUpdate {
+				return nil
+			}
+		}
+		return fmt.Errorf("no redeployed task on %s", host)
+	})
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, tasksReachableCheck(ctx, cli, service.ID, nw.ID))
+	require.NoError(t, err, "tasks unreachable after upgrading %s on %s", plugin, host)
+}
@@ -4,68 +4,57 @@ import (
 	// basic imports
 	"context"
 	"fmt"
-	"io/ioutil"
 	"strings"
-	"sync"
 	"testing"
 	"time"
 
 	// testify
 	"github.com/stretchr/testify/require"
 
-	// http is used to test network endpoints
-	"net/http"
-
 	// docker api
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
 )
 
 // test for Service Discovery in swarm tasks
 func TestServiceDiscovery(t *testing.T) {
 	name := "TestServiceDiscovery"
-	testContext, _ := context.WithTimeout(context.Background(), 2*time.Minute)
+	testContext, cancel := NewTestContext(name, 2*time.Minute)
+	defer cancel()
 	// create a client
 	cli, err := GetClient()
 	require.NoError(t, err, "Client creation failed")
 
-	nwName := getUniqueName("TestServiceDiscoveryOverlay")
-	nc := types.NetworkCreate{
-		Driver:         "overlay",
-		CheckDuplicate: true,
-	}
-	_, err = cli.NetworkCreate(testContext, nwName, nc)
-	require.NoError(t, err, "Error creating overlay network %s", nwName)
-	defer cli.NetworkRemove(testContext, nwName)
+	nwName := UseSuite(t, TagNetwork).Network
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
 
 	var replicas uint64 = 3
-	spec := CannedServiceSpec(cli, name, replicas, []string{"util", "test-service-discovery"}, []string{nwName})
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(replicas).
+		Command("util", "test-service-discovery").
+		Network(nwName).
+		Build()
 
 	// create the service
-	service, err := cli.ServiceCreate(testContext, spec, types.ServiceCreateOptions{})
+	service, err := CreateService(testContext, cli, spec)
 	require.NoError(t, err, "Error creating service %s", name)
-	defer func() {
-		CleanTestServices(testContext, cli, name)
-		// Wait for the tasks to be removed before deleting the network
-		// TODO: covert to WaitForConverge for consistency
-		time.Sleep(3 * time.Second)
-	}()
 
 	// make sure the service is up
-	ctx, _ := context.WithTimeout(testContext, 60*time.Second)
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
 	scaleCheck := ScaleCheck(service.ID, cli)
 	err = WaitForConverge(ctx, 1*time.Second, scaleCheck(ctx, int(replicas)))
 	require.NoError(t, err)
 
-	endpoint, published, err := getNodeIPPort(cli, testContext, service.ID, 80)
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
 	require.NoError(t, err)
 	port := fmt.Sprintf(":%v", published)
 
 	qName := "tasks." + spec.Annotations.Name
-	ip, err := serviceLookup(endpoint, port, qName)
-	require.NoError(t, err)
-	require.Equal(t, int(replicas), len(ip), "incorrect number of task IPs in service-discovery response")
+	_, err = waitForDNS(ctx, endpoint, port, dnsA, qName, dnsCount(int(replicas)))
+	require.NoError(t, err, "incorrect number of task IPs in service-discovery response")
 
 	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
 	//scale up & scale down the service and verify the SD entries get updated
@@ -86,51 +75,121 @@ func TestServiceDiscovery(t *testing.T) {
 	err = WaitForConverge(ctx, 1*time.Second, scaleCheck(ctx, int(replicas)))
 	require.NoError(t, err)
 
-	ip, err = serviceLookup(endpoint, port, qName)
+	_, err = waitForDNS(ctx, endpoint, port, dnsA, qName, dnsCount(int(replicas)))
+	require.NoError(t, err, "incorrect number of task IPs in service-discovery response")
+}
+
+// serviceVIP returns the service's virtual IP on the network, without the
+// prefix length
+func serviceVIP(ctx context.Context, cli *client.Client, serviceID, networkID string) (string, error) {
+	full, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, vip := range full.Endpoint.VirtualIPs {
+		if vip.NetworkID == networkID {
+			return strings.Split(vip.Addr, "/")[0], nil
+		}
+	}
+	return "", fmt.Errorf("service %s has no VIP on network %s", serviceID, networkID)
+}
+
+// TestServiceDiscoveryVIP scales a service up and down, checking that its
+// name keeps resolving to the same VIP while tasks.<name> always resolves to
+// the addresses of the tasks that are running at the time
+func TestServiceDiscoveryVIP(t *testing.T) {
+	name := "TestServiceDiscoveryVIP"
+	testContext, cancel := NewTestContext(name, 4*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	suite := UseSuite(t, TagNetwork)
+	nwName := suite.Network
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	// the resolver does the lookups from inside the network
+	resolverSpec := NewServiceSpec(testContext, cli, name+"Resolver").
+		Command("util", "test-service-discovery").
+		Network(nwName).
+		Label(name).
+		Build()
+	resolver, err := CreateService(testContext, cli, resolverSpec)
+	require.NoError(t, err, "Error creating resolver service")
+	targetSpec := NewServiceSpec(testContext, cli, name+"Target").
+		Replicas(2).
+		Network(nwName).
+		Label(name).
+		Build()
+	target, err := CreateService(testContext, cli, targetSpec)
+	require.NoError(t, err, "Error creating target service")
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	require.NoError(t, WaitForConverge(ctx, time.Second, ScaleCheck(resolver.ID, cli)(ctx, 1)))
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, resolver.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+
+	vip, err := serviceVIP(testContext, cli, target.ID, suite.NetworkID)
 	require.NoError(t, err)
-	require.Equal(t, int(replicas), len(ip), "incorrect number of task IPs in service-discovery response")
+	previous := map[string]bool{}
+	for _, replicas := range []int{2, 5, 1, 3} {
+		require.NoError(t, scaleService(testContext, cli, target.ID, uint64(replicas)))
+		ctx, cancel := WithTimeout(testContext, 60*time.Second)
+		defer cancel()
+		require.NoError(t, WaitForConverge(ctx, time.Second, ScaleCheck(target.ID, cli)(ctx, replicas)))
+
+		tasks, err := GetServiceTasks(testContext, cli, target.ID)
+		require.NoError(t, err)
+		addrs, _ := taskNetworkAddrs(tasks, suite.NetworkID)
+		require.Len(t, addrs, replicas)
+		_, err = waitForDNS(ctx, endpoint, port, dnsA, "tasks."+targetSpec.Name, dnsRecords(addrs...))
+		require.NoError(t, err, "task records at %d replicas", replicas)
+		_, err = waitForDNS(ctx, endpoint, port, dnsA, targetSpec.Name, dnsRecords(vip))
+		require.NoError(t, err, "service record at %d replicas", replicas)
+
+		current, err := serviceVIP(testContext, cli, target.ID, suite.NetworkID)
+		require.NoError(t, err)
+		require.Equal(t, vip, current, "VIP changed when scaling to %d replicas", replicas)
+		for _, addr := range addrs {
+			require.NotEqual(t, vip, addr, "a task was given the VIP")
+		}
+
+		// scaling down keeps the surviving tasks' addresses
+		if len(previous) > replicas {
+			for _, addr := range addrs {
+				require.True(t, previous[addr], "task address %s appeared when scaling down", addr)
+			}
+		}
+		previous = map[string]bool{}
+		for _, addr := range addrs {
+			previous[addr] = true
+		}
+	}
 }
 
 // test for unmanaged container creation on an attached network and SD for unmanaged
 // containers from service tasks.
 func TestAttachableNetwork(t *testing.T) {
 	name := "TestAttachableNetwork"
-	testContext, _ := context.WithTimeout(context.Background(), 2*time.Minute)
+	testContext, cancel := NewTestContext(name, 2*time.Minute)
+	defer cancel()
 	// create a client
 	cli, err := GetClient()
 	require.NoError(t, err, "Client creation failed")
 
-	nwName := getUniqueName("TestAttachableNetwork")
-	nc := types.NetworkCreate{
-		Driver:         "overlay",
-		CheckDuplicate: true,
-		Attachable:     true,
-	}
-	_, err = cli.NetworkCreate(testContext, nwName, nc)
-	require.NoError(t, err, "Error creating overlay network %s", nwName)
-	defer cli.NetworkRemove(testContext, nwName)
-
-	image := GetSelfImage(cli)
-	if _, _, err := cli.ImageInspectWithRaw(context.TODO(), image); err != nil {
-		ticker := time.NewTicker(2 * time.Minute)
-		ch := make(chan bool)
-		go func(ch chan bool) {
-			r, err := cli.ImagePull(context.TODO(), image, types.ImagePullOptions{})
-			require.NoError(t, err, "Error pulling the image, %s", image)
-			_, err = ioutil.ReadAll(r)
-			r.Close()
-			require.NoError(t, err, "Error reading pull response")
-			ch <- true
-		}(ch)
-		select {
-		case <-ticker.C:
-			require.Error(t, fmt.Errorf("Image %s pull timed out", image))
-		case <-ch:
-		}
-	}
+	suite := UseSuite(t, TagNetwork)
+	nwName := suite.Network
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
 	config := &container.Config{
-		Image: image,
-		Cmd:   []string{"util", "test-server"},
+		Image:  suite.Image,
+		Cmd:    []string{"util", "test-server"},
+		Labels: testLabels(name),
 	}
 	hostConfig := &container.HostConfig{
 		AutoRemove:  true,
@@ -141,67 +200,243 @@ func TestAttachableNetwork(t *testing.T) {
 	err = cli.ContainerStart(testContext, resp.ID, types.ContainerStartOptions{})
 	require.NoError(t, err)
 
-	spec := CannedServiceSpec(cli, name, 1, []string{"util", "test-service-discovery"}, []string{nwName})
+	spec := NewServiceSpec(testContext, cli, name).
+		Command("util", "test-service-discovery").
+		Network(nwName).
+		Build()
 	// create the service
-	service, err := cli.ServiceCreate(testContext, spec, types.ServiceCreateOptions{})
+	service, err := CreateService(testContext, cli, spec)
 	require.NoError(t, err, "Error creating service %s", name)
-	defer func() {
-		CleanTestServices(testContext, cli, name)
-		// Wait for the tasks to be removed before deleting the network
-		// TODO: covert to WaitForConverge for consistency
-		time.Sleep(3 * time.Second)
-	}()
 
 	// make sure the service is up
-	ctx, _ := context.WithTimeout(testContext, 60*time.Second)
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
 	scaleCheck := ScaleCheck(service.ID, cli)
 	err = WaitForConverge(ctx, 1*time.Second, scaleCheck(ctx, 1))
 	require.NoError(t, err)
 
-	endpoint, published, err := getNodeIPPort(cli, testContext, service.ID, 80)
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
 	require.NoError(t, err)
 	port := fmt.Sprintf(":%v", published)
 
-	ip, err := serviceLookup(endpoint, port, "test-container")
-	require.NoError(t, err)
-	require.Equal(t, 1, len(ip), "incorrect number of task IPs in service-discovery response")
+	_, err = waitForDNS(ctx, endpoint, port, dnsA, "test-container", dnsCount(1))
+	require.NoError(t, err, "incorrect number of task IPs in service-discovery response")
 
 	err = cli.ContainerRemove(testContext, resp.ID, types.ContainerRemoveOptions{Force: true})
 	require.NoError(t, err)
 }
 
-// tests the load balancer for services with public endpoints
+// attachedContainer is an unmanaged container on an attachable network, along
+// with a client for the engine running it
+type attachedContainer struct {
+	cli  *client.Client
+	id   string
+	name string
+}
+
+// taskGets execs into the container, checking the test server at addr answers
+func taskGets(ctx context.Context, cli *client.Client, containerID, addr string) error {
+	out, _, code, err := execInTask(ctx, cli, containerID, []string{"wget", "-q", "-O", "-", "-T", "5", "http://" + addr}, "")
+	if err != nil {
+		return err
+	}
+	if code != 0 || strings.TrimSpace(out) != "OK" {
+		return fmt.Errorf("request to %s failed: %s", addr, out)
+	}
+	return nil
+}
+
+// TestAttachableNetworkMatrix runs an unmanaged container on every node next
+// to a service with a task on every node, all on attachable networks, and
+// checks every container reaches the service and each of its tasks, and every
+// task reaches each container by name. The containers are then moved to the
+// other network, and the whole matrix has to work there, with the tasks no
+// longer resolving the containers to their old addresses
+func TestAttachableNetworkMatrix(t *testing.T) {
+	name := "TestAttachableNetworkMatrix"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	nodes, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	clients, err := GetNodeClients(testContext, cli)
+	if err != nil {
+		t.Logf("Not running containers on every node: %s", err)
+	}
+
+	containers := []attachedContainer{}
+	defer func() {
+		CaptureFailure(t, cli, name)
+		for _, c := range containers {
+			c.cli.ContainerRemove(testContext, c.id, types.ContainerRemoveOptions{Force: true})
+		}
+		CleanupAll(testContext, cli, UUID(), name)
+		// CleanupAll only sees the containers on the local engine
+		if err := IgnoreUnreachable(testContext, OnEveryNode(testContext, cli, NoContainersLabeled(name))); err != nil {
+			t.Errorf("Containers left behind: %s", err)
+		}
+	}()
+
+	networks := []string{}
+	networkIDs := map[string]string{}
+	for i := 0; i < 2; i++ {
+		nwName := getUniqueName(fmt.Sprintf("%s-%d", name, i))
+		nw, err := cli.NetworkCreate(testContext, nwName, types.NetworkCreate{
+			Driver:         "overlay",
+			CheckDuplicate: true,
+			Attachable:     true,
+			Labels:         testLabels(name),
+		})
+		require.NoError(t, err, "Error creating overlay network %s", nwName)
+		networks = append(networks, nwName)
+		networkIDs[nwName] = nw.ID
+	}
+
+	replicas := len(nodes)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(networks...).
+		Constraint("node.platform.os == linux").
+		Unpublished().
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	require.NoError(t, WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas)))
+
+	// a container on every node, on the first network
+	image := GetSelfImage(testContext, cli)
+	for i, node := range nodes {
+		nodeCli, ok := clients[node.ID]
+		if !ok {
+			continue
+		}
+		err := ensureImage(testContext, nodeCli, image)
+		require.NoError(t, err, "Error pulling %s on %s", image, node.Description.Hostname)
+		ctrName := getUniqueName(fmt.Sprintf("%sContainer%d", name, i))
+		resp, err := nodeCli.ContainerCreate(testContext,
+			&container.Config{Image: image, Cmd: []string{"util", "test-server"}, Labels: testLabels(name)},
+			&container.HostConfig{NetworkMode: container.NetworkMode(networks[0])},
+			nil, ctrName)
+		require.NoError(t, err, "Error creating a container on %s", node.Description.Hostname)
+		containers = append(containers, attachedContainer{cli: nodeCli, id: resp.ID, name: ctrName})
+		require.NoError(t, nodeCli.ContainerStart(testContext, resp.ID, types.ContainerStartOptions{}))
+	}
+	require.NotEmpty(t, containers, "no engine to run containers on")
+	t.Logf("Running containers on %d of %d nodes", len(containers), len(nodes))
+
+	// containerAddrs returns the address of every container on the network
+	containerAddrs := func(nwName string) map[string]string {
+		addrs := map[string]string{}
+		for _, c := range containers {
+			inspect, err := c.cli.ContainerInspect(testContext, c.id)
+			require.NoError(t, err)
+			settings, ok := inspect.NetworkSettings.Networks[nwName]
+			require.True(t, ok, "container %s isn't attached to %s", c.name, nwName)
+			addrs[c.name] = settings.IPAddress
+		}
+		return addrs
+	}
+
+	// checkMatrix checks the traffic between every container and every task
+	// on the network, both ways
+	checkMatrix := func(nwName string) {
+		vip, err := serviceVIP(testContext, cli, service.ID, networkIDs[nwName])
+		require.NoError(t, err)
+		tasks, err := GetServiceTasks(testContext, cli, service.ID)
+		require.NoError(t, err)
+		taskAddrs, _ := taskNetworkAddrs(tasks, networkIDs[nwName])
+		require.Len(t, taskAddrs, replicas, "tasks should each have an address on %s", nwName)
+		ctrAddrs := containerAddrs(nwName)
+
+		for _, c := range containers {
+			ctx, cancel := WithTimeout(testContext, 30*time.Second)
+			err := WaitForConverge(ctx, time.Second, func() error {
+				return taskReaches(ctx, c.cli, c.id, spec.Annotations.Name, vip)
+			})
+			cancel()
+			require.NoError(t, err, "from container %s on %s", c.name, nwName)
+			for _, addr := range taskAddrs {
+				require.NoError(t, taskGets(testContext, c.cli, c.id, addr), "from container %s on %s", c.name, nwName)
+			}
+		}
+
+		withTaskContainers(t, testContext, cli, service.ID, func(nodeCli *client.Client, task types.ContainerJSON) {
+			for ctrName, addr := range ctrAddrs {
+				ctx, cancel := WithTimeout(testContext, 30*time.Second)
+				err := WaitForConverge(ctx, time.Second, func() error {
+					return taskReaches(ctx, nodeCli, task.ID, ctrName, addr)
+				})
+				cancel()
+				require.NoError(t, err, "from task container %s on %s", task.ID, nwName)
+			}
+		})
+	}
+
+	checkMatrix(networks[0])
+	old := containerAddrs(networks[0])
+
+	// move the containers over to the other network
+	for _, c := range containers {
+		require.NoError(t, c.cli.NetworkDisconnect(testContext, networks[0], c.id, false))
+		require.NoError(t, c.cli.NetworkConnect(testContext, networks[1], c.id, nil))
+		inspect, err := c.cli.ContainerInspect(testContext, c.id)
+		require.NoError(t, err)
+		_, ok := inspect.NetworkSettings.Networks[networks[0]]
+		require.False(t, ok, "container %s is still attached to %s", c.name, networks[0])
+	}
+	checkMatrix(networks[1])
+
+	withTaskContainers(t, testContext, cli, service.ID, func(nodeCli *client.Client, task types.ContainerJSON) {
+		for ctrName, addr := range old {
+			out, _, _, err := execInTask(testContext, nodeCli, task.ID, []string{"nslookup", ctrName}, "")
+			require.NoError(t, err)
+			require.NotContains(t, out, addr, "task container %s still resolves %s to its old address", task.ID, ctrName)
+		}
+	})
+}
+
+const (
+	// lbWorkers is how many requests the external load balancer test has in
+	// flight at once
+	lbWorkers = 4
+	// lbRequests is how many requests the latency and error rate of the
+	// routing mesh are measured over
+	lbRequests = 500
+)
+
+// tests the load balancer for services with public endpoints, and how fast
+// and reliably it answers
 func TestNetworkExternalLb(t *testing.T) {
-	// TODO(dperny): there are debugging statements commented out. remove them.
 	t.Parallel()
 	name := "TestNetworkExternalLb"
-	testContext, _ := context.WithTimeout(context.Background(), 2*time.Minute)
+	testContext, cancel := NewTestContext(name, 2*time.Minute)
+	defer cancel()
 	// create a client
 	cli, err := GetClient()
 	require.NoError(t, err, "Client creation failed")
 
 	replicas := 3
-	spec := CannedServiceSpec(cli, name, uint64(replicas), nil, nil)
 	// expose a port
-	spec.EndpointSpec = &swarm.EndpointSpec{
-		Mode: swarm.ResolutionModeVIP,
-		Ports: []swarm.PortConfig{
-			{
-				Protocol:   swarm.PortConfigProtocolTCP,
-				TargetPort: 80,
-			},
-		},
-	}
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		PublishTCP(80).
+		Build()
 
 	// create the service
-	service, err := cli.ServiceCreate(testContext, spec, types.ServiceCreateOptions{})
+	service, err := CreateService(testContext, cli, spec)
 	require.NoError(t, err, "Error creating service")
 	require.NotNil(t, service, "Resp is nil for some reason")
 	require.NotZero(t, service.ID, "serviceonse ID is zero, something is amiss")
 	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
 
 	// now make sure the service comes up
-	ctx, _ := context.WithTimeout(testContext, 60*time.Second)
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
 	scaleCheck := ScaleCheck(service.ID, cli)
 	err = WaitForConverge(ctx, 1*time.Second, scaleCheck(ctx, 3))
 	require.NoError(t, err)
@@ -217,89 +452,28 @@ func TestNetworkExternalLb(t *testing.T) {
 	}
 	port := fmt.Sprintf(":%v", published)
 
-	// create a context, and also grab the cancelfunc
-	ctx, cancel := context.WithTimeout(testContext, 60*time.Second)
-
-	// alright now comes the tricky part. we're gonna hit the endpoint
-	// repeatedly until we get 3 different container ids, twice each.
-	// if we hit twice each, we know that we've been LB'd around to each
-	// instance. why twice? seems like a good number, idk. when i test LB
-	// manually i just hit the endpoint a few times until i've seen each
-	// container a couple of times
-
-	// create a map to store all the containers we've seen
-	containers := make(map[string]int)
-	// create a mutex to synchronize access to this map
-	mu := new(sync.Mutex)
-
 	// select the network endpoint we're going to hit
 	// list the nodes
-	ips, err := GetNodeIps(cli)
+	ips, err := GetNodeIps(testContext, cli)
 	require.NoError(t, err, "error listing nodes to get IP")
 	require.NotZero(t, ips, "no node ip addresses were returned")
 	// take the first node
 	endpoint := ips[0]
 
-	// first we need a function to poll containers, and let it run
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				// stop polling when ctx is done
-				return
-			default:
-				// anonymous func to leverage defers
-				func() {
-					// TODO(dperny) consider breaking out into separate function
-					// lock the mutex to synchronize access to the map
-					mu.Lock()
-					defer mu.Unlock()
-					tr := &http.Transport{}
-					client := &http.Client{Transport: tr, Timeout: time.Duration(5 * time.Second)}
-
-					// poll the endpoint
-					// TODO(dperny): this string concat is probably Bad
-					resp, err := client.Get("http://" + endpoint + port)
-					if err != nil {
-						// TODO(dperny) properly handle error
-						// fmt.Printf("error: %v\n", err)
-						return
-					}
-					defer resp.Body.Close()
-					name := resp.Header.Get("Host")
-
-					if name == "" {
-						// body text should just be the container id
-						namebytes, err := ioutil.ReadAll(resp.Body)
-						// docs say we have to close the body. defer doing so
-						if err != nil {
-							// TODO(dperny) properly handle error
-							return
-						}
-						name = strings.TrimSpace(string(namebytes))
-					}
-					// fmt.Printf("saw %v\n", name)
-
-					// if the container has already been seen, increment its count
-					if count, ok := containers[name]; ok {
-						containers[name] = count + 1
-						// if not, add it as a new record with count 1
-					} else {
-						containers[name] = 1
-					}
-				}()
-				// if we don't sleep, we'll starve the check function. we stop
-				// just long enough for the system to schedule the check function
-				// TODO(dperny): figure out a cleaner way to do this.
-				time.Sleep(5 * time.Millisecond)
-			}
-		}
-	}()
+	// alright now comes the tricky part. we're gonna hit the endpoint
+	// repeatedly until we get 3 different container ids, twice each.
+	// if we hit twice each, we know that we've been LB'd around to each
+	// instance. why twice? seems like a good number, idk. when i test LB
+	// manually i just hit the endpoint a few times until i've seen each
+	// container a couple of times
+	ctx, cancel = WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	load := GenerateLoad(ctx, "http://"+endpoint+port, lbWorkers)
+	defer load.Stop()
 
 	// function to check if we've been LB'd to all containers
 	checkComplete := func() error {
-		mu.Lock()
-		defer mu.Unlock()
+		containers := load.Hosts()
 		c := len(containers)
 		// check if we have too many containers (unlikely but possible)
 		if c > replicas {
@@ -322,9 +496,89 @@ func TestNetworkExternalLb(t *testing.T) {
 	}
 
 	err = WaitForConverge(ctx, time.Second, checkComplete)
-	// cancel the context to stop polling
-	cancel()
+	require.NoError(t, err)
 
+	// now that the routing mesh is up, see how it holds up. the requests
+	// that went out while it was warming up don't count
+	load.Reset()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		if n := load.Requests(); n < lbRequests {
+			return fmt.Errorf("%d of %d requests sent", n, lbRequests)
+		}
+		return nil
+	})
 	require.NoError(t, err)
+	result := load.Stop()
+	t.Logf("Routing mesh: %s", result)
+	require.NoError(t, result.Check(testContext))
+}
+
+// tests the routing mesh for services publishing a UDP port, through the
+// ingress of every node
+func TestNetworkExternalLbUDP(t *testing.T) {
+	t.Parallel()
+	name := "TestNetworkExternalLbUDP"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
 
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Command("util", "test-server", "--udp-listen-address", ":8080").
+		PublishUDP(8080).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+
+	_, published, err := getNodeIPPort(testContext, cli, service.ID, 8080)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+	ips, err := GetNodeIps(testContext, cli)
+	require.NoError(t, err, "error listing nodes to get IP")
+	require.NotZero(t, ips, "no node ip addresses were returned")
+
+	// send datagrams round robin to every node until each node has answered
+	// and each task has been hit at least twice, same as the TCP test
+	containers := map[string]int{}
+	answered := map[string]bool{}
+	sent := 0
+	ctx, cancel = WithTimeout(testContext, 90*time.Second)
+	defer cancel()
+	err = WaitForConverge(ctx, 10*time.Millisecond, func() error {
+		endpoint := ips[sent%len(ips)]
+		sent++
+		// datagrams get lost while the mesh converges, those just don't count
+		if host, err := udpEcho(ctx, endpoint, port, fmt.Sprintf("%s-%d", name, sent)); err == nil {
+			containers[host]++
+			answered[endpoint] = true
+		}
+		if len(containers) > replicas {
+			return fmt.Errorf("expected %v different container IDs, got %v", replicas, len(containers))
+		}
+		if len(containers) < replicas {
+			return fmt.Errorf("haven't seen enough different containers, expected %v got %v", replicas, len(containers))
+		}
+		for host, count := range containers {
+			if count < 2 {
+				return fmt.Errorf("haven't seen container %v twice", host)
+			}
+		}
+		for _, ip := range ips {
+			if !answered[ip] {
+				return fmt.Errorf("no answer through the ingress on %s", ip)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
 }
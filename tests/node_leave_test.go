@@ -0,0 +1,182 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// leaveLabel is the node label the leave test pins a service to the worker with
+const leaveLabel = "e2e.leave"
+
+// taskStatesCheck returns a check that passes once the service has replicas
+// tasks meant to be running, all of them in state and, unless nodeID is
+// empty, on that node
+func taskStatesCheck(ctx context.Context, cli *client.Client, serviceID string, replicas int, state swarm.TaskState, nodeID string) func() error {
+	return func() error {
+		tasks, err := GetServiceTasks(ctx, cli, serviceID)
+		if err != nil {
+			return err
+		}
+		if len(tasks) != replicas {
+			return fmt.Errorf("%d of %d tasks", len(tasks), replicas)
+		}
+		for _, task := range tasks {
+			if task.Status.State != state {
+				return fmt.Errorf("task %s is %s, waiting for %s", task.ID, task.Status.State, state)
+			}
+			if nodeID != "" && task.NodeID != nodeID {
+				return fmt.Errorf("task %s is on %s rather than %s", task.ID, task.NodeID, nodeID)
+			}
+		}
+		return nil
+	}
+}
+
+// TestSwarmNodeLeaveRejoin has a spare worker leave the cluster, removes it
+// from the node list, and joins it back with the worker token. The machine has
+// to come back as a single new node, without the labels it had, and the tasks
+// pinned to it have to wait for it the whole time: the ones pinned by hostname
+// go back as soon as it's ready, the ones pinned by label once the label is
+// set again
+func TestSwarmNodeLeaveRejoin(t *testing.T) {
+	name := "TestSwarmNodeLeaveRejoin"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	host := worker.Description.Hostname
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	require.NotEmpty(t, info.Swarm.RemoteManagers)
+	managerAddr := info.Swarm.RemoteManagers[0].Addr
+
+	label := getUniqueName(name)
+	require.NoError(t, setNodeLabel(testContext, cli, worker.ID, leaveLabel, label))
+
+	// every node ID the machine had in the cluster, to clean up afterwards
+	stale := map[string]bool{worker.ID: true}
+	defer func() {
+		// put the worker back if the test didn't get that far
+		if state, _ := localNodeState(machines, host); state != "active" {
+			sw, err := cli.SwarmInspect(context.Background())
+			if err != nil {
+				t.Logf("Failed to rejoin %s to the cluster: %s", host, err)
+			} else if out, err := machines.Run(host, fmt.Sprintf("sudo docker swarm join --token %s %s", sw.JoinTokens.Worker, managerAddr)); err != nil {
+				t.Logf("Failed to rejoin %s to the cluster: %s: %s", host, err, out)
+			}
+		}
+		for id := range stale {
+			cli.NodeRemove(context.Background(), id, types.NodeRemoveOptions{Force: true})
+		}
+	}()
+
+	replicas := 2
+	byLabel := NewServiceSpec(testContext, cli, name+"Label").
+		Replicas(uint64(replicas)).
+		Label(name).
+		Constraint(fmt.Sprintf("node.labels.%s == %s", leaveLabel, label)).
+		Unpublished().
+		Build()
+	labelService, err := CreateService(testContext, cli, byLabel)
+	require.NoError(t, err, "Error creating service")
+	byHostname := NewServiceSpec(testContext, cli, name+"Hostname").
+		Replicas(uint64(replicas)).
+		Label(name).
+		Constraint("node.hostname == " + host).
+		Unpublished().
+		Build()
+	hostnameService, err := CreateService(testContext, cli, byHostname)
+	require.NoError(t, err, "Error creating service")
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	for _, id := range []string{labelService.ID, hostnameService.ID} {
+		err = WaitForConverge(ctx, time.Second, taskStatesCheck(ctx, cli, id, replicas, swarm.TaskStateRunning, worker.ID))
+		require.NoError(t, err)
+	}
+
+	t.Logf("Taking %s out of the cluster", host)
+	out, err := machines.Run(host, "sudo docker swarm leave")
+	require.NoError(t, err, "%s: %s", host, out)
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, worker.ID)
+		if err != nil {
+			return err
+		}
+		if node.Status.State != swarm.NodeStateDown {
+			return fmt.Errorf("%s is %s after leaving", host, node.Status.State)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// nowhere else satisfies the constraints, so the tasks wait
+	for _, id := range []string{labelService.ID, hostnameService.ID} {
+		err = WaitForConverge(ctx, time.Second, taskStatesCheck(ctx, cli, id, replicas, swarm.TaskStatePending, ""))
+		require.NoError(t, err, "tasks of a service pinned to %s should be pending", host)
+	}
+
+	require.NoError(t, cli.NodeRemove(testContext, worker.ID, types.NodeRemoveOptions{}))
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	for _, node := range nodes {
+		require.NotEqual(t, worker.ID, node.ID, "%s is still in the node list after being removed", host)
+	}
+
+	t.Logf("Joining %s back to the cluster", host)
+	sw, err := cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	out, err = machines.Run(host, fmt.Sprintf("sudo docker swarm join --token %s %s", sw.JoinTokens.Worker, managerAddr))
+	require.NoError(t, err, "%s: %s", host, out)
+	var id string
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, joinedNodeCheck(ctx, cli, host, swarm.NodeRoleWorker, stale, &id))
+	require.NoError(t, err)
+	require.NotEqual(t, worker.ID, id, "%s came back with its old node ID", host)
+
+	nodes, err = cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	entries := 0
+	for _, node := range nodes {
+		if node.Description.Hostname == host {
+			entries++
+		}
+	}
+	require.Equal(t, 1, entries, "%s is in the node list more than once", host)
+	rejoined, _, err := cli.NodeInspectWithRaw(testContext, id)
+	require.NoError(t, err)
+	require.NotContains(t, rejoined.Spec.Labels, leaveLabel, "labels of the old node were carried over")
+
+	// the hostname matches straight away, the label has to be set again
+	err = WaitForConverge(ctx, time.Second, taskStatesCheck(ctx, cli, hostnameService.ID, replicas, swarm.TaskStateRunning, id))
+	require.NoError(t, err)
+	err = taskStatesCheck(ctx, cli, labelService.ID, replicas, swarm.TaskStatePending, "")()
+	require.NoError(t, err, "tasks pinned by label should wait for the label")
+
+	require.NoError(t, setNodeLabel(testContext, cli, id, leaveLabel, label))
+	defer setNodeLabel(context.Background(), cli, id, leaveLabel, "")
+	err = WaitForConverge(ctx, time.Second, taskStatesCheck(ctx, cli, labelService.ID, replicas, swarm.TaskStateRunning, id))
+	require.NoError(t, err)
+}
@@ -0,0 +1,188 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// partitionTargets returns n managers other than the local node, or skips the
+// test if there aren't enough managers for the partition to leave a majority
+// on one side
+func partitionTargets(t *testing.T, ctx context.Context, cli *client.Client, n func(managers int) int) []swarm.Node {
+	managers, self, err := GetManagers(ctx, cli)
+	require.NoError(t, err)
+	if len(managers) < 3 {
+		t.Skipf("partitioning managers needs at least 3 of them, the cluster has %d", len(managers))
+	}
+	want := n(len(managers))
+	targets := []swarm.Node{}
+	for _, node := range managers {
+		if len(targets) < want && node.Description.Hostname != self && node.Description.Platform.OS == "linux" {
+			targets = append(targets, node)
+		}
+	}
+	if len(targets) < want {
+		t.Skipf("need %d linux managers other than the local node, found %d", want, len(targets))
+	}
+	return targets
+}
+
+// TestPartitionManagerMinority cuts a minority of the managers off from the
+// rest of the cluster, checks the majority keeps accepting writes, and that
+// the isolated managers catch up once the partition heals
+func TestPartitionManagerMinority(t *testing.T) {
+	name := "TestPartitionManagerMinority"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	minority := partitionTargets(t, testContext, cli, func(managers int) int { return (managers - 1) / 2 })
+	heal, err := isolate(testContext, cli, machines, minority)
+	require.NoError(t, err)
+	defer func() {
+		heal()
+		ctx, cancel := WithTimeout(testContext, recoveryWindow)
+		defer cancel()
+		WaitForConverge(ctx, time.Second, managersHealthyCheck(ctx, cli))
+	}()
+
+	// the majority notices the isolated managers are gone
+	ctx, cancel := WithTimeout(testContext, recoveryWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		for _, node := range minority {
+			n, _, err := cli.NodeInspectWithRaw(ctx, node.ID)
+			if err != nil {
+				return err
+			}
+			if n.ManagerStatus.Reachability != swarm.ReachabilityUnreachable {
+				return fmt.Errorf("%s is still %s", n.Description.Hostname, n.ManagerStatus.Reachability)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// and can still take writes, once a leader's elected if it was isolated
+	spec := NewServiceSpec(testContext, cli, name).Constraint("node.id == " + info.Swarm.NodeID).Build()
+	var service types.ServiceCreateResponse
+	err = WaitForConverge(ctx, time.Second, func() error {
+		var err error
+		service, err = CreateService(ctx, cli, spec)
+		return err
+	})
+	require.NoError(t, err, "the majority should accept writes")
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, 1))
+	require.NoError(t, err)
+
+	heal()
+	ctx, cancel = WithTimeout(testContext, recoveryWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, managersHealthyCheck(ctx, cli))
+	require.NoError(t, err, "managers did not recover after healing")
+
+	// the isolated managers got the write they missed
+	for _, node := range minority {
+		host := node.Description.Hostname
+		err = WaitForConverge(ctx, time.Second, func() error {
+			out, err := machines.Run(host, "sudo docker service inspect --format '{{.Spec.Name}}' "+service.ID)
+			if err != nil {
+				return fmt.Errorf("%s: %s", err, out)
+			}
+			if strings.TrimSpace(out) != spec.Name {
+				return fmt.Errorf("%s sees service %s as %q", host, service.ID, out)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+// TestPartitionManagerMajority cuts the local manager off from a majority of
+// the managers, checks the API reports the loss of quorum and refuses writes
+// while the majority keeps going on its own, and that the local manager
+// catches up on what it missed once the partition heals
+func TestPartitionManagerMajority(t *testing.T) {
+	name := "TestPartitionManagerMajority"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	majority := partitionTargets(t, testContext, cli, func(managers int) int { return managers/2 + 1 })
+	heal, err := isolate(testContext, cli, machines, majority)
+	require.NoError(t, err)
+	defer func() {
+		heal()
+		ctx, cancel := WithTimeout(testContext, recoveryWindow)
+		defer cancel()
+		WaitForConverge(ctx, time.Second, managersHealthyCheck(ctx, cli))
+	}()
+
+	// the local manager has lost quorum and says so
+	ctx, cancel := WithTimeout(testContext, recoveryWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		_, err := cli.NodeList(ctx, types.NodeListOptions{})
+		if err == nil {
+			return fmt.Errorf("node list still succeeds")
+		}
+		if !strings.Contains(err.Error(), "does not have a leader") {
+			return fmt.Errorf("expected a lost quorum error, got: %s", err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = CreateService(ctx, cli, NewServiceSpec(testContext, cli, name).Build())
+	require.Error(t, err, "writes should be rejected without quorum")
+
+	// the majority side elects a leader of its own and carries on
+	host := majority[0].Description.Hostname
+	serviceName := getUniqueName(name)
+	create := fmt.Sprintf("sudo docker service create --detach=true --replicas 0 --name %s --label %s --label %s=true %s",
+		serviceName, name, E2EServiceLabel, GetSelfImage(testContext, cli))
+	err = WaitForConverge(ctx, time.Second, func() error {
+		out, err := machines.Run(host, create)
+		if err != nil && !strings.Contains(out, "already exists") {
+			return fmt.Errorf("%s: %s", err, out)
+		}
+		return nil
+	})
+	require.NoError(t, err, "the majority should accept writes")
+
+	heal()
+	ctx, cancel = WithTimeout(testContext, recoveryWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, managersHealthyCheck(ctx, cli))
+	require.NoError(t, err, "managers did not recover after healing")
+
+	// the local manager sees what happened while it was cut off
+	f := filters.NewArgs()
+	f.Add("name", serviceName)
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{Filters: f})
+	require.NoError(t, err)
+	require.Len(t, services, 1, "service created during the partition is missing")
+}
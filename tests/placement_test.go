@@ -0,0 +1,182 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// rackLabel is the node label the spread tests put the nodes in racks with
+const rackLabel = "e2e.rack"
+
+// setNodeLabel sets a label on the node, or removes it if value is empty
+func setNodeLabel(ctx context.Context, cli *client.Client, nodeID, key, value string) error {
+	node, _, err := cli.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		return err
+	}
+	if node.Spec.Labels == nil {
+		node.Spec.Labels = map[string]string{}
+	}
+	if value == "" {
+		delete(node.Spec.Labels, key)
+	} else {
+		node.Spec.Labels[key] = value
+	}
+	return cli.NodeUpdate(ctx, nodeID, node.Version, node.Spec)
+}
+
+// tasksPerRack counts the service's running tasks in each rack
+func tasksPerRack(ctx context.Context, cli *client.Client, serviceID string, racks map[string]string) (map[string]int, error) {
+	tasks, err := GetServiceTasks(ctx, cli, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning {
+			counts[racks[task.NodeID]]++
+		}
+	}
+	return counts, nil
+}
+
+// balancedCheck returns a check that passes once all replicas are running,
+// spread over exactly the given racks with at most one task between the
+// fullest and the emptiest
+func balancedCheck(ctx context.Context, cli *client.Client, serviceID string, racks map[string]string, expected []string, replicas int) func() error {
+	return func() error {
+		counts, err := tasksPerRack(ctx, cli, serviceID, racks)
+		if err != nil {
+			return err
+		}
+		total, min, max := 0, replicas, 0
+		for _, rack := range expected {
+			n := counts[rack]
+			total += n
+			if n < min {
+				min = n
+			}
+			if n > max {
+				max = n
+			}
+		}
+		if total != replicas {
+			return fmt.Errorf("%d of %d tasks running in racks %v: %v", total, replicas, expected, counts)
+		}
+		if max-min > 1 {
+			return fmt.Errorf("tasks aren't balanced over racks %v: %v", expected, counts)
+		}
+		return nil
+	}
+}
+
+// TestPlacementSpread puts the nodes in racks with a label, and checks a
+// service spread over the label has the same number of tasks in every rack,
+// however many nodes each one has. Draining a rack has to move its tasks to
+// the others evenly, and forcing an update once it's back has to spread them
+// over all the racks again
+func TestPlacementSpread(t *testing.T) {
+	name := "TestPlacementSpread"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+	nodes, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	if len(nodes) < 2 {
+		t.Skip("spreading over racks needs at least 2 linux nodes")
+	}
+	rackCount := 3
+	if len(nodes) < rackCount {
+		rackCount = len(nodes)
+	}
+	rackNames := []string{}
+	for i := 0; i < rackCount; i++ {
+		rackNames = append(rackNames, fmt.Sprintf("rack-%d", i))
+	}
+	// the local node goes in the first rack, so it's never drained
+	racks := map[string]string{}
+	i := 1
+	for _, node := range nodes {
+		rack := rackNames[0]
+		if node.ID != info.Swarm.NodeID {
+			rack = rackNames[i%rackCount]
+			i++
+		}
+		racks[node.ID] = rack
+		require.NoError(t, setNodeLabel(testContext, cli, node.ID, rackLabel, rack))
+	}
+	defer func() {
+		for id := range racks {
+			setNodeLabel(context.Background(), cli, id, rackLabel, "")
+		}
+	}()
+
+	replicas := 4 * rackCount
+	spec := NewServiceSpec(testContext, cli, name).Replicas(uint64(replicas)).Build()
+	spec.TaskTemplate.Placement = &swarm.Placement{
+		Constraints: []string{"node.platform.os == linux"},
+		Preferences: []swarm.PlacementPreference{
+			{Spread: &swarm.SpreadOver{SpreadDescriptor: "node.labels." + rackLabel}},
+		},
+	}
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, balancedCheck(ctx, cli, service.ID, racks, rackNames, replicas))
+	require.NoError(t, err)
+	counts, err := tasksPerRack(testContext, cli, service.ID, racks)
+	require.NoError(t, err)
+	for _, rack := range rackNames {
+		require.Equal(t, replicas/rackCount, counts[rack], "tasks per rack: %v", counts)
+	}
+
+	drained := rackNames[rackCount-1]
+	t.Logf("Draining %s", drained)
+	for id, rack := range racks {
+		if rack == drained {
+			require.NoError(t, setAvailability(testContext, cli, id, swarm.NodeAvailabilityDrain))
+			defer setAvailability(context.Background(), cli, id, swarm.NodeAvailabilityActive)
+		}
+	}
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, balancedCheck(ctx, cli, service.ID, racks, rackNames[:rackCount-1], replicas))
+	require.NoError(t, err, "tasks of %s weren't spread over the other racks", drained)
+
+	// swarm doesn't move running tasks back by itself, so an update is
+	// needed to use the rack again
+	for id, rack := range racks {
+		if rack == drained {
+			require.NoError(t, setAvailability(testContext, cli, id, swarm.NodeAvailabilityActive))
+		}
+	}
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ForceUpdate++
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+	ctx, cancel = WithTimeout(testContext, 3*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, updateStateCheck(ctx, cli, service.ID, swarm.UpdateStateCompleted))
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, balancedCheck(ctx, cli, service.ID, racks, rackNames, replicas))
+	require.NoError(t, err, "tasks weren't spread over every rack again")
+}
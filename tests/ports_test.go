@@ -0,0 +1,236 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// publishedPortSpec returns a service spec publishing the test server on the
+// given ingress port, or on one swarm picks if it's 0
+func publishedPortSpec(ctx context.Context, cli *client.Client, name string, replicas uint64, published uint32) swarm.ServiceSpec {
+	return NewServiceSpec(ctx, cli, name).
+		Replicas(replicas).
+		Constraint("node.platform.os == linux").
+		Publish(swarm.PortConfig{
+			Protocol:      swarm.PortConfigProtocolTCP,
+			TargetPort:    80,
+			PublishedPort: published,
+		}).
+		Build()
+}
+
+// taskHostnames returns the hostnames of the service's running tasks, which
+// are the short IDs of their containers
+func taskHostnames(ctx context.Context, cli *client.Client, serviceID string) (map[string]bool, error) {
+	tasks, err := GetServiceTasks(ctx, cli, serviceID)
+	if err != nil {
+		return nil, err
+	}
+	hosts := map[string]bool{}
+	for _, task := range tasks {
+		if task.Status.State == swarm.TaskStateRunning && len(task.Status.ContainerStatus.ContainerID) >= 12 {
+			hosts[task.Status.ContainerStatus.ContainerID[:12]] = true
+		}
+	}
+	return hosts, nil
+}
+
+// routesOnlyTo returns a check that passes once requests to the port through
+// every node are answered, and only by the given tasks
+func routesOnlyTo(ctx context.Context, ips []string, port string, hosts map[string]bool) func() error {
+	return func() error {
+		for _, ip := range ips {
+			for i := 0; i < 3; i++ {
+				host, err := getHostname(ctx, ip, port)
+				if err != nil {
+					return fmt.Errorf("no answer on %s%s: %s", ip, port, err)
+				}
+				if !hosts[host] {
+					return fmt.Errorf("%s%s was answered by %s, which isn't a task of the service", ip, port, host)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// createPublished creates the service, waits for it to converge and to be the
+// only thing answering on its port, and returns its ID and published port
+func createPublished(t *testing.T, ctx context.Context, cli *client.Client, spec swarm.ServiceSpec, ips []string) (string, uint32) {
+	replicas := int(*spec.Mode.Replicated.Replicas)
+	service, err := CreateService(ctx, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	convergeCtx, cancel := WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(convergeCtx, time.Second, scaleCheck(convergeCtx, replicas))
+	require.NoError(t, err)
+	_, published, err := getNodeIPPort(ctx, cli, service.ID, 80)
+	require.NoError(t, err)
+
+	hosts, err := taskHostnames(ctx, cli, service.ID)
+	require.NoError(t, err)
+	err = WaitForConverge(convergeCtx, time.Second, routesOnlyTo(convergeCtx, ips, fmt.Sprintf(":%v", published), hosts))
+	require.NoError(t, err)
+	return service.ID, published
+}
+
+// TestPublishedPortConflict checks a second service can't publish a port
+// that's already taken, and that it can have the port as soon as the first
+// service is removed
+func TestPublishedPortConflict(t *testing.T) {
+	t.Parallel()
+	name := "TestPublishedPortConflict"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+	ips, err := GetNodeIps(testContext, cli)
+	require.NoError(t, err, "error listing nodes to get IP")
+
+	first, published := createPublished(t, testContext, cli, publishedPortSpec(testContext, cli, name, 2, 0), ips)
+
+	second := publishedPortSpec(testContext, cli, name, 2, published)
+	_, err = CreateService(testContext, cli, second)
+	require.Error(t, err, "publishing port %d twice should be rejected", published)
+	require.Contains(t, err.Error(), "already in use")
+
+	// no waiting for the first service's tasks to go away
+	require.NoError(t, cli.ServiceRemove(testContext, first))
+	createPublished(t, testContext, cli, second, ips)
+}
+
+// TestPublishedPortCycle publishes the same port from a new service over and
+// over, removing each one as soon as it's up, and checks every one is
+// reachable on every node without the previous one still answering, and that
+// nothing answers once the last one is gone
+func TestPublishedPortCycle(t *testing.T) {
+	t.Parallel()
+	name := "TestPublishedPortCycle"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+	ips, err := GetNodeIps(testContext, cli)
+	require.NoError(t, err, "error listing nodes to get IP")
+
+	var published uint32
+	for i := 0; i < 5; i++ {
+		var id string
+		id, published = createPublished(t, testContext, cli, publishedPortSpec(testContext, cli, name, 2, published), ips)
+		t.Logf("Round %d published on port %d", i, published)
+		require.NoError(t, cli.ServiceRemove(testContext, id))
+	}
+
+	// the rules go away with the last service
+	port := fmt.Sprintf(":%v", published)
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		for _, ip := range ips {
+			if host, err := getHostname(ctx, ip, port); err == nil {
+				return fmt.Errorf("%s%s is still answered by %s", ip, port, host)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+const (
+	// portRangeStart is the first port the range test publishes
+	portRangeStart = 8000
+	// portRangeSize is how many ports the range test publishes
+	portRangeSize = 11
+)
+
+// portRangeSpec returns a service spec publishing the range of ports on the
+// ingress, each to the same port in the tasks, which the test server listens
+// on as well as its usual port
+func portRangeSpec(ctx context.Context, cli *client.Client, name string, replicas uint64, start uint32, size int) swarm.ServiceSpec {
+	command := []string{"util", "test-server"}
+	ports := []swarm.PortConfig{}
+	for i := 0; i < size; i++ {
+		port := start + uint32(i)
+		command = append(command, "--also-listen", fmt.Sprintf(":%d", port))
+		ports = append(ports, swarm.PortConfig{
+			Protocol:      swarm.PortConfigProtocolTCP,
+			TargetPort:    port,
+			PublishedPort: port,
+		})
+	}
+	return NewServiceSpec(ctx, cli, name).
+		Replicas(replicas).
+		Command(command...).
+		Constraint("node.platform.os == linux").
+		Publish(ports...).
+		Build()
+}
+
+// TestPublishedPortRange publishes a range of ports, and checks every port in
+// it is routed to the tasks through every node. Once the service is removed,
+// none of the ports may answer, and another service has to be able to take
+// the whole range straight away
+func TestPublishedPortRange(t *testing.T) {
+	name := "TestPublishedPortRange"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+	ips, err := GetNodeIps(testContext, cli)
+	require.NoError(t, err, "error listing nodes to get IP")
+
+	for round := 0; round < 2; round++ {
+		replicas := 2
+		spec := portRangeSpec(testContext, cli, name, uint64(replicas), portRangeStart, portRangeSize)
+		service, err := CreateService(testContext, cli, spec)
+		require.NoError(t, err, "round %d: the range should be free", round)
+		ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+		defer cancel()
+		err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+		require.NoError(t, err)
+
+		full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+		require.NoError(t, err)
+		require.Len(t, full.Endpoint.Ports, portRangeSize, "every port in the range should be published")
+		hosts, err := taskHostnames(testContext, cli, service.ID)
+		require.NoError(t, err)
+		for i := 0; i < portRangeSize; i++ {
+			port := fmt.Sprintf(":%d", portRangeStart+i)
+			err = WaitForConverge(ctx, time.Second, routesOnlyTo(ctx, ips, port, hosts))
+			require.NoError(t, err, "round %d", round)
+		}
+
+		require.NoError(t, cli.ServiceRemove(testContext, service.ID))
+		err = WaitForConverge(ctx, time.Second, func() error {
+			for i := 0; i < portRangeSize; i++ {
+				port := fmt.Sprintf(":%d", portRangeStart+i)
+				for _, ip := range ips {
+					if host, err := getHostname(ctx, ip, port); err == nil {
+						return fmt.Errorf("%s%s is still answered by %s", ip, port, host)
+					}
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err, "round %d: ports still routed after removal", round)
+	}
+}
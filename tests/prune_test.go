@@ -0,0 +1,110 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// pruneNode runs container, network and dangling image prune on the engine
+func pruneNode(ctx context.Context, cli *client.Client) error {
+	if _, err := cli.ContainersPrune(ctx, filters.NewArgs()); err != nil {
+		return err
+	}
+	if _, err := cli.NetworksPrune(ctx, filters.NewArgs()); err != nil {
+		return err
+	}
+	_, err := cli.ImagesPrune(ctx, filters.NewArgs())
+	return err
+}
+
+// TestPruneUnderSwarm prunes every node it can reach while a service on an
+// overlay network is converging, and checks the task containers, the network
+// and the service's image all survive
+func TestPruneUnderSwarm(t *testing.T) {
+	name := "TestPruneUnderSwarm"
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	clients, err := GetNodeClients(testContext, cli)
+	if len(clients) == 0 {
+		require.NoError(t, err)
+	}
+	if err != nil {
+		t.Logf("Only pruning %d nodes: %s", len(clients), err)
+	}
+
+	nwName := getUniqueName(name)
+	_, err = cli.NetworkCreate(testContext, nwName, types.NetworkCreate{Driver: "overlay", CheckDuplicate: true, Labels: testLabels(name)})
+	require.NoError(t, err, "Error creating overlay network %s", nwName)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 2 * len(clients)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwName).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	// keep pruning the whole time the service converges
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)(ctx, replicas)
+	rounds := 0
+	err = WaitForConverge(ctx, time.Second, func() error {
+		rounds++
+		for id, nodeCli := range clients {
+			if err := pruneNode(ctx, nodeCli); err != nil {
+				return fmt.Errorf("pruning %s: %s", id, err)
+			}
+		}
+		if err := scaleCheck(); err != nil {
+			return err
+		}
+		// a few more rounds against the running tasks
+		if rounds < 5 {
+			return fmt.Errorf("pruned %d times", rounds)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// nothing was restarted by the prunes
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	require.Len(t, tasks, replicas, "no task should have been replaced")
+	_, err = cli.NetworkInspect(testContext, nwName, false)
+	require.NoError(t, err, "overlay network was pruned")
+
+	image := spec.TaskTemplate.ContainerSpec.Image
+	for _, task := range tasks {
+		require.Equal(t, swarm.TaskStateRunning, task.Status.State, "task %s", task.ID)
+		nodeCli, ok := clients[task.NodeID]
+		if !ok {
+			continue
+		}
+		container, err := nodeCli.ContainerInspect(testContext, task.Status.ContainerStatus.ContainerID)
+		require.NoError(t, err, "task container was pruned")
+		require.True(t, container.State.Running)
+		_, err = nodeCli.NetworkInspect(testContext, nwName, false)
+		require.NoError(t, err, "overlay network was pruned from %s", task.NodeID)
+		_, _, err = nodeCli.ImageInspectWithRaw(testContext, image)
+		require.NoError(t, err, "service image was pruned from %s", task.NodeID)
+	}
+}
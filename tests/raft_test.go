@@ -0,0 +1,194 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// raftMutations is how many service updates the raft test makes
+	raftMutations = 3000
+	// raftSnapshotInterval is how many log entries the raft test has the
+	// managers keep between snapshots, low enough for several to be taken
+	raftSnapshotInterval = 500
+	// raftDir holds the WAL and snapshots of a manager
+	raftDir = "/var/lib/docker/swarm/raft"
+	// raftCatchUpWindow bounds how long a restarted manager gets to rejoin
+	// and serve the latest state
+	raftCatchUpWindow = time.Minute
+)
+
+// raftState is what a manager's raft directory looks like on disk
+type raftState struct {
+	WALFiles     int
+	WALBytes     int
+	LastSnapshot string
+}
+
+// getRaftState describes the raft directory of the machine. The directories
+// are suffixed with -encrypted on engines that encrypt the raft store
+func getRaftState(m *Machines, machine string) (raftState, error) {
+	out, err := m.Run(machine,
+		fmt.Sprintf("sudo sh -c 'ls %s/wal-v3*/ | grep -c \\.wal$'", raftDir),
+		fmt.Sprintf("sudo sh -c 'du -sb %s/wal-v3* | cut -f1'", raftDir),
+		fmt.Sprintf("sudo sh -c 'ls %s/snap-v3*/ | grep \\.snap$ | sort | tail -n 1'", raftDir),
+	)
+	if err != nil {
+		return raftState{}, fmt.Errorf("%s: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return raftState{}, fmt.Errorf("unexpected output %q", out)
+	}
+	state := raftState{}
+	if state.WALFiles, err = strconv.Atoi(strings.TrimSpace(lines[0])); err != nil {
+		return raftState{}, err
+	}
+	if state.WALBytes, err = strconv.Atoi(strings.TrimSpace(lines[1])); err != nil {
+		return raftState{}, err
+	}
+	if len(lines) > 2 {
+		state.LastSnapshot = strings.TrimSpace(lines[2])
+	}
+	return state, nil
+}
+
+// setSnapshotInterval changes how many log entries the managers keep between
+// raft snapshots
+func setSnapshotInterval(ctx context.Context, cli *client.Client, interval uint64) error {
+	sw, err := cli.SwarmInspect(ctx)
+	if err != nil {
+		return err
+	}
+	sw.Spec.Raft.SnapshotInterval = interval
+	return cli.SwarmUpdate(ctx, sw.Version, sw.Spec, swarm.UpdateFlags{})
+}
+
+// TestRaftSnapshotting makes thousands of service updates with a low snapshot
+// interval, checks every manager took new snapshots and kept its WAL from
+// growing with the log, then restarts a manager and checks it catches up
+func TestRaftSnapshotting(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping raft growth in short mode")
+	}
+	name := "TestRaftSnapshotting"
+	testContext, cancel := NewTestContext(name, 30*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	sw, err := cli.SwarmInspect(testContext)
+	require.NoError(t, err)
+	originalInterval := sw.Spec.Raft.SnapshotInterval
+	require.NoError(t, setSnapshotInterval(testContext, cli, raftSnapshotInterval))
+	defer func() {
+		if err := setSnapshotInterval(context.Background(), cli, originalInterval); err != nil {
+			t.Logf("Failed to restore the snapshot interval to %d: %s", originalInterval, err)
+		}
+	}()
+
+	managers, self, err := GetManagers(testContext, cli)
+	require.NoError(t, err)
+	before := map[string]raftState{}
+	for _, node := range managers {
+		host := node.Description.Hostname
+		before[host], err = getRaftState(machines, host)
+		require.NoError(t, err, "reading the raft state of %s", host)
+	}
+
+	// no replicas, so only the store sees the updates
+	spec := NewServiceSpec(testContext, cli, name).Replicas(0).Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	start := time.Now()
+	for i := 0; i < raftMutations; i++ {
+		full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+		require.NoError(t, err)
+		full.Spec.Labels["mutation"] = strconv.Itoa(i)
+		_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+		require.NoError(t, err, "update %d", i)
+	}
+	t.Logf("%d updates took %s", raftMutations, time.Since(start))
+
+	// followers might apply the last entries a little later
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	for _, node := range managers {
+		host := node.Description.Hostname
+		var after raftState
+		err = WaitForConverge(ctx, 2*time.Second, func() error {
+			after, err = getRaftState(machines, host)
+			if err != nil {
+				return err
+			}
+			if after.LastSnapshot == before[host].LastSnapshot {
+				return fmt.Errorf("%s hasn't taken a snapshot since %s", host, before[host].LastSnapshot)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		t.Logf("%s: %+v, was %+v", host, after, before[host])
+		// the log is truncated at every snapshot, so the segments before
+		// the last one are dropped rather than piling up
+		require.True(t, after.WALFiles <= before[host].WALFiles+1, "%s went from %d to %d WAL files", host, before[host].WALFiles, after.WALFiles)
+	}
+
+	// restart a manager other than the local one, and check it serves the
+	// latest version of the service once it's back
+	var restarted swarm.Node
+	for _, node := range managers {
+		if node.Description.Hostname != self {
+			restarted = node
+			break
+		}
+	}
+	if restarted.ID == "" {
+		t.Log("No other manager to restart")
+		return
+	}
+	host := restarted.Description.Hostname
+	latest, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	t.Logf("Restarting the engine on %s", host)
+	out, err := machines.Run(host, "sudo systemctl restart docker")
+	require.NoError(t, err, out)
+
+	start = time.Now()
+	ctx, cancel = WithTimeout(testContext, raftCatchUpWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, restarted.ID)
+		if err != nil {
+			return err
+		}
+		if node.ManagerStatus == nil || node.ManagerStatus.Reachability != swarm.ReachabilityReachable {
+			return fmt.Errorf("%s isn't a reachable manager yet", host)
+		}
+		out, err := machines.Run(host, fmt.Sprintf("sudo docker service inspect --format '{{.Version.Index}}' %s", service.ID))
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, out)
+		}
+		if index := strings.TrimSpace(out); index != fmt.Sprint(latest.Meta.Version.Index) {
+			return fmt.Errorf("%s serves version %s of the service, expected %d", host, index, latest.Meta.Version.Index)
+		}
+		return nil
+	})
+	require.NoError(t, err, "%s didn't catch up within %s", host, raftCatchUpWindow)
+	t.Logf("%s caught up in %s", host, time.Since(start))
+}
@@ -0,0 +1,109 @@
+package dockere2e
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// SeedEnv replays the random choices of an earlier run, e.g. which task the
+// chaos killed, with the seed it printed at the start. Every test gets its own
+// source seeded from it and the test's name, see TestRand, so a test makes the
+// same choices however the tests around it are ordered or run in parallel.
+// Object names stay unique to the run, they come from the run's UUID
+const SeedEnv = "E2E_SEED"
+
+var (
+	seedOnce sync.Once
+	seed     int64
+	seedErr  error
+)
+
+// Seed returns the seed of the run, from SeedEnv or picked at random
+func Seed() int64 {
+	seedOnce.Do(func() {
+		value := os.Getenv(SeedEnv)
+		if value == "" {
+			seed = time.Now().UnixNano()
+			return
+		}
+		seed, seedErr = strconv.ParseInt(value, 10, 64)
+		if seedErr != nil {
+			seedErr = fmt.Errorf("%s must be an integer, not %q", SeedEnv, value)
+		}
+	})
+	return seed
+}
+
+// checkSeed makes sure the seed is valid, for TestMain to fail fast rather
+// than have it silently ignored, and seeds the harness' own randomness, like
+// the jitter of the waits, with it
+func checkSeed() error {
+	rand.Seed(Seed())
+	return seedErr
+}
+
+// TestRand returns a source of randomness for the named test, seeded from the
+// run's seed and the name, for everything the test chooses at random
+func TestRand(name string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return rand.New(rand.NewSource(Seed() ^ int64(h.Sum64())))
+}
+
+// RandomNode returns one of the nodes, of which there has to be one at least,
+// chosen with r. The nodes are sorted by hostname first, so that the same seed
+// picks the same node of a cluster whatever order they were listed in
+func RandomNode(r *rand.Rand, nodes []swarm.Node) swarm.Node {
+	return RandomNodes(r, nodes, 1)[0]
+}
+
+// RandomNodes returns n different nodes, chosen with r, or all of them in a
+// random order if there aren't that many
+func RandomNodes(r *rand.Rand, nodes []swarm.Node, n int) []swarm.Node {
+	sorted := append([]swarm.Node{}, nodes...)
+	sort.Sort(byHostname(sorted))
+	picked := []swarm.Node{}
+	for _, i := range r.Perm(len(sorted)) {
+		if len(picked) == n {
+			break
+		}
+		picked = append(picked, sorted[i])
+	}
+	return picked
+}
+
+// byHostname sorts nodes by hostname
+type byHostname []swarm.Node
+
+func (b byHostname) Len() int      { return len(b) }
+func (b byHostname) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byHostname) Less(i, j int) bool {
+	return b[i].Description.Hostname < b[j].Description.Hostname
+}
+
+// bySlot sorts tasks by slot, and the tasks of global services, which all
+// have slot 0, by node
+type bySlot []swarm.Task
+
+func (b bySlot) Len() int      { return len(b) }
+func (b bySlot) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b bySlot) Less(i, j int) bool {
+	if b[i].Slot != b[j].Slot {
+		return b[i].Slot < b[j].Slot
+	}
+	return b[i].NodeID < b[j].NodeID
+}
+
+// RandomPort returns a port to publish a service on, chosen with r below
+// the range swarm assigns published ports from, 30000 to 32767
+func RandomPort(r *rand.Rand) uint32 {
+	return uint32(10000 + r.Intn(20000))
+}
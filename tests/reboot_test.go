@@ -0,0 +1,306 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// servicesConvergedCheck returns a check that passes once every replicated
+// test service is running all of its replicas
+func servicesConvergedCheck(ctx context.Context, cli *client.Client) func() error {
+	return func() error {
+		services, err := cli.ServiceList(ctx, types.ServiceListOptions{Filters: GetTestFilter()})
+		if err != nil {
+			return err
+		}
+		for _, service := range services {
+			if service.Spec.Mode.Replicated == nil || service.Spec.Mode.Replicated.Replicas == nil {
+				continue
+			}
+			replicas := int(*service.Spec.Mode.Replicated.Replicas)
+			if err := ScaleCheck(service.ID, cli)(ctx, replicas)(); err != nil {
+				return fmt.Errorf("service %s is degraded: %s", service.Spec.Name, err)
+			}
+		}
+		return nil
+	}
+}
+
+// rebootAndVerify reboots the node while a service has tasks on it, and checks
+// the tasks were replaced, the node rejoined by itself and nothing was left
+// degraded
+func rebootAndVerify(t *testing.T, ctx context.Context, cli *client.Client, m *Machines, node swarm.Node, name string) {
+	host := node.Description.Hostname
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	require.NoError(t, err)
+	// one task per node, so some end up on the one rebooted
+	replicas := len(nodes)
+	spec := NewServiceSpec(ctx, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(ctx, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	scaleCtx, cancel := WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(scaleCtx, time.Second, scaleCheck(scaleCtx, replicas))
+	require.NoError(t, err)
+	tasks, err := GetServiceTasks(ctx, cli, service.ID)
+	require.NoError(t, err)
+	onNode := []string{}
+	for _, task := range tasks {
+		if task.NodeID == node.ID && task.Status.State == swarm.TaskStateRunning {
+			onNode = append(onNode, task.ID)
+		}
+	}
+
+	t.Logf("Rebooting %s, which runs %d tasks", host, len(onNode))
+	start := time.Now()
+	require.NoError(t, m.Reboot(host))
+
+	recoverCtx, cancel := WithTimeout(ctx, recoveryWindow)
+	defer cancel()
+	err = WaitForConvergeBackoff(recoverCtx, DefaultBackoff, nodeReadyCheck(recoverCtx, cli, node.ID))
+	require.NoError(t, err, "%s did not rejoin after rebooting", host)
+	err = WaitForConverge(recoverCtx, time.Second, servicesConvergedCheck(recoverCtx, cli))
+	require.NoError(t, err)
+	t.Logf("Cluster converged %s after the reboot started", time.Since(start))
+
+	running, err := runningTaskIDs(ctx, cli, service.ID)
+	require.NoError(t, err)
+	for _, id := range onNode {
+		require.False(t, running[id], "task %s can't have survived the reboot", id)
+	}
+}
+
+// TestNodeRebootWorker reboots a worker
+func TestNodeRebootWorker(t *testing.T) {
+	name := "TestNodeRebootWorker"
+	testContext, cancel := NewTestContext(name, 15*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	rebootAndVerify(t, testContext, cli, machines, worker, name)
+}
+
+// TestNodeRebootManager reboots a manager that isn't the leader, which also
+// has to become a reachable member of the raft cluster again
+func TestNodeRebootManager(t *testing.T) {
+	name := "TestNodeRebootManager"
+	testContext, cancel := NewTestContext(name, 15*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	managers, self, err := GetManagers(testContext, cli)
+	require.NoError(t, err)
+	if len(managers) < 3 {
+		t.Skipf("rebooting a manager needs at least 3 managers to keep quorum, the cluster has %d", len(managers))
+	}
+	var target *swarm.Node
+	for i, node := range managers {
+		if node.Description.Hostname != self && !node.ManagerStatus.Leader && node.Description.Platform.OS == "linux" {
+			target = &managers[i]
+			break
+		}
+	}
+	if target == nil {
+		t.Skip("no manager other than the leader and the local node")
+	}
+
+	rebootAndVerify(t, testContext, cli, machines, *target, name)
+	ctx, cancel := WithTimeout(testContext, recoveryWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, target.ID)
+		if err != nil {
+			return err
+		}
+		if node.ManagerStatus == nil || node.ManagerStatus.Reachability != swarm.ReachabilityReachable {
+			return fmt.Errorf("%s is not a reachable manager yet", target.Description.Hostname)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// runningOnNode counts the service's running tasks on the node
+func runningOnNode(ctx context.Context, cli *client.Client, serviceID, nodeID string) (int, error) {
+	tasks, err := GetServiceTasks(ctx, cli, serviceID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, task := range tasks {
+		if task.NodeID == nodeID && task.Status.State == swarm.TaskStateRunning {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// TestNodeMaintenance goes through a scheduled maintenance of a worker the
+// way an operator would: drain it, reboot the machine, change its daemon.json
+// and restart the engine, then make it active again. Its tasks have to move
+// elsewhere while it's drained, it has to stay drained through the reboot,
+// and once it's active it has to take its share of the service back on an
+// update, and run new tasks that need the engine label set in daemon.json
+func TestNodeMaintenance(t *testing.T) {
+	name := "TestNodeMaintenance"
+	testContext, cancel := NewTestContext(name, 20*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	worker, err := GetSpareWorker(testContext, cli)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	host := worker.Description.Hostname
+	nodes, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+
+	replicas := 2 * len(nodes)
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.platform.os == linux").
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+	onWorker, err := runningOnNode(testContext, cli, service.ID, worker.ID)
+	require.NoError(t, err)
+	require.NotZero(t, onWorker, "no task was scheduled on %s", host)
+
+	t.Logf("Draining %s, which runs %d tasks", host, onWorker)
+	require.NoError(t, setAvailability(testContext, cli, worker.ID, swarm.NodeAvailabilityDrain))
+	defer setAvailability(context.Background(), cli, worker.ID, swarm.NodeAvailabilityActive)
+	err = WaitForConverge(ctx, time.Second, func() error {
+		n, err := runningOnNode(ctx, cli, service.ID, worker.ID)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("%d tasks still running on %s", n, host)
+		}
+		return ScaleCheck(service.ID, cli)(ctx, replicas)()
+	})
+	require.NoError(t, err, "tasks weren't moved off %s", host)
+
+	t.Logf("Rebooting %s", host)
+	require.NoError(t, machines.Reboot(host))
+	ctx, cancel = WithTimeout(testContext, recoveryWindow)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, nodeReadyCheck(ctx, cli, worker.ID))
+	require.NoError(t, err, "%s did not rejoin after rebooting", host)
+	diff, err := ExpectedState{
+		Services: map[string]int{service.ID: replicas},
+		Nodes:    map[string]swarm.NodeAvailability{worker.ID: swarm.NodeAvailabilityDrain},
+	}.Diff(testContext, cli)
+	require.NoError(t, err)
+	require.Empty(t, diff, "%s should stay drained through the reboot", host)
+
+	t.Logf("Changing the daemon.json of %s", host)
+	engineLabel := fmt.Sprintf("e2e.maintenance=%s", getUniqueName(name))
+	original, err := setDaemonConfig(machines, host, "labels", []string{engineLabel})
+	require.NoError(t, err)
+	defer func() {
+		if err := machines.WriteFile(host, daemonJSONPath, original); err != nil {
+			t.Logf("Failed to restore %s on %s: %s", daemonJSONPath, host, err)
+			return
+		}
+		if err := restartEngine(context.Background(), cli, machines, host, worker.ID); err != nil {
+			t.Log(err)
+		}
+	}()
+	require.NoError(t, restartEngine(testContext, cli, machines, host, worker.ID))
+	ctx, cancel = WithTimeout(testContext, time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		node, _, err := cli.NodeInspectWithRaw(ctx, worker.ID)
+		if err != nil {
+			return err
+		}
+		key := strings.SplitN(engineLabel, "=", 2)
+		if node.Description.Engine.Labels[key[0]] != key[1] {
+			return fmt.Errorf("%s has engine labels %v", host, node.Description.Engine.Labels)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Logf("Making %s active again", host)
+	require.NoError(t, setAvailability(testContext, cli, worker.ID, swarm.NodeAvailabilityActive))
+	// running tasks aren't moved back by themselves, it takes an update
+	updateService(t, testContext, cli, service.ID, func(spec *swarm.ServiceSpec) {
+		spec.TaskTemplate.ForceUpdate++
+	})
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		if err := ScaleCheck(service.ID, cli)(ctx, replicas)(); err != nil {
+			return err
+		}
+		n, err := runningOnNode(ctx, cli, service.ID, worker.ID)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no task of the update was scheduled on %s", host)
+		}
+		return nil
+	})
+	require.NoError(t, err, "the service didn't rebalance onto %s", host)
+
+	// and a new service that can only run there
+	pinned := NewServiceSpec(testContext, cli, name+"Pinned").
+		Replicas(2).
+		Label(name).
+		Constraint("engine.labels." + strings.Replace(engineLabel, "=", " == ", 1)).
+		Unpublished().
+		Build()
+	pinnedService, err := CreateService(testContext, cli, pinned)
+	require.NoError(t, err, "Error creating service")
+	err = WaitForConverge(ctx, time.Second, func() error {
+		n, err := runningOnNode(ctx, cli, pinnedService.ID, worker.ID)
+		if err != nil {
+			return err
+		}
+		if n != 2 {
+			return fmt.Errorf("%d of 2 tasks running on %s", n, host)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
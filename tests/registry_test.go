@@ -0,0 +1,406 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// htpasswd entries for the registry
+	"golang.org/x/crypto/bcrypt"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// registryImage is the registry the auth tests run in the cluster
+const registryImage = "registry:2"
+
+// testRegistry is a registry requiring basic auth, running as a service on
+// the local node. The engines reach it through the routing mesh on
+// localhost, which they don't require TLS for.
+type testRegistry struct {
+	cli       *client.Client
+	name      string
+	serviceID string
+	volume    string
+	Addr      string
+}
+
+// htpasswd returns an htpasswd file with the single user in it
+func htpasswd(user, password string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%s:%s\n", user, hash)), nil
+}
+
+// registryAuth encodes the credentials the way the API expects them in the
+// X-Registry-Auth header
+func registryAuth(server, user, password string) (string, error) {
+	data, err := json.Marshal(types.AuthConfig{
+		Username:      user,
+		Password:      password,
+		ServerAddress: server,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// htpasswdSecret creates a secret holding the htpasswd file for the user
+func htpasswdSecret(ctx context.Context, cli *client.Client, name, user, password string) (*swarm.SecretReference, error) {
+	data, err := htpasswd(user, password)
+	if err != nil {
+		return nil, err
+	}
+	spec := CannedSecretSpec(name+user, data, name)
+	secret, err := cli.SecretCreate(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	return &swarm.SecretReference{
+		SecretID:   secret.ID,
+		SecretName: spec.Name,
+		File: &swarm.SecretReferenceFileTarget{
+			Name: "htpasswd",
+			UID:  "0",
+			GID:  "0",
+			Mode: 0444,
+		},
+	}, nil
+}
+
+// startRegistry runs a registry letting in only the user, keeping its storage
+// in a volume on the local node so that it survives the service being updated
+func startRegistry(t *testing.T, ctx context.Context, cli *client.Client, name, user, password string) *testRegistry {
+	info, err := cli.Info(ctx)
+	require.NoError(t, err)
+	ref, err := htpasswdSecret(ctx, cli, name, user, password)
+	require.NoError(t, err, "Error creating htpasswd secret")
+
+	volume := getUniqueName(name + "Registry")
+	spec := NewServiceSpec(ctx, cli, name+"Registry").
+		Label(name).
+		Image(registryImage).
+		Command().
+		Env(
+			"REGISTRY_AUTH=htpasswd",
+			"REGISTRY_AUTH_HTPASSWD_REALM=e2e",
+			"REGISTRY_AUTH_HTPASSWD_PATH=/run/secrets/htpasswd",
+		).
+		Secret(ref).
+		Mount(mount.Mount{Type: mount.TypeVolume, Source: volume, Target: "/var/lib/registry"}).
+		Constraint("node.id == " + info.Swarm.NodeID).
+		PublishTCP(5000).
+		Build()
+	service, err := CreateService(ctx, cli, spec)
+	require.NoError(t, err, "Error creating registry service")
+
+	scaleCtx, cancel := WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(scaleCtx, time.Second, ScaleCheck(service.ID, cli)(scaleCtx, 1))
+	require.NoError(t, err)
+	endpoint, published, err := getNodeIPPort(ctx, cli, service.ID, 5000)
+	require.NoError(t, err)
+
+	// the registry answers 401 to anonymous requests once it's up
+	err = WaitForConverge(scaleCtx, time.Second, registryUpCheck(endpoint, published))
+	require.NoError(t, err)
+	return &testRegistry{
+		cli:       cli,
+		name:      name,
+		serviceID: service.ID,
+		volume:    volume,
+		Addr:      fmt.Sprintf("localhost:%d", published),
+	}
+}
+
+// registryUpCheck returns a check that passes once the registry on the port
+// asks for credentials
+func registryUpCheck(endpoint string, port uint32) func() error {
+	return func() error {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(fmt.Sprintf("http://%s:%d/v2/", endpoint, port))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			return fmt.Errorf("registry returned %d to an anonymous request", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Push tags the image the tests run in into the registry, returning the
+// reference to deploy from
+func (r *testRegistry) Push(ctx context.Context, tag, auth string) (string, error) {
+	return r.PushImage(ctx, GetSelfImage(ctx, r.cli), tag, auth)
+}
+
+// PushImage tags a local image into the registry, replacing whatever the tag
+// pointed to before
+func (r *testRegistry) PushImage(ctx context.Context, image, tag, auth string) (string, error) {
+	ref := fmt.Sprintf("%s/e2e-%s:%s", r.Addr, UUID(), tag)
+	if err := r.cli.ImageTag(ctx, image, ref); err != nil {
+		return "", err
+	}
+	resp, err := r.cli.ImagePush(ctx, ref, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+	// failures come back in the stream rather than as an error
+	if err := jsonmessage.DisplayJSONMessagesStream(resp, discard{}, 0, false, nil); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+// Rotate replaces the registry's htpasswd, letting only the new user in
+func (r *testRegistry) Rotate(ctx context.Context, user, password string) error {
+	ref, err := htpasswdSecret(ctx, r.cli, r.name, user, password)
+	if err != nil {
+		return err
+	}
+	full, _, err := r.cli.ServiceInspectWithRaw(ctx, r.serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return err
+	}
+	full.Spec.TaskTemplate.ContainerSpec.Secrets = []*swarm.SecretReference{ref}
+	_, err = r.cli.ServiceUpdate(ctx, r.serviceID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		return err
+	}
+	return WaitForConverge(ctx, time.Second, func() error {
+		tasks, err := GetServiceTasks(ctx, r.cli, r.serviceID)
+		if err != nil {
+			return err
+		}
+		if len(tasks) == 0 {
+			return fmt.Errorf("registry has no tasks")
+		}
+		for _, task := range tasks {
+			if task.Status.State != swarm.TaskStateRunning || len(task.Spec.ContainerSpec.Secrets) != 1 || task.Spec.ContainerSpec.Secrets[0].SecretID != ref.SecretID {
+				return fmt.Errorf("registry hasn't restarted with the new credentials")
+			}
+		}
+		return nil
+	})
+}
+
+// Remove removes the registry along with the images pushed to it
+func (r *testRegistry) Remove(ctx context.Context) error {
+	if err := r.cli.ServiceRemove(ctx, r.serviceID); err != nil {
+		return err
+	}
+	return WaitForConverge(ctx, time.Second, func() error {
+		// fails while the task's container is still being removed
+		return r.cli.VolumeRemove(ctx, r.volume, false)
+	})
+}
+
+// discard throws away the push progress
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+// remoteLinuxConstraints keeps a service off the local node, which has every
+// image pushed to the registry without pulling it
+func remoteLinuxConstraints(t *testing.T, ctx context.Context, cli *client.Client) ([]string, int) {
+	info, err := cli.Info(ctx)
+	require.NoError(t, err)
+	linux, err := GetPlatformNodes(ctx, cli, "linux")
+	require.NoError(t, err)
+	remote := 0
+	for _, node := range linux {
+		if node.ID != info.Swarm.NodeID {
+			remote++
+		}
+	}
+	if remote == 0 {
+		t.Skip("pulls can only be checked on nodes other than the local one")
+	}
+	return []string{"node.platform.os == linux", "node.id != " + info.Swarm.NodeID}, remote
+}
+
+// pullFailureCheck returns a check that passes once the service has tasks
+// rejected for failing to pull, without any of them running
+func pullFailureCheck(ctx context.Context, cli *client.Client, serviceID string) func() error {
+	return func() error {
+		filter := GetTestFilter()
+		filter.Add("service", serviceID)
+		tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: filter})
+		if err != nil {
+			return err
+		}
+		rejected := 0
+		for _, task := range tasks {
+			if task.Status.State == swarm.TaskStateRunning {
+				return fmt.Errorf("task %s is running on %s", task.ID, task.NodeID)
+			}
+			if task.Status.State == swarm.TaskStateRejected && task.Status.Err != "" {
+				rejected++
+			}
+		}
+		if rejected == 0 {
+			return fmt.Errorf("no task has failed to pull yet")
+		}
+		return nil
+	}
+}
+
+// TestRegistryAuthDeploy pushes the test image to a registry requiring auth,
+// and checks a service created with the credentials can pull it on every node
+// while one created without them can't
+func TestRegistryAuthDeploy(t *testing.T) {
+	name := "TestRegistryAuthDeploy"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	constraints, replicas := remoteLinuxConstraints(t, testContext, cli)
+	defer cleanSecretTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	registry := startRegistry(t, testContext, cli, name, "e2e", "initial")
+	defer registry.Remove(testContext)
+	auth, err := registryAuth(registry.Addr, "e2e", "initial")
+	require.NoError(t, err)
+	withAuth, err := registry.Push(testContext, "with-auth", auth)
+	require.NoError(t, err, "Error pushing to the registry")
+	withoutAuth, err := registry.Push(testContext, "without-auth", auth)
+	require.NoError(t, err, "Error pushing to the registry")
+
+	spec := NewServiceSpec(testContext, cli, name+"WithAuth").
+		Replicas(uint64(replicas)).
+		Label(name).
+		Image(withAuth).
+		Constraint(constraints...).
+		Build()
+	service, err := CreateServiceWithOptions(testContext, cli, spec, types.ServiceCreateOptions{EncodedRegistryAuth: auth})
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err, "service with credentials didn't pull")
+
+	spec = NewServiceSpec(testContext, cli, name+"WithoutAuth").
+		Replicas(uint64(replicas)).
+		Label(name).
+		Image(withoutAuth).
+		Constraint(constraints...).
+		Build()
+	service, err = CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, pullFailureCheck(ctx, cli, service.ID))
+	require.NoError(t, err, "service without credentials")
+}
+
+// TestRegistryAuthRotation changes the registry's password, and checks a
+// service can't be updated to a new image with the old credentials, but can
+// with the new ones
+func TestRegistryAuthRotation(t *testing.T) {
+	name := "TestRegistryAuthRotation"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	constraints, replicas := remoteLinuxConstraints(t, testContext, cli)
+	defer cleanSecretTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	registry := startRegistry(t, testContext, cli, name, "e2e", "before")
+	defer registry.Remove(testContext)
+	oldAuth, err := registryAuth(registry.Addr, "e2e", "before")
+	require.NoError(t, err)
+	first, err := registry.Push(testContext, "first", oldAuth)
+	require.NoError(t, err, "Error pushing to the registry")
+	second, err := registry.Push(testContext, "second", oldAuth)
+	require.NoError(t, err, "Error pushing to the registry")
+
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Label(name).
+		Image(first).
+		Constraint(constraints...).
+		Build()
+	service, err := CreateServiceWithOptions(testContext, cli, spec, types.ServiceCreateOptions{EncodedRegistryAuth: oldAuth})
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	require.NoError(t, registry.Rotate(ctx, "e2e-rotated", "after"), "Error rotating the registry credentials")
+	newAuth, err := registryAuth(registry.Addr, "e2e-rotated", "after")
+	require.NoError(t, err)
+
+	// the old credentials no longer get the second image anywhere
+	update := func(auth string) {
+		full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+		require.NoError(t, err)
+		full.Spec.TaskTemplate.ContainerSpec.Image = second
+		full.Spec.TaskTemplate.ForceUpdate++
+		full.Spec.UpdateConfig = &swarm.UpdateConfig{Parallelism: uint64(replicas), FailureAction: swarm.UpdateFailureActionPause}
+		_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{EncodedRegistryAuth: auth})
+		require.NoError(t, err)
+	}
+	update(oldAuth)
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		filter := GetTestFilter()
+		filter.Add("service", service.ID)
+		tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: filter})
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if task.Spec.ContainerSpec.Image == second && task.Status.State == swarm.TaskStateRejected {
+				return nil
+			}
+		}
+		return fmt.Errorf("no task failed to pull %s with the old credentials", second)
+	})
+	require.NoError(t, err)
+
+	update(newAuth)
+	ctx, cancel = WithTimeout(testContext, 3*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		tasks, err := GetServiceTasks(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		running := 0
+		for _, task := range tasks {
+			if task.Spec.ContainerSpec.Image == second && task.Status.State == swarm.TaskStateRunning {
+				running++
+			}
+		}
+		if running != replicas {
+			return fmt.Errorf("%d of %d tasks running %s", running, replicas, second)
+		}
+		return nil
+	})
+	require.NoError(t, err, "service didn't update with the new credentials")
+}
@@ -0,0 +1,446 @@
+package dockere2e
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// The go test output is all the tests produce, which CI dashboards can't do
+// much with. When ReportDirEnv is set, TestMain runs the tests verbosely and
+// reads their output as it goes to stdout, writing the results to the
+// directory once they're done:
+//
+//	junit.xml       one testcase per test and subtest
+//	results.json    the same results, with the cluster they ran against
+//	artifacts/      a directory for every failed or flaky test, with its
+//	                output and whatever CaptureFailure saved
+//
+// The same output tells TestMain which tests to run again when retries are
+// enabled, see RetriesEnv.
+const ReportDirEnv = "E2E_REPORT_DIR"
+
+// syncMarker is written through the pipe to know when everything written
+// before it has been collected
+const syncMarker = "=== e2e reporter sync"
+
+// resultLine matches the line go test prints when a test or subtest finishes,
+// indented by 4 spaces per level of subtest
+var resultLine = regexp.MustCompile(`^(\s*)--- (PASS|FAIL|SKIP): (\S+) \(([0-9.]+)s\)$`)
+
+// testResult is the outcome of a single test or subtest. A test that failed
+// and then passed when run again has the status flaky, with the output of
+// every failed run in Retries
+type testResult struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Duration float64    `json:"duration"`
+	Attempts int        `json:"attempts"`
+	Output   []string   `json:"output,omitempty"`
+	Retries  [][]string `json:"retries,omitempty"`
+	Artifact string     `json:"artifact,omitempty"`
+
+	indent int
+	// end is when the result was read, for the spans of the tests
+	end time.Time
+}
+
+// nodeMetadata describes a node of the cluster at the end of the run
+type nodeMetadata struct {
+	Hostname      string `json:"hostname"`
+	Role          string `json:"role"`
+	OS            string `json:"os"`
+	Availability  string `json:"availability"`
+	State         string `json:"state"`
+	EngineVersion string `json:"engine_version"`
+}
+
+// clusterMetadata describes the cluster the tests ran against
+type clusterMetadata struct {
+	ServerVersion string         `json:"server_version"`
+	APIVersion    string         `json:"api_version"`
+	Experimental  bool           `json:"experimental"`
+	Nodes         []nodeMetadata `json:"nodes"`
+}
+
+// runSummary is what goes in results.json
+type runSummary struct {
+	UUID     string          `json:"uuid"`
+	Start    time.Time       `json:"start"`
+	Duration float64         `json:"duration"`
+	Passed   int             `json:"passed"`
+	Failed   int             `json:"failed"`
+	Skipped  int             `json:"skipped"`
+	Flaky    int             `json:"flaky"`
+	Cluster  clusterMetadata `json:"cluster"`
+	Tests    []*testResult   `json:"tests"`
+}
+
+// Reporter collects the results of the tests from their output
+type Reporter struct {
+	dir    string
+	start  time.Time
+	stdout *os.File
+	pipe   *os.File
+	done   chan struct{}
+	synced chan struct{}
+
+	mu    sync.Mutex
+	tests []*testResult
+	// retries holds the output of the failed runs of the tests being run
+	// again, by test name
+	retries map[string][][]string
+	// summary is what Finish made of the results
+	summary runSummary
+}
+
+// NewReporter starts collecting the output of the tests, by swapping stdout
+// for a pipe and copying everything read from it to the real stdout. The
+// results are only written if dir isn't empty
+func NewReporter(dir string) (*Reporter, error) {
+	if dir != "" {
+		if err := os.MkdirAll(filepath.Join(dir, "artifacts"), 0755); err != nil {
+			return nil, err
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	reporter := &Reporter{
+		dir:     dir,
+		start:   time.Now(),
+		stdout:  os.Stdout,
+		pipe:    w,
+		done:    make(chan struct{}),
+		synced:  make(chan struct{}),
+		retries: map[string][][]string{},
+	}
+	os.Stdout = w
+	go reporter.collect(r)
+	return reporter, nil
+}
+
+// collect parses the output until the pipe is closed. go test prints the log
+// of a test indented under the line with its result, so indented lines belong
+// to the last test that finished at a lower indentation
+func (r *Reporter) collect(in io.Reader) {
+	defer close(r.done)
+	var current *testResult
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == syncMarker {
+			current = nil
+			r.synced <- struct{}{}
+			continue
+		}
+		fmt.Fprintln(r.stdout, line)
+
+		if m := resultLine.FindStringSubmatch(line); m != nil {
+			duration, _ := strconv.ParseFloat(m[4], 64)
+			current = &testResult{
+				Name:     m[3],
+				Status:   strings.ToLower(m[2]),
+				Duration: duration,
+				Attempts: 1,
+				indent:   len(m[1]),
+				end:      time.Now(),
+			}
+			r.mu.Lock()
+			r.tests = append(r.tests, current)
+			r.mu.Unlock()
+			continue
+		}
+		trimmed := strings.TrimLeft(line, " \t")
+		if current == nil || len(line)-len(trimmed) <= current.indent || strings.HasPrefix(trimmed, "=== ") {
+			current = nil
+			continue
+		}
+		current.Output = append(current.Output, strings.TrimSpace(trimmed))
+	}
+}
+
+// sync waits until the collector has caught up with everything written so far
+func (r *Reporter) sync() {
+	fmt.Fprintln(r.pipe, syncMarker)
+	<-r.synced
+}
+
+// Failed returns the top level tests that failed the last time they ran
+func (r *Reporter) Failed() []string {
+	r.sync()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failed := []string{}
+	for _, test := range r.tests {
+		if test.indent == 0 && test.Status == "fail" {
+			failed = append(failed, test.Name)
+		}
+	}
+	return failed
+}
+
+// Results returns the results of the top level tests collected so far, by name
+func (r *Reporter) Results() map[string]*testResult {
+	r.sync()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := map[string]*testResult{}
+	for _, test := range r.tests {
+		if test.indent == 0 {
+			results[test.Name] = test
+		}
+	}
+	return results
+}
+
+// Reset forgets the results collected so far, before the tests are run again
+// to be reported on their own
+func (r *Reporter) Reset() {
+	r.sync()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tests = nil
+}
+
+// Retry sets the results of the top level tests aside, along with their
+// subtests, before they're run again
+func (r *Reporter) Retry(tests []string) {
+	r.sync()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	retried := map[string]bool{}
+	for _, test := range tests {
+		retried[test] = true
+	}
+	kept := []*testResult{}
+	for _, test := range r.tests {
+		top := strings.SplitN(test.Name, "/", 2)[0]
+		if !retried[top] {
+			kept = append(kept, test)
+			continue
+		}
+		if test.Name == top {
+			r.retries[top] = append(r.retries[top], test.Output)
+		}
+	}
+	r.tests = kept
+}
+
+// Finish stops collecting, and writes the results along with a description of
+// the cluster
+func (r *Reporter) Finish(ctx context.Context, cli *client.Client) error {
+	os.Stdout = r.stdout
+	r.pipe.Close()
+	<-r.done
+
+	summary := runSummary{
+		UUID:     UUID(),
+		Start:    r.start,
+		Duration: time.Since(r.start).Seconds(),
+		Tests:    r.tests,
+	}
+	for _, test := range r.tests {
+		if retries, ok := r.retries[test.Name]; ok {
+			test.Retries = retries
+			test.Attempts += len(retries)
+			if test.Status == "pass" {
+				test.Status = "flaky"
+			}
+		}
+		switch test.Status {
+		case "pass":
+			summary.Passed++
+		case "fail":
+			summary.Failed++
+		case "skip":
+			summary.Skipped++
+		case "flaky":
+			summary.Flaky++
+		}
+	}
+	r.summary = summary
+	if r.dir == "" {
+		return nil
+	}
+
+	for _, test := range r.tests {
+		if test.Status == "fail" || test.Status == "flaky" {
+			test.Artifact = filepath.Join("artifacts", artifactName(test.Name))
+			if err := os.MkdirAll(filepath.Join(r.dir, test.Artifact), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(r.dir, test.Artifact, "output.log"), testLog(test), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	cluster, err := describeCluster(ctx, cli)
+	if err != nil {
+		// the results are still worth having without it
+		fmt.Fprintf(os.Stderr, "Error describing the cluster for the report: %s\n", err)
+	}
+	summary.Cluster = cluster
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.dir, "results.json"), data, 0644); err != nil {
+		return err
+	}
+	data, err = xml.MarshalIndent(junitReport(summary), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.dir, "junit.xml"), append([]byte(xml.Header), data...), 0644)
+}
+
+// Summary returns the results of the run, once Finish has been called
+func (r *Reporter) Summary() runSummary {
+	return r.summary
+}
+
+// testLog puts the output of every run of the test together
+func testLog(test *testResult) []byte {
+	log := ""
+	for i, output := range append(test.Retries, test.Output) {
+		log += fmt.Sprintf("=== attempt %d of %d: %s\n", i+1, test.Attempts, strings.Join(output, "\n"))
+	}
+	return []byte(log)
+}
+
+// artifactName turns a test name into a directory name, subtests included
+func artifactName(test string) string {
+	return strings.NewReplacer("/", "_", " ", "_").Replace(test)
+}
+
+// describeCluster collects the versions and nodes of the cluster
+func describeCluster(ctx context.Context, cli *client.Client) (clusterMetadata, error) {
+	cluster := clusterMetadata{}
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return cluster, err
+	}
+	cluster.ServerVersion = version.Version
+	cluster.APIVersion = version.APIVersion
+	cluster.Experimental = version.Experimental
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return cluster, err
+	}
+	for _, node := range nodes {
+		cluster.Nodes = append(cluster.Nodes, nodeMetadata{
+			Hostname:      node.Description.Hostname,
+			Role:          string(node.Spec.Role),
+			OS:            node.Description.Platform.OS,
+			Availability:  string(node.Spec.Availability),
+			State:         string(node.Status.State),
+			EngineVersion: node.Description.Engine.EngineVersion,
+		})
+	}
+	return cluster, nil
+}
+
+type junitSuite struct {
+	XMLName    xml.Name        `xml:"testsuite"`
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitCase     `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	// the failed runs of a test that passed on retry, which Jenkins and
+	// most dashboards show as flaky
+	FlakyFailures []junitMessage `xml:"flakyFailure,omitempty"`
+	SystemOut     string         `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// junitReport converts the summary to a JUnit test suite
+func junitReport(summary runSummary) junitSuite {
+	suite := junitSuite{
+		Name:      "dockere2e",
+		Tests:     len(summary.Tests),
+		Failures:  summary.Failed,
+		Skipped:   summary.Skipped,
+		Time:      fmt.Sprintf("%.3f", summary.Duration),
+		Timestamp: summary.Start.Format("2006-01-02T15:04:05"),
+		Properties: []junitProperty{
+			{"uuid", summary.UUID},
+			{"server_version", summary.Cluster.ServerVersion},
+			{"api_version", summary.Cluster.APIVersion},
+			{"nodes", strconv.Itoa(len(summary.Cluster.Nodes))},
+		},
+	}
+	for _, test := range summary.Tests {
+		output := strings.Join(test.Output, "\n")
+		c := junitCase{
+			Classname: "dockere2e",
+			Name:      test.Name,
+			Time:      fmt.Sprintf("%.3f", test.Duration),
+		}
+		switch test.Status {
+		case "fail":
+			c.Failure = &junitMessage{Message: failureMessage(test.Output), Body: output}
+		case "skip":
+			c.Skipped = &junitMessage{Message: output}
+		default:
+			c.SystemOut = output
+		}
+		for _, retry := range test.Retries {
+			c.FlakyFailures = append(c.FlakyFailures, junitMessage{
+				Message: failureMessage(retry),
+				Body:    strings.Join(retry, "\n"),
+			})
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	return suite
+}
+
+// failureMessage picks the gist of a failure out of the output of a test,
+// which testify puts on its Error line
+func failureMessage(output []string) string {
+	for _, line := range output {
+		if strings.HasPrefix(line, "Error:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Error:"))
+		}
+	}
+	return "failed"
+}
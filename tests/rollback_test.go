@@ -0,0 +1,164 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// updateService applies change to the service's current spec and waits for the
+// update to complete
+func updateService(t *testing.T, ctx context.Context, cli *client.Client, serviceID string, change func(*swarm.ServiceSpec)) {
+	full, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	change(&full.Spec)
+	_, err = cli.ServiceUpdate(ctx, serviceID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+	updateCtx, cancel := WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(updateCtx, time.Second, updateStateCheck(updateCtx, cli, serviceID, swarm.UpdateStateCompleted))
+	require.NoError(t, err)
+}
+
+// watchUpdateStates polls the service's update status until it reaches final,
+// returning every state seen in order
+func watchUpdateStates(ctx context.Context, cli *client.Client, serviceID string, final swarm.UpdateState) ([]swarm.UpdateState, error) {
+	states := []swarm.UpdateState{}
+	err := WaitForConverge(ctx, 200*time.Millisecond, func() error {
+		service, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+		if err != nil {
+			return err
+		}
+		if service.UpdateStatus == nil {
+			return fmt.Errorf("service has no update status")
+		}
+		state := service.UpdateStatus.State
+		if len(states) == 0 || states[len(states)-1] != state {
+			states = append(states, state)
+		}
+		if state != final {
+			return fmt.Errorf("update is %s, waiting for %s", state, final)
+		}
+		return nil
+	})
+	return states, err
+}
+
+// TestServiceRollbackPrevious updates a service twice, then asks for a
+// rollback through the API, and checks the spec from before the second update
+// comes back exactly, with the update status going through the rollback
+// states and the tasks running the restored spec
+func TestServiceRollbackPrevious(t *testing.T) {
+	t.Parallel()
+	name := "TestServiceRollbackPrevious"
+	RequiresAPIVersion(t, "1.28")
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	nwIDs := []string{}
+	for i := 0; i < 2; i++ {
+		nwName := getUniqueName(fmt.Sprintf("%s-%d", name, i))
+		nw, err := cli.NetworkCreate(testContext, nwName, types.NetworkCreate{
+			Driver:         "overlay",
+			CheckDuplicate: true,
+			Labels:         testLabels(name),
+		})
+		require.NoError(t, err, "Error creating overlay network %s", nwName)
+		nwIDs = append(nwIDs, nw.ID)
+	}
+
+	replicas := 2
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwIDs[0]).
+		Env("E2E_ROLLBACK=first").
+		UpdateConfig(swarm.UpdateConfig{Parallelism: uint64(replicas)}).
+		RollbackConfig(swarm.UpdateConfig{Parallelism: uint64(replicas)}).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+
+	updateService(t, testContext, cli, service.ID, func(spec *swarm.ServiceSpec) {
+		spec.TaskTemplate.ContainerSpec.Env = []string{"E2E_ROLLBACK=second"}
+		spec.TaskTemplate.Networks = append(spec.TaskTemplate.Networks, swarm.NetworkAttachmentConfig{Target: nwIDs[1]})
+	})
+	second, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+
+	updateService(t, testContext, cli, service.ID, func(spec *swarm.ServiceSpec) {
+		spec.TaskTemplate.ContainerSpec.Env = []string{"E2E_ROLLBACK=third", "E2E_EXTRA=1"}
+		spec.TaskTemplate.Networks = []swarm.NetworkAttachmentConfig{{Target: nwIDs[1]}}
+		spec.Labels["third"] = ""
+	})
+	third, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	require.NotNil(t, third.PreviousSpec, "service has no previous spec after two updates")
+	require.Equal(t, second.Spec, *third.PreviousSpec, "previous spec should be the spec before the last update")
+
+	_, err = cli.ServiceUpdate(testContext, service.ID, third.Meta.Version, third.Spec, types.ServiceUpdateOptions{Rollback: "previous"})
+	require.NoError(t, err)
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	states, err := watchUpdateStates(ctx, cli, service.ID, swarm.UpdateStateRollbackCompleted)
+	require.NoError(t, err, "rollback went through %v", states)
+	t.Logf("Rollback went through %v", states)
+	for _, state := range states {
+		require.Contains(t, []swarm.UpdateState{swarm.UpdateStateRollbackStarted, swarm.UpdateStateRollbackCompleted}, state, "unexpected state during the rollback")
+	}
+
+	rolledBack, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	require.Equal(t, second.Spec.TaskTemplate.ContainerSpec.Image, rolledBack.Spec.TaskTemplate.ContainerSpec.Image)
+	require.Equal(t, second.Spec.TaskTemplate.ContainerSpec.Env, rolledBack.Spec.TaskTemplate.ContainerSpec.Env)
+	require.Equal(t, second.Spec.TaskTemplate.Networks, rolledBack.Spec.TaskTemplate.Networks)
+	require.Equal(t, second.Spec, rolledBack.Spec, "spec should be restored exactly")
+	require.NotNil(t, rolledBack.PreviousSpec)
+	require.Equal(t, third.Spec, *rolledBack.PreviousSpec, "the rolled back spec becomes the previous one")
+
+	// the tasks end up on the restored spec, attached to both networks
+	err = WaitForConverge(ctx, time.Second, func() error {
+		tasks, err := GetServiceTasks(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		running := 0
+		for _, task := range tasks {
+			if task.Status.State != swarm.TaskStateRunning {
+				continue
+			}
+			env := task.Spec.ContainerSpec.Env
+			if len(env) != 1 || env[0] != "E2E_ROLLBACK=second" {
+				return fmt.Errorf("task %s runs with %v", task.ID, env)
+			}
+			for _, id := range nwIDs {
+				if addrs, _ := taskNetworkAddrs([]swarm.Task{task}, id); len(addrs) == 0 {
+					return fmt.Errorf("task %s isn't attached to %s", task.ID, id)
+				}
+			}
+			running++
+		}
+		if running != replicas {
+			return fmt.Errorf("%d of %d tasks running", running, replicas)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
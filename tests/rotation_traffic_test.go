@@ -0,0 +1,205 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// contentPoller keeps reading a file through the load balancer, counting what
+// content each request sees and how many requests fail
+type contentPoller struct {
+	mu       sync.Mutex
+	cutover  bool
+	failures []string
+	before   map[string]int
+	after    map[string]int
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// pollContent starts polling path on the service's published port
+func pollContent(ctx context.Context, endpoint, port, path string) *contentPoller {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &contentPoller{
+		before: map[string]int{},
+		after:  map[string]int{},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			info, err := getFile(ctx, endpoint, port, path)
+			p.mu.Lock()
+			if err != nil {
+				p.failures = append(p.failures, err.Error())
+			} else if p.cutover {
+				p.after[info.Content]++
+			} else {
+				p.before[info.Content]++
+			}
+			p.mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	return p
+}
+
+// markCutover separates the requests made during the update from those made
+// after it completed
+func (p *contentPoller) markCutover() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cutover = true
+}
+
+// stop waits for the poller to finish and returns what it saw during the
+// update, after it, and the failed requests
+func (p *contentPoller) stop() (map[string]int, map[string]int, []string) {
+	p.cancel()
+	<-p.done
+	return p.before, p.after, p.failures
+}
+
+// rotateUnderTraffic updates the service with swap while polling path, and
+// checks no request fails, only the old and new contents are ever served, and
+// only the new one once the update has completed
+func rotateUnderTraffic(t *testing.T, ctx context.Context, cli *client.Client, serviceID, path, oldContent, newContent string, swap func(*swarm.ServiceSpec)) {
+	endpoint, published, err := getNodeIPPort(ctx, cli, serviceID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+	poller := pollContent(ctx, endpoint, port, path)
+	defer poller.stop()
+
+	full, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	swap(&full.Spec)
+	_, err = cli.ServiceUpdate(ctx, serviceID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+
+	updateCtx, cancel := WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(updateCtx, time.Second, updateStateCheck(updateCtx, cli, serviceID, swarm.UpdateStateCompleted))
+	require.NoError(t, err)
+	poller.markCutover()
+	// give the load balancer a few seconds of traffic on the new tasks
+	time.Sleep(5 * time.Second)
+
+	before, after, failures := poller.stop()
+	t.Logf("during the update: %v, after: %v", before, after)
+	require.Empty(t, failures, "requests failed during the rotation")
+	for content := range before {
+		require.Contains(t, []string{oldContent, newContent}, content, "unexpected content during the rotation")
+	}
+	require.NotZero(t, after[newContent], "no requests after the update completed")
+	require.Len(t, after, 1, "old content still served after the update completed")
+}
+
+// rotatingService creates a service that updates one task at a time,
+// starting the new task before stopping the old one, and waits for it
+func rotatingService(t *testing.T, ctx context.Context, cli *client.Client, spec swarm.ServiceSpec, replicas int) string {
+	spec.UpdateConfig = &swarm.UpdateConfig{
+		Parallelism:   1,
+		Delay:         2 * time.Second,
+		FailureAction: swarm.UpdateFailureActionPause,
+		Monitor:       5 * time.Second,
+		Order:         swarm.UpdateOrderStartFirst,
+	}
+	service, err := CreateService(ctx, cli, spec)
+	require.NoError(t, err, "Error creating service %s", spec.Name)
+
+	scaleCtx, cancel := WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(scaleCtx, time.Second, scaleCheck(scaleCtx, replicas))
+	require.NoError(t, err)
+	return service.ID
+}
+
+// TestSecretsRotateUnderTraffic swaps a service's secret for a new one while
+// its content is being served
+func TestSecretsRotateUnderTraffic(t *testing.T) {
+	t.Parallel()
+	name := "TestSecretsRotateUnderTraffic"
+	testContext, cancel := NewTestContext(name, 4*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanSecretTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	oldSpec := CannedSecretSpec(name+"Old", []byte("old"), name)
+	oldSecret, err := cli.SecretCreate(testContext, oldSpec)
+	require.NoError(t, err, "Error creating secret")
+	newSpec := CannedSecretSpec(name+"New", []byte("new"), name)
+	newSecret, err := cli.SecretCreate(testContext, newSpec)
+	require.NoError(t, err, "Error creating secret")
+
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Secret(secretReference(oldSecret.ID, oldSpec.Name, "0", "0", 0444)).
+		Build()
+	serviceID := rotatingService(t, testContext, cli, spec, replicas)
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, secretContentCheck(ctx, cli, serviceID, "old", 2*replicas))
+	require.NoError(t, err)
+
+	rotateUnderTraffic(t, testContext, cli, serviceID, "/run/secrets/"+secretTarget, "old", "new", func(spec *swarm.ServiceSpec) {
+		spec.TaskTemplate.ContainerSpec.Secrets = []*swarm.SecretReference{
+			secretReference(newSecret.ID, newSpec.Name, "0", "0", 0444),
+		}
+	})
+}
+
+// TestConfigsRotateUnderTraffic swaps a service's config for a new one while
+// its content is being served
+func TestConfigsRotateUnderTraffic(t *testing.T) {
+	t.Parallel()
+	name := "TestConfigsRotateUnderTraffic"
+	RequiresAPIVersion(t, "1.30")
+	testContext, cancel := NewTestContext(name, 4*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanConfigTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	oldSpec := CannedConfigSpec(name+"Old", []byte("old"), name)
+	oldConfig, err := cli.ConfigCreate(testContext, oldSpec)
+	require.NoError(t, err, "Error creating config")
+	newSpec := CannedConfigSpec(name+"New", []byte("new"), name)
+	newConfig, err := cli.ConfigCreate(testContext, newSpec)
+	require.NoError(t, err, "Error creating config")
+
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Config(configReference(oldConfig.ID, oldSpec.Name, "0", "0", 0444)).
+		Build()
+	serviceID := rotatingService(t, testContext, cli, spec, replicas)
+
+	rotateUnderTraffic(t, testContext, cli, serviceID, configTarget, "old", "new", func(spec *swarm.ServiceSpec) {
+		spec.TaskTemplate.ContainerSpec.Configs = []*swarm.ConfigReference{
+			configReference(newConfig.ID, newSpec.Name, "0", "0", 0444),
+		}
+	})
+}
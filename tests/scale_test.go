@@ -0,0 +1,429 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+const (
+	// ScaleReplicasEnv overrides how many replicas the scale profile runs
+	ScaleReplicasEnv = "E2E_SCALE_REPLICAS"
+	// defaultScaleReplicas is enough to put some load on a small cluster
+	defaultScaleReplicas = 300
+	// ScaleNetworksEnv overrides how many networks the many-networks test
+	// creates
+	ScaleNetworksEnv = "E2E_SCALE_NETWORKS"
+	// defaultScaleNetworks is well past the number of overlays a cluster
+	// usually has
+	defaultScaleNetworks = 120
+	// scaleNetworksBatch is how many network creates are averaged together
+	// when looking at how the latency changes
+	scaleNetworksBatch = 20
+	// exhaustedSubnet is too small for the replicas the exhaustion check
+	// asks for, once the VIP and the nodes' load balancers have addresses
+	exhaustedSubnet = "10.250.0.0/29"
+)
+
+// scaleService sets the number of replicas of a replicated service
+func scaleService(ctx context.Context, cli *client.Client, serviceID string, replicas uint64) error {
+	full, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+	if err != nil {
+		return err
+	}
+	full.Spec.Mode.Replicated.Replicas = &replicas
+	_, err = cli.ServiceUpdate(ctx, serviceID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	return err
+}
+
+// scaleSubnet returns a subnet just big enough for the replicas, plus some
+// room for the VIP and the per-node addresses, so that leaking the addresses
+// of one round of tasks starves the next one
+func scaleSubnet(replicas, nodes int) string {
+	needed := replicas + nodes + 16
+	bits := int(math.Ceil(math.Log2(float64(needed))))
+	return fmt.Sprintf("10.249.0.0/%d", 32-bits)
+}
+
+// countNetns returns the number of network namespaces docker has on the
+// machine, which includes a sandbox for every task container
+func countNetns(m *Machines, machine string) (int, error) {
+	out, err := m.Run(machine, "sudo ls /var/run/docker/netns | wc -l")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err, out)
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// countLinks returns the number of network interfaces on the machine, outside
+// of any container or overlay namespace
+func countLinks(m *Machines, machine string) (int, error) {
+	out, err := m.Run(machine, "ip -o link | wc -l")
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err, out)
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// envInt returns the integer in the environment variable, or def if it's unset
+func envInt(t *testing.T, key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	require.NoError(t, err, "invalid %s", key)
+	return i
+}
+
+// meanDuration returns the average of the durations
+func meanDuration(durations []time.Duration) time.Duration {
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	return total / time.Duration(len(durations))
+}
+
+// TestScaleProfile runs a service with hundreds of replicas on an overlay
+// network across the cluster, timing how long it takes to converge, then
+// scales it to zero and back to check the addresses were given back, and
+// finally removes it and checks no node kept containers, the network, or, if
+// the machines can be reached, sandboxes around
+func TestScaleProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the scale profile in short mode")
+	}
+	name := "TestScaleProfile"
+	replicas := envInt(t, ScaleReplicasEnv, defaultScaleReplicas)
+	testContext, cancel := NewTestContext(name, 30*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+
+	// sandboxes before the service, to compare against once it's gone
+	machines := LookupMachines()
+	netns := map[string]int{}
+	if machines != nil {
+		for _, node := range nodes {
+			if node.Description.Platform.OS != "linux" {
+				continue
+			}
+			host := node.Description.Hostname
+			netns[host], err = countNetns(machines, host)
+			require.NoError(t, err)
+		}
+	}
+
+	nwName := getUniqueName(name)
+	subnet := scaleSubnet(replicas, len(nodes))
+	_, err = cli.NetworkCreate(testContext, nwName, types.NetworkCreate{
+		Driver:         "overlay",
+		CheckDuplicate: true,
+		Labels:         testLabels(name),
+		IPAM:           &network.IPAM{Config: []network.IPAMConfig{{Subnet: subnet}}},
+	})
+	require.NoError(t, err, "Error creating overlay network %s", nwName)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Network(nwName).
+		Constraint("node.platform.os == linux").
+		Build()
+	start := time.Now()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	scaleCheck := ScaleCheck(service.ID, cli)
+	ctx, cancel := WithTimeout(testContext, 10*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+	t.Logf("%d replicas converged in %s on %s", replicas, time.Since(start), subnet)
+
+	start = time.Now()
+	require.NoError(t, scaleService(testContext, cli, service.ID, 0))
+	ctx, cancel = WithTimeout(testContext, 10*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, scaleCheck(ctx, 0))
+	require.NoError(t, err)
+	t.Logf("Scaled down to 0 in %s", time.Since(start))
+
+	// the subnet only fits one round of tasks
+	start = time.Now()
+	require.NoError(t, scaleService(testContext, cli, service.ID, uint64(replicas)))
+	ctx, cancel = WithTimeout(testContext, 10*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err, "addresses of the first round of tasks were not released")
+	t.Logf("Scaled back up to %d in %s", replicas, time.Since(start))
+
+	require.NoError(t, CleanTestServices(testContext, cli, name))
+	ctx, cancel = WithTimeout(testContext, 5*time.Minute)
+	defer cancel()
+	containerFilter := filters.NewArgs()
+	containerFilter.Add("label", "com.docker.swarm.service.id="+service.ID)
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		return IgnoreUnreachable(ctx, OnEveryNode(ctx, cli, NoContainers(containerFilter)))
+	})
+	require.NoError(t, err, "task containers were left behind")
+
+	// the overlay goes away on the nodes without tasks on it, which is all
+	// of them but the managers
+	noNetwork := NoNetworkOnNode(nwName)
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		return IgnoreUnreachable(ctx, OnEveryNode(ctx, cli, func(ctx context.Context, node swarm.Node, nodeCli *client.Client) error {
+			if node.ManagerStatus != nil {
+				return nil
+			}
+			return noNetwork(ctx, node, nodeCli)
+		}))
+	})
+	require.NoError(t, err)
+
+	for host, before := range netns {
+		err = WaitForConverge(ctx, 2*time.Second, func() error {
+			after, err := countNetns(machines, host)
+			if err != nil {
+				return err
+			}
+			if after > before {
+				return fmt.Errorf("%s has %d sandboxes, %d before the test", host, after, before)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+// TestScaleManyNetworks creates over a hundred overlays, each with a service
+// on it, timing every network create to check they don't slow down as the
+// count grows, and checking each got its own VXLAN ID and subnet. Running out
+// of addresses on a network, or asking for a VXLAN ID that's taken, has to
+// leave the tasks pending without hurting the managers. Once everything is
+// removed, the machines, if they can be reached, must be back to the
+// interfaces and sandboxes they started with
+func TestScaleManyNetworks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the many-networks test in short mode")
+	}
+	name := "TestScaleManyNetworks"
+	count := envInt(t, ScaleNetworksEnv, defaultScaleNetworks)
+	testContext, cancel := NewTestContext(name, 45*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	cleanup := func() {
+		CaptureFailure(t, cli, name)
+		// the networks are in use until the tasks are gone
+		ctx, cancel := WithTimeout(testContext, 5*time.Minute)
+		defer cancel()
+		CleanupAll(ctx, cli, UUID(), name)
+	}
+	defer cleanup()
+
+	nodes, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	machines := LookupMachines()
+	links := map[string]int{}
+	netns := map[string]int{}
+	if machines != nil {
+		for _, node := range nodes {
+			host := node.Description.Hostname
+			links[host], err = countLinks(machines, host)
+			require.NoError(t, err)
+			netns[host], err = countNetns(machines, host)
+			require.NoError(t, err)
+		}
+	}
+
+	createNetwork := func(nwName string, nc types.NetworkCreate) (string, error) {
+		nc.Driver = "overlay"
+		nc.CheckDuplicate = true
+		nc.Labels = testLabels(name)
+		resp, err := cli.NetworkCreate(testContext, nwName, nc)
+		if err != nil {
+			return "", err
+		}
+		return resp.ID, nil
+	}
+	constraints := []string{"node.platform.os == linux"}
+	latencies := []time.Duration{}
+	nwIDs := []string{}
+	serviceIDs := []string{}
+	for i := 0; i < count; i++ {
+		nwName := getUniqueName(fmt.Sprintf("%s-%d", name, i))
+		start := time.Now()
+		id, err := createNetwork(nwName, types.NetworkCreate{})
+		require.NoError(t, err, "Error creating network %d", i)
+		latencies = append(latencies, time.Since(start))
+		nwIDs = append(nwIDs, id)
+
+		spec := NewServiceSpec(testContext, cli, fmt.Sprintf("%s-%d", name, i)).
+			Network(nwName).
+			Label(name).
+			Constraint(constraints...).
+			Unpublished().
+			Build()
+		service, err := CreateService(testContext, cli, spec)
+		require.NoError(t, err, "Error creating service on network %d", i)
+		serviceIDs = append(serviceIDs, service.ID)
+	}
+	batches := []time.Duration{}
+	for i := 0; i < len(latencies); i += scaleNetworksBatch {
+		end := i + scaleNetworksBatch
+		if end > len(latencies) {
+			end = len(latencies)
+		}
+		batches = append(batches, meanDuration(latencies[i:end]))
+	}
+	t.Logf("Mean network create latency every %d networks: %v", scaleNetworksBatch, batches)
+	// some growth is expected, as every create is checked against every
+	// existing network, but it shouldn't get anywhere near this
+	first, last := batches[0], batches[len(batches)-1]
+	require.True(t, last < 10*first+time.Second, "network creates slowed from %s to %s", first, last)
+
+	ctx, cancel := WithTimeout(testContext, 15*time.Minute)
+	defer cancel()
+	start := time.Now()
+	for _, id := range serviceIDs {
+		require.NoError(t, WaitForConverge(ctx, 2*time.Second, ScaleCheck(id, cli)(ctx, 1)))
+	}
+	t.Logf("%d services converged in %s", len(serviceIDs), time.Since(start))
+
+	// overlays are only allocated once tasks need them, so now every one of
+	// them has its own VXLAN ID and subnet
+	vxlanIDs := map[string]string{}
+	subnets := map[string]string{}
+	for _, id := range nwIDs {
+		nw, err := cli.NetworkInspect(testContext, id, false)
+		require.NoError(t, err)
+		vxlanID := nw.Options[vxlanIDOption]
+		require.NotEmpty(t, vxlanID, "network %s has no VXLAN ID", nw.Name)
+		require.Empty(t, vxlanIDs[vxlanID], "networks %s and %s share VXLAN ID %s", vxlanIDs[vxlanID], nw.Name, vxlanID)
+		vxlanIDs[vxlanID] = nw.Name
+		require.Len(t, nw.IPAM.Config, 1)
+		subnet := nw.IPAM.Config[0].Subnet
+		require.Empty(t, subnets[subnet], "networks %s and %s share subnet %s", subnets[subnet], nw.Name, subnet)
+		subnets[subnet] = nw.Name
+	}
+
+	// a network asking for a VXLAN ID that's taken is either rejected, or
+	// never gets its tasks running
+	var takenID string
+	for id := range vxlanIDs {
+		takenID = id
+		break
+	}
+	dupName := getUniqueName(name + "DupVXLAN")
+	if _, err := createNetwork(dupName, types.NetworkCreate{Options: map[string]string{vxlanIDOption: takenID}}); err != nil {
+		t.Logf("Network with VXLAN ID %s rejected on creation: %s", takenID, err)
+	} else {
+		spec := NewServiceSpec(testContext, cli, name+"DupVXLAN").
+			Network(dupName).
+			Label(name).
+			Constraint(constraints...).
+			Unpublished().
+			Build()
+		service, err := CreateService(testContext, cli, spec)
+		if err != nil {
+			t.Logf("Service on a network with VXLAN ID %s rejected: %s", takenID, err)
+		} else {
+			ctx, cancel := WithTimeout(testContext, 30*time.Second)
+			err = WaitForConverge(ctx, time.Second, ScaleCheck(service.ID, cli)(ctx, 1))
+			cancel()
+			require.Error(t, err, "service on a network reusing VXLAN ID %s shouldn't start", takenID)
+			cli.ServiceRemove(testContext, service.ID)
+		}
+	}
+
+	// a network too small for the service runs what fits, and leaves the
+	// rest pending rather than failing
+	smallName := getUniqueName(name + "Exhausted")
+	_, err = createNetwork(smallName, types.NetworkCreate{IPAM: &network.IPAM{Config: []network.IPAMConfig{{Subnet: exhaustedSubnet}}}})
+	require.NoError(t, err)
+	replicas := 8
+	spec := NewServiceSpec(testContext, cli, name+"Exhausted").
+		Replicas(uint64(replicas)).
+		Network(smallName).
+		Label(name).
+		Constraint(constraints...).
+		Unpublished().
+		Build()
+	exhausted, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err)
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, func() error {
+		tasks, err := GetServiceTasks(ctx, cli, exhausted.ID)
+		if err != nil {
+			return err
+		}
+		running, pending := 0, 0
+		for _, task := range tasks {
+			switch task.Status.State {
+			case swarm.TaskStateRunning:
+				running++
+			case swarm.TaskStateNew, swarm.TaskStatePending:
+				pending++
+			}
+		}
+		if pending == 0 || running+pending != replicas {
+			return fmt.Errorf("%d running and %d pending of %d on %s", running, pending, replicas, exhaustedSubnet)
+		}
+		return nil
+	})
+	require.NoError(t, err, "tasks that don't fit %s should be left pending", exhaustedSubnet)
+	require.NoError(t, WaitForConverge(ctx, time.Second, managersHealthyCheck(ctx, cli)))
+	require.NoError(t, scaleService(testContext, cli, exhausted.ID, 2))
+	err = WaitForConverge(ctx, 2*time.Second, ScaleCheck(exhausted.ID, cli)(ctx, 2))
+	require.NoError(t, err, "service should run once it fits %s", exhaustedSubnet)
+
+	start = time.Now()
+	cleanup()
+	t.Logf("Removed everything in %s", time.Since(start))
+	networks, err := cli.NetworkList(testContext, types.NetworkListOptions{Filters: GetTestFilter(name)})
+	require.NoError(t, err)
+	require.Empty(t, networks, "networks left after the teardown")
+
+	ctx, cancel = WithTimeout(testContext, 5*time.Minute)
+	defer cancel()
+	for host := range links {
+		err = WaitForConverge(ctx, 2*time.Second, func() error {
+			l, err := countLinks(machines, host)
+			if err != nil {
+				return err
+			}
+			n, err := countNetns(machines, host)
+			if err != nil {
+				return err
+			}
+			if l > links[host] || n > netns[host] {
+				return fmt.Errorf("%s has %d interfaces and %d sandboxes, %d and %d before the test", host, l, n, links[host], netns[host])
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
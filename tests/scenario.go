@@ -0,0 +1,465 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// ScenariosEnv is the directory TestScenarios reads the scenarios from,
+// scenarios/ next to the test binary's sources by default
+const ScenariosEnv = "E2E_SCENARIOS"
+
+// defaultScenarioTimeout bounds a scenario that doesn't set its own timeout
+const defaultScenarioTimeout = 5 * time.Minute
+
+// Scenario is a test written in YAML rather than Go: the services to create,
+// what to do to them and the cluster step by step, and the state the cluster
+// should end up in. See scenarios/ for examples
+type Scenario struct {
+	Name string `yaml:"name"`
+	// Timeout is how long the whole scenario may take, e.g. 10m, scaled like
+	// the timeouts of the tests are
+	Timeout  string            `yaml:"timeout"`
+	Networks []string          `yaml:"networks"`
+	Services []ScenarioService `yaml:"services"`
+	Steps    []ScenarioStep    `yaml:"steps"`
+	Expect   ScenarioState     `yaml:"expect"`
+
+	file string
+}
+
+// ScenarioService is a service the scenario creates before the steps, running
+// the util test server by default
+type ScenarioService struct {
+	Name        string   `yaml:"name"`
+	Replicas    uint64   `yaml:"replicas"`
+	Global      bool     `yaml:"global"`
+	Image       string   `yaml:"image"`
+	Command     []string `yaml:"command"`
+	Env         []string `yaml:"env"`
+	Networks    []string `yaml:"networks"`
+	Constraints []string `yaml:"constraints"`
+	Publish     []uint32 `yaml:"publish"`
+}
+
+// ScenarioStep is one thing the scenario does, and optionally the state to
+// wait for afterwards. Nodes are given by hostname, or as manager or worker
+// for one of them other than the node the tests run on, picked at random the
+// first time and the same one for the rest of the scenario
+type ScenarioStep struct {
+	Update *ScenarioUpdate `yaml:"update"`
+	// KillTask kills a random task of the service
+	KillTask string `yaml:"kill_task"`
+	// RestartDaemon restarts the engine of the node
+	RestartDaemon string `yaml:"restart_daemon"`
+	// PartitionManagers cuts a minority of the managers off from the rest
+	PartitionManagers bool `yaml:"partition_managers"`
+	// Drain and Activate change the availability of the node
+	Drain    string `yaml:"drain"`
+	Activate string `yaml:"activate"`
+	// Sleep waits for the duration, e.g. 10s
+	Sleep  string         `yaml:"sleep"`
+	Expect *ScenarioState `yaml:"expect"`
+}
+
+// ScenarioUpdate changes a service, leaving out what isn't set
+type ScenarioUpdate struct {
+	Service  string   `yaml:"service"`
+	Replicas *uint64  `yaml:"replicas"`
+	Image    string   `yaml:"image"`
+	Env      []string `yaml:"env"`
+}
+
+// ScenarioState is the ExpectedState of a scenario, by the names the scenario
+// uses for its services, networks and nodes
+type ScenarioState struct {
+	Services map[string]int    `yaml:"services"`
+	Networks map[string]bool   `yaml:"networks"`
+	Nodes    map[string]string `yaml:"nodes"`
+}
+
+// LoadScenarios reads every .yaml file in the directory, sorted by name,
+// making sure they're all valid before any of them runs
+func LoadScenarios(dir string) ([]*Scenario, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	scenarios := []*Scenario{}
+	names := map[string]string{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		s := &Scenario{file: file}
+		if err := yaml.UnmarshalStrict(data, s); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		if other, ok := names[s.Name]; ok {
+			return nil, fmt.Errorf("%s: scenario %s is already in %s", file, s.Name, other)
+		}
+		names[s.Name] = file
+		scenarios = append(scenarios, s)
+	}
+	return scenarios, nil
+}
+
+// validate makes sure the scenario only refers to what it has, so that a typo
+// fails when the scenarios are loaded rather than halfway through one
+func (s *Scenario) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("scenario has no name")
+	}
+	if _, err := s.timeout(); err != nil {
+		return err
+	}
+	networks := map[string]bool{}
+	for _, nw := range s.Networks {
+		networks[nw] = true
+	}
+	services := map[string]bool{}
+	for _, service := range s.Services {
+		if service.Name == "" {
+			return fmt.Errorf("service without a name")
+		}
+		if service.Global && service.Replicas > 0 {
+			return fmt.Errorf("service %s is global, it can't have replicas", service.Name)
+		}
+		for _, nw := range service.Networks {
+			if !networks[nw] {
+				return fmt.Errorf("service %s is on network %s, which the scenario doesn't have", service.Name, nw)
+			}
+		}
+		services[service.Name] = true
+	}
+	checkState := func(state *ScenarioState) error {
+		for service := range state.Services {
+			if !services[service] {
+				return fmt.Errorf("expects service %s, which the scenario doesn't have", service)
+			}
+		}
+		for nw := range state.Networks {
+			if !networks[nw] {
+				return fmt.Errorf("expects network %s, which the scenario doesn't have", nw)
+			}
+		}
+		for node, availability := range state.Nodes {
+			switch swarm.NodeAvailability(availability) {
+			case swarm.NodeAvailabilityActive, swarm.NodeAvailabilityPause, swarm.NodeAvailabilityDrain:
+			default:
+				return fmt.Errorf("node %s can't be %q", node, availability)
+			}
+		}
+		return nil
+	}
+	for i, step := range s.Steps {
+		actions := 0
+		for _, set := range []bool{step.Update != nil, step.KillTask != "", step.RestartDaemon != "", step.PartitionManagers, step.Drain != "", step.Activate != "", step.Sleep != ""} {
+			if set {
+				actions++
+			}
+		}
+		if actions > 1 || (actions == 0 && step.Expect == nil) {
+			return fmt.Errorf("step %d has to do one thing, it does %d", i+1, actions)
+		}
+		if step.Update != nil && !services[step.Update.Service] {
+			return fmt.Errorf("step %d updates service %s, which the scenario doesn't have", i+1, step.Update.Service)
+		}
+		if step.KillTask != "" && !services[step.KillTask] {
+			return fmt.Errorf("step %d kills a task of service %s, which the scenario doesn't have", i+1, step.KillTask)
+		}
+		if step.Sleep != "" {
+			if _, err := time.ParseDuration(step.Sleep); err != nil {
+				return fmt.Errorf("step %d sleeps for %q: %s", i+1, step.Sleep, err)
+			}
+		}
+		if step.Expect != nil {
+			if err := checkState(step.Expect); err != nil {
+				return fmt.Errorf("step %d %s", i+1, err)
+			}
+		}
+	}
+	if err := checkState(&s.Expect); err != nil {
+		return fmt.Errorf("scenario %s", err)
+	}
+	return nil
+}
+
+// timeout returns how long the scenario may take
+func (s *Scenario) timeout() (time.Duration, error) {
+	if s.Timeout == "" {
+		return defaultScenarioTimeout, nil
+	}
+	d, err := time.ParseDuration(s.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("timeout must be a positive duration, not %q", s.Timeout)
+	}
+	return d, nil
+}
+
+// scenarioRun is the state of a scenario while it runs
+type scenarioRun struct {
+	t     *testing.T
+	cli   *client.Client
+	chaos *Chaos
+	rand  *rand.Rand
+
+	services map[string]string
+	networks map[string]string
+	nodes    map[string]swarm.Node
+}
+
+// Run runs the scenario as the test t, removing everything it created and
+// undoing every fault it injected once it's done
+func (s *Scenario) Run(t *testing.T, cli *client.Client) {
+	name := "TestScenarios_" + artifactName(s.Name)
+	timeout, _ := s.timeout()
+	ctx, cancel := NewTestContext(name, timeout)
+	defer cancel()
+	r := &scenarioRun{
+		t:        t,
+		cli:      cli,
+		chaos:    NewChaos(t, cli, name),
+		rand:     TestRand(name),
+		services: map[string]string{},
+		networks: map[string]string{},
+		nodes:    map[string]swarm.Node{},
+	}
+	defer func() {
+		// the scenario's own context may be what ran out
+		ctx, cancel := WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		CleanupAll(ctx, cli, UUID(), name)
+	}()
+	defer r.chaos.Cleanup(ctx)
+	defer CaptureFailure(t, cli, name)
+
+	for _, nw := range s.Networks {
+		resp, err := cli.NetworkCreate(ctx, getUniqueName(nw), types.NetworkCreate{
+			Driver:         "overlay",
+			CheckDuplicate: true,
+			Labels:         testLabels(name),
+		})
+		if err != nil {
+			t.Fatalf("%s: creating network %s: %s", s.file, nw, err)
+		}
+		r.networks[nw] = resp.ID
+	}
+	initial := ExpectedState{Services: map[string]int{}}
+	for _, service := range s.Services {
+		id, err := r.createService(ctx, name, service)
+		if err != nil {
+			t.Fatalf("%s: creating service %s: %s", s.file, service.Name, err)
+		}
+		r.services[service.Name] = id
+		if !service.Global {
+			initial.Services[id] = int(service.Replicas)
+		}
+	}
+	if err := WaitForState(ctx, cli, initial); err != nil {
+		t.Fatalf("%s: services didn't start: %s", s.file, err)
+	}
+
+	for i, step := range s.Steps {
+		if err := r.step(ctx, step); err != nil {
+			t.Fatalf("%s: step %d: %s", s.file, i+1, err)
+		}
+	}
+	expected, err := r.expected(ctx, s.Expect)
+	if err == nil {
+		err = WaitForState(ctx, cli, expected)
+	}
+	if err != nil {
+		t.Fatalf("%s: %s", s.file, err)
+	}
+}
+
+// createService creates the service of the scenario, labeled with the name
+// of the scenario's test
+func (r *scenarioRun) createService(ctx context.Context, name string, service ScenarioService) (string, error) {
+	b := NewServiceSpec(ctx, r.cli, service.Name).Label(name)
+	if service.Global {
+		b = b.Global()
+	} else {
+		replicas := service.Replicas
+		if replicas == 0 {
+			replicas = 1
+		}
+		b = b.Replicas(replicas)
+	}
+	if service.Image != "" {
+		b = b.Image(service.Image)
+	}
+	if len(service.Command) > 0 {
+		b = b.Command(service.Command...)
+	}
+	if len(service.Env) > 0 {
+		b = b.Env(service.Env...)
+	}
+	for _, nw := range service.Networks {
+		b = b.Network(r.networks[nw])
+	}
+	if len(service.Constraints) > 0 {
+		b = b.Constraint(service.Constraints...)
+	}
+	if len(service.Publish) > 0 {
+		b = b.PublishTCP(service.Publish...)
+	} else {
+		b = b.Unpublished()
+	}
+	resp, err := CreateService(ctx, r.cli, b.Build())
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// step does what the step says, then waits for the state it expects
+func (r *scenarioRun) step(ctx context.Context, step ScenarioStep) error {
+	var err error
+	switch {
+	case step.Update != nil:
+		err = r.update(ctx, *step.Update)
+	case step.KillTask != "":
+		_, err = r.chaos.KillRandomTask(ctx, r.services[step.KillTask])
+	case step.RestartDaemon != "":
+		var node swarm.Node
+		if node, err = r.node(ctx, step.RestartDaemon); err == nil {
+			err = r.chaos.RestartDaemonOn(ctx, node)
+		}
+	case step.PartitionManagers:
+		_, err = r.chaos.PartitionManagers(ctx)
+	case step.Drain != "":
+		err = r.setAvailability(ctx, step.Drain, swarm.NodeAvailabilityDrain)
+	case step.Activate != "":
+		err = r.setAvailability(ctx, step.Activate, swarm.NodeAvailabilityActive)
+	case step.Sleep != "":
+		d, _ := time.ParseDuration(step.Sleep)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil || step.Expect == nil {
+		return err
+	}
+	expected, err := r.expected(ctx, *step.Expect)
+	if err != nil {
+		return err
+	}
+	return WaitForState(ctx, r.cli, expected)
+}
+
+// update applies the update to the service, again if the orchestrator bumped
+// its version in between
+func (r *scenarioRun) update(ctx context.Context, update ScenarioUpdate) error {
+	id := r.services[update.Service]
+	return WaitForConverge(ctx, 100*time.Millisecond, func() error {
+		full, _, err := r.cli.ServiceInspectWithRaw(ctx, id, types.ServiceInspectOptions{})
+		if err != nil {
+			return err
+		}
+		spec := full.Spec
+		if update.Replicas != nil {
+			if spec.Mode.Replicated == nil {
+				return fmt.Errorf("service %s is global, it can't be scaled", update.Service)
+			}
+			replicas := *update.Replicas
+			spec.Mode.Replicated.Replicas = &replicas
+		}
+		if update.Image != "" {
+			spec.TaskTemplate.ContainerSpec.Image = update.Image
+		}
+		if len(update.Env) > 0 {
+			spec.TaskTemplate.ContainerSpec.Env = update.Env
+		}
+		_, err = r.cli.ServiceUpdate(ctx, id, full.Meta.Version, spec, types.ServiceUpdateOptions{})
+		return err
+	})
+}
+
+// setAvailability changes the availability of the node, and puts it back to
+// active once the scenario is done
+func (r *scenarioRun) setAvailability(ctx context.Context, selector string, availability swarm.NodeAvailability) error {
+	node, err := r.node(ctx, selector)
+	if err != nil {
+		return err
+	}
+	if availability != swarm.NodeAvailabilityActive {
+		r.chaos.onCleanup(func(ctx context.Context) error {
+			return setAvailability(ctx, r.cli, node.ID, swarm.NodeAvailabilityActive)
+		})
+	}
+	return setAvailability(ctx, r.cli, node.ID, availability)
+}
+
+// node resolves a node of the scenario, see ScenarioStep
+func (r *scenarioRun) node(ctx context.Context, selector string) (swarm.Node, error) {
+	if node, ok := r.nodes[selector]; ok {
+		return node, nil
+	}
+	nodes, err := r.cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return swarm.Node{}, err
+	}
+	candidates := []swarm.Node{}
+	for _, node := range nodes {
+		switch selector {
+		case string(swarm.NodeRoleManager), string(swarm.NodeRoleWorker):
+			if string(node.Spec.Role) == selector && node.ID != GetCluster(r.t).Self && node.Status.State == swarm.NodeStateReady {
+				candidates = append(candidates, node)
+			}
+		default:
+			if node.Description.Hostname == selector {
+				candidates = append(candidates, node)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		r.t.Skipf("the cluster has no %s node for the scenario", selector)
+	}
+	node := RandomNode(r.rand, candidates)
+	r.nodes[selector] = node
+	return node, nil
+}
+
+// expected resolves the names of the state to what the cluster calls them
+func (r *scenarioRun) expected(ctx context.Context, state ScenarioState) (ExpectedState, error) {
+	expected := ExpectedState{
+		Services: map[string]int{},
+		Networks: map[string]bool{},
+		Nodes:    map[string]swarm.NodeAvailability{},
+	}
+	for service, running := range state.Services {
+		expected.Services[r.services[service]] = running
+	}
+	for nw, exists := range state.Networks {
+		expected.Networks[r.networks[nw]] = exists
+	}
+	for selector, availability := range state.Nodes {
+		node, err := r.node(ctx, selector)
+		if err != nil {
+			return expected, err
+		}
+		expected.Nodes[node.ID] = swarm.NodeAvailability(availability)
+	}
+	return expected, nil
+}
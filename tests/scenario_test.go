@@ -0,0 +1,33 @@
+package dockere2e
+
+import (
+	// basic imports
+	"os"
+	"testing"
+
+	// testify
+	"github.com/stretchr/testify/require"
+)
+
+// TestScenarios runs every scenario of the scenarios directory as a subtest,
+// one after the other since they may inject faults, see Scenario
+func TestScenarios(t *testing.T) {
+	dir := os.Getenv(ScenariosEnv)
+	if dir == "" {
+		dir = "scenarios"
+	}
+	scenarios, err := LoadScenarios(dir)
+	require.NoError(t, err, "Error loading scenarios")
+	if len(scenarios) == 0 {
+		t.Skipf("no scenarios in %s", dir)
+	}
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.Name, func(t *testing.T) {
+			s.Run(t, cli)
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// secretTarget is where the secret tests mount their secrets, under
+// /run/secrets
+const secretTarget = "e2e-secret"
+
+// secretReference mounts the secret at secretTarget with the given ownership
+// and permissions
+func secretReference(id, name, uid, gid string, mode os.FileMode) *swarm.SecretReference {
+	return &swarm.SecretReference{
+		SecretID:   id,
+		SecretName: name,
+		File: &swarm.SecretReferenceFileTarget{
+			Name: secretTarget,
+			UID:  uid,
+			GID:  gid,
+			Mode: mode,
+		},
+	}
+}
+
+// secretContentCheck returns a check that passes once requests to the
+// service's tasks all see the expected secret content
+func secretContentCheck(ctx context.Context, cli *client.Client, serviceID, expected string, requests int) func() error {
+	return func() error {
+		endpoint, published, err := getNodeIPPort(ctx, cli, serviceID, 80)
+		if err != nil {
+			return err
+		}
+		port := fmt.Sprintf(":%v", published)
+		for i := 0; i < requests; i++ {
+			info, err := getFile(ctx, endpoint, port, "/run/secrets/"+secretTarget)
+			if err != nil {
+				return err
+			}
+			if info.Content != expected {
+				return fmt.Errorf("task %s has secret content %q, expected %q", info.Hostname, info.Content, expected)
+			}
+		}
+		return nil
+	}
+}
+
+// cleanSecretTest removes the test's services, then its secrets once the
+// tasks using them are gone
+func cleanSecretTest(ctx context.Context, cli *client.Client, name string) {
+	CleanTestServices(ctx, cli, name)
+	waitCtx, cancel := WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	WaitForConverge(waitCtx, time.Second, func() error {
+		return CleanTestSecrets(waitCtx, cli, name)
+	})
+}
+
+func TestSecretsCreateInspectRemove(t *testing.T) {
+	t.Parallel()
+	name := "TestSecretsCreateInspectRemove"
+	testContext, cancel := NewTestContext(name, time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestSecrets(testContext, cli, name)
+
+	spec := CannedSecretSpec(name, []byte("e2e secret data"))
+	resp, err := cli.SecretCreate(testContext, spec)
+	require.NoError(t, err, "Error creating secret")
+	require.NotZero(t, resp.ID, "response ID shouldn't be zero")
+
+	// inspect returns the spec, but never the secret data itself
+	secret, _, err := cli.SecretInspectWithRaw(testContext, resp.ID)
+	require.NoError(t, err, "Error inspecting secret")
+	require.Equal(t, spec.Name, secret.Spec.Name)
+	require.Equal(t, UUID(), secret.Spec.Labels["uuid"])
+	require.Empty(t, secret.Spec.Data, "secret data should not be returned by inspect")
+
+	secrets, err := cli.SecretList(testContext, types.SecretListOptions{Filters: GetTestFilter(name)})
+	require.NoError(t, err, "Error listing secrets")
+	require.Len(t, secrets, 1)
+	require.Equal(t, resp.ID, secrets[0].ID)
+
+	// names are unique
+	_, err = cli.SecretCreate(testContext, spec)
+	require.Error(t, err, "creating a secret with a duplicate name should fail")
+
+	err = cli.SecretRemove(testContext, resp.ID)
+	require.NoError(t, err, "Error removing secret")
+	_, _, err = cli.SecretInspectWithRaw(testContext, resp.ID)
+	require.Error(t, err, "secret should be gone after removal")
+	require.True(t, client.IsErrSecretNotFound(err), "unexpected error: %v", err)
+}
+
+// TestSecretsServiceFile checks that a secret is mounted into every task with
+// the requested content, ownership and permissions
+func TestSecretsServiceFile(t *testing.T) {
+	t.Parallel()
+	name := "TestSecretsServiceFile"
+	testContext, cancel := NewTestContext(name, 2*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanSecretTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	data := "mounted into every task"
+	secretSpec := CannedSecretSpec(name, []byte(data))
+	secret, err := cli.SecretCreate(testContext, secretSpec)
+	require.NoError(t, err, "Error creating secret")
+
+	var replicas uint64 = 2
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(replicas).
+		Secret(secretReference(secret.ID, secretSpec.Name, "1000", "1000", 0440)).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, int(replicas)))
+	require.NoError(t, err)
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+
+	// the routing mesh may take a moment to pick up the tasks, so poll until
+	// every task has answered
+	seen := map[string]*fileInfo{}
+	err = WaitForConverge(ctx, time.Second, func() error {
+		info, err := getFile(ctx, endpoint, port, "/run/secrets/"+secretTarget)
+		if err != nil {
+			return err
+		}
+		seen[info.Hostname] = info
+		if len(seen) < int(replicas) {
+			return fmt.Errorf("only %d of %d tasks answered", len(seen), replicas)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	for host, info := range seen {
+		require.Equal(t, data, info.Content, "wrong secret content in %s", host)
+		require.Equal(t, 1000, info.UID, "wrong secret owner in %s", host)
+		require.Equal(t, 1000, info.GID, "wrong secret group in %s", host)
+		require.Equal(t, "-r--r-----", info.Mode.String(), "wrong secret mode in %s", host)
+	}
+}
+
+// TestSecretsRotate checks that secret data can't be changed in place, and
+// that rotating a secret means swapping it for a new one with a service update
+func TestSecretsRotate(t *testing.T) {
+	t.Parallel()
+	name := "TestSecretsRotate"
+	testContext, cancel := NewTestContext(name, 2*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanSecretTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	oldSpec := CannedSecretSpec(name+"Old", []byte("old"), name)
+	oldSecret, err := cli.SecretCreate(testContext, oldSpec)
+	require.NoError(t, err, "Error creating secret")
+
+	var replicas uint64 = 2
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(replicas).
+		Secret(secretReference(oldSecret.ID, oldSpec.Name, "0", "0", 0444)).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, int(replicas)))
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, secretContentCheck(ctx, cli, service.ID, "old", 2*int(replicas)))
+	require.NoError(t, err)
+
+	// only labels can be updated on an existing secret
+	current, _, err := cli.SecretInspectWithRaw(testContext, oldSecret.ID)
+	require.NoError(t, err)
+	current.Spec.Data = []byte("new")
+	err = cli.SecretUpdate(testContext, oldSecret.ID, current.Version, current.Spec)
+	require.Error(t, err, "updating secret data in place should fail")
+
+	newSpec := CannedSecretSpec(name+"New", []byte("new"), name)
+	newSecret, err := cli.SecretCreate(testContext, newSpec)
+	require.NoError(t, err, "Error creating secret")
+
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ContainerSpec.Secrets = []*swarm.SecretReference{
+		secretReference(newSecret.ID, newSpec.Name, "0", "0", 0444),
+	}
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+
+	ctx, cancel = WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, secretContentCheck(ctx, cli, service.ID, "new", 2*int(replicas)))
+	require.NoError(t, err)
+
+	// once the old tasks are gone, nothing uses the old secret
+	err = WaitForConverge(ctx, time.Second, func() error {
+		return cli.SecretRemove(ctx, oldSecret.ID)
+	})
+	require.NoError(t, err, "old secret should be removable after rotation")
+}
+
+// TestSecretsRemoveInUse checks that a secret can't be removed while a
+// service references it
+func TestSecretsRemoveInUse(t *testing.T) {
+	t.Parallel()
+	name := "TestSecretsRemoveInUse"
+	testContext, cancel := NewTestContext(name, 2*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer cleanSecretTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	secretSpec := CannedSecretSpec(name, []byte("in use"))
+	secret, err := cli.SecretCreate(testContext, secretSpec)
+	require.NoError(t, err, "Error creating secret")
+
+	spec := NewServiceSpec(testContext, cli, name).
+		Secret(secretReference(secret.ID, secretSpec.Name, "0", "0", 0444)).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, 1))
+	require.NoError(t, err)
+
+	err = cli.SecretRemove(testContext, secret.ID)
+	require.Error(t, err, "removing a secret in use should fail")
+	require.True(t, strings.Contains(err.Error(), "in use"), "unexpected error: %v", err)
+
+	// removing the service frees the secret
+	err = cli.ServiceRemove(testContext, service.ID)
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, func() error {
+		return cli.SecretRemove(ctx, secret.ID)
+	})
+	require.NoError(t, err, "secret should be removable once the service is gone")
+}
@@ -0,0 +1,214 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// capability bits in the masks of /proc/<pid>/status
+var capabilityBits = map[string]uint{
+	"CAP_CHOWN":      0,
+	"CAP_NET_RAW":    13,
+	"CAP_SYS_PTRACE": 19,
+}
+
+// procStatus parses the test server's /proc/self/status into its fields
+func procStatus(content string) map[string]string {
+	status := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			status[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+	return status
+}
+
+// securedService creates the service and waits for it to converge, returning
+// its ID and the address its port is published on
+func securedService(t *testing.T, ctx context.Context, cli *client.Client, spec swarm.ServiceSpec, replicas int) (string, string, string) {
+	service, err := CreateService(ctx, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	scaleCtx, cancel := WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(scaleCtx, time.Second, scaleCheck(scaleCtx, replicas))
+	require.NoError(t, err)
+
+	endpoint, published, err := getNodeIPPort(ctx, cli, service.ID, 80)
+	require.NoError(t, err)
+	return service.ID, endpoint, fmt.Sprintf(":%v", published)
+}
+
+// inspectTaskContainers calls check with the container of every task of the
+// service whose engine can be reached
+func inspectTaskContainers(t *testing.T, ctx context.Context, cli *client.Client, serviceID string, check func(types.ContainerJSON)) {
+	withTaskContainers(t, ctx, cli, serviceID, func(_ *client.Client, container types.ContainerJSON) {
+		check(container)
+	})
+}
+
+// withTaskContainers calls fn with the container of every task of the service
+// whose engine can be reached, along with a client for that engine
+func withTaskContainers(t *testing.T, ctx context.Context, cli *client.Client, serviceID string, fn func(*client.Client, types.ContainerJSON)) {
+	c := GetCluster(t)
+	tasks, err := GetServiceTasks(ctx, cli, serviceID)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		nodeCli, err := c.ClientForNode(ctx, task.NodeID)
+		if err != nil {
+			t.Logf("Not inspecting task %s: %s", task.ID, err)
+			continue
+		}
+		container, err := nodeCli.ContainerInspect(ctx, task.Status.ContainerStatus.ContainerID)
+		require.NoError(t, err, "inspecting the container of task %s", task.ID)
+		fn(nodeCli, container)
+	}
+}
+
+// TestSecurityReadOnlyRootfs runs a service with a read-only root filesystem
+// and a tmpfs, and checks the tasks can only write to the tmpfs
+func TestSecurityReadOnlyRootfs(t *testing.T) {
+	t.Parallel()
+	name := "TestSecurityReadOnlyRootfs"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 2
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.platform.os == linux").
+		Mount(mount.Mount{Type: mount.TypeTmpfs, Target: "/scratch"}).
+		Build()
+	spec.TaskTemplate.ContainerSpec.ReadOnly = true
+	serviceID, endpoint, port := securedService(t, testContext, cli, spec, replicas)
+
+	inspectTaskContainers(t, testContext, cli, serviceID, func(container types.ContainerJSON) {
+		require.True(t, container.HostConfig.ReadonlyRootfs, "container %s has a writable rootfs", container.ID)
+	})
+
+	// the load balancer spreads the writes, so keep going until every task
+	// has taken one
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	written := map[string]bool{}
+	writable := map[string]bool{}
+	err = WaitForConverge(ctx, 100*time.Millisecond, func() error {
+		host, err := putFile(ctx, endpoint, port, "/scratch/"+name, name)
+		if err != nil {
+			return fmt.Errorf("writing to the tmpfs: %s", err)
+		}
+		if host, err := putFile(ctx, endpoint, port, "/"+name, name); err == nil {
+			writable[host] = true
+		}
+		written[host] = true
+		if len(written) < replicas {
+			return fmt.Errorf("only %d of %d tasks answered", len(written), replicas)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, writable, "tasks could write to their root filesystem")
+}
+
+// TestSecurityPrivileges runs a service that drops and adds capabilities and
+// sets no-new-privileges, and checks both the containers' host config and
+// what the processes in the tasks actually end up with
+func TestSecurityPrivileges(t *testing.T) {
+	t.Parallel()
+	name := "TestSecurityPrivileges"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 2
+	dropped := []string{"CAP_CHOWN", "CAP_NET_RAW"}
+	added := []string{"CAP_SYS_PTRACE"}
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.platform.os == linux").
+		Build()
+	spec.TaskTemplate.ContainerSpec.CapabilityDrop = dropped
+	spec.TaskTemplate.ContainerSpec.CapabilityAdd = added
+	spec.TaskTemplate.ContainerSpec.Privileges = &swarm.Privileges{NoNewPrivileges: true}
+	serviceID, endpoint, port := securedService(t, testContext, cli, spec, replicas)
+
+	inspectTaskContainers(t, testContext, cli, serviceID, func(container types.ContainerJSON) {
+		for _, c := range dropped {
+			require.Contains(t, container.HostConfig.CapDrop, c, "container %s", container.ID)
+		}
+		for _, c := range added {
+			require.Contains(t, container.HostConfig.CapAdd, c, "container %s", container.ID)
+		}
+		nnp := false
+		for _, opt := range container.HostConfig.SecurityOpt {
+			if opt == "no-new-privileges" || opt == "no-new-privileges:true" {
+				nnp = true
+			}
+		}
+		require.True(t, nnp, "container %s is missing no-new-privileges: %v", container.ID, container.HostConfig.SecurityOpt)
+	})
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	// a task that's wrong once is wrong for good, so the problems are
+	// collected rather than retried
+	seen := map[string]bool{}
+	problems := []string{}
+	err = WaitForConverge(ctx, 100*time.Millisecond, func() error {
+		info, err := getFile(ctx, endpoint, port, "/proc/self/status")
+		if err != nil {
+			return err
+		}
+		if seen[info.Hostname] {
+			return fmt.Errorf("only %d of %d tasks answered", len(seen), replicas)
+		}
+		seen[info.Hostname] = true
+		status := procStatus(info.Content)
+		if status["NoNewPrivs"] != "1" {
+			problems = append(problems, fmt.Sprintf("no-new-privileges isn't set in %s", info.Hostname))
+		}
+		bounding, err := strconv.ParseUint(status["CapBnd"], 16, 64)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("bad CapBnd in %s: %s", info.Hostname, err))
+		}
+		for _, c := range dropped {
+			if bounding&(1<<capabilityBits[c]) != 0 {
+				problems = append(problems, fmt.Sprintf("%s still has %s", info.Hostname, c))
+			}
+		}
+		for _, c := range added {
+			if bounding&(1<<capabilityBits[c]) == 0 {
+				problems = append(problems, fmt.Sprintf("%s doesn't have %s", info.Hostname, c))
+			}
+		}
+		if len(seen) < replicas {
+			return fmt.Errorf("only %d of %d tasks answered", len(seen), replicas)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
@@ -2,7 +2,6 @@ package dockere2e
 
 import (
 	// basic imports
-	"context"
 	"testing"
 	"time"
 
@@ -15,7 +14,8 @@ import (
 func TestServicesList(t *testing.T) {
 	t.Parallel()
 	cli, err := GetClient()
-	testContext, _ := context.WithTimeout(context.Background(), time.Minute)
+	testContext, cancel := NewTestContext("TestServicesList", time.Minute)
+	defer cancel()
 
 	assert.NoError(t, err, "Client creation failed")
 
@@ -43,7 +43,8 @@ func TestServicesCreate(t *testing.T) {
 	// minute. If this context lapses, all of the API calls will just quick
 	// return, saving time. This should also be used as the parent context for
 	// any subcontexts you create.
-	testContext, _ := context.WithTimeout(context.Background(), time.Minute)
+	testContext, cancel := NewTestContext(name, time.Minute)
+	defer cancel()
 
 	// Use the same client for the whole test. Verify that your client has been
 	// created properly.
@@ -51,16 +52,17 @@ func TestServicesCreate(t *testing.T) {
 	assert.NoError(t, err, "Client creation failed")
 
 	// Create a service spec to use. Your service specs should always be
-	// created with CannedServiceSpec. This function gives you a service spec
-	// with sensible default fields, as well as labels that assist in cleaning
-	// up. In addition, CannedServiceSpec mangles the name and adds the uuid
-	// label that we rely on to isolate this particular instance of the tests
-	// from any other instance that may be running
-	serviceSpec := CannedServiceSpec(cli, name, 3, nil, nil)
+	// created with NewServiceSpec. This function gives you a builder with
+	// sensible default fields, as well as labels that assist in cleaning up,
+	// and you only call the methods for what your test cares about. In
+	// addition, NewServiceSpec mangles the name and adds the uuid label that
+	// we rely on to isolate this particular instance of the tests from any
+	// other instance that may be running
+	serviceSpec := NewServiceSpec(testContext, cli, name).Replicas(3).Build()
 
 	// Now, do an API call. Pass testContext, which will take care of the
 	// timeout for us.
-	resp, err := cli.ServiceCreate(testContext, serviceSpec, types.ServiceCreateOptions{})
+	resp, err := CreateService(testContext, cli, serviceSpec)
 	// Always make sure that the call completed as expected: no errors, non-nil
 	// response, and non-zero ID.
 	assert.NoError(t, err, "Error creating service")
@@ -83,7 +85,8 @@ func TestServicesCreate(t *testing.T) {
 	// will assume the test has succeeded. If the context times out, the
 	// polling will stop and and the error returned on the last poll of the
 	// function will be returned
-	ctx, _ := context.WithTimeout(testContext, 10*time.Second)
+	ctx, cancel := WithTimeout(testContext, 10*time.Second)
+	defer cancel()
 	err = WaitForConverge(ctx, 2*time.Second, func() error {
 		// in this case, we're just waiting for inspect to return no errors,
 		// which should happen almost instantly. More complicated checks will
@@ -107,21 +110,23 @@ func TestServicesCreate(t *testing.T) {
 func TestServicesScale(t *testing.T) {
 	t.Parallel()
 	name := "TestServicesScale"
-	testContext, _ := context.WithTimeout(context.Background(), time.Minute)
+	testContext, cancel := NewTestContext(name, time.Minute)
+	defer cancel()
 
 	cli, err := GetClient()
 	assert.NoError(t, err, "could not create client")
 
 	// create a new service
-	serviceSpec := CannedServiceSpec(cli, name, 1, nil, nil)
-	service, err := cli.ServiceCreate(testContext, serviceSpec, types.ServiceCreateOptions{})
+	serviceSpec := NewServiceSpec(testContext, cli, name).Build()
+	service, err := CreateService(testContext, cli, serviceSpec)
 	assert.NoError(t, err, "error creating service")
 
 	// get a new scale check generator
 	scaleCheck := ScaleCheck(service.ID, cli)
 
 	// check that it converges to 1 replica
-	ctx, _ := context.WithTimeout(testContext, 30*time.Second)
+	ctx, cancel := WithTimeout(testContext, 30*time.Second)
+	defer cancel()
 	err = WaitForConverge(ctx, 2*time.Second, scaleCheck(ctx, 1))
 	assert.NoError(t, err)
 
@@ -136,7 +141,8 @@ func TestServicesScale(t *testing.T) {
 	assert.NoError(t, err)
 
 	// check that it converges to 3 replicas
-	ctx, _ = context.WithTimeout(testContext, 30*time.Second)
+	ctx, cancel = WithTimeout(testContext, 30*time.Second)
+	defer cancel()
 	err = WaitForConverge(ctx, 2*time.Second, scaleCheck(ctx, 3))
 	assert.NoError(t, err)
 
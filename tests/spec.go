@@ -0,0 +1,223 @@
+package dockere2e
+
+import (
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// ServiceSpecBuilder builds a service spec for a test, so that tests only spell
+// out what they care about. It starts from a single replica of the test server
+// with port 80 published through the routing mesh, named and labeled like the
+// rest of the test's objects so that CleanTestServices finds it
+type ServiceSpecBuilder struct {
+	spec     swarm.ServiceSpec
+	replicas uint64
+	cli      *client.Client
+}
+
+// NewServiceSpec starts a spec for a service of the named test
+func NewServiceSpec(ctx context.Context, cli *client.Client, name string) *ServiceSpecBuilder {
+	b := &ServiceSpecBuilder{
+		spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name:   getUniqueName(name),
+				Labels: testLabels(name),
+			},
+			TaskTemplate: swarm.TaskSpec{
+				ContainerSpec: swarm.ContainerSpec{
+					Image:   GetSelfImage(ctx, cli),
+					Command: []string{"util", "test-server"},
+				},
+			},
+		},
+		replicas: 1,
+		cli:      cli,
+	}
+	return b.PublishTCP(80)
+}
+
+// Build returns the spec. A spec running the util manifest list, see
+// UtilImageEnv, is limited to its Linux platforms unless it already picks the
+// nodes' OS itself
+func (b *ServiceSpecBuilder) Build() swarm.ServiceSpec {
+	spec := b.spec
+	if spec.Mode.Global == nil {
+		replicas := b.replicas
+		spec.Mode = swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
+	}
+	if list := os.Getenv(UtilImageEnv); list != "" && spec.TaskTemplate.ContainerSpec.Image == list && !b.picksOS() {
+		placement := swarm.Placement{}
+		if spec.TaskTemplate.Placement != nil {
+			placement = *spec.TaskTemplate.Placement
+		}
+		placement.Platforms = utilLinuxPlatforms(b.cli)
+		spec.TaskTemplate.Placement = &placement
+	}
+	return spec
+}
+
+// picksOS returns whether the spec limits the tasks to an OS already, by
+// platform or by constraint
+func (b *ServiceSpecBuilder) picksOS() bool {
+	placement := b.spec.TaskTemplate.Placement
+	if placement == nil {
+		return false
+	}
+	if len(placement.Platforms) > 0 {
+		return true
+	}
+	for _, constraint := range placement.Constraints {
+		if strings.Contains(constraint, "node.platform.os") {
+			return true
+		}
+	}
+	return false
+}
+
+// Replicas makes it a replicated service with n tasks
+func (b *ServiceSpecBuilder) Replicas(n uint64) *ServiceSpecBuilder {
+	b.replicas = n
+	b.spec.Mode = swarm.ServiceMode{}
+	return b
+}
+
+// Global makes it a global service
+func (b *ServiceSpecBuilder) Global() *ServiceSpecBuilder {
+	b.spec.Mode = swarm.ServiceMode{Global: &swarm.GlobalService{}}
+	return b
+}
+
+// Image runs another image. The test server command is kept, call Command to
+// change it
+func (b *ServiceSpecBuilder) Image(image string) *ServiceSpecBuilder {
+	b.spec.TaskTemplate.ContainerSpec.Image = image
+	return b
+}
+
+// Command replaces the command, with none running the image's own
+func (b *ServiceSpecBuilder) Command(command ...string) *ServiceSpecBuilder {
+	b.spec.TaskTemplate.ContainerSpec.Command = command
+	return b
+}
+
+// Env adds environment variables, as KEY=value
+func (b *ServiceSpecBuilder) Env(env ...string) *ServiceSpecBuilder {
+	b.spec.TaskTemplate.ContainerSpec.Env = append(b.spec.TaskTemplate.ContainerSpec.Env, env...)
+	return b
+}
+
+// Label adds key-only labels to the service, like the one holding the
+// unmangled name
+func (b *ServiceSpecBuilder) Label(labels ...string) *ServiceSpecBuilder {
+	for _, label := range labels {
+		b.spec.Annotations.Labels[label] = ""
+	}
+	return b
+}
+
+// Network attaches the tasks to the networks, by name or ID
+func (b *ServiceSpecBuilder) Network(targets ...string) *ServiceSpecBuilder {
+	for _, target := range targets {
+		b.spec.TaskTemplate.Networks = append(b.spec.TaskTemplate.Networks, swarm.NetworkAttachmentConfig{Target: target})
+	}
+	return b
+}
+
+// Constraint adds placement constraints, e.g. "node.platform.os == linux"
+func (b *ServiceSpecBuilder) Constraint(constraints ...string) *ServiceSpecBuilder {
+	placement := b.placement()
+	placement.Constraints = append(placement.Constraints, constraints...)
+	return b
+}
+
+// Platforms limits the tasks to nodes of the platforms
+func (b *ServiceSpecBuilder) Platforms(platforms ...swarm.Platform) *ServiceSpecBuilder {
+	placement := b.placement()
+	placement.Platforms = append(placement.Platforms, platforms...)
+	return b
+}
+
+func (b *ServiceSpecBuilder) placement() *swarm.Placement {
+	if b.spec.TaskTemplate.Placement == nil {
+		b.spec.TaskTemplate.Placement = &swarm.Placement{}
+	}
+	return b.spec.TaskTemplate.Placement
+}
+
+// Publish replaces the published ports
+func (b *ServiceSpecBuilder) Publish(ports ...swarm.PortConfig) *ServiceSpecBuilder {
+	if b.spec.EndpointSpec == nil {
+		b.spec.EndpointSpec = &swarm.EndpointSpec{}
+	}
+	b.spec.EndpointSpec.Ports = ports
+	return b
+}
+
+// PublishTCP replaces the published ports with the TCP target ports, each
+// published through the routing mesh on a port swarm picks
+func (b *ServiceSpecBuilder) PublishTCP(targets ...uint32) *ServiceSpecBuilder {
+	return b.Publish(targetPorts(swarm.PortConfigProtocolTCP, targets)...)
+}
+
+// PublishUDP is PublishTCP for UDP ports
+func (b *ServiceSpecBuilder) PublishUDP(targets ...uint32) *ServiceSpecBuilder {
+	return b.Publish(targetPorts(swarm.PortConfigProtocolUDP, targets)...)
+}
+
+// Unpublished leaves the service without an endpoint spec, so nothing is
+// published and the service gets the default VIP
+func (b *ServiceSpecBuilder) Unpublished() *ServiceSpecBuilder {
+	b.spec.EndpointSpec = nil
+	return b
+}
+
+// DNSRR resolves the service name to the task addresses rather than a VIP.
+// The routing mesh needs a VIP, so the ports published so far are dropped,
+// ports published afterwards have to use host mode
+func (b *ServiceSpecBuilder) DNSRR() *ServiceSpecBuilder {
+	b.spec.EndpointSpec = &swarm.EndpointSpec{Mode: swarm.ResolutionModeDNSRR}
+	return b
+}
+
+// Mount adds mounts to the containers
+func (b *ServiceSpecBuilder) Mount(mounts ...mount.Mount) *ServiceSpecBuilder {
+	b.spec.TaskTemplate.ContainerSpec.Mounts = append(b.spec.TaskTemplate.ContainerSpec.Mounts, mounts...)
+	return b
+}
+
+// Secret gives the containers the secrets
+func (b *ServiceSpecBuilder) Secret(refs ...*swarm.SecretReference) *ServiceSpecBuilder {
+	b.spec.TaskTemplate.ContainerSpec.Secrets = append(b.spec.TaskTemplate.ContainerSpec.Secrets, refs...)
+	return b
+}
+
+// Config gives the containers the configs
+func (b *ServiceSpecBuilder) Config(refs ...*swarm.ConfigReference) *ServiceSpecBuilder {
+	b.spec.TaskTemplate.ContainerSpec.Configs = append(b.spec.TaskTemplate.ContainerSpec.Configs, refs...)
+	return b
+}
+
+// UpdateConfig sets how updates roll out
+func (b *ServiceSpecBuilder) UpdateConfig(config swarm.UpdateConfig) *ServiceSpecBuilder {
+	b.spec.UpdateConfig = &config
+	return b
+}
+
+// RollbackConfig sets how rollbacks roll out
+func (b *ServiceSpecBuilder) RollbackConfig(config swarm.UpdateConfig) *ServiceSpecBuilder {
+	b.spec.RollbackConfig = &config
+	return b
+}
+
+// targetPorts returns ingress port configs for the target ports
+func targetPorts(protocol swarm.PortConfigProtocol, targets []uint32) []swarm.PortConfig {
+	ports := []swarm.PortConfig{}
+	for _, target := range targets {
+		ports = append(ports, swarm.PortConfig{Protocol: protocol, TargetPort: target})
+	}
+	return ports
+}
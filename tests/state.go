@@ -0,0 +1,132 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// ExpectedState describes what a test expects the cluster to look like, so
+// that it can check all of it at once and get every difference back, rather
+// than checking it piece by piece and stopping at the first one:
+//
+//	err = WaitForState(ctx, cli, ExpectedState{
+//		Services: map[string]int{frontend.ID: 3, backend.ID: 2},
+//		Networks: map[string]bool{nwName: true},
+//		Nodes:    map[string]swarm.NodeAvailability{host: swarm.NodeAvailabilityDrain},
+//	})
+type ExpectedState struct {
+	// Services are how many running tasks each service should have, by
+	// service name or ID
+	Services map[string]int
+	// Networks are whether each network should exist, by name or ID
+	Networks map[string]bool
+	// Nodes are the availability each node should have, by hostname or ID
+	Nodes map[string]swarm.NodeAvailability
+}
+
+// StateError lists how the cluster differs from the expected state
+type StateError struct {
+	Differences []string
+}
+
+func (e *StateError) Error() string {
+	return "cluster isn't in the expected state:\n\t" + strings.Join(e.Differences, "\n\t")
+}
+
+// Diff returns how the cluster differs from the expected state, sorted, or
+// nothing if it doesn't
+func (e ExpectedState) Diff(ctx context.Context, cli *client.Client) ([]string, error) {
+	diff := []string{}
+	for service, running := range e.Services {
+		full, _, err := cli.ServiceInspectWithRaw(ctx, service, types.ServiceInspectOptions{})
+		if err != nil {
+			if client.IsErrServiceNotFound(err) {
+				diff = append(diff, fmt.Sprintf("service %s: missing, expected %d running tasks", service, running))
+				continue
+			}
+			return nil, err
+		}
+		tasks, err := GetServiceTasks(ctx, cli, full.ID)
+		if err != nil {
+			return nil, err
+		}
+		states := map[swarm.TaskState]int{}
+		for _, task := range tasks {
+			states[task.Status.State]++
+		}
+		if states[swarm.TaskStateRunning] == running && len(tasks) == running {
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("service %s: %s, expected %d running", full.Spec.Name, describeTaskStates(states), running))
+	}
+	for network, exists := range e.Networks {
+		_, err := cli.NetworkInspect(ctx, network, false)
+		if err != nil && !client.IsErrNetworkNotFound(err) {
+			return nil, err
+		}
+		if found := err == nil; found != exists {
+			if exists {
+				diff = append(diff, fmt.Sprintf("network %s: missing", network))
+			} else {
+				diff = append(diff, fmt.Sprintf("network %s: still exists", network))
+			}
+		}
+	}
+	for name, availability := range e.Nodes {
+		node, _, err := cli.NodeInspectWithRaw(ctx, name)
+		if err != nil {
+			if client.IsErrNodeNotFound(err) {
+				diff = append(diff, fmt.Sprintf("node %s: missing, expected %s", name, availability))
+				continue
+			}
+			return nil, err
+		}
+		if node.Spec.Availability != availability {
+			diff = append(diff, fmt.Sprintf("node %s: %s, expected %s", node.Description.Hostname, node.Spec.Availability, availability))
+		}
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
+
+// describeTaskStates lists how many tasks are in each state, e.g. "2
+// running, 1 preparing", or "no tasks"
+func describeTaskStates(states map[swarm.TaskState]int) string {
+	if len(states) == 0 {
+		return "no tasks"
+	}
+	parts := []string{}
+	for state, n := range states {
+		parts = append(parts, fmt.Sprintf("%d %s", n, state))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// Check returns a check for WaitForConverge that passes once the cluster is
+// in the expected state, and returns a *StateError otherwise
+func (e ExpectedState) Check(ctx context.Context, cli *client.Client) func() error {
+	return func() error {
+		diff, err := e.Diff(ctx, cli)
+		if err != nil {
+			return err
+		}
+		if len(diff) > 0 {
+			return &StateError{Differences: diff}
+		}
+		return nil
+	}
+}
+
+// WaitForState waits for the cluster to be in the expected state, returning
+// what was still different when the context ran out
+func WaitForState(ctx context.Context, cli *client.Client, expected ExpectedState) error {
+	return WaitForConverge(ctx, time.Second, expected.Check(ctx, cli))
+}
@@ -0,0 +1,367 @@
+package dockere2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// StatsIntervalEnv turns on sampling the resource usage of the services of
+// the tests that ask for it, see SampleStats, and is how often to sample, e.g.
+// 5s. Sampling is off when it's unset
+const StatsIntervalEnv = "E2E_STATS_INTERVAL"
+
+// statsInterval returns how often to sample, 0 if sampling is off
+func statsInterval() (time.Duration, error) {
+	value := os.Getenv(StatsIntervalEnv)
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, not %q", StatsIntervalEnv, value)
+	}
+	return interval, nil
+}
+
+// checkStatsInterval makes sure the sampling interval is valid, for TestMain
+// to fail fast rather than have it silently ignored
+func checkStatsInterval() error {
+	_, err := statsInterval()
+	return err
+}
+
+// ContainerSample is the resource usage of a task's container
+type ContainerSample struct {
+	Container   string  `json:"container"`
+	Service     string  `json:"service"`
+	Node        string  `json:"node"`
+	CPUPercent  float64 `json:"cpu_percent"`
+	Memory      uint64  `json:"memory"`
+	MemoryLimit uint64  `json:"memory_limit"`
+	NetworkRx   uint64  `json:"network_rx"`
+	NetworkTx   uint64  `json:"network_tx"`
+}
+
+// NodeSample is the load of a Linux node running the tasks, read from the
+// machine itself
+type NodeSample struct {
+	Node            string  `json:"node"`
+	Load1           float64 `json:"load1"`
+	MemoryTotal     uint64  `json:"memory_total"`
+	MemoryAvailable uint64  `json:"memory_available"`
+}
+
+// StatsSample is everything sampled at one point of the test
+type StatsSample struct {
+	Time       time.Time         `json:"time"`
+	Containers []ContainerSample `json:"containers"`
+	Nodes      []NodeSample      `json:"nodes,omitempty"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// StatsSampler samples the resource usage of a test's services in the
+// background
+type StatsSampler struct {
+	name     string
+	cli      *client.Client
+	interval time.Duration
+	machines *Machines
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	clients map[string]*client.Client
+	samples []StatsSample
+}
+
+// SampleStats starts sampling the containers of the services labeled name,
+// and the nodes they're on when machine control is available, every
+// StatsIntervalEnv until Stop is called. It doesn't sample anything when the
+// interval isn't set, so tests asserting on the samples should check Enabled.
+//
+//	stats := SampleStats(testContext, cli, name)
+//	defer stats.Stop()
+func SampleStats(ctx context.Context, cli *client.Client, name string) *StatsSampler {
+	interval, _ := statsInterval()
+	s := &StatsSampler{
+		name:     name,
+		cli:      cli,
+		interval: interval,
+		machines: LookupMachines(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		clients:  map[string]*client.Client{},
+	}
+	if interval == 0 {
+		close(s.done)
+		return s
+	}
+	Logger(ctx).WithField("interval", interval).Info("stats sampling started")
+	go s.run(ctx)
+	return s
+}
+
+// Enabled returns whether the sampler is taking samples
+func (s *StatsSampler) Enabled() bool {
+	return s.interval > 0
+}
+
+// run samples every interval until stopped or the context is done
+func (s *StatsSampler) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.sample(ctx)
+		select {
+		case <-s.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops sampling and, when the results are being written, saves the
+// timeline of the test as stats/<test>.json in the report directory
+func (s *StatsSampler) Stop() {
+	select {
+	case <-s.stop:
+		return
+	default:
+		close(s.stop)
+	}
+	<-s.done
+	dir := os.Getenv(ReportDirEnv)
+	if !s.Enabled() || dir == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.Samples(), "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(dir, "stats"), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "stats", artifactName(s.name)+".json"), data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving the stats of %s: %s\n", s.name, err)
+	}
+}
+
+// Samples returns the timeline sampled so far
+func (s *StatsSampler) Samples() []StatsSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StatsSample{}, s.samples...)
+}
+
+// Peak returns the highest CPU and memory usage sampled of any one container
+// of the service
+func (s *StatsSampler) Peak(service string) (cpuPercent float64, memory uint64) {
+	for _, sample := range s.Samples() {
+		for _, c := range sample.Containers {
+			if c.Service != service {
+				continue
+			}
+			if c.CPUPercent > cpuPercent {
+				cpuPercent = c.CPUPercent
+			}
+			if c.Memory > memory {
+				memory = c.Memory
+			}
+		}
+	}
+	return cpuPercent, memory
+}
+
+// sample takes a sample of the running tasks of the test's services
+func (s *StatsSampler) sample(ctx context.Context) {
+	ctx, cancel := WithTimeout(ctx, s.interval+10*time.Second)
+	defer cancel()
+	sample := StatsSample{Time: time.Now()}
+	services, err := s.cli.ServiceList(ctx, types.ServiceListOptions{Filters: GetTestFilter(s.name)})
+	if err != nil {
+		sample.Errors = append(sample.Errors, err.Error())
+		s.add(sample)
+		return
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	nodes := map[string]bool{}
+	for _, service := range services {
+		tasks, err := GetServiceTasks(ctx, s.cli, service.ID)
+		if err != nil {
+			mu.Lock()
+			sample.Errors = append(sample.Errors, err.Error())
+			mu.Unlock()
+			continue
+		}
+		for _, task := range tasks {
+			if task.Status.State != swarm.TaskStateRunning || task.Status.ContainerStatus.ContainerID == "" {
+				continue
+			}
+			nodes[task.NodeID] = true
+			wg.Add(1)
+			go func(service string, task swarm.Task) {
+				defer wg.Done()
+				c, err := s.containerSample(ctx, task)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					sample.Errors = append(sample.Errors, fmt.Sprintf("%s: %s", task.ID, err))
+					return
+				}
+				c.Service = service
+				sample.Containers = append(sample.Containers, c)
+			}(service.Spec.Name, task)
+		}
+	}
+	if s.machines != nil {
+		for nodeID := range nodes {
+			wg.Add(1)
+			go func(nodeID string) {
+				defer wg.Done()
+				n, err := s.nodeSample(ctx, nodeID)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					sample.Errors = append(sample.Errors, fmt.Sprintf("%s: %s", nodeID, err))
+					return
+				}
+				if n != nil {
+					sample.Nodes = append(sample.Nodes, *n)
+				}
+			}(nodeID)
+		}
+	}
+	wg.Wait()
+	s.add(sample)
+}
+
+// add appends the sample to the timeline
+func (s *StatsSampler) add(sample StatsSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+}
+
+// nodeClient returns a client for the engine of the node, kept for the next
+// samples
+func (s *StatsSampler) nodeClient(ctx context.Context, nodeID string) (*client.Client, swarm.Node, error) {
+	node, _, err := s.cli.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		return nil, node, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.clients[nodeID]; ok {
+		return c, node, nil
+	}
+	info, err := s.cli.Info(ctx)
+	if err != nil {
+		return nil, node, err
+	}
+	c := s.cli
+	if info.Swarm.NodeID != nodeID {
+		c, err = GetNodeClient(node)
+		if err != nil {
+			return nil, node, err
+		}
+	}
+	s.clients[nodeID] = c
+	return c, node, nil
+}
+
+// containerSample reads the stats of the task's container from its engine
+func (s *StatsSampler) containerSample(ctx context.Context, task swarm.Task) (ContainerSample, error) {
+	c, node, err := s.nodeClient(ctx, task.NodeID)
+	if err != nil {
+		return ContainerSample{}, err
+	}
+	id := task.Status.ContainerStatus.ContainerID
+	resp, err := c.ContainerStats(ctx, id, false)
+	if err != nil {
+		return ContainerSample{}, err
+	}
+	defer resp.Body.Close()
+	var stats types.StatsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return ContainerSample{}, err
+	}
+	sample := ContainerSample{
+		Container:   id,
+		Node:        node.Description.Hostname,
+		CPUPercent:  cpuPercent(stats),
+		Memory:      stats.MemoryStats.Usage,
+		MemoryLimit: stats.MemoryStats.Limit,
+	}
+	for _, nw := range stats.Networks {
+		sample.NetworkRx += nw.RxBytes
+		sample.NetworkTx += nw.TxBytes
+	}
+	return sample, nil
+}
+
+// cpuPercent works out the CPU usage of the container since the previous
+// reading the engine took, like docker stats does, 100 being one full CPU
+func cpuPercent(stats types.StatsJSON) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+	return cpuDelta / systemDelta * float64(len(stats.CPUStats.CPUUsage.PercpuUsage)) * 100
+}
+
+// nodeSample reads the load and memory of a Linux node, nil for other nodes
+func (s *StatsSampler) nodeSample(ctx context.Context, nodeID string) (*NodeSample, error) {
+	node, _, err := s.cli.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if node.Description.Platform.OS != "linux" {
+		return nil, nil
+	}
+	host := node.Description.Hostname
+	out, err := s.machines.Run(host, "cat /proc/loadavg /proc/meminfo")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, out)
+	}
+	sample := &NodeSample{Node: host}
+	lines := strings.Split(out, "\n")
+	if fields := strings.Fields(lines[0]); len(fields) > 0 {
+		sample.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	}
+	for _, line := range lines[1:] {
+		// e.g. "MemAvailable:    1234567 kB"
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			sample.MemoryTotal = kb * 1024
+		case "MemAvailable:":
+			sample.MemoryAvailable = kb * 1024
+		}
+	}
+	return sample, nil
+}
@@ -0,0 +1,214 @@
+package dockere2e
+
+import (
+	// basic imports
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// signalRecord is a stop signal the test server logged, at the time the
+// engine received the log line
+type signalRecord struct {
+	Signal string
+	Time   time.Time
+}
+
+// taskSignals returns the stop signals the test server in the container
+// logged, in the order they were received
+func taskSignals(ctx context.Context, cli *client.Client, containerID string) ([]signalRecord, error) {
+	logs, err := cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer logs.Close()
+	// logrus writes to stderr, but there's no harm in reading both
+	output := &bytes.Buffer{}
+	if _, err := stdcopy.StdCopy(output, output, logs); err != nil {
+		return nil, err
+	}
+
+	records := []signalRecord{}
+	for _, line := range strings.Split(output.String(), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		entry := struct {
+			Msg    string `json:"msg"`
+			Signal string `json:"signal"`
+		}{}
+		if err := json.Unmarshal([]byte(parts[1]), &entry); err != nil || entry.Msg != "Received signal" {
+			continue
+		}
+		received, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad log timestamp %q: %s", parts[0], err)
+		}
+		records = append(records, signalRecord{Signal: entry.Signal, Time: received})
+	}
+	return records, nil
+}
+
+// stoppedTask is the outcome of stopping one task of a service
+type stoppedTask struct {
+	Task swarm.Task
+	// Signals and Finished are only filled in when the task's engine could
+	// be reached
+	Signals  []signalRecord
+	Finished time.Time
+}
+
+// stopTasks creates a service with the stop settings, scales it to zero once
+// it has converged, and returns the tasks once they've all stopped
+func stopTasks(t *testing.T, ctx context.Context, cli *client.Client, spec swarm.ServiceSpec, replicas int) []stoppedTask {
+	info, err := cli.Info(ctx)
+	require.NoError(t, err)
+	service, err := CreateService(ctx, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	scaleCtx, cancel := WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(scaleCtx, time.Second, scaleCheck(scaleCtx, replicas))
+	require.NoError(t, err)
+	tasks, err := GetServiceTasks(ctx, cli, service.ID)
+	require.NoError(t, err)
+
+	require.NoError(t, scaleService(ctx, cli, service.ID, 0))
+	stopCtx, cancel := WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(stopCtx, time.Second, func() error {
+		for i, task := range tasks {
+			current, _, err := cli.TaskInspectWithRaw(stopCtx, task.ID)
+			if err != nil {
+				return err
+			}
+			if current.Status.State == swarm.TaskStateRunning {
+				return fmt.Errorf("task %s is still running", task.ID)
+			}
+			tasks[i] = current
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	require.NoError(t, err)
+	byID := map[string]swarm.Node{}
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+	stopped := []stoppedTask{}
+	for _, task := range tasks {
+		s := stoppedTask{Task: task}
+		nodeCli := cli
+		if task.NodeID != info.Swarm.NodeID {
+			nodeCli, err = GetNodeClient(byID[task.NodeID])
+			if err != nil {
+				// the exit codes can still be checked through the manager
+				t.Logf("Not checking the timing of the task on %s: %s", byID[task.NodeID].Description.Hostname, err)
+				stopped = append(stopped, s)
+				continue
+			}
+		}
+		containerID := task.Status.ContainerStatus.ContainerID
+		container, err := nodeCli.ContainerInspect(ctx, containerID)
+		require.NoError(t, err, "inspecting the container of task %s", task.ID)
+		s.Finished, err = time.Parse(time.RFC3339Nano, container.State.FinishedAt)
+		require.NoError(t, err)
+		s.Signals, err = taskSignals(ctx, nodeCli, containerID)
+		require.NoError(t, err, "reading the logs of task %s", task.ID)
+		stopped = append(stopped, s)
+	}
+	return stopped
+}
+
+// TestStopSignal sets a custom stop signal on a service whose tasks take a
+// while to shut down, and checks they got that signal and were left to exit
+// on their own within the grace period
+func TestStopSignal(t *testing.T) {
+	t.Parallel()
+	name := "TestStopSignal"
+	testContext, cancel := NewTestContext(name, 4*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 3
+	delay := 5 * time.Second
+	grace := 30 * time.Second
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Command("util", "test-server", "--stop-delay", delay.String()).
+		Constraint("node.platform.os == linux").
+		Build()
+	spec.TaskTemplate.ContainerSpec.StopSignal = "SIGUSR1"
+	spec.TaskTemplate.ContainerSpec.StopGracePeriod = &grace
+
+	for _, s := range stopTasks(t, testContext, cli, spec, replicas) {
+		require.Equal(t, 0, s.Task.Status.ContainerStatus.ExitCode, "task %s should have exited on its own", s.Task.ID)
+		if s.Finished.IsZero() {
+			continue
+		}
+		require.Len(t, s.Signals, 1, "task %s should have been signaled once", s.Task.ID)
+		require.Equal(t, "SIGUSR1", s.Signals[0].Signal)
+		took := s.Finished.Sub(s.Signals[0].Time)
+		require.True(t, took >= delay-time.Second, "task %s stopped %s after the signal, before it was done", s.Task.ID, took)
+		require.True(t, took < grace, "task %s stopped %s after the signal", s.Task.ID, took)
+	}
+}
+
+// TestStopGracePeriod runs tasks that ignore the stop signal, and checks they
+// get the default signal and are only killed once the grace period is over
+func TestStopGracePeriod(t *testing.T) {
+	t.Parallel()
+	name := "TestStopGracePeriod"
+	testContext, cancel := NewTestContext(name, 4*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 3
+	grace := 15 * time.Second
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Command("util", "test-server", "--stop-delay", "10m").
+		Constraint("node.platform.os == linux").
+		Build()
+	spec.TaskTemplate.ContainerSpec.StopGracePeriod = &grace
+
+	for _, s := range stopTasks(t, testContext, cli, spec, replicas) {
+		// killed by SIGKILL
+		require.Equal(t, 137, s.Task.Status.ContainerStatus.ExitCode, "task %s should have been killed", s.Task.ID)
+		if s.Finished.IsZero() {
+			continue
+		}
+		require.Len(t, s.Signals, 1, "task %s should have been signaled once before the kill", s.Task.ID)
+		require.Equal(t, "SIGTERM", s.Signals[0].Signal)
+		took := s.Finished.Sub(s.Signals[0].Time)
+		require.True(t, took >= grace-time.Second, "task %s was killed %s after the signal, before the grace period ran out", s.Task.ID, took)
+		require.True(t, took < grace+10*time.Second, "task %s was killed %s after the signal", s.Task.ID, took)
+	}
+}
@@ -0,0 +1,265 @@
+package dockere2e
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tests are grouped into suites by tags, so that a run can be limited to part
+// of them with -suite and -skip, or E2E_SUITE and E2E_SKIP, each a comma
+// separated list of tags. TestMain turns the selection into -test.run, which
+// is why every test has to be in testTags, even without any tag: a test that
+// isn't there never runs once a selection is made.
+const (
+	// SuiteEnv is the default for -suite, the tags of the tests to run
+	SuiteEnv = "E2E_SUITE"
+	// SkipEnv is the default for -skip, the tags of the tests not to run
+	SkipEnv = "E2E_SKIP"
+	// RetriesEnv is the default for -retries, how many more times a failed
+	// test tagged flaky is run before it counts as a failure
+	RetriesEnv = "E2E_RETRIES"
+)
+
+const (
+	// TagCluster is for tests of the swarm itself: membership, raft, certs
+	TagCluster = "cluster"
+	// TagServices is for tests of services and their tasks
+	TagServices = "services"
+	// TagNetwork is for tests of overlays, service discovery and load balancing
+	TagNetwork = "network"
+	// TagSecrets is for tests of secrets and configs
+	TagSecrets = "secrets"
+	// TagSecurity is for tests of how tasks and the cluster are locked down
+	TagSecurity = "security"
+	// TagWindows is for tests that need Windows nodes
+	TagWindows = "windows"
+	// TagSlow is for tests that take more than a few minutes
+	TagSlow = "slow"
+	// TagDestructive is for tests that restart engines, reboot or cut off
+	// machines, or change settings of the whole cluster
+	TagDestructive = "destructive"
+	// TagFlaky is for tests known to fail now and then for reasons outside
+	// of what they test, which are run again when they fail
+	TagFlaky = "flaky"
+)
+
+var (
+	suiteFlag   = flag.String("suite", os.Getenv(SuiteEnv), "only run tests with one of these comma separated tags")
+	skipFlag    = flag.String("skip", os.Getenv(SkipEnv), "don't run tests with any of these comma separated tags")
+	retriesFlag = flag.Int("retries", defaultRetries(), "how many more times to run failed tests tagged flaky")
+	listFlag    = flag.Bool("list", false, "print the selected tests with their tags instead of running them")
+)
+
+// defaultRetries reads RetriesEnv, no retries if it's unset or invalid
+func defaultRetries() int {
+	retries, err := strconv.Atoi(os.Getenv(RetriesEnv))
+	if err != nil {
+		return 0
+	}
+	return retries
+}
+
+// testTags lists every test, with its tags
+var testTags = map[string][]string{
+	"TestDefaultAddressPools":        {TagNetwork, TagDestructive, TagSlow},
+	"TestSwarmAutolock":              {TagCluster, TagSecurity, TagDestructive},
+	"TestSwarmAutolockRebootAll":     {TagCluster, TagSecurity, TagDestructive, TagSlow},
+	"TestSwarmBackupRestore":         {TagCluster, TagDestructive, TagSlow},
+	"TestCARotation":                 {TagCluster, TagSecurity, TagDestructive},
+	"TestCARotationNodeRestart":      {TagCluster, TagSecurity, TagDestructive},
+	"TestCertRenewalUnderLoad":       {TagCluster, TagSecurity, TagSlow},
+	"TestChaosTaskKill":              {TagServices},
+	"TestServiceChurn":               {TagServices, TagSlow},
+	"TestClusterNodeAvailable":       {TagCluster},
+	"TestConfigsServiceFile":         {TagSecrets},
+	"TestConfigsRotate":              {TagSecrets},
+	"TestDaemonRestart":              {TagCluster, TagDestructive},
+	"TestServiceDigestPinning":       {TagServices},
+	"TestNetworkEncryptedOverlay":    {TagNetwork, TagSecurity},
+	"TestEventsStream":               {TagCluster},
+	"TestExecIntoTasks":              {TagServices},
+	"TestExperimentalGating":         {TagCluster, TagDestructive, TagSlow},
+	"TestManagerLeaderFailover":      {TagCluster, TagDestructive, TagSlow},
+	"TestHealthcheckFlapping":        {TagServices, TagFlaky},
+	"TestNetworkIngressCustomize":    {TagNetwork, TagDestructive},
+	"TestSwarmJoinTokenRotation":     {TagCluster, TagSecurity, TagDestructive},
+	"TestNetworkMacvlan":             {TagNetwork},
+	"TestMixedOSApplication":         {TagServices, TagWindows},
+	"TestServiceMounts":              {TagServices},
+	"TestServiceAnonymousVolumes":    {TagServices},
+	"TestNetworkOverlayMTU":          {TagNetwork},
+	"TestDaemonMTU":                  {TagNetwork, TagDestructive, TagSlow},
+	"TestNetworkMultipleAttachments": {TagNetwork},
+	"TestNetworkAliases":             {TagNetwork},
+	"TestNetworkCustomIPAM":          {TagNetwork},
+	"TestNetworkDefaultAddressPool":  {TagNetwork},
+	"TestNetworkPluginSwarmScope":    {TagNetwork, TagDestructive},
+	"TestServiceDiscovery":           {TagNetwork},
+	"TestServiceDiscoveryVIP":        {TagNetwork},
+	"TestAttachableNetwork":          {TagNetwork},
+	"TestAttachableNetworkMatrix":    {TagNetwork},
+	"TestNetworkExternalLb":          {TagNetwork, TagFlaky},
+	"TestNetworkExternalLbUDP":       {TagNetwork, TagFlaky},
+	"TestSwarmNodeLeaveRejoin":       {TagCluster, TagDestructive},
+	"TestPartitionManagerMinority":   {TagCluster, TagDestructive},
+	"TestPartitionManagerMajority":   {TagCluster, TagDestructive},
+	"TestPlacementSpread":            {TagServices},
+	"TestPublishedPortConflict":      {TagNetwork},
+	"TestPublishedPortCycle":         {TagNetwork},
+	"TestPublishedPortRange":         {TagNetwork},
+	"TestPruneUnderSwarm":            {TagCluster, TagDestructive},
+	"TestRaftSnapshotting":           {TagCluster, TagDestructive},
+	"TestNodeRebootWorker":           {TagCluster, TagDestructive, TagSlow},
+	"TestNodeRebootManager":          {TagCluster, TagDestructive, TagSlow},
+	"TestNodeMaintenance":            {TagCluster, TagDestructive, TagSlow},
+	"TestRegistryAuthDeploy":         {TagServices, TagSecrets},
+	"TestRegistryAuthRotation":       {TagServices, TagSecrets},
+	"TestServiceRollbackPrevious":    {TagServices},
+	"TestSecretsRotateUnderTraffic":  {TagSecrets, TagNetwork},
+	"TestConfigsRotateUnderTraffic":  {TagSecrets, TagNetwork},
+	"TestScaleProfile":               {TagServices, TagSlow},
+	"TestScaleManyNetworks":          {TagNetwork, TagSlow},
+	"TestScenarios":                  {TagServices, TagSlow},
+	"TestSecretsCreateInspectRemove": {TagSecrets},
+	"TestSecretsServiceFile":         {TagSecrets},
+	"TestSecretsRotate":              {TagSecrets},
+	"TestSecretsRemoveInUse":         {TagSecrets},
+	"TestSecurityReadOnlyRootfs":     {TagServices, TagSecurity},
+	"TestSecurityPrivileges":         {TagServices, TagSecurity},
+	"TestServicesList":               {TagServices},
+	"TestServicesCreate":             {TagServices},
+	"TestServicesScale":              {TagServices},
+	"TestStopSignal":                 {TagServices},
+	"TestStopGracePeriod":            {TagServices},
+	"TestServiceTemplating":          {TagServices},
+	"TestUpdateFailurePause":         {TagServices},
+	"TestUpdateFailureContinue":      {TagServices},
+	"TestUpdateFailureRollback":      {TagServices},
+	"TestUpdateTimingSerial":         {TagServices, TagFlaky},
+	"TestUpdateTimingBatches":        {TagServices, TagFlaky},
+	"TestVolumePluginReschedule":     {TagServices, TagDestructive},
+	"TestWindowsServiceScheduling":   {TagServices, TagWindows},
+	"TestWindowsPublishedPort":       {TagNetwork, TagWindows},
+	"TestWindowsServiceDiscovery":    {TagNetwork, TagWindows},
+	"TestWindowsCredentialSpec":      {TagSecurity, TagWindows},
+}
+
+// knownTags are the tags -suite and -skip accept
+var knownTags = map[string]bool{
+	TagCluster:     true,
+	TagServices:    true,
+	TagNetwork:     true,
+	TagSecrets:     true,
+	TagSecurity:    true,
+	TagWindows:     true,
+	TagSlow:        true,
+	TagDestructive: true,
+	TagFlaky:       true,
+}
+
+// parseTags splits a comma separated list of tags, checking they all exist
+func parseTags(list string) (map[string]bool, error) {
+	tags := map[string]bool{}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !knownTags[tag] {
+			return nil, fmt.Errorf("unknown tag %q", tag)
+		}
+		tags[tag] = true
+	}
+	return tags, nil
+}
+
+// hasTag returns whether any of the test's tags is in the set
+func hasTag(test string, set map[string]bool) bool {
+	for _, tag := range testTags[test] {
+		if set[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedTests returns the tests selected by -suite and -skip, out of the
+// ones run matches if it's set, sorted
+func selectedTests(run string) ([]string, error) {
+	suites, err := parseTags(*suiteFlag)
+	if err != nil {
+		return nil, err
+	}
+	skips, err := parseTags(*skipFlag)
+	if err != nil {
+		return nil, err
+	}
+	var runRegexp *regexp.Regexp
+	if run != "" {
+		if runRegexp, err = regexp.Compile(run); err != nil {
+			return nil, err
+		}
+	}
+
+	selected := []string{}
+	for test := range testTags {
+		if len(suites) > 0 && !hasTag(test, suites) {
+			continue
+		}
+		if hasTag(test, skips) {
+			continue
+		}
+		if runRegexp != nil && !runRegexp.MatchString(test) {
+			continue
+		}
+		selected = append(selected, test)
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
+
+// selectTests returns the -test.run pattern for the tests selected by -suite
+// and -skip, out of the ones run already matches, or an empty string if there
+// is no selection to make
+func selectTests(run string) (string, error) {
+	if *suiteFlag == "" && *skipFlag == "" {
+		return "", nil
+	}
+	selected, err := selectedTests(run)
+	if err != nil {
+		return "", err
+	}
+	if len(selected) == 0 {
+		return "", fmt.Errorf("no test has tags %q without %q", *suiteFlag, *skipFlag)
+	}
+	return "^(" + strings.Join(selected, "|") + ")$", nil
+}
+
+// listTests prints the selected tests, one per line with their comma
+// separated tags after a tab, for tools splitting a run up
+func listTests(run string) error {
+	selected, err := selectedTests(run)
+	if err != nil {
+		return err
+	}
+	for _, test := range selected {
+		fmt.Printf("%s\t%s\n", test, strings.Join(testTags[test], ","))
+	}
+	return nil
+}
+
+// retryable returns the tests tagged flaky
+func retryable(tests []string) []string {
+	flaky := []string{}
+	for _, test := range tests {
+		if hasTag(test, map[string]bool{TagFlaky: true}) {
+			flaky = append(flaky, test)
+		}
+	}
+	return flaky
+}
@@ -0,0 +1,141 @@
+package dockere2e
+
+import (
+	// basic imports
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// containerEnv returns the value of the variable in the container's
+// environment, and whether it was set
+func containerEnv(env []string, key string) (string, bool) {
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if parts[0] == key && len(parts) == 2 {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+// TestServiceTemplating creates a service with placeholders in its
+// environment, hostname and volume source, and checks each task's container
+// got them rendered for its own service, node and slot
+func TestServiceTemplating(t *testing.T) {
+	t.Parallel()
+	name := "TestServiceTemplating"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	info, err := cli.Info(testContext)
+	require.NoError(t, err)
+
+	linux, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	nodes := map[string]swarm.Node{}
+	for _, node := range linux {
+		nodes[node.ID] = node
+	}
+
+	replicas := 3
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		Constraint("node.platform.os == linux").
+		Env(
+			"E2E_SERVICE={{.Service.Name}}",
+			"E2E_SERVICE_ID={{.Service.ID}}",
+			"E2E_SLOT={{.Task.Slot}}",
+			"E2E_NODE={{.Node.ID}}",
+			"E2E_TASK={{.Task.Name}}",
+		).
+		Mount(mount.Mount{Type: mount.TypeVolume, Source: "{{.Service.Name}}-{{.Task.Slot}}", Target: "/data"}).
+		Build()
+	// the service name can take up the whole 63 characters a hostname has
+	spec.TaskTemplate.ContainerSpec.Hostname = "e2e-{{.Task.Slot}}-{{.Node.ID}}"
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	hostnames := map[string]bool{}
+	for _, task := range tasks {
+		hostname := fmt.Sprintf("e2e-%d-%s", task.Slot, task.NodeID)
+		hostnames[hostname] = true
+
+		node := nodes[task.NodeID]
+		nodeCli := cli
+		if task.NodeID != info.Swarm.NodeID {
+			nodeCli, err = GetNodeClient(node)
+			if err != nil {
+				// the hostnames are still checked through the routing mesh
+				t.Logf("Skipping the task on %s: %s", node.Description.Hostname, err)
+				continue
+			}
+		}
+		container, err := nodeCli.ContainerInspect(testContext, task.Status.ContainerStatus.ContainerID)
+		require.NoError(t, err, "inspecting the container of task %s", task.ID)
+
+		expected := map[string]string{
+			"E2E_SERVICE":    spec.Name,
+			"E2E_SERVICE_ID": service.ID,
+			"E2E_SLOT":       fmt.Sprint(task.Slot),
+			"E2E_NODE":       task.NodeID,
+			"E2E_TASK":       fmt.Sprintf("%s.%d.%s", spec.Name, task.Slot, task.ID),
+		}
+		for key, value := range expected {
+			actual, ok := containerEnv(container.Config.Env, key)
+			require.True(t, ok, "%s missing from task %s", key, task.ID)
+			require.Equal(t, value, actual, "wrong %s in task %s", key, task.ID)
+		}
+		require.Equal(t, hostname, container.Config.Hostname, "wrong hostname in task %s", task.ID)
+
+		volume := fmt.Sprintf("%s-%d", spec.Name, task.Slot)
+		found := false
+		for _, m := range container.Mounts {
+			if m.Destination == "/data" {
+				require.Equal(t, volume, m.Name, "wrong volume in task %s", task.ID)
+				found = true
+			}
+		}
+		require.True(t, found, "no volume mounted in task %s", task.ID)
+	}
+
+	// the test server reports the hostname it sees from inside the task
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+	seen := map[string]bool{}
+	err = WaitForConverge(ctx, 100*time.Millisecond, func() error {
+		hostname, err := getHostname(ctx, endpoint, port)
+		if err != nil {
+			return err
+		}
+		if !hostnames[hostname] {
+			return fmt.Errorf("unexpected hostname %q", hostname)
+		}
+		seen[hostname] = true
+		if len(seen) < replicas {
+			return fmt.Errorf("only %d of %d tasks answered", len(seen), replicas)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,96 @@
+package dockere2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The timeouts in the tests are sized for a cluster of real machines. Slower
+// environments, like nested virtualization on CI, can scale all of them with
+// E2E_TIMEOUT_MULTIPLIER, and the ones of particular suites with
+// E2E_TIMEOUT_MULTIPLIER_<TAG>, e.g. E2E_TIMEOUT_MULTIPLIER_NETWORK=3. A test
+// with several tags that have their own multiplier gets the largest of them.
+//
+// Tests start from NewTestContext rather than context.Background, and derive
+// every other context from it with WithTimeout, so that the multiplier of the
+// test follows its context into the helpers
+const TimeoutMultiplierEnv = "E2E_TIMEOUT_MULTIPLIER"
+
+// multiplierKey is the context key of the test's multiplier
+type multiplierKey struct{}
+
+// parseMultiplier reads the multiplier from the variable, 0 if it's unset
+func parseMultiplier(env string) (float64, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseFloat(value, 64)
+	if err != nil || m <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number, not %q", env, value)
+	}
+	return m, nil
+}
+
+// checkTimeoutMultipliers makes sure all the multipliers that are set are
+// valid, for TestMain to fail fast rather than have them silently ignored
+func checkTimeoutMultipliers() error {
+	envs := []string{TimeoutMultiplierEnv}
+	for tag := range knownTags {
+		envs = append(envs, TimeoutMultiplierEnv+"_"+strings.ToUpper(tag))
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		if _, err := parseMultiplier(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeoutMultiplier returns what the named test's timeouts are scaled by
+func timeoutMultiplier(test string) float64 {
+	multiplier := 0.0
+	for _, tag := range testTags[test] {
+		if m, _ := parseMultiplier(TimeoutMultiplierEnv + "_" + strings.ToUpper(tag)); m > multiplier {
+			multiplier = m
+		}
+	}
+	if multiplier == 0 {
+		multiplier, _ = parseMultiplier(TimeoutMultiplierEnv)
+	}
+	if multiplier == 0 {
+		return 1
+	}
+	return multiplier
+}
+
+// Scale returns the duration scaled by the multiplier of the test the context
+// belongs to, or the global multiplier outside of a test, for waits that
+// aren't bounded by a context
+func Scale(ctx context.Context, d time.Duration) time.Duration {
+	multiplier, ok := ctx.Value(multiplierKey{}).(float64)
+	if !ok {
+		multiplier = timeoutMultiplier("")
+	}
+	return time.Duration(float64(d) * multiplier)
+}
+
+// NewTestContext returns the context of the named test, which times out after
+// the scaled duration. The events logged with it are tagged with the test
+func NewTestContext(test string, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), multiplierKey{}, timeoutMultiplier(test))
+	ctx = context.WithValue(ctx, testNameKey{}, test)
+	Logger(ctx).WithField("timeout", Scale(ctx, d)).Info("test started")
+	return WithTimeout(ctx, d)
+}
+
+// WithTimeout is context.WithTimeout, with the duration scaled like Scale does
+func WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, Scale(parent, d))
+}
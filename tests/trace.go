@@ -0,0 +1,147 @@
+package dockere2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// TraceURLEnv is the Zipkin-compatible endpoint of a Jaeger collector to
+	// send a span of every test to once the run is done, e.g.
+	// http://jaeger:9411/api/v2/spans
+	TraceURLEnv = "E2E_TRACE_URL"
+	// TraceParentEnv puts the spans of the run under a span of another trace,
+	// given as <trace ID>-<span ID>. testkit sets it to the environment's
+	// trace, for the tests to show up after its creation
+	TraceParentEnv = "E2E_TRACE_PARENT"
+)
+
+// traceParent matches the value of TraceParentEnv
+var traceParent = regexp.MustCompile(`^([0-9a-f]{16}|[0-9a-f]{32})-([0-9a-f]{16})$`)
+
+// span is a span in the Zipkin v2 JSON format
+type span struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint map[string]string `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// checkTracing makes sure the tracing settings are valid, for TestMain to
+// fail fast rather than after the whole run
+func checkTracing() error {
+	value := os.Getenv(TraceURLEnv)
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL, not %q", TraceURLEnv, value)
+	}
+	if parent := os.Getenv(TraceParentEnv); parent != "" && !traceParent.MatchString(parent) {
+		return fmt.Errorf("%s must be <trace ID>-<span ID> in hex, not %q", TraceParentEnv, parent)
+	}
+	return nil
+}
+
+func newSpanID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// microseconds converts a duration in seconds to what the spans expect
+func microseconds(seconds float64) int64 {
+	return int64(seconds * 1e6)
+}
+
+// sendTraces sends a span of the run, with a span of every test and subtest
+// under it, if there's a collector to send them to. go test only tells how
+// long the tests took, and prints the results of the subtests along with
+// their parent's once it's done, so the tests start when their result was
+// read minus their duration and the subtests one after the other from the
+// start of their parent
+func sendTraces(ctx context.Context, summary runSummary) error {
+	collector := os.Getenv(TraceURLEnv)
+	if collector == "" {
+		return nil
+	}
+	run := span{
+		TraceID:       newSpanID(16),
+		ID:            newSpanID(8),
+		Name:          "e2e run",
+		Timestamp:     summary.Start.UnixNano() / int64(time.Microsecond),
+		Duration:      microseconds(summary.Duration),
+		LocalEndpoint: map[string]string{"serviceName": "e2e"},
+		Tags: map[string]string{
+			"uuid":    summary.UUID,
+			"passed":  fmt.Sprint(summary.Passed),
+			"failed":  fmt.Sprint(summary.Failed),
+			"skipped": fmt.Sprint(summary.Skipped),
+			"flaky":   fmt.Sprint(summary.Flaky),
+		},
+	}
+	if m := traceParent.FindStringSubmatch(os.Getenv(TraceParentEnv)); m != nil {
+		run.TraceID, run.ParentID = m[1], m[2]
+	}
+
+	spans := []span{run}
+	// the span ID of every test, and where the next of its subtests starts,
+	// by name. A subtest's result comes after its parent's
+	ids := map[string]string{}
+	next := map[string]int64{}
+	for _, test := range summary.Tests {
+		s := span{
+			TraceID:       run.TraceID,
+			ID:            newSpanID(8),
+			ParentID:      run.ID,
+			Name:          test.Name,
+			Timestamp:     test.end.UnixNano()/int64(time.Microsecond) - microseconds(test.Duration),
+			Duration:      microseconds(test.Duration),
+			LocalEndpoint: run.LocalEndpoint,
+			Tags: map[string]string{
+				"status":   test.Status,
+				"attempts": fmt.Sprint(test.Attempts),
+			},
+		}
+		if i := strings.LastIndex(test.Name, "/"); i >= 0 {
+			parent := test.Name[:i]
+			if id, ok := ids[parent]; ok {
+				s.ParentID = id
+				s.Timestamp = next[parent]
+				next[parent] += s.Duration
+			}
+		}
+		if test.Status == "fail" {
+			s.Tags["error"] = failureMessage(test.Output)
+		}
+		ids[test.Name] = s.ID
+		next[test.Name] = s.Timestamp
+		spans = append(spans, s)
+	}
+
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, collector, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doUpload(ctx, req)
+}
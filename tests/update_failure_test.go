@@ -0,0 +1,186 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// crashCommand makes tasks exit with an error straight away, standing in for a
+// broken image
+var crashCommand = []string{"sh", "-c", "exit 1"}
+
+// startFailingUpdate creates a healthy service that updates one task at a
+// time with the given failure action, then updates it to crash
+func startFailingUpdate(t *testing.T, ctx context.Context, cli *client.Client, name, action string, replicas int) string {
+	spec := NewServiceSpec(ctx, cli, name).
+		Replicas(uint64(replicas)).
+		UpdateConfig(swarm.UpdateConfig{
+			Parallelism:   1,
+			Delay:         time.Second,
+			FailureAction: action,
+			Monitor:       10 * time.Second,
+		}).
+		Build()
+	service, err := CreateService(ctx, cli, spec)
+	require.NoError(t, err, "Error creating service %s", name)
+
+	scaleCtx, cancel := WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(scaleCtx, time.Second, scaleCheck(scaleCtx, replicas))
+	require.NoError(t, err)
+
+	full, _, err := cli.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ContainerSpec.Command = crashCommand
+	_, err = cli.ServiceUpdate(ctx, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+	return service.ID
+}
+
+// updateStateCheck returns a check that passes once the service's update
+// reaches the given state
+func updateStateCheck(ctx context.Context, cli *client.Client, serviceID string, state swarm.UpdateState) func() error {
+	return func() error {
+		service, _, err := cli.ServiceInspectWithRaw(ctx, serviceID, types.ServiceInspectOptions{})
+		if err != nil {
+			return err
+		}
+		if service.UpdateStatus == nil {
+			return fmt.Errorf("service has no update status")
+		}
+		if service.UpdateStatus.State != state {
+			return fmt.Errorf("update is %s, expected %s: %s", service.UpdateStatus.State, state, service.UpdateStatus.Message)
+		}
+		return nil
+	}
+}
+
+// countRunningByCommand counts the service's running tasks that are on the
+// crashing spec and those that are not
+func countRunningByCommand(ctx context.Context, cli *client.Client, serviceID string) (int, int, error) {
+	tasks, err := GetServiceTasks(ctx, cli, serviceID)
+	if err != nil {
+		return 0, 0, err
+	}
+	crashing, healthy := 0, 0
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		if len(task.Spec.ContainerSpec.Command) > 0 && task.Spec.ContainerSpec.Command[0] == crashCommand[0] {
+			crashing++
+		} else {
+			healthy++
+		}
+	}
+	return crashing, healthy, nil
+}
+
+// TestUpdateFailurePause checks that a failing update stops after the first
+// batch, leaving the remaining tasks on the old spec
+func TestUpdateFailurePause(t *testing.T) {
+	t.Parallel()
+	name := "TestUpdateFailurePause"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 3
+	serviceID := startFailingUpdate(t, testContext, cli, name, swarm.UpdateFailureActionPause, replicas)
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, updateStateCheck(ctx, cli, serviceID, swarm.UpdateStatePaused))
+	require.NoError(t, err)
+
+	// only the first task was touched before the update paused
+	_, healthy, err := countRunningByCommand(testContext, cli, serviceID)
+	require.NoError(t, err)
+	require.Equal(t, replicas-1, healthy, "tasks outside the first batch should still be on the old spec")
+
+	service, _, err := cli.ServiceInspectWithRaw(testContext, serviceID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	require.Equal(t, crashCommand, service.Spec.TaskTemplate.ContainerSpec.Command, "a paused update keeps the new spec")
+}
+
+// TestUpdateFailureContinue checks that a failing update carries on through
+// every task regardless
+func TestUpdateFailureContinue(t *testing.T) {
+	t.Parallel()
+	name := "TestUpdateFailureContinue"
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 3
+	serviceID := startFailingUpdate(t, testContext, cli, name, swarm.UpdateFailureActionContinue, replicas)
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, updateStateCheck(ctx, cli, serviceID, swarm.UpdateStateCompleted))
+	require.NoError(t, err)
+
+	// every task was replaced, so none of the healthy ones are left
+	err = WaitForConverge(ctx, time.Second, func() error {
+		_, healthy, err := countRunningByCommand(ctx, cli, serviceID)
+		if err != nil {
+			return err
+		}
+		if healthy != 0 {
+			return fmt.Errorf("%d tasks still on the old spec", healthy)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// TestUpdateFailureRollback checks that a failing update is reverted to the
+// previous spec, with all tasks healthy again
+func TestUpdateFailureRollback(t *testing.T) {
+	t.Parallel()
+	name := "TestUpdateFailureRollback"
+	RequiresAPIVersion(t, "1.28")
+	testContext, cancel := NewTestContext(name, 3*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 3
+	serviceID := startFailingUpdate(t, testContext, cli, name, swarm.UpdateFailureActionRollback, replicas)
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, updateStateCheck(ctx, cli, serviceID, swarm.UpdateStateRollbackCompleted))
+	require.NoError(t, err)
+
+	service, _, err := cli.ServiceInspectWithRaw(testContext, serviceID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"util", "test-server"}, service.Spec.TaskTemplate.ContainerSpec.Command, "spec should be rolled back")
+
+	scaleCheck := ScaleCheck(serviceID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+	crashing, _, err := countRunningByCommand(testContext, cli, serviceID)
+	require.NoError(t, err)
+	require.Zero(t, crashing, "no tasks should be left on the crashing spec")
+}
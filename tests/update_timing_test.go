@@ -0,0 +1,130 @@
+package dockere2e
+
+import (
+	// basic imports
+	"sort"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// updateMarker is set in the env of the updated tasks, to tell them apart
+// from the ones they replace
+const updateMarker = "E2E_UPDATED=1"
+
+// updateSlack is how much longer than the configured delay a batch may take
+// to start, covering the time the previous batch takes to come up
+const updateSlack = 15 * time.Second
+
+// byCreation sorts tasks by when the orchestrator created them
+type byCreation []swarm.Task
+
+func (b byCreation) Len() int           { return len(b) }
+func (b byCreation) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCreation) Less(i, j int) bool { return b[i].CreatedAt.Before(b[j].CreatedAt) }
+
+// updateBatches groups the tasks created by an update into the batches the
+// updater started them in. Tasks of a batch are created together, the next
+// batch only after the delay, so anything within half the delay of the
+// start of a batch belongs to it. Only creation times are used, which all
+// come from the leader's clock
+func updateBatches(tasks []swarm.Task, delay time.Duration) [][]swarm.Task {
+	sorted := append([]swarm.Task{}, tasks...)
+	sort.Sort(byCreation(sorted))
+	batches := [][]swarm.Task{}
+	for _, task := range sorted {
+		last := len(batches) - 1
+		if last >= 0 && task.CreatedAt.Sub(batches[last][0].CreatedAt) < delay/2 {
+			batches[last] = append(batches[last], task)
+			continue
+		}
+		batches = append(batches, []swarm.Task{task})
+	}
+	return batches
+}
+
+// checkUpdateTiming rolls out an update to a service and checks from the
+// creation times of the new tasks that they were started parallelism at a
+// time, with delay between the batches
+func checkUpdateTiming(t *testing.T, name string, replicas, parallelism int, delay time.Duration) {
+	testContext, cancel := NewTestContext(name, 5*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	spec := NewServiceSpec(testContext, cli, name).
+		Replicas(uint64(replicas)).
+		UpdateConfig(swarm.UpdateConfig{
+			Parallelism: uint64(parallelism),
+			Delay:       delay,
+			Monitor:     time.Second,
+		}).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	ctx, cancel := WithTimeout(testContext, 60*time.Second)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.ContainerSpec.Env = append(full.Spec.TaskTemplate.ContainerSpec.Env, updateMarker)
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+
+	batches := (replicas + parallelism - 1) / parallelism
+	ctx, cancel = WithTimeout(testContext, time.Duration(batches)*(delay+updateSlack)+time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, updateStateCheck(ctx, cli, service.ID, swarm.UpdateStateCompleted))
+	require.NoError(t, err)
+
+	f := GetTestFilter()
+	f.Add("service", service.ID)
+	tasks, err := cli.TaskList(testContext, types.TaskListOptions{Filters: f})
+	require.NoError(t, err)
+	updated := []swarm.Task{}
+	for _, task := range tasks {
+		for _, env := range task.Spec.ContainerSpec.Env {
+			if env == updateMarker {
+				updated = append(updated, task)
+			}
+		}
+	}
+	require.Len(t, updated, replicas, "every slot should have been updated once")
+
+	started := updateBatches(updated, delay)
+	for i, batch := range started {
+		t.Logf("Batch %d: %d tasks at %s", i, len(batch), batch[0].CreatedAt)
+		require.True(t, len(batch) <= parallelism, "batch %d started %d tasks, parallelism is %d", i, len(batch), parallelism)
+		if i == 0 {
+			continue
+		}
+		gap := batch[0].CreatedAt.Sub(started[i-1][0].CreatedAt)
+		require.True(t, gap >= delay, "batch %d started %s after the previous one, delay is %s", i, gap, delay)
+		require.True(t, gap <= delay+updateSlack, "batch %d started %s after the previous one, delay is %s", i, gap, delay)
+	}
+	require.Len(t, started, batches, "%d replicas should update in batches of %d", replicas, parallelism)
+}
+
+// TestUpdateTimingSerial updates one task at a time
+func TestUpdateTimingSerial(t *testing.T) {
+	t.Parallel()
+	checkUpdateTiming(t, "TestUpdateTimingSerial", 3, 1, 5*time.Second)
+}
+
+// TestUpdateTimingBatches updates a few tasks at a time, with a longer delay
+func TestUpdateTimingBatches(t *testing.T) {
+	t.Parallel()
+	checkUpdateTiming(t, "TestUpdateTimingBatches", 6, 2, 10*time.Second)
+}
@@ -0,0 +1,322 @@
+package dockere2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CI workers are often thrown away along with their disks as soon as the run
+// is over, and the results with them. When UploadURLEnv is set as well as
+// ReportDirEnv, TestMain uploads the results once they're written, under
+// <url>/<run UUID>/:
+//
+//	results.json, junit.xml   as they are, for dashboards to read
+//	artifacts.tar.gz          everything else in the report directory: the
+//	                          artifacts of the failed tests, the stats and
+//	                          loop.json
+//
+// The URL picks where they go:
+//
+//	s3://bucket/prefix   with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+//	                     optionally AWS_SESSION_TOKEN and AWS_REGION
+//	gs://bucket/prefix   with an OAuth token in GOOGLE_OAUTH_ACCESS_TOKEN,
+//	                     e.g. from gcloud auth print-access-token
+//	https://host/prefix  a PUT of every file, with UploadTokenEnv as a bearer
+//	                     token if it's set
+const (
+	UploadURLEnv   = "E2E_UPLOAD_URL"
+	UploadTokenEnv = "E2E_UPLOAD_TOKEN"
+)
+
+// uploadFiles are uploaded on their own rather than in the bundle
+var uploadFiles = []string{"results.json", "junit.xml"}
+
+// uploader puts a file at a key under the destination
+type uploader interface {
+	put(ctx context.Context, key string, data []byte, contentType string) error
+	url(key string) string
+}
+
+// newUploader returns the uploader for the destination, or an error if it's
+// not one the harness can upload to or its credentials are missing
+func newUploader(destination string) (uploader, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a URL: %s", UploadURLEnv, err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		s := &s3Uploader{
+			bucket:       u.Host,
+			prefix:       prefix,
+			region:       os.Getenv("AWS_REGION"),
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if s.accessKey == "" || s.secretKey == "" {
+			return nil, fmt.Errorf("uploading to S3 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return s, nil
+	case "gs":
+		token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+		if token == "" {
+			return nil, fmt.Errorf("uploading to GCS needs GOOGLE_OAUTH_ACCESS_TOKEN")
+		}
+		base := "https://storage.googleapis.com/" + u.Host
+		if prefix != "" {
+			base += "/" + prefix
+		}
+		return &httpUploader{base: base, token: token}, nil
+	case "http", "https":
+		return &httpUploader{base: strings.TrimSuffix(destination, "/"), token: os.Getenv(UploadTokenEnv)}, nil
+	}
+	return nil, fmt.Errorf("%s must be an s3://, gs:// or http(s):// URL, not %q", UploadURLEnv, destination)
+}
+
+// checkUpload makes sure the results can be uploaded where asked, for TestMain
+// to fail fast rather than find out after the run
+func checkUpload() error {
+	destination := os.Getenv(UploadURLEnv)
+	if destination == "" {
+		return nil
+	}
+	if os.Getenv(ReportDirEnv) == "" {
+		return fmt.Errorf("%s needs %s to write the results to first", UploadURLEnv, ReportDirEnv)
+	}
+	_, err := newUploader(destination)
+	return err
+}
+
+// uploadResults uploads the results in the report directory, if there's
+// somewhere to upload them to
+func uploadResults(ctx context.Context, dir string) error {
+	destination := os.Getenv(UploadURLEnv)
+	if destination == "" || dir == "" {
+		return nil
+	}
+	up, err := newUploader(destination)
+	if err != nil {
+		return err
+	}
+	for _, file := range uploadFiles {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		contentType := "application/json"
+		if filepath.Ext(file) == ".xml" {
+			contentType = "application/xml"
+		}
+		if err := up.put(ctx, UUID()+"/"+file, data, contentType); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	bundle, err := bundleReport(dir)
+	if err != nil {
+		return err
+	}
+	if err := up.put(ctx, UUID()+"/artifacts.tar.gz", bundle, "application/gzip"); err != nil {
+		return fmt.Errorf("artifacts.tar.gz: %s", err)
+	}
+	fmt.Printf("Uploaded the results to %s\n", up.url(UUID()+"/"))
+	return nil
+}
+
+// bundleReport tars and gzips everything in the report directory but the
+// files uploaded on their own
+func bundleReport(dir string) ([]byte, error) {
+	skip := map[string]bool{}
+	for _, file := range uploadFiles {
+		skip[file] = true
+	}
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." || skip[rel] {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// httpUploader PUTs every file under a base URL, which is also how GCS takes
+// objects with an OAuth token
+type httpUploader struct {
+	base  string
+	token string
+}
+
+func (h *httpUploader) url(key string) string {
+	return h.base + "/" + key
+}
+
+func (h *httpUploader) put(ctx context.Context, key string, data []byte, contentType string) error {
+	req, err := http.NewRequest("PUT", h.url(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	return doUpload(ctx, req)
+}
+
+// s3Uploader puts objects in an S3 bucket, signing the requests with AWS
+// signature version 4
+type s3Uploader struct {
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func (s *s3Uploader) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *s3Uploader) url(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(key))
+}
+
+func (s *s3Uploader) put(ctx context.Context, key string, data []byte, contentType string) error {
+	host := fmt.Sprintf("%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	path := "/" + s3Escape(s.key(key))
+	req, err := http.NewRequest("PUT", "https://"+host+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	payload := sha256.Sum256(data)
+	headers := map[string]string{
+		"content-type":         contentType,
+		"host":                 host,
+		"x-amz-content-sha256": hex.EncodeToString(payload[:]),
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if s.sessionToken != "" {
+		headers["x-amz-security-token"] = s.sessionToken
+	}
+	// the headers are signed in order
+	names := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if s.sessionToken != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	canonical := "PUT\n" + path + "\n\n"
+	for _, name := range names {
+		canonical += name + ":" + headers[name] + "\n"
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	signed := strings.Join(names, ";")
+	canonical += "\n" + signed + "\n" + headers["x-amz-content-sha256"]
+
+	day := now.Format("20060102")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + headers["x-amz-date"] + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signed, signature))
+	return doUpload(ctx, req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes an object key the way signature version 4 expects, every
+// byte but the unreserved ones and the slashes
+func s3Escape(key string) string {
+	escaped := ""
+	for _, b := range []byte(key) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			escaped += string(b)
+		default:
+			escaped += fmt.Sprintf("%%%02X", b)
+		}
+	}
+	return escaped
+}
+
+// doUpload sends the request, failing on anything but a success
+func doUpload(ctx context.Context, req *http.Request) error {
+	req = req.WithContext(ctx)
+	resp, err := (&http.Client{Timeout: 5 * time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -9,6 +10,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,6 +31,22 @@ func TestServiceDiscovery(c *cli.Context) error {
 		}
 		json.NewEncoder(w).Encode(ips)
 	})
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	http.HandleFunc("/dns", func(w http.ResponseWriter, r *http.Request) {
+		// GET /dns?type=<A|AAAA|SRV>&name=<name> resolves the name with the
+		// container's resolver, reporting a name that doesn't exist as an
+		// answer rather than an error
+		answer, err := lookupDNS(r.URL.Query().Get("type"), r.URL.Query().Get("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		answer.Hostname = hostname
+		json.NewEncoder(w).Encode(answer)
+	})
 
 	server := &http.Server{
 		Addr: c.String("listen-address"),
@@ -37,6 +56,44 @@ func TestServiceDiscovery(c *cli.Context) error {
 	return server.ListenAndServe()
 }
 
+// DNSAnswer is the response of the /dns endpoint
+type DNSAnswer struct {
+	Hostname string     `json:"hostname"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	NotFound bool       `json:"not_found"`
+	IPs      []net.IP   `json:"ips"`
+	SRV      []*net.SRV `json:"srv"`
+}
+
+func lookupDNS(qType, name string) (*DNSAnswer, error) {
+	if name == "" {
+		return nil, fmt.Errorf("no name given")
+	}
+	answer := &DNSAnswer{Name: name, Type: qType, IPs: []net.IP{}, SRV: []*net.SRV{}}
+	var err error
+	switch qType {
+	case "A", "AAAA":
+		var ips []net.IP
+		ips, err = net.LookupIP(name)
+		for _, ip := range ips {
+			if (ip.To4() != nil) == (qType == "A") {
+				answer.IPs = append(answer.IPs, ip)
+			}
+		}
+	case "SRV":
+		// without a service and protocol, the name is looked up as is
+		_, answer.SRV, err = net.LookupSRV("", "", name)
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", qType)
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Err == "no such host" {
+		answer.NotFound = true
+		return answer, nil
+	}
+	return answer, err
+}
+
 // TestServer is invoked for the `test-server` command
 func TestServer(c *cli.Context) error {
 	hostname, err := os.Hostname()
@@ -51,6 +108,17 @@ func TestServer(c *cli.Context) error {
 		time.Sleep(time.Duration(msSleep) * time.Millisecond)
 		fmt.Fprintf(w, "OK")
 	})
+	for _, addr := range c.StringSlice("also-listen") {
+		go func(addr string) {
+			log.Infof("Also listening on %s", addr)
+			log.Fatal(http.ListenAndServe(addr, nil))
+		}(addr)
+	}
+	if addr := c.String("udp-listen-address"); addr != "" {
+		go func() {
+			log.Fatal(udpEcho(addr, hostname))
+		}()
+	}
 	http.HandleFunc("/fanout", func(w http.ResponseWriter, r *http.Request) {
 		// POST to /fanout with a new-line delimited list of URLs to request
 		body, err := ioutil.ReadAll(r.Body)
@@ -74,6 +142,52 @@ func TestServer(c *cli.Context) error {
 			}
 		}
 	})
+	http.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		// GET /file?path=<path> describes a file inside the container, so tests
+		// can check how secrets and configs were mounted. PUT writes the body
+		// to the file, for checking where the data of volumes ends up
+		w.Header().Set("Host", hostname)
+		if r.Method == http.MethodPut {
+			if err := writeFile(r.URL.Query().Get("path"), r); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "OK")
+			return
+		}
+		info, err := describeFile(r.URL.Query().Get("path"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		info.Hostname = hostname
+		json.NewEncoder(w).Encode(info)
+	})
+	http.HandleFunc("/payload", func(w http.ResponseWriter, r *http.Request) {
+		// GET /payload?size=<bytes> returns that many bytes, for pushing
+		// large responses through the network
+		size, err := strconv.Atoi(r.URL.Query().Get("size"))
+		if err != nil || size < 0 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Host", hostname)
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(bytes.Repeat([]byte("e"), size))
+	})
+	healthy, err := healthSchedule(c.Duration("health-flap"), c.String("unhealthy-until"))
+	if err != nil {
+		return err
+	}
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Host", hostname)
+		if !healthy() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "OK")
+	})
+	go handleSignals(c.Duration("stop-delay"))
 	server := &http.Server{
 		Addr: c.String("listen-address"),
 	}
@@ -104,6 +218,132 @@ func TestServer(c *cli.Context) error {
 
 }
 
+// FileInfo is the response of the test server's /file endpoint
+type FileInfo struct {
+	Hostname string      `json:"hostname"`
+	Mode     os.FileMode `json:"mode"`
+	UID      int         `json:"uid"`
+	GID      int         `json:"gid"`
+	Content  string      `json:"content"`
+}
+
+func writeFile(path string, r *http.Request) error {
+	if path == "" {
+		return fmt.Errorf("no path given")
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func describeFile(path string) (*FileInfo, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no path given")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	uid, gid := fileOwner(fi)
+	return &FileInfo{
+		Mode:    fi.Mode().Perm(),
+		UID:     uid,
+		GID:     gid,
+		Content: string(content),
+	}, nil
+}
+
+// handleSignals logs every stop signal the server receives, so tests can check
+// which one the engine sent and when, and exits delay after the first one. A
+// delay longer than the stop grace period gets the server killed instead
+func handleSignals(delay time.Duration) {
+	signals := make(chan os.Signal, 1)
+	for sig := range stopSignals {
+		signal.Notify(signals, sig)
+	}
+	var exit <-chan time.Time
+	for {
+		select {
+		case sig := <-signals:
+			log.WithField("signal", stopSignals[sig]).Info("Received signal")
+			if exit == nil {
+				exit = time.After(delay)
+			}
+		case <-exit:
+			log.Info("Exiting")
+			os.Exit(0)
+		}
+	}
+}
+
+// healthSchedule returns whether the server should report itself healthy. Up
+// to the until time, the health flips every flap period, starting out healthy,
+// and after it the server stays healthy. Without a flap period the server is
+// always healthy
+func healthSchedule(flap time.Duration, until string) (func() bool, error) {
+	if flap == 0 {
+		return func() bool { return true }, nil
+	}
+	var steady time.Time
+	if until != "" {
+		var err error
+		if steady, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	return func() bool {
+		now := time.Now()
+		if !steady.IsZero() && now.After(steady) {
+			return true
+		}
+		return (now.Sub(start)/flap)%2 == 0
+	}, nil
+}
+
+// HealthCheck is invoked for the `health-check` command, and fails unless the
+// url answers 200, for use as a container healthcheck
+func HealthCheck(c *cli.Context) error {
+	client := &http.Client{Timeout: c.Duration("timeout")}
+	resp, err := client.Get(c.String("url"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", c.String("url"), resp.StatusCode)
+	}
+	return nil
+}
+
+// udpEcho sends every datagram received on addr back to its sender, prefixed
+// with the hostname so tests can tell which task answered
+func udpEcho(addr, hostname string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Infof("Echoing UDP on %s", addr)
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		reply := append([]byte(hostname+" "), buf[:n]...)
+		if _, err := conn.WriteTo(reply, from); err != nil {
+			log.Warnf("Failed to echo to %s: %s", from, err)
+		}
+	}
+}
+
 func TestTLSServer(c *cli.Context) error {
 	if c.String("cert") == "" || c.String("key") == "" {
 		log.Fatal("Unable to start ucp-proxy without TLS configuration")
@@ -124,7 +364,7 @@ func TestTLSServer(c *cli.Context) error {
 var cmdTestServiceDiscovery = cli.Command{
 	Name:        "test-service-discovery",
 	Usage:       "util test-service-discovery",
-	Description: "returns the JSON encoded list of net.IP addresses for the name in url query at /service-discovery:<publish-port>?v4=name",
+	Description: "returns the JSON encoded list of net.IP addresses for the name in url query at /service-discovery:<publish-port>?v4=name, and the A, AAAA or SRV records at /dns:<publish-port>?type=<type>&name=name",
 	Action:      TestServiceDiscovery,
 	Flags: []cli.Flag{
 		cli.StringFlag{
@@ -179,6 +419,45 @@ var cmdTestServer = cli.Command{
 			Usage: "Time to take in milliseconds before responding with OK",
 			Value: 0,
 		},
+		cli.StringSliceFlag{
+			Name:  "also-listen",
+			Usage: "Also serve HTTP on this address, can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "udp-listen-address",
+			Usage: "Also echo UDP datagrams on this address, prefixed with the hostname",
+		},
+		cli.DurationFlag{
+			Name:  "stop-delay",
+			Usage: "Time to keep running after the first stop signal, which is logged along with any later ones",
+		},
+		cli.DurationFlag{
+			Name:  "health-flap",
+			Usage: "Flip the health reported at /health every period, starting out healthy",
+		},
+		cli.StringFlag{
+			Name:  "unhealthy-until",
+			Usage: "RFC3339 time after which /health stops flapping and stays healthy",
+		},
+	},
+}
+
+// The `health-check` command exits non-zero unless a URL answers 200 OK
+var cmdHealthCheck = cli.Command{
+	Name:   "health-check",
+	Usage:  "Fails unless the URL returns 200 OK",
+	Action: HealthCheck,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "url",
+			Usage: "URL to check",
+			Value: "http://localhost:80/health",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Time to wait for the response",
+			Value: 5 * time.Second,
+		},
 	},
 }
 
@@ -215,6 +494,7 @@ func main() {
 		cmdTestServer,
 		cmdTestTLSServer,
 		cmdTestServiceDiscovery,
+		cmdHealthCheck,
 	}
 	log.SetFormatter(&log.JSONFormatter{})
 
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignals are the signals the test server reports, windows only delivers
+// the console ones
+var stopSignals = map[os.Signal]string{
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGINT:  "SIGINT",
+}
@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -29,6 +34,23 @@ func GetClient() (*client.Client, error) {
 	return cli, nil
 }
 
+// CreateService creates the service, logging it as a step of the test
+func CreateService(ctx context.Context, cli *client.Client, spec swarm.ServiceSpec) (types.ServiceCreateResponse, error) {
+	return CreateServiceWithOptions(ctx, cli, spec, types.ServiceCreateOptions{})
+}
+
+// CreateServiceWithOptions is CreateService with create options, e.g. the
+// registry credentials
+func CreateServiceWithOptions(ctx context.Context, cli *client.Client, spec swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	resp, err := cli.ServiceCreate(ctx, spec, options)
+	if err != nil {
+		Logger(ctx).WithField("service", spec.Name).WithError(err).Warn("service create failed")
+		return resp, err
+	}
+	Logger(ctx).WithField("service", spec.Name).WithField("id", resp.ID).Info("service created")
+	return resp, nil
+}
+
 // CleanTestServices removes all e2etesting services with the specified labels
 func CleanTestServices(ctx context.Context, cli *client.Client, labels ...string) error {
 	// create a new filter for our test label
@@ -50,6 +72,98 @@ func CleanTestServices(ctx context.Context, cli *client.Client, labels ...string
 	return nil
 }
 
+// CleanTestSecrets removes all e2etesting secrets with the specified labels.
+// Secrets still in use by a service can't be removed, so this returns the
+// last removal error to let callers wait for the tasks to go away.
+func CleanTestSecrets(ctx context.Context, cli *client.Client, labels ...string) error {
+	secrets, err := cli.SecretList(ctx, types.SecretListOptions{Filters: GetTestFilter(labels...)})
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, secret := range secrets {
+		if err := cli.SecretRemove(ctx, secret.ID); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// CleanTestConfigs removes all e2etesting configs with the specified labels,
+// returning the last removal error like CleanTestSecrets
+func CleanTestConfigs(ctx context.Context, cli *client.Client, labels ...string) error {
+	configs, err := cli.ConfigList(ctx, types.ConfigListOptions{Filters: GetTestFilter(labels...)})
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, config := range configs {
+		if err := cli.ConfigRemove(ctx, config.ID); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// CleanupAll removes everything the run with the ID created that has all the
+// labels: services, containers on the engine, networks, secrets and configs.
+// The networks, secrets and configs can only go once the tasks using them are
+// gone, so those are retried until they're all removed or ctx is done
+func CleanupAll(ctx context.Context, cli *client.Client, runID string, labels ...string) error {
+	f := filters.NewArgs()
+	f.Add("label", "uuid="+runID)
+	for _, l := range labels {
+		f.Add("label", l)
+	}
+
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{Filters: f})
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		cli.ServiceRemove(ctx, service.ID)
+	}
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: f})
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{Force: true})
+	}
+
+	return WaitForConvergeBackoff(ctx, DefaultBackoff, func() error {
+		var lastErr error
+		networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: f})
+		if err != nil {
+			return err
+		}
+		for _, nw := range networks {
+			if err := cli.NetworkRemove(ctx, nw.ID); err != nil {
+				lastErr = err
+			}
+		}
+		secrets, err := cli.SecretList(ctx, types.SecretListOptions{Filters: f})
+		if err != nil {
+			return err
+		}
+		for _, secret := range secrets {
+			if err := cli.SecretRemove(ctx, secret.ID); err != nil {
+				lastErr = err
+			}
+		}
+		configs, err := cli.ConfigList(ctx, types.ConfigListOptions{Filters: f})
+		if err != nil {
+			return err
+		}
+		for _, config := range configs {
+			if err := cli.ConfigRemove(ctx, config.ID); err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	})
+}
+
 // truncName truncates the name to 63 characters, or 62 if the last character is a dash.
 func truncName(name string) string {
 	// we don't need to truncate anything less than 63 characters
@@ -64,61 +178,213 @@ func getUniqueName(name string) string {
 	return truncName(name + UUID())
 }
 
-// CannedServiceSpec returns a ready-to-go service spec with name and replicas
-func CannedServiceSpec(cli *client.Client, name string, replicas uint64, command, nw []string, labels ...string) swarm.ServiceSpec {
-	// first create the canned spec
-	spec := swarm.ServiceSpec{
+// testLabels returns the labels that mark an object as belonging to the
+// named test
+func testLabels(name string, labels ...string) map[string]string {
+	l := map[string]string{
+		name:            "",
+		E2EServiceLabel: "true",
+		"uuid":          UUID(),
+	}
+	for _, label := range labels {
+		l[label] = ""
+	}
+	return l
+}
+
+// CannedSecretSpec returns a secret spec with a mangled name and the test
+// labels, so that it can be cleaned up with CleanTestSecrets
+func CannedSecretSpec(name string, data []byte, labels ...string) swarm.SecretSpec {
+	return swarm.SecretSpec{
 		Annotations: swarm.Annotations{
-			Name: truncName(name + UUID()),
-			Labels: map[string]string{
-				// the pre-mangled service name is a raw key-only label.
-				name:            "",
-				E2EServiceLabel: "true",
-				"uuid":          UUID(),
-			},
+			Name:   getUniqueName(name),
+			Labels: testLabels(name, labels...),
 		},
-		TaskTemplate: swarm.TaskSpec{
-			ContainerSpec: swarm.ContainerSpec{
-				Image: GetSelfImage(cli),
-			},
-		},
-		Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}},
-		EndpointSpec: &swarm.EndpointSpec{
-			Ports: []swarm.PortConfig{
-				{
-					Protocol:   "tcp",
-					TargetPort: 80,
-				},
-			},
+		Data: data,
+	}
+}
+
+// CannedConfigSpec returns a config spec with a mangled name and the test
+// labels, so that it can be cleaned up with CleanTestConfigs
+func CannedConfigSpec(name string, data []byte, labels ...string) swarm.ConfigSpec {
+	return swarm.ConfigSpec{
+		Annotations: swarm.Annotations{
+			Name:   getUniqueName(name),
+			Labels: testLabels(name, labels...),
 		},
+		Data: data,
+	}
+}
+
+// Backoff says how long WaitForConvergeBackoff waits between checks: Initial
+// at first, multiplied by Factor after every failed check up to Max, with up to
+// Jitter of it (a fraction, 0.1 for 10%) added or taken away at random so that
+// concurrent waits don't all hit the managers at the same time
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64
+}
+
+// DefaultBackoff suits checks of things that take a while, like tasks starting
+// on other nodes, without hammering the API
+var DefaultBackoff = Backoff{
+	Initial: 100 * time.Millisecond,
+	Max:     5 * time.Second,
+	Factor:  1.5,
+	Jitter:  0.2,
+}
+
+// next returns the interval after the current one
+func (b Backoff) next(current time.Duration) time.Duration {
+	if b.Factor > 1 {
+		current = time.Duration(float64(current) * b.Factor)
+	}
+	if b.Max > 0 && current > b.Max {
+		current = b.Max
 	}
+	return current
+}
 
-	if command != nil {
-		spec.TaskTemplate.ContainerSpec.Command = command
-	} else {
-		spec.TaskTemplate.ContainerSpec.Command =
-			[]string{"util", "test-server"}
+// jittered returns the interval with the jitter applied
+func (b Backoff) jittered(interval time.Duration) time.Duration {
+	if b.Jitter <= 0 {
+		return interval
 	}
-	if nw != nil {
-		networks := []swarm.NetworkAttachmentConfig{}
-		for _, n := range nw {
-			networks = append(networks,
-				swarm.NetworkAttachmentConfig{Target: n})
+	delta := time.Duration(b.Jitter * float64(interval) * (2*rand.Float64() - 1))
+	return interval + delta
+}
+
+// truncMillis drops the part of the duration below a millisecond, which is
+// only noise in messages
+func truncMillis(d time.Duration) time.Duration {
+	return d - d%time.Millisecond
+}
+
+// convergeErrorHistory is how many of the last check errors a ConvergeError
+// keeps
+const convergeErrorHistory = 5
+
+// ConvergeError is what WaitForConverge returns when the check never passed.
+// It keeps the last few distinct errors the check returned, so that a timeout
+// shows what state things were stuck in, and how they got there
+type ConvergeError struct {
+	Elapsed time.Duration
+	Checks  int
+	// Last holds the last distinct errors, oldest first, with how many times
+	// in a row each one was returned
+	Last   []error
+	Repeat []int
+	// EngineLogs holds what the engines logged during the wait on the nodes
+	// the tasks of the services the check was about were on, by hostname.
+	// It's only filled in when machine control is available
+	EngineLogs map[string]string
+	// StackDumps are the files the goroutine stacks of the same engines were
+	// saved to when the wait timed out, see ReportDirEnv
+	StackDumps []string
+
+	// services are the services the check was about, see ForService
+	services map[string]*client.Client
+}
+
+func (e *ConvergeError) Error() string {
+	if len(e.Last) == 0 {
+		return fmt.Sprintf("failed to converge: no check ran in %s", e.Elapsed)
+	}
+	lines := []string{}
+	for i, err := range e.Last {
+		line := err.Error()
+		if e.Repeat[i] > 1 {
+			line = fmt.Sprintf("%s (x%d)", line, e.Repeat[i])
 		}
-		spec.TaskTemplate.Networks = networks
+		lines = append(lines, line)
+	}
+	msg := fmt.Sprintf("failed to converge after %s and %d checks: %s", truncMillis(e.Elapsed), e.Checks, lines[len(lines)-1])
+	if len(lines) > 1 {
+		msg += "\nbefore that: " + strings.Join(lines[:len(lines)-1], "; ")
+	}
+	hosts := []string{}
+	for host := range e.EngineLogs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		msg += fmt.Sprintf("\nengine log of %s during the wait:\n%s", host, strings.TrimRight(e.EngineLogs[host], "\n"))
 	}
+	if len(e.StackDumps) > 0 {
+		msg += "\ngoroutine stacks of the engines saved to " + strings.Join(e.StackDumps, ", ")
+	}
+	return msg
+}
 
-	// then, add labels
-	for _, label := range labels {
-		// TODO(dperny): allow labels in form key=value?
-		spec.Annotations.Labels[label] = ""
+// Cause returns the last error the check returned, for errors.Cause
+func (e *ConvergeError) Cause() error {
+	if len(e.Last) == 0 {
+		return nil
 	}
+	return e.Last[len(e.Last)-1]
+}
 
-	return spec
+// record adds the error of a failed check
+func (e *ConvergeError) record(err error) {
+	e.Checks++
+	if se, ok := err.(*serviceError); ok {
+		if e.services == nil {
+			e.services = map[string]*client.Client{}
+		}
+		e.services[se.serviceID] = se.cli
+	}
+	// if the context times out during a call to the docker api, we get context
+	// deadline exceeded, which would mask the real error
+	if len(e.Last) > 0 && strings.Contains(err.Error(), "context deadline exceeded") {
+		return
+	}
+	if n := len(e.Last); n > 0 && e.Last[n-1].Error() == err.Error() {
+		e.Repeat[n-1]++
+		return
+	}
+	e.Last = append(e.Last, err)
+	e.Repeat = append(e.Repeat, 1)
+	if len(e.Last) > convergeErrorHistory {
+		e.Last = e.Last[1:]
+		e.Repeat = e.Repeat[1:]
+	}
+}
+
+// serviceError is the error of a check about a service, which lets a failed
+// wait find the nodes the service's tasks are on
+type serviceError struct {
+	serviceID string
+	cli       *client.Client
+	err       error
+}
+
+func (e *serviceError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the error of the check, for errors.Cause
+func (e *serviceError) Cause() error {
+	return e.err
+}
+
+// ForService marks test as a check about the service, so that when a wait on
+// it fails the error has the engine logs of the nodes the service's tasks are
+// on for the time of the wait, see ConvergeError. The checks of ScaleCheck
+// already are
+func ForService(serviceID string, cli *client.Client, test func() error) func() error {
+	return func() error {
+		if err := test(); err != nil {
+			return &serviceError{serviceID: serviceID, cli: cli, err: err}
+		}
+		return nil
+	}
 }
 
 // WaitForConverge does test every poll
-// returns nothing if test returns nothing, or test's error after context is done
+// returns nothing if test returns nothing, or a *ConvergeError with test's last
+// errors after context is done
 //
 // make sure that context is either canceled or given a timeout; if it isn't,
 // test will run until half life 3 is released.
@@ -126,50 +392,46 @@ func CannedServiceSpec(cli *client.Client, name string, replicas uint64, command
 // if an irrecoverable error is noticed during the test function, calling the
 // context's cancel func from inside the test can be used to abort the test
 // before the timeout
+//
+// the interval is fixed, for tests that watch for short lived states; use
+// WaitForConvergeBackoff to back off instead
 func WaitForConverge(ctx context.Context, poll time.Duration, test func() error) error {
-	// create a ticker and a timer
-	r := time.NewTicker(poll)
-	// don't forget to close this thing
-	// do we have to close this thing? idk
-	defer r.Stop()
+	return WaitForConvergeBackoff(ctx, Backoff{Initial: poll, Max: poll}, test)
+}
 
-	var err error
+// WaitForConvergeBackoff is WaitForConverge, waiting between the checks
+// according to backoff. The first check happens after the first interval
+func WaitForConvergeBackoff(ctx context.Context, backoff Backoff, test func() error) error {
+	start := time.Now()
+	log := Logger(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		log = log.WithField("timeout", truncMillis(deadline.Sub(start)))
+	}
+	log.Info("converge started")
+	failure := &ConvergeError{}
+	interval := backoff.Initial
+	timer := time.NewTimer(backoff.jittered(interval))
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			// if the context is done, just return whatever our last saved error was
-			return errors.Wrap(err, "failed to converge")
-		case <-r.C:
-			// do test, save the error
-			nextErr := test()
-			// TODO(dperny) ughhhhhhhhhhhhhhhhhhhhh
-			// if the context times out during a call to the docker api, we
-			// will get context deadline exceeded which could mask the real
-			// error. in this case, if we already have an error, discard the
-			// the deadline exceeded error
-
-			// if we haven't caught an error yet, keep this one no matter what
-			// OR, if nextErr is nil.
-			if err == nil || nextErr == nil {
-				err = nextErr
-			}
-
-			// if we have already caught an error, and we just caught another one
-			if err != nil && nextErr != nil {
-				// check if it's a not context deadline exceeded error
-				if !strings.Contains(nextErr.Error(), "context deadline exceeded") {
-					// if it isn't, then it's useful; keep it
-					err = nextErr
-				}
-				// if it was context deadline exceed, go with whatever the last
-				// error was, but wrap it to tell the user
-				err = errors.Wrap(err, "context deadline exceeded. last recorded failure condition wrapped.")
-			}
+			failure.Elapsed = time.Since(start)
+			observeConverge(failure.Elapsed, false)
+			failure.diagnose(ctx, start)
+			log.WithField("checks", failure.Checks).WithError(failure.Cause()).Warn("converge failed")
+			return failure
+		case <-timer.C:
 		}
-		// if there is no error, we're done
+		err := test()
 		if err == nil {
+			observeConverge(time.Since(start), true)
+			log.WithField("elapsed", truncMillis(time.Since(start))).WithField("checks", failure.Checks+1).Info("converge met")
 			return nil
 		}
+		log.WithError(err).Debug("converge check failed")
+		failure.record(err)
+		interval = backoff.next(interval)
+		timer.Reset(backoff.jittered(interval))
 	}
 }
 
@@ -203,7 +465,7 @@ func GetTestFilter(labels ...string) filters.Args {
 // and replicas to that to get a scale checker
 func ScaleCheck(serviceID string, cli *client.Client) func(context.Context, int) func() error {
 	return func(ctx context.Context, replicas int) func() error {
-		return func() error {
+		return ForService(serviceID, cli, func() error {
 			// get all of the tasks for the service
 			tasks, err := GetServiceTasks(ctx, cli, serviceID)
 			if err != nil {
@@ -221,40 +483,154 @@ func ScaleCheck(serviceID string, cli *client.Client) func(context.Context, int)
 			}
 			// if all of the above checks out, service has converged
 			return nil
-		}
+		})
+	}
+}
+
+// setAvailability changes the availability of the node
+func setAvailability(ctx context.Context, cli *client.Client, nodeID string, availability swarm.NodeAvailability) error {
+	node, _, err := cli.NodeInspectWithRaw(ctx, nodeID)
+	if err != nil {
+		return err
 	}
+	node.Spec.Availability = availability
+	return cli.NodeUpdate(ctx, nodeID, node.Version, node.Spec)
 }
 
 // GetNodeIps returns a list of all node IP addresses in the cluster
-func GetNodeIps(cli *client.Client) ([]string, error) {
-	nodes, err := cli.NodeList(context.TODO(), types.NodeListOptions{})
+func GetNodeIps(ctx context.Context, cli *client.Client) ([]string, error) {
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
 	if err != nil {
 		return nil, err
 	}
 	// standard cluster is like 3 managers 5 workers, so 8 is a good start
 	ips := make([]string, 0, 8)
 	for _, node := range nodes {
-		ip := node.Status.Addr
-		// Prefer the manager IP if present
-		if node.ManagerStatus != nil && node.ManagerStatus.Addr != "" {
-			ip, _, err = net.SplitHostPort(node.ManagerStatus.Addr)
-			if err != nil {
-				return nil, fmt.Errorf("malformed node.ManagerStatus.Addr: %s", err)
-			}
-		}
-		if ip == "" {
-			return nil, errors.New("some node didn't have an associated IP")
+		ip, err := nodeIP(node)
+		if err != nil {
+			return nil, err
 		}
 		ips = append(ips, ip)
 	}
 	return ips, nil
 }
 
+// nodeIP returns the address the node is reached on
+func nodeIP(node swarm.Node) (string, error) {
+	ip := node.Status.Addr
+	// Prefer the manager IP if present
+	if node.ManagerStatus != nil && node.ManagerStatus.Addr != "" {
+		var err error
+		ip, _, err = net.SplitHostPort(node.ManagerStatus.Addr)
+		if err != nil {
+			return "", fmt.Errorf("malformed node.ManagerStatus.Addr: %s", err)
+		}
+	}
+	if ip == "" {
+		return "", errors.New("some node didn't have an associated IP")
+	}
+	return ip, nil
+}
+
+// GetPlatformNodes returns the ready nodes running the given OS, "linux" or
+// "windows"
+func GetPlatformNodes(ctx context.Context, cli *client.Client, platform string) ([]swarm.Node, error) {
+	nodes, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	matching := []swarm.Node{}
+	for _, node := range nodes {
+		if node.Description.Platform.OS == platform && node.Status.State == swarm.NodeStateReady {
+			matching = append(matching, node)
+		}
+	}
+	return matching, nil
+}
+
+const (
+	// ImageEnv pins the tests to an image ID, as printed by testkit
+	// build-image once it has loaded the image on every node
+	ImageEnv = "E2E_IMAGE"
+	// UtilImageEnv names a manifest list of the util image for every
+	// platform of the cluster: the e2e image for linux/amd64, and the builds
+	// of Dockerfile.arm64 and Dockerfile.windows. Every node pulls its own
+	// variant, so the tests' services run on ARM and Windows nodes too
+	UtilImageEnv = "E2E_UTIL_IMAGE"
+	// WindowsImageEnv names the nanoserver build of the util image, from
+	// Dockerfile.windows, that the tests run on the Windows nodes when
+	// there's no manifest list with it
+	WindowsImageEnv = "E2E_WINDOWS_IMAGE"
+)
+
+var (
+	utilPlatformsOnce sync.Once
+	utilPlatformList  []swarm.Platform
+)
+
+// utilPlatforms returns the platforms the util manifest list has an image
+// for, looked up in the registry once, or nothing if it can't be
+func utilPlatforms(cli *client.Client) []swarm.Platform {
+	utilPlatformsOnce.Do(func() {
+		image := os.Getenv(UtilImageEnv)
+		if image == "" {
+			return
+		}
+		ctx, cancel := WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		dist, err := cli.DistributionInspect(ctx, image, "")
+		if err != nil {
+			Logger(ctx).WithError(err).Warn("failed to look up the platforms of the util image")
+			return
+		}
+		for _, p := range dist.Platforms {
+			utilPlatformList = append(utilPlatformList, swarm.Platform{OS: p.OS, Architecture: p.Architecture})
+		}
+	})
+	return utilPlatformList
+}
+
+// utilLinuxPlatforms returns the Linux platforms of the util manifest list,
+// which the services running it are limited to unless they say otherwise:
+// the routing mesh and VIPs the tests rely on don't exist on Windows
+func utilLinuxPlatforms(cli *client.Client) []swarm.Platform {
+	linux := []swarm.Platform{}
+	for _, p := range utilPlatforms(cli) {
+		if p.OS == "linux" {
+			linux = append(linux, p)
+		}
+	}
+	return linux
+}
+
+// GetSelfWindowsImage returns the Windows util image, from WindowsImageEnv or
+// else the manifest list of UtilImageEnv if it has a Windows variant, or an
+// empty string if there is none
+func GetSelfWindowsImage(cli *client.Client) string {
+	if image := os.Getenv(WindowsImageEnv); image != "" {
+		return image
+	}
+	for _, p := range utilPlatforms(cli) {
+		if p.OS == "windows" {
+			return os.Getenv(UtilImageEnv)
+		}
+	}
+	return ""
+}
+
 // GetSelfImage returns the image name or ID of the current running environment
 // or the image that the outter rigging expects to use for nested containers
 // If we're unable to determine the image, "dockerswarm/e2e:latest" is returned
-// as a sensible default suitable for running child container scnearios
-func GetSelfImage(cli *client.Client) string {
+// as a sensible default suitable for running child container scnearios. An
+// image pinned with E2E_IMAGE takes precedence over all of these, and the
+// manifest list of E2E_UTIL_IMAGE over that
+func GetSelfImage(ctx context.Context, cli *client.Client) string {
+	if list := os.Getenv(UtilImageEnv); list != "" {
+		return list
+	}
+	if pinned := os.Getenv(ImageEnv); pinned != "" {
+		return pinned
+	}
 	imageName := os.Getenv("TEST_IMAGE_NAME")
 	if imageName == "" {
 		imageName = "dockerswarm/e2e:latest"
@@ -266,41 +642,154 @@ func GetSelfImage(cli *client.Client) string {
 
 	args := filters.NewArgs()
 	args.Add("id", hostname)
-	containers, err := cli.ContainerList(context.TODO(), types.ContainerListOptions{Filters: args})
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{Filters: args})
 	if err == nil && len(containers) > 0 {
 		return containers[0].ImageID
 	}
 	return imageName
 }
 
-// serviceLookup resolves the passed name by using the test server's /service-discovery endpoint
-func serviceLookup(endpoint, port, qName string) ([]net.IP, error) {
-	tr := &http.Transport{}
-	client := &http.Client{Transport: tr, Timeout: time.Duration(5 * time.Second)}
+// ensureImage pulls the image onto the engine if it isn't there yet. The
+// image pinned with E2E_IMAGE can't be pulled, it has to have been loaded on
+// every node already, but any other image is, like the E2E_UTIL_IMAGE that
+// takes precedence over it. The pull is bounded by ctx, callers have to leave
+// it the time a pull takes
+func ensureImage(ctx context.Context, cli *client.Client, image string) error {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, image); err == nil {
+		return nil
+	}
+	if pinned := os.Getenv(ImageEnv); pinned != "" && image == pinned {
+		return fmt.Errorf("pinned image %s is missing, load it on every node with testkit build-image", image)
+	}
+	// a pull that hangs would otherwise take all of what's left of ctx
+	ctx, cancel := WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	r, err := cli.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	return err
+}
+
+// DNS record types the test-service-discovery server answers queries for
+const (
+	dnsA    = "A"
+	dnsAAAA = "AAAA"
+	dnsSRV  = "SRV"
+)
+
+// dnsAnswer is what the embedded DNS answered a test-service-discovery task
+type dnsAnswer struct {
+	Hostname string     `json:"hostname"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	NotFound bool       `json:"not_found"`
+	IPs      []net.IP   `json:"ips"`
+	SRV      []*net.SRV `json:"srv"`
+}
+
+// Records returns the addresses, or the targets and ports for SRV records,
+// sorted so that answers can be compared
+func (a *dnsAnswer) Records() []string {
+	records := []string{}
+	for _, ip := range a.IPs {
+		records = append(records, ip.String())
+	}
+	for _, srv := range a.SRV {
+		records = append(records, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+	}
+	sort.Strings(records)
+	return records
+}
+
+func (a *dnsAnswer) String() string {
+	if a.NotFound {
+		return fmt.Sprintf("%s %s: not found", a.Type, a.Name)
+	}
+	return fmt.Sprintf("%s %s: %v", a.Type, a.Name, a.Records())
+}
 
-	resp, err := client.Get("http://" + endpoint + port + "/service-discovery?v4=" + qName)
+// getWithContext is client.Get, giving up when ctx is done
+func getWithContext(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Accessing /service-discovery endpoint failed")
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return client.Do(req.WithContext(ctx))
+}
 
-	result, err := ioutil.ReadAll(resp.Body)
+// queryDNS has whichever task the load balancer picks look up the records of
+// the type for the name, using the test server's /dns endpoint
+func queryDNS(ctx context.Context, endpoint, port, qType, qName string) (*dnsAnswer, error) {
+	client := &http.Client{Timeout: time.Duration(5 * time.Second)}
+
+	query := url.Values{"type": {qType}, "name": {qName}}
+	resp, err := getWithContext(ctx, client, "http://"+endpoint+port+"/dns?"+query.Encode())
 	if err != nil {
-		return nil, fmt.Errorf("Reading /service-discovery response failed")
+		return nil, fmt.Errorf("Accessing /dns endpoint failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("/dns returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	answer := &dnsAnswer{}
+	if err := json.NewDecoder(resp.Body).Decode(answer); err != nil {
+		return nil, fmt.Errorf("Reading /dns response failed: %s", err)
+	}
+	return answer, nil
+}
+
+// waitForDNS queries until the answer passes check, which records take a
+// while to do after tasks come and go, returning the last answer
+func waitForDNS(ctx context.Context, endpoint, port, qType, qName string, check func(*dnsAnswer) error) (*dnsAnswer, error) {
+	var answer *dnsAnswer
+	err := WaitForConvergeBackoff(ctx, DefaultBackoff, func() error {
+		a, err := queryDNS(ctx, endpoint, port, qType, qName)
+		if err != nil {
+			return err
+		}
+		answer = a
+		return check(a)
+	})
+	return answer, err
+}
+
+// dnsCount returns a check that passes once there are count records, or the
+// name is gone if count is 0
+func dnsCount(count int) func(*dnsAnswer) error {
+	return func(a *dnsAnswer) error {
+		if n := len(a.Records()); n != count {
+			return fmt.Errorf("%s, expected %d records", a, count)
+		}
+		return nil
+	}
+}
+
+// dnsRecords returns a check that passes once the records are exactly the
+// expected ones, as returned by Records
+func dnsRecords(expected ...string) func(*dnsAnswer) error {
+	want := append([]string{}, expected...)
+	sort.Strings(want)
+	return func(a *dnsAnswer) error {
+		if got := a.Records(); !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("%s, expected %v", a, want)
+		}
+		return nil
 	}
-	ip := []net.IP{}
-	err = json.Unmarshal(result, &ip)
-	return ip, err
 }
 
 // getNodeIPPort fetchces one cluster member IP and published port for the given targetPort
-func getNodeIPPort(cli *client.Client, c context.Context, id string, targetPort uint32) (string, uint32, error) {
-	ips, err := GetNodeIps(cli)
+func getNodeIPPort(ctx context.Context, cli *client.Client, id string, targetPort uint32) (string, uint32, error) {
+	ips, err := GetNodeIps(ctx, cli)
 	if err != nil || len(ips) == 0 {
 		return "", 0, fmt.Errorf("error listing nodes to get IP")
 	}
 
-	full, _, err := cli.ServiceInspectWithRaw(c, id, types.ServiceInspectOptions{})
+	full, _, err := cli.ServiceInspectWithRaw(ctx, id, types.ServiceInspectOptions{})
 	if err != nil {
 		return "", 0, fmt.Errorf("error getting service")
 	}
@@ -311,3 +800,123 @@ func getNodeIPPort(cli *client.Client, c context.Context, id string, targetPort
 	}
 	return "", 0, fmt.Errorf("error getting PublishedPort for targetPort %d", targetPort)
 }
+
+// fileInfo is the test server's description of a file inside a task
+type fileInfo struct {
+	Hostname string      `json:"hostname"`
+	Mode     os.FileMode `json:"mode"`
+	UID      int         `json:"uid"`
+	GID      int         `json:"gid"`
+	Content  string      `json:"content"`
+}
+
+// getFile describes a file inside whichever task the load balancer sends the
+// request to, using the test server's /file endpoint
+func getFile(ctx context.Context, endpoint, port, path string) (*fileInfo, error) {
+	client := &http.Client{Timeout: time.Duration(5 * time.Second)}
+
+	resp, err := getWithContext(ctx, client, "http://"+endpoint+port+"/file?path="+url.QueryEscape(path))
+	if err != nil {
+		return nil, fmt.Errorf("Accessing /file endpoint failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("/file returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	info := &fileInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("Reading /file response failed: %s", err)
+	}
+	return info, nil
+}
+
+// fanout asks whichever task the load balancer picks to request each of the
+// targets using the test server's /fanout endpoint, returning the per-target
+// results in the form "<target>:<status code>:<body>" or "<target>:ERROR:<err>"
+func fanout(ctx context.Context, endpoint, port string, targets []string) ([]string, error) {
+	client := &http.Client{Timeout: time.Duration(30 * time.Second)}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+endpoint+port+"/fanout", strings.NewReader(strings.Join(targets, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Accessing /fanout endpoint failed: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Reading /fanout response failed: %s", err)
+	}
+	return strings.Split(strings.TrimSpace(string(body)), "\n"), nil
+}
+
+// udpEcho sends payload to the test server's UDP echo port, returning the
+// hostname of the task that answered
+func udpEcho(ctx context.Context, endpoint, port, payload string) (string, error) {
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	conn, err := dialer.DialContext(ctx, "udp", endpoint+port)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	reply := strings.SplitN(string(buf[:n]), " ", 2)
+	if len(reply) != 2 || reply[1] != payload {
+		return "", fmt.Errorf("unexpected echo %q for %q", string(buf[:n]), payload)
+	}
+	return reply[0], nil
+}
+
+// putFile writes data to a file inside whichever task the load balancer sends
+// the request to, returning the hostname of that task
+func putFile(ctx context.Context, endpoint, port, path, data string) (string, error) {
+	client := &http.Client{Timeout: time.Duration(5 * time.Second)}
+
+	req, err := http.NewRequest(http.MethodPut, "http://"+endpoint+port+"/file?path="+url.QueryEscape(path), strings.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("Accessing /file endpoint failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("/file returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp.Header.Get("Host"), nil
+}
+
+// getHostname requests the test server's root, returning the hostname of
+// whichever task the load balancer sent the request to
+func getHostname(ctx context.Context, endpoint, port string) (string, error) {
+	client := &http.Client{Timeout: time.Duration(5 * time.Second)}
+
+	resp, err := getWithContext(ctx, client, "http://"+endpoint+port+"/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("/ returned %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Host"), nil
+}
@@ -0,0 +1,56 @@
+package dockere2e
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/versions"
+)
+
+// The same test binary runs against several engine versions, so tests of
+// features newer than the oldest engine supported skip themselves on engines
+// that don't have them, rather than failing. The version is that of the local
+// manager, which is the engine every request of the tests goes to
+var (
+	engineVersionOnce sync.Once
+	engineVersion     types.Version
+	engineVersionErr  error
+)
+
+// EngineVersion returns the version of the local engine, asked for once per
+// run, failing the test if it can't be
+func EngineVersion(t *testing.T) types.Version {
+	engineVersionOnce.Do(func() {
+		cli, err := GetClient()
+		if err != nil {
+			engineVersionErr = err
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		engineVersion, engineVersionErr = cli.ServerVersion(ctx)
+	})
+	if engineVersionErr != nil {
+		t.Fatalf("Failed to get the engine version: %s", engineVersionErr)
+	}
+	return engineVersion
+}
+
+// RequiresAPIVersion skips the test if the engine's API is older than min,
+// e.g. "1.30"
+func RequiresAPIVersion(t *testing.T, min string) {
+	if v := EngineVersion(t); versions.LessThan(v.APIVersion, min) {
+		t.Skipf("needs API %s, the engine runs %s (%s)", min, v.APIVersion, v.Version)
+	}
+}
+
+// RequiresExperimental skips the test if the engine isn't running in
+// experimental mode
+func RequiresExperimental(t *testing.T) {
+	if v := EngineVersion(t); !v.Experimental {
+		t.Skipf("needs experimental mode, the engine %s doesn't have it on", v.Version)
+	}
+}
@@ -0,0 +1,206 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// A volume plugin only keeps data across nodes if it's backed by shared
+// storage, which the environment has to provide
+const (
+	// VolumePluginEnv names the managed plugin to test, vieux/sshfs by default
+	VolumePluginEnv = "E2E_VOLUME_PLUGIN"
+	// VolumePluginOptsEnv holds the driver options pointing the plugin at the
+	// shared storage, as comma separated key=value pairs, e.g.
+	// sshcmd=e2e@storage:/srv/e2e,password=secret
+	VolumePluginOptsEnv = "E2E_VOLUME_PLUGIN_OPTS"
+)
+
+// installPlugin makes sure the plugin is installed and enabled on every node,
+// returning a func that removes it from the nodes it was installed on. The
+// plugin API is only reachable on the local engine, the other nodes go
+// through the CLI
+func installPlugin(t *testing.T, ctx context.Context, cli *client.Client, m *Machines, nodes []swarm.Node, self, plugin string) func() {
+	removals := []func(){}
+	cleanup := func() {
+		for _, remove := range removals {
+			remove()
+		}
+	}
+	for _, node := range nodes {
+		host := node.Description.Hostname
+		if host == self {
+			if _, _, err := cli.PluginInspectWithRaw(ctx, plugin); err == nil {
+				continue
+			}
+			rc, err := cli.PluginInstall(ctx, plugin, types.PluginInstallOptions{RemoteRef: plugin, AcceptAllPermissions: true})
+			if err == nil {
+				_, err = ioutil.ReadAll(rc)
+				rc.Close()
+			}
+			if err != nil {
+				cleanup()
+				require.NoError(t, err, "Error installing %s", plugin)
+			}
+			removals = append(removals, func() {
+				cli.PluginRemove(context.Background(), plugin, types.PluginRemoveOptions{Force: true})
+			})
+			continue
+		}
+		if _, err := m.Run(host, "sudo docker plugin inspect "+plugin); err == nil {
+			continue
+		}
+		out, err := m.Run(host, "sudo docker plugin install --grant-all-permissions "+plugin)
+		if err != nil {
+			cleanup()
+			require.NoError(t, err, "Error installing %s on %s: %s", plugin, host, out)
+		}
+		removals = append(removals, func() {
+			m.Run(host, "sudo docker plugin rm -f "+plugin)
+		})
+	}
+	p, _, err := cli.PluginInspectWithRaw(ctx, plugin)
+	if err != nil || !p.Enabled {
+		cleanup()
+		require.NoError(t, err)
+		require.True(t, p.Enabled, "%s was installed disabled", plugin)
+	}
+	return cleanup
+}
+
+// TestVolumePluginReschedule writes data to a plugin backed volume from a
+// task, moves the task to another node and checks the data moved with it
+func TestVolumePluginReschedule(t *testing.T) {
+	name := "TestVolumePluginReschedule"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	machines := GetMachines(t)
+
+	plugin := os.Getenv(VolumePluginEnv)
+	if plugin == "" {
+		plugin = "vieux/sshfs:latest"
+	}
+	opts := os.Getenv(VolumePluginOptsEnv)
+	if opts == "" {
+		t.Skipf("set %s to the driver options of %s to run volume plugin tests", VolumePluginOptsEnv, plugin)
+	}
+	driverOpts := map[string]string{}
+	for _, opt := range strings.Split(opts, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		require.Len(t, kv, 2, "malformed %s option %q", VolumePluginOptsEnv, opt)
+		driverOpts[kv[0]] = kv[1]
+	}
+
+	nodes, err := cli.NodeList(testContext, types.NodeListOptions{})
+	require.NoError(t, err)
+	linux := []swarm.Node{}
+	for _, node := range nodes {
+		if node.Description.Platform.OS == "linux" && node.Status.State == swarm.NodeStateReady {
+			linux = append(linux, node)
+		}
+	}
+	if len(linux) < 2 {
+		t.Skip("rescheduling between nodes needs at least 2 linux nodes")
+	}
+	_, self, err := GetManagers(testContext, cli)
+	require.NoError(t, err)
+	defer installPlugin(t, testContext, cli, machines, linux, self, plugin)()
+
+	volName := getUniqueName(name)
+	defer func() {
+		// the volume was created on each node the task ran on
+		for _, node := range linux {
+			machines.Run(node.Description.Hostname, "sudo docker volume rm "+volName)
+		}
+	}()
+	defer func() {
+		CaptureFailure(t, cli, name)
+		CleanTestServices(testContext, cli, name)
+		// Wait for the tasks to be removed before the volumes
+		time.Sleep(3 * time.Second)
+	}()
+
+	first, second := linux[0], linux[1]
+	spec := NewServiceSpec(testContext, cli, name).
+		Mount(mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: volName,
+			Target: "/data",
+			VolumeOptions: &mount.VolumeOptions{
+				DriverConfig: &mount.Driver{Name: plugin, Options: driverOpts},
+			},
+		}).
+		Constraint("node.id == " + first.ID).
+		Build()
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	ctx, cancel := WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, time.Second, scaleCheck(ctx, 1))
+	require.NoError(t, err)
+
+	endpoint, published, err := getNodeIPPort(testContext, cli, service.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+	data := "written on " + first.Description.Hostname
+	path := "/data/" + name
+	err = WaitForConverge(ctx, time.Second, func() error {
+		_, err := putFile(ctx, endpoint, port, path, data)
+		return err
+	})
+	require.NoError(t, err)
+
+	t.Logf("Moving the task to %s", second.Description.Hostname)
+	full, _, err := cli.ServiceInspectWithRaw(testContext, service.ID, types.ServiceInspectOptions{})
+	require.NoError(t, err)
+	full.Spec.TaskTemplate.Placement.Constraints = []string{"node.id == " + second.ID}
+	_, err = cli.ServiceUpdate(testContext, service.ID, full.Meta.Version, full.Spec, types.ServiceUpdateOptions{})
+	require.NoError(t, err)
+
+	ctx, cancel = WithTimeout(testContext, 2*time.Minute)
+	defer cancel()
+	err = WaitForConverge(ctx, time.Second, func() error {
+		tasks, err := GetServiceTasks(ctx, cli, service.ID)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if task.Status.State == swarm.TaskStateRunning && task.NodeID != second.ID {
+				return fmt.Errorf("task %s still running on %s", task.ID, task.NodeID)
+			}
+		}
+		return scaleCheck(ctx, 1)()
+	})
+	require.NoError(t, err)
+
+	err = WaitForConverge(ctx, time.Second, func() error {
+		info, err := getFile(ctx, endpoint, port, path)
+		if err != nil {
+			return err
+		}
+		if info.Content != data {
+			return fmt.Errorf("volume holds %q, expected %q", info.Content, data)
+		}
+		return nil
+	})
+	require.NoError(t, err, "data did not follow the task to the new node")
+}
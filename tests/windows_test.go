@@ -0,0 +1,270 @@
+package dockere2e
+
+import (
+	// basic imports
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	// testify
+	"github.com/stretchr/testify/require"
+
+	// docker api
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+)
+
+// CredentialSpecEnv names a file holding a gMSA credential spec the Windows
+// nodes can use, for the credential spec test
+const CredentialSpecEnv = "E2E_CREDENTIAL_SPEC"
+
+// windowsConverge bounds how long Windows tasks get to start, pulling and
+// starting nanoserver containers is a lot slower than on Linux
+const windowsConverge = 5 * time.Minute
+
+// requireWindows returns the Windows image and the ready Windows nodes,
+// skipping the test if either is missing
+func requireWindows(t *testing.T, ctx context.Context, cli *client.Client) (string, map[string]swarm.Node) {
+	image := GetSelfWindowsImage(cli)
+	if image == "" {
+		t.Skipf("set %s or %s to the Windows util image to run this test", WindowsImageEnv, UtilImageEnv)
+	}
+	nodes, err := GetPlatformNodes(ctx, cli, "windows")
+	require.NoError(t, err)
+	if len(nodes) == 0 {
+		t.Skip("no ready Windows nodes in the cluster")
+	}
+	byID := map[string]swarm.Node{}
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+	return image, byID
+}
+
+// windowsServiceSpec returns a canned spec running the Windows image, only on
+// Windows nodes. Windows has neither the routing mesh nor VIPs, so nothing is
+// published and names resolve to the tasks
+func windowsServiceSpec(ctx context.Context, cli *client.Client, image, name string, replicas uint64, nw []string, labels ...string) swarm.ServiceSpec {
+	return NewServiceSpec(ctx, cli, name).
+		Replicas(replicas).
+		Network(nw...).
+		Label(labels...).
+		Image(image).
+		Constraint("node.platform.os == windows").
+		DNSRR().
+		Build()
+}
+
+// TestWindowsServiceScheduling runs more tasks than there are Windows nodes,
+// and checks they all land on Windows nodes
+func TestWindowsServiceScheduling(t *testing.T) {
+	t.Parallel()
+	name := "TestWindowsServiceScheduling"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	image, windows := requireWindows(t, testContext, cli)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 2 * len(windows)
+	spec := windowsServiceSpec(testContext, cli, image, name, uint64(replicas), nil)
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	ctx, cancel := WithTimeout(testContext, windowsConverge)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, 2*time.Second, scaleCheck(ctx, replicas))
+	require.NoError(t, err)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		_, ok := windows[task.NodeID]
+		require.True(t, ok, "task %s was scheduled on %s, which isn't a Windows node", task.ID, task.NodeID)
+	}
+}
+
+// TestWindowsPublishedPort publishes a port in host mode from a global
+// Windows service, and checks each node answers on its own task's port
+func TestWindowsPublishedPort(t *testing.T) {
+	t.Parallel()
+	name := "TestWindowsPublishedPort"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	image, windows := requireWindows(t, testContext, cli)
+	defer CleanTestServices(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	spec := windowsServiceSpec(testContext, cli, image, name, 0, nil)
+	spec.Mode = swarm.ServiceMode{Global: &swarm.GlobalService{}}
+	// without the routing mesh, the engine picks a port on each host instead
+	spec.EndpointSpec = &swarm.EndpointSpec{
+		Mode: swarm.ResolutionModeDNSRR,
+		Ports: []swarm.PortConfig{
+			{
+				Protocol:    swarm.PortConfigProtocolTCP,
+				TargetPort:  80,
+				PublishMode: swarm.PortConfigPublishModeHost,
+			},
+		},
+	}
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	ctx, cancel := WithTimeout(testContext, windowsConverge)
+	defer cancel()
+	scaleCheck := ScaleCheck(service.ID, cli)
+	err = WaitForConverge(ctx, 2*time.Second, scaleCheck(ctx, len(windows)))
+	require.NoError(t, err)
+
+	tasks, err := GetServiceTasks(testContext, cli, service.ID)
+	require.NoError(t, err)
+	for _, task := range tasks {
+		node := windows[task.NodeID]
+		ip, err := nodeIP(node)
+		require.NoError(t, err)
+		var published uint32
+		for _, port := range task.Status.PortStatus.Ports {
+			if port.TargetPort == 80 {
+				published = port.PublishedPort
+			}
+		}
+		require.NotZero(t, published, "task %s has no published port", task.ID)
+		port := fmt.Sprintf(":%v", published)
+
+		err = WaitForConverge(ctx, time.Second, func() error {
+			host, err := getHostname(ctx, ip, port)
+			if err != nil {
+				return err
+			}
+			if host != task.Status.ContainerStatus.ContainerID[:12] {
+				return fmt.Errorf("%s%s was answered by %s, expected the task on it", ip, port, host)
+			}
+			return nil
+		})
+		require.NoError(t, err, "%s didn't answer on its task's port", node.Description.Hostname)
+	}
+}
+
+// TestWindowsServiceDiscovery puts a Windows service on an overlay with a
+// Linux service, and checks the Linux tasks resolve the Windows ones
+func TestWindowsServiceDiscovery(t *testing.T) {
+	t.Parallel()
+	name := "TestWindowsServiceDiscovery"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	image, _ := requireWindows(t, testContext, cli)
+
+	nwName := getUniqueName(name)
+	_, err = cli.NetworkCreate(testContext, nwName, types.NetworkCreate{Driver: "overlay", CheckDuplicate: true, Labels: testLabels(name)})
+	require.NoError(t, err, "Error creating overlay network %s", nwName)
+	defer CleanupAll(testContext, cli, UUID(), name)
+	defer CaptureFailure(t, cli, name)
+
+	replicas := 2
+	spec := windowsServiceSpec(testContext, cli, image, name, uint64(replicas), []string{nwName})
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+
+	resolverSpec := NewServiceSpec(testContext, cli, name+"Resolver").
+		Command("util", "test-service-discovery").
+		Network(nwName).
+		Label(name).
+		Constraint("node.platform.os == linux").
+		Build()
+	resolver, err := CreateService(testContext, cli, resolverSpec)
+	require.NoError(t, err, "Error creating resolver service")
+
+	ctx, cancel := WithTimeout(testContext, windowsConverge)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, ScaleCheck(service.ID, cli)(ctx, replicas))
+	require.NoError(t, err)
+	err = WaitForConverge(ctx, time.Second, ScaleCheck(resolver.ID, cli)(ctx, 1))
+	require.NoError(t, err)
+
+	// reach the resolver through a Linux node, which has the routing mesh
+	linux, err := GetPlatformNodes(testContext, cli, "linux")
+	require.NoError(t, err)
+	require.NotEmpty(t, linux, "no ready Linux nodes")
+	endpoint, err := nodeIP(linux[0])
+	require.NoError(t, err)
+	_, published, err := getNodeIPPort(testContext, cli, resolver.ID, 80)
+	require.NoError(t, err)
+	port := fmt.Sprintf(":%v", published)
+
+	for _, qName := range []string{spec.Name, "tasks." + spec.Name} {
+		_, err = waitForDNS(ctx, endpoint, port, dnsA, qName, dnsCount(replicas))
+		require.NoError(t, err)
+	}
+}
+
+// TestWindowsCredentialSpec delivers a gMSA credential spec as a config, and
+// checks the service starts with the spec applied to its containers. A spec
+// naming a config the service doesn't reference must be rejected
+func TestWindowsCredentialSpec(t *testing.T) {
+	t.Parallel()
+	name := "TestWindowsCredentialSpec"
+	testContext, cancel := NewTestContext(name, 10*time.Minute)
+	defer cancel()
+	cli, err := GetClient()
+	require.NoError(t, err, "Client creation failed")
+	image, windows := requireWindows(t, testContext, cli)
+	path := os.Getenv(CredentialSpecEnv)
+	if path == "" {
+		t.Skipf("set %s to a credential spec for the Windows nodes to run this test", CredentialSpecEnv)
+	}
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	defer cleanConfigTest(testContext, cli, name)
+	defer CaptureFailure(t, cli, name)
+
+	configSpec := CannedConfigSpec(name, data, name)
+	config, err := cli.ConfigCreate(testContext, configSpec)
+	require.NoError(t, err, "Error creating config")
+
+	// the config only has to reach the engine, not the container's filesystem
+	spec := windowsServiceSpec(testContext, cli, image, name, uint64(len(windows)), nil)
+	spec.TaskTemplate.ContainerSpec.Privileges = &swarm.Privileges{
+		CredentialSpec: &swarm.CredentialSpec{Config: config.ID},
+	}
+	unreferenced, err := CreateService(testContext, cli, spec)
+	if err == nil {
+		cli.ServiceRemove(testContext, unreferenced.ID)
+	}
+	require.Error(t, err, "credential spec naming a config the service doesn't use should be rejected")
+
+	spec.TaskTemplate.ContainerSpec.Configs = []*swarm.ConfigReference{
+		{
+			ConfigID:   config.ID,
+			ConfigName: configSpec.Name,
+			Runtime:    &swarm.ConfigReferenceRuntimeTarget{},
+		},
+	}
+	service, err := CreateService(testContext, cli, spec)
+	require.NoError(t, err, "Error creating service")
+	ctx, cancel := WithTimeout(testContext, windowsConverge)
+	defer cancel()
+	err = WaitForConverge(ctx, 2*time.Second, ScaleCheck(service.ID, cli)(ctx, len(windows)))
+	require.NoError(t, err, "service with the credential spec didn't start")
+
+	checked := 0
+	withTaskContainers(t, testContext, cli, service.ID, func(_ *client.Client, c types.ContainerJSON) {
+		opts := strings.Join(c.HostConfig.SecurityOpt, " ")
+		require.Contains(t, opts, "credentialspec=", "container %s has no credential spec", c.ID)
+		require.Contains(t, opts, config.ID, "container %s doesn't use the config's credential spec", c.ID)
+		checked++
+	})
+	t.Logf("Checked the credential spec of %d of %d containers", checked, len(windows))
+}